@@ -0,0 +1,73 @@
+package turn
+
+import (
+	"net"
+	"time"
+)
+
+// AllocationInfo describes an allocation of the Server, with the peers it relays for, e.g.
+// to find out why a peer doesn't receive data. See Server.Allocations
+type AllocationInfo struct {
+	// SrcAddr and DstAddr are the client and server side of the 5-tuple
+	SrcAddr net.Addr
+	DstAddr net.Addr
+
+	// Username is the username that authenticated the Allocate request
+	Username string
+
+	// RelayAddr is the relayed address of the allocation
+	RelayAddr net.Addr
+
+	// Permissions and ChannelBindings are the peers of the allocation, in no particular order
+	Permissions     []PermissionInfo
+	ChannelBindings []ChannelBindingInfo
+}
+
+// PermissionInfo describes a permission of an allocation
+type PermissionInfo struct {
+	// Peer is the address the permission was created for, it permits every port of its IP
+	Peer net.Addr
+
+	// ExpiresAt is when the permission expires unless it is refreshed
+	ExpiresAt time.Time
+}
+
+// ChannelBindingInfo describes a channel bound to a peer of an allocation
+type ChannelBindingInfo struct {
+	Number ChannelNumber
+	Peer   net.Addr
+
+	// ExpiresAt is when the binding expires unless it is refreshed
+	ExpiresAt time.Time
+}
+
+// Allocations returns the allocations of all listeners. The permissions and channel bindings
+// of an allocation are each copied at once, so every list is consistent on its own while
+// clients keep changing them
+func (s *Server) Allocations() []AllocationInfo {
+	s.allocationManagersLock.Lock()
+	defer s.allocationManagersLock.Unlock()
+
+	infos := []AllocationInfo{}
+	for allocationManager := range s.allocationManagers {
+		for _, a := range allocationManager.Allocations() {
+			permissions, channelBinds := a.Peers()
+			info := AllocationInfo{
+				SrcAddr:         a.FiveTuple().SrcAddr,
+				DstAddr:         a.FiveTuple().DstAddr,
+				Username:        a.Username(),
+				RelayAddr:       a.RelayAddr,
+				Permissions:     make([]PermissionInfo, 0, len(permissions)),
+				ChannelBindings: make([]ChannelBindingInfo, 0, len(channelBinds)),
+			}
+			for _, p := range permissions {
+				info.Permissions = append(info.Permissions, PermissionInfo(p))
+			}
+			for _, c := range channelBinds {
+				info.ChannelBindings = append(info.ChannelBindings, ChannelBindingInfo(c))
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
@@ -0,0 +1,124 @@
+package turn
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v2/internal/allocation"
+)
+
+// AllocationRecord is the metadata of an allocation written to an AllocationStore
+type AllocationRecord struct {
+	// SrcAddr and DstAddr are the client and server side of the 5-tuple
+	SrcAddr net.Addr
+	DstAddr net.Addr
+
+	// Username is the username that authenticated the Allocate request
+	Username string
+
+	// RelayAddr is the relayed address of the allocation
+	RelayAddr net.Addr
+
+	// Lifetime is the lifetime the allocation was created or last refreshed with,
+	// ExpiresAt is when it runs out without another refresh
+	Lifetime  time.Duration
+	ExpiresAt time.Time
+}
+
+// AllocationStore is written the metadata of the allocations the Server creates, refreshes
+// and deletes, e.g. to inspect the allocations of a fleet of servers from a control plane.
+// The allocations are still relayed by the Server that created them, only their metadata
+// is written. The methods are called from the goroutine handling the request and should
+// return quickly. Errors are logged and otherwise ignored, a failing AllocationStore never
+// fails a request or deletes an allocation
+type AllocationStore interface {
+	Create(r AllocationRecord) error
+	Update(r AllocationRecord) error
+	Delete(srcAddr, dstAddr net.Addr) error
+}
+
+// MemoryAllocationStore is an AllocationStore that keeps the records in memory,
+// it is the default of ServerConfig.AllocationStore
+type MemoryAllocationStore struct {
+	lock    sync.RWMutex
+	records map[string]AllocationRecord
+}
+
+// NewMemoryAllocationStore creates an empty MemoryAllocationStore
+func NewMemoryAllocationStore() *MemoryAllocationStore {
+	return &MemoryAllocationStore{records: make(map[string]AllocationRecord)}
+}
+
+// Create implements Create from AllocationStore
+func (s *MemoryAllocationStore) Create(r AllocationRecord) error {
+	return s.Update(r)
+}
+
+// Update implements Update from AllocationStore
+func (s *MemoryAllocationStore) Update(r AllocationRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.records[recordKey(r.SrcAddr, r.DstAddr)] = r
+	return nil
+}
+
+// Delete implements Delete from AllocationStore
+func (s *MemoryAllocationStore) Delete(srcAddr, dstAddr net.Addr) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.records, recordKey(srcAddr, dstAddr))
+	return nil
+}
+
+func recordKey(srcAddr, dstAddr net.Addr) string {
+	return srcAddr.String() + " " + dstAddr.String()
+}
+
+// Records returns the records of the allocations in the MemoryAllocationStore
+func (s *MemoryAllocationStore) Records() []AllocationRecord {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	records := make([]AllocationRecord, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	return records
+}
+
+// AllocationStore returns the AllocationStore of the Server, a MemoryAllocationStore
+// unless ServerConfig.AllocationStore was set
+func (s *Server) AllocationStore() AllocationStore {
+	return s.allocationStore
+}
+
+// allocationStore adapts an AllocationStore to allocation.Store
+type allocationStore struct {
+	store AllocationStore
+}
+
+func (a allocationStore) Create(r allocation.Record) error {
+	return a.store.Create(newAllocationRecord(r))
+}
+
+func (a allocationStore) Update(r allocation.Record) error {
+	return a.store.Update(newAllocationRecord(r))
+}
+
+func (a allocationStore) Delete(fiveTuple allocation.FiveTuple) error {
+	return a.store.Delete(fiveTuple.SrcAddr, fiveTuple.DstAddr)
+}
+
+func newAllocationRecord(r allocation.Record) AllocationRecord {
+	return AllocationRecord{
+		SrcAddr:   r.FiveTuple.SrcAddr,
+		DstAddr:   r.FiveTuple.DstAddr,
+		Username:  r.Username,
+		RelayAddr: r.RelayAddr,
+		Lifetime:  r.Lifetime,
+		ExpiresAt: r.ExpiresAt,
+	}
+}
@@ -0,0 +1,86 @@
+package turn
+
+import (
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/proto"
+)
+
+// The TURN attributes of RFC 5766 re-exported to build and parse messages with
+// github.com/pion/stun, e.g. to test a TURN server or to implement a custom client.
+// Each attribute implements stun.Setter with AddTo and, but for DontFragment that is
+// checked with IsSet, stun.Getter with GetFrom:
+//
+//	m := stun.MustBuild(stun.TransactionID, turn.SendIndicationType,
+//		turn.XORPeerAddress{IP: ip, Port: port}, turn.Data(payload), stun.Fingerprint)
+//
+// The covered attributes are XOR-PEER-ADDRESS, XOR-RELAYED-ADDRESS, LIFETIME, DATA,
+// CHANNEL-NUMBER, EVEN-PORT, RESERVATION-TOKEN, REQUESTED-TRANSPORT and DONT-FRAGMENT.
+// REQUESTED-ADDRESS-FAMILY is covered by RequestedAddressFamily. ChannelData encodes and
+// decodes the ChannelData messages relayed over a channel instead of STUN messages.
+type (
+	// PeerAddress is the XOR-PEER-ADDRESS attribute, RFC 5766 Section 14.3
+	PeerAddress = proto.PeerAddress
+
+	// XORPeerAddress is an alias of PeerAddress
+	XORPeerAddress = proto.XORPeerAddress
+
+	// RelayedAddress is the XOR-RELAYED-ADDRESS attribute, RFC 5766 Section 14.5
+	RelayedAddress = proto.RelayedAddress
+
+	// XORRelayedAddress is an alias of RelayedAddress
+	XORRelayedAddress = proto.XORRelayedAddress
+
+	// Lifetime is the LIFETIME attribute, RFC 5766 Section 14.2
+	Lifetime = proto.Lifetime
+
+	// Data is the DATA attribute, RFC 5766 Section 14.4
+	Data = proto.Data
+
+	// ChannelNumber is the CHANNEL-NUMBER attribute, RFC 5766 Section 14.1
+	ChannelNumber = proto.ChannelNumber
+
+	// EvenPort is the EVEN-PORT attribute, RFC 5766 Section 14.6
+	EvenPort = proto.EvenPort
+
+	// ReservationToken is the RESERVATION-TOKEN attribute, RFC 5766 Section 14.9
+	ReservationToken = proto.ReservationToken
+
+	// RequestedTransport is the REQUESTED-TRANSPORT attribute, RFC 5766 Section 14.7
+	RequestedTransport = proto.RequestedTransport
+
+	// Protocol is the IANA assigned protocol number of RequestedTransport
+	Protocol = proto.Protocol
+
+	// DontFragment is the DONT-FRAGMENT attribute, RFC 5766 Section 14.8
+	DontFragment = proto.DontFragmentAttr
+
+	// ChannelData is a ChannelData message, RFC 5766 Section 11.4
+	ChannelData = proto.ChannelData
+)
+
+const (
+	// ProtoUDP is the Protocol of UDP, the only transport RFC 5766 allows to relay
+	ProtoUDP = proto.ProtoUDP
+
+	// DefaultLifetime is the lifetime of an allocation requested without LIFETIME
+	DefaultLifetime = proto.DefaultLifetime
+
+	// MinChannelNumber and MaxChannelNumber are the bounds of a valid ChannelNumber
+	MinChannelNumber = proto.MinChannelNumber
+	MaxChannelNumber = proto.MaxChannelNumber
+)
+
+// Message types of the TURN methods
+var (
+	AllocateRequestType         = proto.AllocateRequest()
+	RefreshRequestType          = proto.RefreshRequest()
+	CreatePermissionRequestType = proto.CreatePermissionRequest()
+	ChannelBindRequestType      = stun.NewType(stun.MethodChannelBind, stun.ClassRequest)
+	SendIndicationType          = proto.SendIndication()
+)
+
+// IsChannelData returns true if buf looks like a ChannelData message
+// rather than a STUN message
+func IsChannelData(buf []byte) bool {
+	return proto.IsChannelData(buf)
+}
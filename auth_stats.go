@@ -0,0 +1,86 @@
+package turn
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/turn/v2/internal/server"
+)
+
+// AuthStats counts the outcomes of authenticating requests. Comparing them tells
+// misconfigured clients, e.g. with a wrong password or realm, apart from clients
+// guessing credentials. Malformed requests answered with a 400 aren't counted.
+type AuthStats struct {
+	// Success is the number of requests with valid credentials
+	Success uint64
+
+	// MissingIntegrity is the number of requests without MESSAGE-INTEGRITY, they are
+	// answered with a 401 carrying the NONCE to authenticate with. Every client starts
+	// with one, it is not a failure
+	MissingIntegrity uint64
+
+	// BadIntegrity is the number of requests of known users with a MESSAGE-INTEGRITY that
+	// doesn't match, e.g. because of a wrong password, answered with a 401
+	BadIntegrity uint64
+
+	// StaleNonce is the number of requests answered with a 438 because their NONCE wasn't
+	// issued by the server, expired or their session outlived MaxSessionDuration
+	StaleNonce uint64
+
+	// UnknownUser is the number of requests the AuthHandler found no user for, answered with a 401
+	UnknownUser uint64
+
+	// Rejected is the number of requests with a realm that isn't served, a username refused
+	// by the UsernameValidator or a NONCE the NonceHandler found invalid, answered with a 401
+	Rejected uint64
+
+	// ShadowDiscrepancies is the number of requests the ShadowAuthHandler decided differently
+	// than the AuthHandler, they are counted next to the outcome of the AuthHandler
+	ShadowDiscrepancies uint64
+}
+
+// authStats holds the counters behind AuthStats, it is only accessed atomically
+type authStats struct {
+	success          uint64
+	missingIntegrity uint64
+	badIntegrity     uint64
+	staleNonce       uint64
+	unknownUser      uint64
+	rejected         uint64
+
+	shadowDiscrepancies uint64
+}
+
+// AuthStats returns a snapshot of the authentication counters
+func (s *Server) AuthStats() AuthStats {
+	return AuthStats{
+		Success:          atomic.LoadUint64(&s.authStats.success),
+		MissingIntegrity: atomic.LoadUint64(&s.authStats.missingIntegrity),
+		BadIntegrity:     atomic.LoadUint64(&s.authStats.badIntegrity),
+		StaleNonce:       atomic.LoadUint64(&s.authStats.staleNonce),
+		UnknownUser:      atomic.LoadUint64(&s.authStats.unknownUser),
+		Rejected:         atomic.LoadUint64(&s.authStats.rejected),
+
+		ShadowDiscrepancies: atomic.LoadUint64(&s.authStats.shadowDiscrepancies),
+	}
+}
+
+func (s *Server) onShadowAuthDiscrepancy() {
+	atomic.AddUint64(&s.authStats.shadowDiscrepancies, 1)
+}
+
+func (s *Server) onAuthResult(result server.AuthResult) {
+	switch result {
+	case server.AuthResultSuccess:
+		atomic.AddUint64(&s.authStats.success, 1)
+	case server.AuthResultMissingIntegrity:
+		atomic.AddUint64(&s.authStats.missingIntegrity, 1)
+	case server.AuthResultBadIntegrity:
+		atomic.AddUint64(&s.authStats.badIntegrity, 1)
+	case server.AuthResultStaleNonce:
+		atomic.AddUint64(&s.authStats.staleNonce, 1)
+	case server.AuthResultUnknownUser:
+		atomic.AddUint64(&s.authStats.unknownUser, 1)
+	case server.AuthResultRejected:
+		atomic.AddUint64(&s.authStats.rejected, 1)
+	}
+}
@@ -1,6 +1,7 @@
 package turn
 
 import (
+	"crypto/tls"
 	b64 "encoding/base64"
 	"fmt"
 	"math"
@@ -19,6 +20,7 @@ const (
 	defaultRTO        = 200 * time.Millisecond
 	maxRtxCount       = 7              // total 7 requests (Rc)
 	maxDataBufferSize = math.MaxUint16 //message size limit for Chromium
+	maxRedirects      = 3              // ALTERNATE-SERVER redirects followed by Allocate
 )
 
 //              interval [msec]
@@ -31,31 +33,116 @@ const (
 // 6: 31500 ms  +32000
 // -: 63500 ms  failed
 
+// RequestedAddressFamily is the address family of the relayed transport address
+// requested by Client.Allocate, see RFC 6156
+type RequestedAddressFamily byte
+
+// Values for ClientConfig.RequestedAddressFamily
+const (
+	RequestedAddressFamilyIPv4 = RequestedAddressFamily(proto.RequestedFamilyIPv4)
+	RequestedAddressFamilyIPv6 = RequestedAddressFamily(proto.RequestedFamilyIPv6)
+)
+
+func (f RequestedAddressFamily) String() string {
+	return proto.RequestedAddressFamily(f).String()
+}
+
+// AddTo adds REQUESTED-ADDRESS-FAMILY to m, nothing is added for the zero value
+func (f RequestedAddressFamily) AddTo(m *stun.Message) error {
+	if f == 0 {
+		return nil
+	}
+	return proto.RequestedAddressFamily(f).AddTo(m)
+}
+
 // ClientConfig is a bag of config parameters for Client.
 type ClientConfig struct {
 	STUNServerAddr string // STUN server address (e.g. "stun.abc.com:3478")
-	TURNServerAddr string // TURN server addrees (e.g. "turn.abc.com:3478")
+	TURNServerAddr string // TURN server addrees (e.g. "turn.abc.com:3478"), see below for URIs
 	Username       string
 	Password       string
 	Realm          string
 	Software       string
 	RTO            time.Duration
-	Conn           net.PacketConn // Listening socket (net.PacketConn)
 	LoggerFactory  logging.LoggerFactory
 	Net            *vnet.Net
+
+	// Conn is the socket the client sends from and listens on. It is owned by the caller, it
+	// may be shared with other users, e.g. an ICE agent gathering host candidates on the same
+	// port, and must be closed by the caller after Close. Conn takes precedence over LocalPort.
+	Conn net.PacketConn
+
+	// LocalPort is used when Conn is nil, the client then binds its own UDP socket on this
+	// port on all interfaces. The socket is owned by the client, Close closes it.
+	LocalPort int
+
+	// DisableFingerprint stops adding FINGERPRINT to the messages sent to the server, for
+	// interop with servers that can't handle it. FINGERPRINT is sent by default
+	DisableFingerprint bool
+
+	// DisablePermissionRefresh turns off the automatic refresh of permissions for peers
+	// that are in use. When set permissions expire after 5 minutes unless CreatePermission is called.
+	DisablePermissionRefresh bool
+
+	// RequestedAddressFamily selects the address family of the relay requested by Allocate.
+	// Servers that can't relay the family answer with 440 (Address Family not Supported),
+	// Allocate then returns ErrAddressFamilyNotSupported. When unset the attribute isn't sent
+	// and the server allocates an IPv4 relay.
+	RequestedAddressFamily RequestedAddressFamily
+
+	// AutoReallocateOnMismatch allocates again when the server answers a Refresh or
+	// CreatePermission with 437 (Allocation Mismatch), i.e. it lost the allocation, e.g.
+	// because it restarted. The permissions and channel bindings are installed again and the
+	// conn returned by Allocate keeps relaying, from a new relayed address. OnReallocated,
+	// which is optional, is called with it so the new relay candidate can be advertised.
+	AutoReallocateOnMismatch bool
+	OnReallocated            func(relayedAddr net.Addr)
+
+	// TURNServerAddr may also be a turn: or turns: URI as defined by RFC 7065, e.g.
+	// "turns:turn.abc.com:5349?transport=tcp". For TCP, TLS and DTLS the client dials the
+	// server itself, on the native network, and frames the messages for the transport.
+	// Conn, LocalPort and STUNServerAddr must then be unset, the connection is closed by
+	// Close. TLSConfig is used by turns:, for DTLS only its Certificates, RootCAs,
+	// ServerName, InsecureSkipVerify and VerifyPeerCertificate are used. ServerName
+	// defaults to the host of the URI. Allocations can't be redirected to another server
+	// over these transports.
+	TLSConfig *tls.Config
+
+	// CorrelationID is optional, every log line of the client starts with it in brackets,
+	// e.g. to tie the logs of one of many clients to the call it relays. The logs are
+	// written to the loggers of LoggerFactory, with the scope "turnc"
+	CorrelationID string
+
+	// OnUnknownPeerData is optional, it is called when a Data indication arrives from a peer
+	// the client never created a permission for, e.g. because the permission was created by
+	// another user of a shared allocation. The data is delivered if it returns true and
+	// dropped otherwise. When nil such data is delivered, the server already checked that
+	// the allocation has a permission for the peer.
+	OnUnknownPeerData func(peer net.Addr) bool
+
+	// CredentialProvider is optional, it is called with the REALM of the 401 (Unauthorized)
+	// the server challenges an Allocate with and returns the username and password to
+	// authenticate in that realm, e.g. ephemeral credentials fetched from a provisioning
+	// service. Username and Password are ignored when it is set.
+	CredentialProvider func(realm string) (username, password string)
 }
 
 // Client is a STUN server client
+//
+// The methods of Client and of the net.PacketConn returned by Allocate are safe for concurrent
+// use by multiple goroutines, e.g. a media sender, an ICE agent and the refresh timers of the
+// allocation. Only Allocate is serialized: a call made while another one is in progress fails
+// instead of waiting for it
 type Client struct {
 	conn          net.PacketConn         // read-only
 	stunServ      net.Addr               // read-only
-	turnServ      net.Addr               // read-only
+	turnServ      net.Addr               // protected by mutex, changes on redirect
 	stunServStr   string                 // read-only, used for dmuxing
-	turnServStr   string                 // read-only, used for dmuxing
-	username      stun.Username          // read-only
-	password      string                 // read-only
-	realm         stun.Realm             // read-only
-	integrity     stun.MessageIntegrity  // read-only
+	turnServStr   string                 // protected by mutex, changes on redirect
+	username      stun.Username          // protected by mutex, changes with CredentialProvider
+	password      string                 // changes with CredentialProvider, only used by Allocate
+	realm         stun.Realm             // protected by mutex, set by Allocate
+	integrity     stun.Setter            // protected by mutex, set by Allocate
 	software      stun.Software          // read-only
 	trMap         *client.TransactionMap // thread-safe
 	rto           time.Duration          // read-only
@@ -66,6 +153,29 @@ type Client struct {
 	mutex         sync.RWMutex           // thread-safe
 	mutexTrMap    sync.Mutex             // thread-safe
 	log           logging.LeveledLogger  // read-only
+
+	disablePermissionRefresh bool                   // read-only
+	disableFingerprint       bool                   // read-only
+	requestedAddressFamily   RequestedAddressFamily // read-only
+	autoReallocate           bool                   // read-only
+	onReallocated            func(net.Addr)         // read-only
+	onUnknownPeerData        func(net.Addr) bool    // read-only
+
+	credentialProvider func(realm string) (username, password string) // read-only
+
+	selfTestLock sync.Mutex  // serializes RelaySelfTest
+	relayProbe   *relayProbe // protected by mutex, set while RelaySelfTest waits for it
+
+	redirected bool // protected by mutex
+
+	passwordAlgorithm PasswordAlgorithm // protected by mutex
+
+	ownsConn bool // read-only, conn was bound from ClientConfig.LocalPort
+
+	dialed bool // read-only, conn is a connection to the TURN server dialed by the client
+
+	statsLock sync.Mutex
+	stats     map[stun.Method]*TransactionStats // protected by statsLock
 }
 
 // NewClient returns a new Client instance. listeningAddress is the address and port to listen on, default "0.0.0.0:0"
@@ -75,10 +185,20 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		loggerFactory = logging.NewDefaultLoggerFactory()
 	}
 
-	log := loggerFactory.NewLogger("turnc")
+	log := newCorrelatedLogger(loggerFactory.NewLogger("turnc"), config.CorrelationID)
 
-	if config.Conn == nil {
-		return nil, fmt.Errorf("conn cannot not be nil")
+	turnURI, err := parseTURNServerURI(config.TURNServerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case turnURI.dialed() && (config.Conn != nil || config.LocalPort != 0):
+		return nil, errTURNServerURIWithConn
+	case turnURI.dialed() && len(config.STUNServerAddr) > 0:
+		return nil, errTURNServerURIWithSTUNServer
+	case !turnURI.dialed() && config.Conn == nil && config.LocalPort == 0:
+		return nil, fmt.Errorf("conn cannot not be nil when LocalPort is unset")
 	}
 
 	if config.Net == nil {
@@ -89,7 +209,6 @@ func NewClient(config *ClientConfig) (*Client, error) {
 
 	var stunServ, turnServ net.Addr
 	var stunServStr, turnServStr string
-	var err error
 	if len(config.STUNServerAddr) > 0 {
 		log.Debugf("resolving %s", config.STUNServerAddr)
 		stunServ, err = config.Net.ResolveUDPAddr("udp4", config.STUNServerAddr)
@@ -99,9 +218,9 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		stunServStr = stunServ.String()
 		log.Debugf("stunServ: %s", stunServStr)
 	}
-	if len(config.TURNServerAddr) > 0 {
-		log.Debugf("resolving %s", config.TURNServerAddr)
-		turnServ, err = config.Net.ResolveUDPAddr("udp4", config.TURNServerAddr)
+	if len(config.TURNServerAddr) > 0 && !turnURI.dialed() {
+		log.Debugf("resolving %s", turnURI.addr)
+		turnServ, err = config.Net.ResolveUDPAddr("udp4", turnURI.addr)
 		if err != nil {
 			return nil, err
 		}
@@ -109,13 +228,28 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		log.Debugf("turnServ: %s", turnServStr)
 	}
 
+	conn, ownsConn := config.Conn, false
+	if turnURI.dialed() {
+		log.Debugf("dialing %s", config.TURNServerAddr)
+		if conn, turnServ, err = dialTURNServer(turnURI, config.TLSConfig); err != nil {
+			return nil, err
+		}
+		turnServStr = turnServ.String()
+		ownsConn = true
+	} else if conn == nil {
+		if conn, err = config.Net.ListenPacket("udp4", fmt.Sprintf("0.0.0.0:%d", config.LocalPort)); err != nil {
+			return nil, err
+		}
+		ownsConn = true
+	}
+
 	rto := defaultRTO
 	if config.RTO > 0 {
 		rto = config.RTO
 	}
 
 	c := &Client{
-		conn:        config.Conn,
+		conn:        conn,
 		stunServ:    stunServ,
 		turnServ:    turnServ,
 		stunServStr: stunServStr,
@@ -128,16 +262,50 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		trMap:       client.NewTransactionMap(),
 		rto:         rto,
 		log:         log,
+
+		disablePermissionRefresh: config.DisablePermissionRefresh,
+		disableFingerprint:       config.DisableFingerprint,
+		requestedAddressFamily:   config.RequestedAddressFamily,
+		autoReallocate:           config.AutoReallocateOnMismatch,
+		onReallocated:            config.OnReallocated,
+		onUnknownPeerData:        config.OnUnknownPeerData,
+		credentialProvider:       config.CredentialProvider,
+		ownsConn:                 ownsConn,
+		dialed:                   turnURI.dialed(),
+		stats:                    map[stun.Method]*TransactionStats{},
+		passwordAlgorithm:        PasswordAlgorithmMD5,
 	}
 
 	return c, nil
 }
 
-// TURNServerAddr return the TURN server address
+// TURNServerAddr return the TURN server address. After Allocate was redirected
+// it is the address of the server the allocation was made on
 func (c *Client) TURNServerAddr() net.Addr {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	return c.turnServ
 }
 
+// Redirected returns true if Allocate was redirected to another server with a
+// 300 (Try Alternate), TURNServerAddr then returns the server it was redirected to
+func (c *Client) Redirected() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.redirected
+}
+
+func (c *Client) redirect(to net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.turnServ = to
+	c.turnServStr = to.String()
+	c.redirected = true
+}
+
 // STUNServerAddr return the STUN server address
 func (c *Client) STUNServerAddr() net.Addr {
 	return c.stunServ
@@ -145,14 +313,25 @@ func (c *Client) STUNServerAddr() net.Addr {
 
 // Username returns username
 func (c *Client) Username() stun.Username {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	return c.username
 }
 
 // Realm return realm
 func (c *Client) Realm() stun.Realm {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	return c.realm
 }
 
+// LocalAddr returns the local address of the socket the client sends from
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
 // WriteTo sends data to the specified destination using the base socket.
 func (c *Client) WriteTo(data []byte, to net.Addr) (int, error) {
 	return c.conn.WriteTo(data, to)
@@ -175,10 +354,10 @@ func (c *Client) Listen() error {
 				break
 			}
 
-			_, err = c.HandleInbound(buf[:n], from)
-			if err != nil {
-				c.log.Debugf("exiting read loop: %s", err.Error())
-				break
+			// A packet that fails to be handled is dropped, it must not stop
+			// the delivery of the responses and relayed data that follow it
+			if _, err = c.HandleInbound(buf[:n], from); err != nil {
+				c.log.Debugf("dropping packet from %s: %s", from, err.Error())
 			}
 		}
 
@@ -188,12 +367,19 @@ func (c *Client) Listen() error {
 	return nil
 }
 
-// Close closes this client
+// Close closes this client. The socket is only closed if the client bound it
+// from ClientConfig.LocalPort, a ClientConfig.Conn is left open for the caller
 func (c *Client) Close() {
 	c.mutexTrMap.Lock()
 	defer c.mutexTrMap.Unlock()
 
 	c.trMap.CloseAndDeleteAll()
+
+	if c.ownsConn {
+		if err := c.conn.Close(); err != nil {
+			c.log.Debugf("failed to close conn: %s", err.Error())
+		}
+	}
 }
 
 // TransactionID & Base64: https://play.golang.org/p/EEgmJDI971P
@@ -236,78 +422,134 @@ func (c *Client) SendBindingRequest() (net.Addr, error) {
 
 // Allocate sends a TURN allocation request to the given transport address
 func (c *Client) Allocate() (net.PacketConn, error) {
+	relayedConn, _, err := c.allocateConn()
+	if err != nil {
+		return nil, err
+	}
+	return relayedConn, nil
+}
+
+// Gather returns the server reflexive address of the Client and allocates a relayed
+// net.PacketConn, whose LocalAddr is the relay candidate, e.g. to gather ICE candidates
+// in one call. The server reflexive address is the XOR-MAPPED-ADDRESS of the Allocate
+// response, a Binding request is only sent to the STUN server, or the TURN server if it
+// isn't set, when the response lacks one
+func (c *Client) Gather() (srflx net.Addr, relayedConn net.PacketConn, err error) {
+	relayedUDPConn, srflx, err := c.allocateConn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if srflx == nil {
+		to := c.stunServ
+		if to == nil {
+			to = c.TURNServerAddr()
+		}
+		if srflx, err = c.SendBindingRequestTo(to); err != nil {
+			if closeErr := relayedUDPConn.Close(); closeErr != nil {
+				c.log.Errorf("failed to close relayed conn: %s", closeErr.Error())
+			}
+			return nil, nil, err
+		}
+	}
+	return srflx, relayedUDPConn, nil
+}
+
+// allocateConn allocates the relayed conn of Allocate and Gather, it also returns the
+// XOR-MAPPED-ADDRESS of the Allocate response, nil if it had none
+func (c *Client) allocateConn() (*client.UDPConn, net.Addr, error) {
 	if err := c.allocTryLock.Lock(); err != nil {
-		return nil, fmt.Errorf("only one Allocate() caller is allowed: %s", err.Error())
+		return nil, nil, fmt.Errorf("only one Allocate() caller is allowed: %s", err.Error())
 	}
 	defer c.allocTryLock.Unlock()
 
 	relayedConn := c.relayedUDPConn()
 	if relayedConn != nil {
-		return nil, fmt.Errorf("already allocated at %s", relayedConn.LocalAddr().String())
+		return nil, nil, fmt.Errorf("already allocated at %s", relayedConn.LocalAddr().String())
 	}
 
-	msg, err := stun.Build(
-		stun.TransactionID,
-		stun.NewType(stun.MethodAllocate, stun.ClassRequest),
-		proto.RequestedTransport{Protocol: proto.ProtoUDP},
-		stun.Fingerprint,
-	)
+	relayedAddr, mappedAddr, nonce, lifetime, err := c.allocateRelay()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	trRes, err := c.PerformTransaction(msg, c.turnServ, false)
-	if err != nil {
-		return nil, err
-	}
+	c.mutex.RLock()
+	integrity := c.integrity
+	c.mutex.RUnlock()
 
-	res := trRes.Msg
+	config := &client.UDPConnConfig{
+		Observer:    c,
+		RelayedAddr: relayedAddr,
+		Integrity:   integrity,
+		Nonce:       nonce,
+		Lifetime:    lifetime,
+		Log:         c.log,
 
-	// Anonymous allocate failed, trying to authenticate.
-	var nonce stun.Nonce
-	if err = nonce.GetFrom(res); err != nil {
-		return nil, err
-	}
-	if err = c.realm.GetFrom(res); err != nil {
-		return nil, err
+		DisablePermissionRefresh: c.disablePermissionRefresh,
+		DisableFingerprint:       c.disableFingerprint,
 	}
-	c.realm = append([]byte(nil), c.realm...)
-	c.integrity = stun.NewLongTermIntegrity(
-		c.username.String(), c.realm.String(), c.password,
-	)
-	// Trying to authorize.
-	msg, err = stun.Build(
-		stun.TransactionID,
-		stun.NewType(stun.MethodAllocate, stun.ClassRequest),
-		proto.RequestedTransport{Protocol: proto.ProtoUDP},
-		&c.username,
-		&c.realm,
-		&nonce,
-		&c.integrity,
-		stun.Fingerprint,
-	)
-	if err != nil {
-		return nil, err
+	if c.autoReallocate {
+		config.Reallocate = c.reallocate
+		config.OnReallocated = c.onReallocated
 	}
+	relayedConn = client.NewUDPConn(config)
+
+	c.setRelayedUDPConn(relayedConn)
+
+	return relayedConn, mappedAddr, nil
+}
+
+// reallocate replaces an allocation the server lost, see ClientConfig.AutoReallocateOnMismatch
+func (c *Client) reallocate() (net.Addr, stun.Nonce, time.Duration, error) {
+	c.log.Warnf("allocation on %s was lost, allocating again", c.TURNServerAddr())
+	relayedAddr, _, nonce, lifetime, err := c.allocateRelay()
+	return relayedAddr, nonce, lifetime, err
+}
 
-	trRes, err = c.PerformTransaction(msg, c.turnServ, false)
+// allocateRelay requests an allocation, following redirects, and returns its relayed
+// address, the XOR-MAPPED-ADDRESS if the response has one, the nonce to authenticate
+// with and the granted lifetime
+func (c *Client) allocateRelay() (net.Addr, net.Addr, stun.Nonce, time.Duration, error) {
+	// Servers may redirect with a 300 (Try Alternate), the request is retried on the
+	// ALTERNATE-SERVER. Servers already tried are refused so redirects can't loop.
+	tried := map[string]bool{c.TURNServerAddr().String(): true}
+	res, nonce, err := c.allocate()
+	for err == nil {
+		alternate, ok := alternateServer(res)
+		if !ok {
+			break
+		}
+		if c.dialed {
+			return nil, nil, nil, 0, fmt.Errorf("%w: %s", errRedirectOverConnection, alternate)
+		}
+		if len(tried) > maxRedirects || tried[alternate.String()] {
+			return nil, nil, nil, 0, fmt.Errorf("%w: %s", errTooManyRedirects, alternate)
+		}
+		tried[alternate.String()] = true
+
+		c.log.Infof("allocate redirected from %s to %s", c.TURNServerAddr(), alternate)
+		c.redirect(alternate)
+		res, nonce, err = c.allocate()
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, 0, err
 	}
-	res = trRes.Msg
 
 	if res.Type.Class == stun.ClassErrorResponse {
 		var code stun.ErrorCodeAttribute
 		if err = code.GetFrom(res); err == nil {
-			return nil, fmt.Errorf("%s (error %s)", res.Type, code)
+			if code.Code == stun.CodeAddrFamilyNotSupported {
+				return nil, nil, nil, 0, fmt.Errorf("%w: %s", ErrAddressFamilyNotSupported, c.requestedAddressFamily)
+			}
+			return nil, nil, nil, 0, fmt.Errorf("%s (error %s)", res.Type, code)
 		}
-		return nil, fmt.Errorf("%s", res.Type)
+		return nil, nil, nil, 0, fmt.Errorf("%s", res.Type)
 	}
 
 	// Getting relayed addresses from response.
 	var relayed proto.RelayedAddress
 	if err := relayed.GetFrom(res); err != nil {
-		return nil, err
+		return nil, nil, nil, 0, err
 	}
 	relayedAddr := &net.UDPAddr{
 		IP:   relayed.IP,
@@ -317,21 +559,157 @@ func (c *Client) Allocate() (net.PacketConn, error) {
 	// Getting lifetime from response
 	var lifetime proto.Lifetime
 	if err := lifetime.GetFrom(res); err != nil {
-		return nil, err
+		return nil, nil, nil, 0, err
 	}
 
-	relayedConn = client.NewUDPConn(&client.UDPConnConfig{
-		Observer:    c,
-		RelayedAddr: relayedAddr,
-		Integrity:   c.integrity,
-		Nonce:       nonce,
-		Lifetime:    lifetime.Duration,
-		Log:         c.log,
-	})
+	var mappedAddr net.Addr
+	var mapped stun.XORMappedAddress
+	if err := mapped.GetFrom(res); err == nil {
+		mappedAddr = &net.UDPAddr{
+			IP:   mapped.IP,
+			Port: mapped.Port,
+		}
+	}
 
-	c.setRelayedUDPConn(relayedConn)
+	return relayedAddr, mappedAddr, nonce, lifetime.Duration, nil
+}
 
-	return relayedConn, nil
+// allocate runs the Allocate exchange with the TURN server, it returns the response to the
+// authenticated request, or the response to the first one if it is a 300 (Try Alternate)
+func (c *Client) allocate() (*stun.Message, stun.Nonce, error) {
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		proto.RequestedTransport{Protocol: proto.ProtoUDP},
+		c.requestedAddressFamily,
+		client.FingerprintSetter(c.disableFingerprint),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trRes, err := c.PerformTransaction(msg, c.TURNServerAddr(), false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := trRes.Msg
+	if _, ok := alternateServer(res); ok {
+		return res, nil, nil
+	}
+
+	// Anonymous allocate failed, trying to authenticate. Only a 401 (Unauthorized)
+	// carries the REALM and NONCE to authenticate with, other responses are final
+	if !hasErrorCode(res, stun.CodeUnauthorized) {
+		return res, nil, nil
+	}
+
+	// The authenticated request is retried once with the new NONCE of a 438 (Stale Nonce),
+	// the nonce may have expired in between, e.g. because the server restarted
+	for attempt := 0; ; attempt++ {
+		var nonce stun.Nonce
+		if err = nonce.GetFrom(res); err != nil {
+			return nil, nil, err
+		}
+		var realm stun.Realm
+		if err = realm.GetFrom(res); err != nil {
+			return nil, nil, err
+		}
+		realm = append([]byte(nil), realm...)
+		if c.credentialProvider != nil {
+			username, password := c.credentialProvider(realm.String())
+			c.mutex.Lock()
+			c.username, c.password = stun.NewUsername(username), password
+			c.mutex.Unlock()
+		}
+
+		// A reallocation runs alongside the requests of the relayed conn, which read the realm
+		c.mutex.Lock()
+		c.realm = realm
+		integrity, passwordAlgorithm := c.longTermIntegrity(res, nonce)
+		c.integrity, c.passwordAlgorithm = integrity, passwordAlgorithm
+		username := c.username
+		c.mutex.Unlock()
+
+		// Trying to authorize.
+		msg, err = stun.Build(
+			stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			proto.RequestedTransport{Protocol: proto.ProtoUDP},
+			c.requestedAddressFamily,
+			&username,
+			&realm,
+			&nonce,
+			integrity,
+			client.FingerprintSetter(c.disableFingerprint),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		trRes, err = c.PerformTransaction(msg, c.TURNServerAddr(), false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		res = trRes.Msg
+		if attempt > 0 || !hasErrorCode(res, stun.CodeStaleNonce) {
+			return res, nonce, nil
+		}
+		c.log.Debug("nonce is stale, retrying allocate with the new nonce")
+	}
+}
+
+// hasErrorCode returns true if res is an error response with code
+func hasErrorCode(res *stun.Message, code stun.ErrorCode) bool {
+	if res.Type.Class != stun.ClassErrorResponse {
+		return false
+	}
+
+	var errorCode stun.ErrorCodeAttribute
+	return errorCode.GetFrom(res) == nil && errorCode.Code == code
+}
+
+// alternateServer returns the ALTERNATE-SERVER of a 300 (Try Alternate) error response
+func alternateServer(res *stun.Message) (net.Addr, bool) {
+	if res.Type.Class != stun.ClassErrorResponse {
+		return nil, false
+	}
+
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(res); err != nil || code.Code != stun.CodeTryAlternate {
+		return nil, false
+	}
+
+	var alternate stun.AlternateServer
+	if err := alternate.GetFrom(res); err != nil {
+		return nil, false
+	}
+	return &net.UDPAddr{IP: alternate.IP, Port: alternate.Port}, true
+}
+
+// CreatePermission creates or refreshes the permissions for the given peers
+// on the current allocation. https://tools.ietf.org/html/rfc5766#section-9
+func (c *Client) CreatePermission(addrs ...net.Addr) error {
+	relayedConn := c.relayedUDPConn()
+	if relayedConn == nil {
+		return fmt.Errorf("no relayed conn allocated")
+	}
+
+	return relayedConn.CreatePermissions(addrs...)
+}
+
+// RemovePermission stops refreshing the permission for the IP of peer on the current
+// allocation and forgets its channel bindings, e.g. once a long-lived client is done with
+// a peer. The permission expires on the server, writing to the peer creates it again
+func (c *Client) RemovePermission(peer net.Addr) error {
+	relayedConn := c.relayedUDPConn()
+	if relayedConn == nil {
+		return fmt.Errorf("no relayed conn allocated")
+	}
+
+	relayedConn.RemovePermission(peer)
+	return nil
 }
 
 // PerformTransaction performs STUN transaction
@@ -344,6 +722,7 @@ func (c *Client) PerformTransaction(msg *stun.Message, to net.Addr, ignoreResult
 
 	tr := client.NewTransaction(&client.TransactionConfig{
 		Key:          trKey,
+		Method:       msg.Type.Method,
 		Raw:          raw,
 		To:           to,
 		Interval:     c.rto,
@@ -372,6 +751,48 @@ func (c *Client) PerformTransaction(msg *stun.Message, to net.Addr, ignoreResult
 	return res, nil
 }
 
+// RoundTrip sends msg to the TURN server and returns the response with its transaction ID,
+// retransmitting msg every RTO like every other request of the Client. It is an escape hatch
+// to build custom flows, e.g. with attributes the Client doesn't support. msg is sent as is,
+// it must be encoded and signed by the caller. An error response is returned without error
+func (c *Client) RoundTrip(msg *stun.Message) (*stun.Message, error) {
+	if len(msg.Raw) == 0 {
+		return nil, errEmptyMessage
+	}
+
+	res, err := c.PerformTransaction(msg, c.TURNServerAddr(), false)
+	if err != nil {
+		return nil, err
+	}
+	return res.Msg, nil
+}
+
+// AllocationExpiry returns when the allocation made with Allocate expires unless it is
+// refreshed, based on the lifetime granted by the last Allocate or Refresh. The allocation
+// is refreshed automatically halfway through its lifetime. The zero time is returned
+// when there is no allocation
+func (c *Client) AllocationExpiry() time.Time {
+	relayedConn := c.relayedUDPConn()
+	if relayedConn == nil {
+		return time.Time{}
+	}
+	return relayedConn.ExpiresAt()
+}
+
+// SetPeerKeepalive sends payload to peer through the allocation made with Allocate every
+// interval, e.g. to keep the NAT in front of the peer open while bursty media pauses. The
+// payload may be empty, the peer gets a zero-length datagram then. Calling it again for the
+// same peer replaces its keepalive, an interval of zero or less stops it. Keepalives stop
+// when the relayed conn is closed
+func (c *Client) SetPeerKeepalive(peer net.Addr, interval time.Duration, payload []byte) error {
+	relayedConn := c.relayedUDPConn()
+	if relayedConn == nil {
+		return fmt.Errorf("no relayed conn allocated")
+	}
+	relayedConn.SetPeerKeepalive(peer, interval, payload)
+	return nil
+}
+
 // OnDeallocated is called when deallocation of relay address has been complete.
 // (Called by UDPConn)
 func (c *Client) OnDeallocated(relayedAddr net.Addr) {
@@ -412,6 +833,9 @@ func (c *Client) HandleInbound(data []byte, from net.Addr) (bool, error) {
 	case len(c.stunServStr) != 0 && from.String() == c.stunServStr:
 		// received from STUN server but it is not a STUN message
 		return true, fmt.Errorf("non-STUN message from STUN server")
+	case c.receivedRelayProbe(data):
+		// the probe of RelaySelfTest came back through the relay
+		return true, nil
 	default:
 		// assume, this is an application data
 		c.log.Tracef("non-STUN/TURN packect, unhandled")
@@ -457,6 +881,11 @@ func (c *Client) handleSTUNMessage(data []byte, from net.Addr) error {
 				return nil // silently discard
 			}
 
+			if c.onUnknownPeerData != nil && !relayedConn.HasPermission(from) && !c.onUnknownPeerData(from) {
+				c.log.Debugf("dropped data indication from unknown peer %s", from.String())
+				return nil
+			}
+
 			relayedConn.HandleInbound(data, from)
 		}
 		return nil
@@ -482,6 +911,7 @@ func (c *Client) handleSTUNMessage(data []byte, from net.Addr) error {
 	tr.StopRtxTimer()
 	c.trMap.Delete(trKey)
 	c.mutexTrMap.Unlock()
+	c.recordTransaction(tr.Method, msg, tr.Retries(), time.Since(tr.Start))
 
 	if !tr.WriteResult(client.TransactionResult{
 		Msg:     msg,
@@ -530,8 +960,9 @@ func (c *Client) onRtxTimeout(trKey string, nRtx int) {
 	}
 
 	if nRtx == maxRtxCount {
-		// all retransmisstions failed
+		// all retransmisstions failed, the last timer expiry wasn't a retransmission
 		c.trMap.Delete(trKey)
+		c.recordTransaction(tr.Method, nil, nRtx-1, 0)
 		if !tr.WriteResult(client.TransactionResult{
 			Err: fmt.Errorf("all retransmissions for %s failed", trKey),
 		}) {
@@ -545,6 +976,7 @@ func (c *Client) onRtxTimeout(trKey string, nRtx int) {
 	_, err := c.conn.WriteTo(tr.Raw, tr.To)
 	if err != nil {
 		c.trMap.Delete(trKey)
+		c.recordTransaction(tr.Method, nil, nRtx-1, 0)
 		if !tr.WriteResult(client.TransactionResult{
 			Err: fmt.Errorf("failed to retransmit transaction %s", trKey),
 		}) {
@@ -0,0 +1,48 @@
+package turn
+
+import (
+	"fmt"
+
+	"github.com/pion/logging"
+)
+
+// correlatedLogger prefixes every log line with the ClientConfig.CorrelationID
+type correlatedLogger struct {
+	logging.LeveledLogger
+	prefix string
+}
+
+// newCorrelatedLogger returns log prefixing its lines with correlationID, log as is
+// when correlationID is empty
+func newCorrelatedLogger(log logging.LeveledLogger, correlationID string) logging.LeveledLogger {
+	if correlationID == "" {
+		return log
+	}
+	return &correlatedLogger{LeveledLogger: log, prefix: fmt.Sprintf("[%s] ", correlationID)}
+}
+
+func (l *correlatedLogger) Trace(msg string) { l.LeveledLogger.Trace(l.prefix + msg) }
+func (l *correlatedLogger) Debug(msg string) { l.LeveledLogger.Debug(l.prefix + msg) }
+func (l *correlatedLogger) Info(msg string)  { l.LeveledLogger.Info(l.prefix + msg) }
+func (l *correlatedLogger) Warn(msg string)  { l.LeveledLogger.Warn(l.prefix + msg) }
+func (l *correlatedLogger) Error(msg string) { l.LeveledLogger.Error(l.prefix + msg) }
+
+func (l *correlatedLogger) Tracef(format string, args ...interface{}) {
+	l.LeveledLogger.Tracef(l.prefix+format, args...)
+}
+
+func (l *correlatedLogger) Debugf(format string, args ...interface{}) {
+	l.LeveledLogger.Debugf(l.prefix+format, args...)
+}
+
+func (l *correlatedLogger) Infof(format string, args ...interface{}) {
+	l.LeveledLogger.Infof(l.prefix+format, args...)
+}
+
+func (l *correlatedLogger) Warnf(format string, args ...interface{}) {
+	l.LeveledLogger.Warnf(l.prefix+format, args...)
+}
+
+func (l *correlatedLogger) Errorf(format string, args ...interface{}) {
+	l.LeveledLogger.Errorf(l.prefix+format, args...)
+}
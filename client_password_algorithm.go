@@ -0,0 +1,82 @@
+package turn
+
+import (
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/proto"
+)
+
+// PasswordAlgorithm is the algorithm the key of the long-term credentials is derived
+// with, see Client.PasswordAlgorithm
+type PasswordAlgorithm uint16
+
+// Password algorithms of RFC 8489
+const (
+	PasswordAlgorithmMD5    = PasswordAlgorithm(proto.PasswordAlgorithmMD5)
+	PasswordAlgorithmSHA256 = PasswordAlgorithm(proto.PasswordAlgorithmSHA256)
+)
+
+func (a PasswordAlgorithm) String() string {
+	return proto.PasswordAlgorithm(a).String()
+}
+
+// PasswordAlgorithm returns the algorithm the key the client authenticates with was derived
+// with by the last Allocate. SHA-256, with MESSAGE-INTEGRITY-SHA256, is selected when the
+// NONCE of the server starts with an RFC 8489 nonce cookie advertising password algorithms
+// and the server offers SHA-256 in PASSWORD-ALGORITHMS. Otherwise it is MD5, with the
+// MESSAGE-INTEGRITY of RFC 5389.
+//
+// Only the client side of the negotiation is implemented, the Server of this package doesn't
+// advertise password algorithms and is always authenticated with MD5
+func (c *Client) PasswordAlgorithm() PasswordAlgorithm {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.passwordAlgorithm
+}
+
+// negotiatedIntegrity adds the PASSWORD-ALGORITHMS offered by the server and the
+// PASSWORD-ALGORITHM selected from them before the integrity, RFC 8489 Section 9.2.4
+type negotiatedIntegrity struct {
+	algorithms proto.PasswordAlgorithms
+	algorithm  proto.PasswordAlgorithm
+	integrity  stun.Setter
+}
+
+func (i negotiatedIntegrity) AddTo(m *stun.Message) error {
+	for _, s := range []stun.Setter{i.algorithms, i.algorithm, i.integrity} {
+		if err := s.AddTo(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// longTermIntegrity returns the integrity to authenticate with after the 401 (Unauthorized)
+// res carrying nonce, and the PasswordAlgorithm its key is derived with
+func (c *Client) longTermIntegrity(res *stun.Message, nonce stun.Nonce) (stun.Setter, PasswordAlgorithm) {
+	integrity := stun.NewLongTermIntegrity(c.username.String(), c.realm.String(), c.password)
+
+	var algorithms proto.PasswordAlgorithms
+	features, ok := proto.ParseNonceCookie(nonce.String())
+	if !ok || features&proto.SecurityFeaturePasswordAlgorithms == 0 || algorithms.GetFrom(res) != nil {
+		return integrity, PasswordAlgorithmMD5
+	}
+
+	switch {
+	case algorithms.Contains(proto.PasswordAlgorithmSHA256):
+		return negotiatedIntegrity{
+			algorithms: algorithms,
+			algorithm:  proto.PasswordAlgorithmSHA256,
+			integrity:  proto.NewLongTermIntegritySHA256(c.username.String(), c.realm.String(), c.password),
+		}, PasswordAlgorithmSHA256
+	case algorithms.Contains(proto.PasswordAlgorithmMD5):
+		return negotiatedIntegrity{
+			algorithms: algorithms,
+			algorithm:  proto.PasswordAlgorithmMD5,
+			integrity:  integrity,
+		}, PasswordAlgorithmMD5
+	default:
+		c.log.Warnf("server offers no supported password algorithm, falling back to MD5")
+		return integrity, PasswordAlgorithmMD5
+	}
+}
@@ -0,0 +1,99 @@
+package turn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// relayProbeSize is the size of the probe of RelaySelfTest, its first byte is neither the
+// one of a STUN message nor the one of a ChannelData message
+const relayProbeSize = 20
+
+type relayProbe struct {
+	data     []byte
+	received chan struct{}
+}
+
+// RelaySelfTest checks that the allocation actually relays, not only that the server accepted
+// the Allocate request. It sends a probe from the relayed address to the server reflexive
+// address of the client, learned with a Binding request to the TURN server, and waits up to
+// timeout for the probe to come back on the client's socket. A firewall or NAT filtering
+// packets from the relay, or a relay that can't send at all, make it fail with an error that
+// tells which step failed.
+//
+// An allocation is made for the test if there is none, and deleted afterwards. Either Listen
+// must be running or the packets of the socket must be passed to HandleInbound. The TURN
+// server must be reached over UDP.
+func (c *Client) RelaySelfTest(timeout time.Duration) error {
+	if c.dialed {
+		return errRelaySelfTestOverConnection
+	}
+
+	c.selfTestLock.Lock()
+	defer c.selfTestLock.Unlock()
+
+	relayedConn := c.relayedUDPConn()
+	if relayedConn == nil {
+		conn, _, err := c.allocateConn()
+		if err != nil {
+			return fmt.Errorf("%w: failed to allocate: %v", errRelaySelfTestFailed, err)
+		}
+		defer func() {
+			if closeErr := conn.Close(); closeErr != nil {
+				c.log.Warnf("failed to delete the allocation of the relay self-test: %v", closeErr)
+			}
+		}()
+		relayedConn = conn
+	}
+
+	srflx, err := c.SendBindingRequestTo(c.TURNServerAddr())
+	if err != nil {
+		return fmt.Errorf("%w: failed to learn the server reflexive address: %v", errRelaySelfTestFailed, err)
+	}
+
+	probe := &relayProbe{data: make([]byte, relayProbeSize), received: make(chan struct{}, 1)}
+	if _, err = rand.Read(probe.data[1:]); err != nil {
+		return err
+	}
+	probe.data[0] = 0xFF
+
+	c.mutex.Lock()
+	c.relayProbe = probe
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.relayProbe = nil
+		c.mutex.Unlock()
+	}()
+
+	// WriteTo creates the permission for the server reflexive address first
+	if _, err = relayedConn.WriteTo(probe.data, srflx); err != nil {
+		return fmt.Errorf("%w: failed to send the probe from %s to %s: %v", errRelaySelfTestFailed, relayedConn.LocalAddr(), srflx, err)
+	}
+
+	select {
+	case <-probe.received:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%w: the probe sent from %s to %s didn't arrive within %v", errRelaySelfTestFailed, relayedConn.LocalAddr(), srflx, timeout)
+	}
+}
+
+// receivedRelayProbe returns true if data is the probe RelaySelfTest waits for
+func (c *Client) receivedRelayProbe(data []byte) bool {
+	c.mutex.RLock()
+	probe := c.relayProbe
+	c.mutex.RUnlock()
+
+	if probe == nil || !bytes.Equal(data, probe.data) {
+		return false
+	}
+
+	select {
+	case probe.received <- struct{}{}:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package turn
+
+import (
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// TransactionStats aggregates the transactions the Client performed for one method,
+// e.g. stun.MethodAllocate, stun.MethodRefresh or stun.MethodCreatePermission
+type TransactionStats struct {
+	// Successes and Failures count the transactions answered with a success or an
+	// error response. Timeouts count the ones that got no response at all
+	Successes uint64
+	Failures  uint64
+	Timeouts  uint64
+
+	// Retransmissions is the number of times requests were sent again
+	Retransmissions uint64
+
+	// RTT samples are only taken from transactions answered without a retransmission,
+	// the response to a retransmitted request can't be matched to the request it answers.
+	// The mean RTT is TotalRTT divided by RTTSamples
+	RTTSamples uint64
+	TotalRTT   time.Duration
+	MinRTT     time.Duration
+	MaxRTT     time.Duration
+	LastRTT    time.Duration
+}
+
+// Stats returns the transaction statistics of the Client by method. Requests the
+// Client doesn't wait on, e.g. the Refresh deleting the allocation on close, are
+// counted as well. Indications have no response and aren't counted
+func (c *Client) Stats() map[stun.Method]TransactionStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	stats := make(map[stun.Method]TransactionStats, len(c.stats))
+	for method, s := range c.stats {
+		stats[method] = *s
+	}
+	return stats
+}
+
+// recordTransaction adds the outcome of a transaction of method to the Stats
+func (c *Client) recordTransaction(method stun.Method, res *stun.Message, retries int, rtt time.Duration) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	s, ok := c.stats[method]
+	if !ok {
+		s = &TransactionStats{}
+		c.stats[method] = s
+	}
+	s.Retransmissions += uint64(retries)
+
+	switch {
+	case res == nil:
+		s.Timeouts++
+		return
+	case res.Type.Class == stun.ClassErrorResponse:
+		s.Failures++
+	default:
+		s.Successes++
+	}
+
+	if retries != 0 {
+		return
+	}
+	s.RTTSamples++
+	s.TotalRTT += rtt
+	s.LastRTT = rtt
+	if s.MinRTT == 0 || rtt < s.MinRTT {
+		s.MinRTT = rtt
+	}
+	if rtt > s.MaxRTT {
+		s.MaxRTT = rtt
+	}
+}
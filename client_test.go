@@ -3,12 +3,23 @@
 package turn
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
 	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/test"
 	"github.com/pion/transport/vnet"
+	"github.com/pion/turn/v2/internal/proto"
+	"github.com/pion/turn/v2/turntest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -183,3 +194,1784 @@ func TestClientNonceExpiration(t *testing.T) {
 	assert.NoError(t, conn.Close())
 	assert.NoError(t, server.Close())
 }
+
+func TestClientInterleavedDataIndication(t *testing.T) {
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	c, err := NewClient(&ClientConfig{
+		TURNServerAddr: serverConn.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Listen())
+
+	peerAddr := proto.PeerAddress{IP: net.IPv4(10, 0, 0, 2), Port: 6000}
+	integrity := stun.NewLongTermIntegrity("user", "pion.ly", "pass")
+
+	// The fake server answers the Allocate handshake, then answers the next
+	// request only after sending a Data indication and an unexpected request
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+
+		read := func() (*stun.Message, net.Addr) {
+			buf := make([]byte, 1500)
+			n, from, readErr := serverConn.ReadFrom(buf)
+			assert.NoError(t, readErr)
+
+			m := &stun.Message{Raw: buf[:n]}
+			assert.NoError(t, m.Decode())
+			return m, from
+		}
+		send := func(to net.Addr, setters ...stun.Setter) {
+			m, buildErr := stun.Build(setters...)
+			assert.NoError(t, buildErr)
+			_, writeErr := serverConn.WriteTo(m.Raw, to)
+			assert.NoError(t, writeErr)
+		}
+
+		m, from := read()
+		send(from, m, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse),
+			&stun.ErrorCodeAttribute{Code: stun.CodeUnauthorized}, stun.NewNonce("nonce"), stun.NewRealm("pion.ly"))
+
+		m, from = read()
+		send(from, m, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+			&proto.RelayedAddress{IP: net.IPv4(10, 0, 0, 1), Port: 5000},
+			&proto.Lifetime{Duration: time.Hour},
+			&stun.XORMappedAddress{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+			integrity)
+
+		m, from = read()
+		send(from, stun.TransactionID, stun.BindingRequest)
+		send(from, stun.TransactionID, stun.NewType(stun.MethodData, stun.ClassIndication), peerAddr, proto.Data("Hello"))
+		send(from, m, stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse), &proto.Lifetime{Duration: time.Hour}, integrity)
+	}()
+
+	relayConn, err := c.Allocate()
+	assert.NoError(t, err)
+
+	refresh, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassRequest),
+		&proto.Lifetime{Duration: time.Hour}, c.username, c.realm, stun.NewNonce("nonce"), integrity)
+	assert.NoError(t, err)
+
+	res, err := c.PerformTransaction(refresh, c.turnServ, false)
+	assert.NoError(t, err)
+	assert.Equal(t, stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse), res.Msg.Type)
+
+	assert.NoError(t, relayConn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1500)
+	n, from, err := relayConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", string(buf[:n]))
+	assert.Equal(t, peerAddr.String(), from.String())
+
+	<-serverDone
+	assert.NoError(t, relayConn.Close())
+	c.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, serverConn.Close())
+}
+
+func TestClientRequestedAddressFamily(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	// allocate runs Allocate against a server relaying on an in-memory network
+	allocate := func(t *testing.T, generator *inMemoryRelayAddressGenerator, family RequestedAddressFamily, f func(relayConn net.PacketConn, err error)) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				return GenerateAuthKey(username, realm, "pass"), true
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn:            udpListener,
+					RelayAddressGenerator: generator,
+				},
+			},
+			Realm: "pion.ly",
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr:         udpListener.LocalAddr().String(),
+			Username:               "user",
+			Password:               "pass",
+			Conn:                   conn,
+			RequestedAddressFamily: family,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		f(client.Allocate())
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	}
+
+	t.Run("IPv6", func(t *testing.T) {
+		network := turntest.NewNetwork()
+		peer, err := network.ListenPacket("udp6", "[fd00::2]:5000")
+		assert.NoError(t, err)
+
+		allocate(t, &inMemoryRelayAddressGenerator{network: network}, RequestedAddressFamilyIPv6, func(relayConn net.PacketConn, err error) {
+			assert.NoError(t, err)
+			assert.Equal(t, "fd00::1", relayConn.LocalAddr().(*net.UDPAddr).IP.String())
+
+			_, err = relayConn.WriteTo([]byte("Hello"), peer.LocalAddr())
+			assert.NoError(t, err)
+
+			buf := make([]byte, 1500)
+			n, from, err := peer.ReadFrom(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, "Hello", string(buf[:n]))
+			assert.Equal(t, relayConn.LocalAddr().String(), from.String())
+
+			assert.NoError(t, relayConn.Close())
+		})
+		assert.NoError(t, peer.Close())
+	})
+
+	t.Run("IPv4", func(t *testing.T) {
+		allocate(t, &inMemoryRelayAddressGenerator{network: turntest.NewNetwork()}, RequestedAddressFamilyIPv4, func(relayConn net.PacketConn, err error) {
+			assert.NoError(t, err)
+			assert.Equal(t, "10.0.0.1", relayConn.LocalAddr().(*net.UDPAddr).IP.String())
+			assert.NoError(t, relayConn.Close())
+		})
+	})
+
+	t.Run("NotSupported", func(t *testing.T) {
+		generator := &inMemoryRelayAddressGenerator{network: turntest.NewNetwork(), ipv4Only: true}
+		allocate(t, generator, RequestedAddressFamilyIPv6, func(relayConn net.PacketConn, err error) {
+			assert.True(t, errors.Is(err, ErrAddressFamilyNotSupported), "unexpected error: %v", err)
+			assert.Nil(t, relayConn)
+		})
+	})
+}
+
+// redirectingServer answers every request on conn with a 300 (Try Alternate) to alternate
+func redirectingServer(t *testing.T, conn net.PacketConn, alternate *net.UDPAddr) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		m := &stun.Message{Raw: buf[:n]}
+		assert.NoError(t, m.Decode())
+
+		res, err := stun.Build(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+			&stun.ErrorCodeAttribute{Code: stun.CodeTryAlternate},
+			&stun.AlternateServer{IP: alternate.IP, Port: alternate.Port})
+		assert.NoError(t, err)
+
+		_, err = conn.WriteTo(res.Raw, from)
+		assert.NoError(t, err)
+	}
+}
+
+func TestClientAlternateServer(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	createClient := func(turnServerAddr net.Addr) (*Client, net.PacketConn) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: turnServerAddr.String(),
+			Username:       "user",
+			Password:       "pass",
+			Conn:           conn,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+		return client, conn
+	}
+
+	t.Run("Redirect", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				return GenerateAuthKey(username, realm, "pass"), true
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "127.0.0.1",
+					},
+				},
+			},
+			Realm: "pion.ly",
+		})
+		assert.NoError(t, err)
+
+		redirectConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go redirectingServer(t, redirectConn, udpListener.LocalAddr().(*net.UDPAddr))
+
+		client, conn := createClient(redirectConn.LocalAddr())
+		assert.False(t, client.Redirected())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		assert.True(t, client.Redirected())
+		assert.Equal(t, udpListener.LocalAddr().String(), client.TURNServerAddr().String())
+
+		// The allocation is refreshed and deleted on the server it was redirected to
+		assert.NoError(t, relayConn.Close())
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, redirectConn.Close())
+		assert.NoError(t, server.Close())
+	})
+
+	t.Run("Loop", func(t *testing.T) {
+		first, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		second, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		go redirectingServer(t, first, second.LocalAddr().(*net.UDPAddr))
+		go redirectingServer(t, second, first.LocalAddr().(*net.UDPAddr))
+
+		client, conn := createClient(first.LocalAddr())
+
+		_, err = client.Allocate()
+		assert.True(t, errors.Is(err, errTooManyRedirects), "unexpected error: %v", err)
+		assert.Equal(t, second.LocalAddr().String(), client.TURNServerAddr().String())
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, first.Close())
+		assert.NoError(t, second.Close())
+	})
+}
+
+func TestClientLocalPort(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	t.Run("LocalPort", func(t *testing.T) {
+		// Find a free port
+		conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+		assert.NoError(t, err)
+		localPort := conn.LocalAddr().(*net.UDPAddr).Port
+		assert.NoError(t, conn.Close())
+
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       "user",
+			Password:       "pass",
+			LocalPort:      localPort,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, localPort, client.LocalAddr().(*net.UDPAddr).Port)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		assert.NoError(t, relayConn.Close())
+
+		// The client bound the socket, Close releases the port
+		client.Close()
+		conn, err = net.ListenPacket("udp4", fmt.Sprintf("0.0.0.0:%d", localPort))
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("Conn", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       "user",
+			Password:       "pass",
+			Conn:           conn,
+			LocalPort:      1,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, conn.LocalAddr(), client.LocalAddr())
+
+		// The socket belongs to the caller, it is still usable after Close
+		client.Close()
+		_, err = conn.WriteTo([]byte("Hello"), udpListener.LocalAddr())
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("Unset", func(t *testing.T) {
+		_, err := NewClient(&ClientConfig{TURNServerAddr: udpListener.LocalAddr().String()})
+		assert.Error(t, err)
+	})
+
+	assert.NoError(t, server.Close())
+}
+
+func TestClientWriteTo(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// The first write creates the permission and is sent in a Send indication
+	n, err := relayConn.WriteTo([]byte("Hello"), peerConn.LocalAddr())
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	buf := make([]byte, inboundMTU)
+	n, from, err := peerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", string(buf[:n]))
+	assert.Equal(t, relayConn.LocalAddr().String(), from.String())
+
+	_, err = peerConn.WriteTo([]byte("World"), from)
+	assert.NoError(t, err)
+	n, from, err = relayConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "World", string(buf[:n]))
+	assert.Equal(t, peerConn.LocalAddr().String(), from.String())
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestClientAutoReallocateOnMismatch(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	startServer := func(addr string) (*Server, net.PacketConn) {
+		udpListener, err := net.ListenPacket("udp4", addr)
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				return GenerateAuthKey(username, realm, "pass"), true
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "127.0.0.1",
+					},
+				},
+			},
+			Realm: "pion.ly",
+		})
+		assert.NoError(t, err)
+		return server, udpListener
+	}
+	server, udpListener := startServer("127.0.0.1:0")
+
+	reallocated := make(chan net.Addr, 1)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr:           udpListener.LocalAddr().String(),
+		Username:                 "user",
+		Password:                 "pass",
+		Conn:                     conn,
+		AutoReallocateOnMismatch: true,
+		OnReallocated: func(relayedAddr net.Addr) {
+			reallocated <- relayedAddr
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+	lostAddr := relayConn.LocalAddr()
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	otherPeerConn, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	assert.NoError(t, err)
+
+	buf := make([]byte, inboundMTU)
+	_, err = relayConn.WriteTo([]byte("Hello"), peerConn.LocalAddr())
+	assert.NoError(t, err)
+	_, _, err = peerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	// The restarted server knows neither the nonce nor the allocation, the permission
+	// for a new peer is refused with 437 and the client allocates again
+	assert.NoError(t, server.Close())
+	server, _ = startServer(udpListener.LocalAddr().String())
+
+	_, err = relayConn.WriteTo([]byte("Hello"), otherPeerConn.LocalAddr())
+	assert.NoError(t, err)
+	_, from, err := otherPeerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	relayedAddr := <-reallocated
+	assert.NotEqual(t, lostAddr.String(), relayedAddr.String())
+	assert.Equal(t, relayedAddr.String(), relayConn.LocalAddr().String())
+	assert.Equal(t, relayedAddr.String(), from.String())
+
+	// The permission of the first peer was installed again on the new allocation
+	_, err = peerConn.WriteTo([]byte("World"), relayedAddr)
+	assert.NoError(t, err)
+	n, from, err := relayConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "World", string(buf[:n]))
+	assert.Equal(t, peerConn.LocalAddr().String(), from.String())
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, otherPeerConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestClientAllocateStaleNonce(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// The server challenges the anonymous Allocate, finds the nonce of the authenticated
+	// one stale and then refuses the allocation. The nonce of every request is recorded
+	nonces := make(chan string, 4)
+	go func() {
+		buf := make([]byte, 1500)
+		for i := 0; ; i++ {
+			n, from, err := serverConn.ReadFrom(buf)
+			if err != nil {
+				close(nonces)
+				return
+			}
+
+			m := &stun.Message{Raw: buf[:n]}
+			assert.NoError(t, m.Decode())
+
+			var nonce stun.Nonce
+			_ = nonce.GetFrom(m)
+			nonces <- nonce.String()
+
+			setters := []stun.Setter{m, stun.NewType(m.Type.Method, stun.ClassErrorResponse)}
+			switch i {
+			case 0:
+				setters = append(setters, &stun.ErrorCodeAttribute{Code: stun.CodeUnauthorized}, stun.NewNonce("first"), stun.NewRealm("pion.ly"))
+			case 1:
+				setters = append(setters, &stun.ErrorCodeAttribute{Code: stun.CodeStaleNonce}, stun.NewNonce("second"), stun.NewRealm("pion.ly"))
+			default:
+				setters = append(setters, &stun.ErrorCodeAttribute{Code: stun.CodeInsufficientCapacity})
+			}
+
+			res, err := stun.Build(setters...)
+			assert.NoError(t, err)
+			_, err = serverConn.WriteTo(res.Raw, from)
+			assert.NoError(t, err)
+		}
+	}()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: serverConn.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	// The error of the final response is returned
+	_, err = client.Allocate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "508")
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, serverConn.Close())
+
+	var sent []string
+	for nonce := range nonces {
+		sent = append(sent, nonce)
+	}
+	assert.Equal(t, []string{"", "first", "second"}, sent)
+}
+
+func TestClientStats(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	t.Run("Outcomes", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				return GenerateAuthKey(username, realm, "pass"), true
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "127.0.0.1",
+					},
+				},
+			},
+			Realm: "pion.ly",
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       "user",
+			Password:       "pass",
+			Conn:           conn,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+		assert.Empty(t, client.Stats())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		assert.NoError(t, client.CreatePermission(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}))
+		assert.NoError(t, relayConn.Close())
+
+		// Close doesn't wait for the response to its Refresh
+		assert.Eventually(t, func() bool {
+			return client.Stats()[stun.MethodRefresh].Successes == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		stats := client.Stats()
+
+		// The anonymous Allocate is challenged with a 401 (Unauthorized)
+		allocate := stats[stun.MethodAllocate]
+		assert.Equal(t, uint64(1), allocate.Successes)
+		assert.Equal(t, uint64(1), allocate.Failures)
+		assert.Equal(t, uint64(2), allocate.RTTSamples)
+		assert.True(t, allocate.MinRTT > 0 && allocate.MinRTT <= allocate.MaxRTT)
+		assert.True(t, allocate.TotalRTT >= allocate.MinRTT+allocate.MaxRTT)
+
+		for _, method := range []stun.Method{stun.MethodCreatePermission, stun.MethodRefresh} {
+			assert.Equal(t, uint64(1), stats[method].Successes, method)
+			assert.Equal(t, uint64(0), stats[method].Failures, method)
+			assert.Equal(t, stats[method].TotalRTT, stats[method].LastRTT, method)
+		}
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		// Nothing answers on serverConn
+		serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: serverConn.LocalAddr().String(),
+			Conn:           conn,
+			RTO:            time.Millisecond,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		_, err = client.Allocate()
+		assert.Error(t, err)
+
+		allocate := client.Stats()[stun.MethodAllocate]
+		assert.Equal(t, uint64(1), allocate.Timeouts)
+		assert.Equal(t, uint64(maxRtxCount-1), allocate.Retransmissions)
+		assert.Equal(t, uint64(0), allocate.RTTSamples)
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, serverConn.Close())
+	})
+}
+
+// channelDataConn remembers whether the last packet it read was ChannelData
+type channelDataConn struct {
+	net.PacketConn
+	channelData uint32
+}
+
+func (c *channelDataConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		var channelData uint32
+		if proto.IsChannelData(p[:n]) {
+			channelData = 1
+		}
+		atomic.StoreUint32(&c.channelData, channelData)
+	}
+	return n, addr, err
+}
+
+func TestClientReadFromPeerAddr(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	udpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	conn := &channelDataConn{PacketConn: udpConn}
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	var peers []net.PacketConn
+	for i := 0; i < 2; i++ {
+		peerConn, listenErr := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, listenErr)
+		peers = append(peers, peerConn)
+	}
+
+	// Without a channel the payloads of the peers are relayed in Data indications
+	buf := make([]byte, inboundMTU)
+	assert.NoError(t, client.CreatePermission(peers[0].LocalAddr(), peers[1].LocalAddr()))
+	for i, peerConn := range peers {
+		payload := fmt.Sprintf("peer %d", i)
+		_, err = peerConn.WriteTo([]byte(payload), relayConn.LocalAddr())
+		assert.NoError(t, err)
+
+		n, from, readErr := relayConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, payload, string(buf[:n]))
+		assert.Equal(t, peerConn.LocalAddr().String(), from.String())
+		assert.Equal(t, uint32(0), atomic.LoadUint32(&conn.channelData))
+	}
+
+	// Writing to a peer binds a channel, the peers echo what they receive until it comes
+	// back in ChannelData, mapped back to the address of the peer
+	for i, peerConn := range peers {
+		viaChannelData := false
+		for attempt := 0; attempt < 100 && !viaChannelData; attempt++ {
+			payload := fmt.Sprintf("peer %d attempt %d", i, attempt)
+			_, err = relayConn.WriteTo([]byte(payload), peerConn.LocalAddr())
+			assert.NoError(t, err)
+
+			n, from, readErr := peerConn.ReadFrom(buf)
+			assert.NoError(t, readErr)
+			_, err = peerConn.WriteTo(buf[:n], from)
+			assert.NoError(t, err)
+
+			n, from, readErr = relayConn.ReadFrom(buf)
+			assert.NoError(t, readErr)
+			assert.Equal(t, payload, string(buf[:n]))
+			assert.Equal(t, peerConn.LocalAddr().String(), from.String())
+
+			viaChannelData = atomic.LoadUint32(&conn.channelData) == 1
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.True(t, viaChannelData, "peer %d never sent ChannelData", i)
+	}
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	for _, peerConn := range peers {
+		assert.NoError(t, peerConn.Close())
+	}
+	assert.NoError(t, udpConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestClientAllocationExpiry(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+	assert.True(t, client.AllocationExpiry().IsZero())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(proto.DefaultLifetime), client.AllocationExpiry(), 5*time.Second)
+
+	assert.NoError(t, relayConn.Close())
+	assert.True(t, client.AllocationExpiry().IsZero())
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestClientGather(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	srflx, relayConn, err := client.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, conn.LocalAddr().String(), srflx.String())
+	assert.NotEqual(t, srflx.String(), relayConn.LocalAddr().String())
+
+	// The server reflexive address is taken from the Allocate response
+	_, sentBinding := client.Stats()[stun.MethodBinding]
+	assert.False(t, sentBinding)
+
+	// A second allocation is refused
+	_, _, err = client.Gather()
+	assert.Error(t, err)
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestParseTURNServerURI(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		uri  turnServerURI
+	}{
+		{"127.0.0.1:3478", turnServerURI{addr: "127.0.0.1:3478"}},
+		{"turn:turn.abc.com", turnServerURI{host: "turn.abc.com", addr: "turn.abc.com:3478"}},
+		{"turn:turn.abc.com:1234?transport=tcp", turnServerURI{tcp: true, host: "turn.abc.com", addr: "turn.abc.com:1234"}},
+		{"turns:turn.abc.com", turnServerURI{secure: true, tcp: true, host: "turn.abc.com", addr: "turn.abc.com:5349"}},
+		{"turns:[::1]?transport=udp", turnServerURI{secure: true, host: "::1", addr: "[::1]:5349"}},
+	} {
+		uri, err := parseTURNServerURI(tc.addr)
+		assert.NoError(t, err, tc.addr)
+		assert.Equal(t, tc.uri, uri, tc.addr)
+	}
+
+	for _, addr := range []string{"turns:", "turn:turn.abc.com?transport=sctp"} {
+		_, err := parseTURNServerURI(addr)
+		assert.True(t, errors.Is(err, errInvalidTURNServerURI), addr)
+	}
+}
+
+func TestClientTURNServerURI(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	certificate, err := selfsign.GenerateSelfSigned()
+	assert.NoError(t, err)
+
+	_, err = NewClient(&ClientConfig{
+		TURNServerAddr: "turns:127.0.0.1",
+		LocalPort:      3478,
+	})
+	assert.Equal(t, errTURNServerURIWithConn, err)
+
+	for _, tc := range []struct {
+		name     string
+		listen   func() (net.Listener, error)
+		scheme   string
+		datagram bool
+	}{
+		{"TLS", func() (net.Listener, error) {
+			return tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+		}, "turns:%s?transport=tcp", false},
+		{"DTLS", func() (net.Listener, error) {
+			return dtls.Listen("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &dtls.Config{Certificates: []tls.Certificate{certificate}})
+		}, "turns:%s?transport=udp", true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := tc.listen()
+			assert.NoError(t, err)
+
+			server, err := NewServer(ServerConfig{
+				AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+					return GenerateAuthKey(username, realm, "pass"), true
+				},
+				ListenerConfigs: []ListenerConfig{
+					{
+						Listener: listener,
+						RelayAddressGenerator: &RelayAddressGeneratorStatic{
+							RelayAddress: net.ParseIP("127.0.0.1"),
+							Address:      "127.0.0.1",
+						},
+						Datagram: tc.datagram,
+					},
+				},
+				Realm:         "pion.ly",
+				LoggerFactory: logging.NewDefaultLoggerFactory(),
+			})
+			assert.NoError(t, err)
+
+			// The client dials the server and frames the messages itself
+			client, err := NewClient(&ClientConfig{
+				TURNServerAddr: fmt.Sprintf(tc.scheme, listener.Addr()),
+				TLSConfig:      &tls.Config{InsecureSkipVerify: true}, // nolint
+				Username:       "user",
+				Password:       "pass",
+				LoggerFactory:  logging.NewDefaultLoggerFactory(),
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, client.Listen())
+
+			relayConn, err := client.Allocate()
+			assert.NoError(t, err)
+
+			peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			assert.NoError(t, err)
+
+			_, err = relayConn.WriteTo([]byte("Hello"), peerConn.LocalAddr())
+			assert.NoError(t, err)
+
+			buf := make([]byte, 1500)
+			n, from, err := peerConn.ReadFrom(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, "Hello", string(buf[:n]))
+
+			_, err = peerConn.WriteTo([]byte("World"), from)
+			assert.NoError(t, err)
+
+			n, _, err = relayConn.ReadFrom(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, "World", string(buf[:n]))
+
+			assert.NoError(t, relayConn.Close())
+			client.Close()
+			assert.NoError(t, peerConn.Close())
+			assert.NoError(t, server.Close())
+		})
+	}
+}
+
+func TestClientCancelAll(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	// The server never answers
+	blackHole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: blackHole.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+	assert.Equal(t, 0, client.CancelAll())
+
+	allocateErr := make(chan error)
+	go func() {
+		_, allocErr := client.Allocate()
+		allocateErr <- allocErr
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(client.PendingTransactions()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	buf := make([]byte, 1500)
+	n, _, err := blackHole.ReadFrom(buf)
+	assert.NoError(t, err)
+	msg := &stun.Message{Raw: buf[:n]}
+	assert.NoError(t, msg.Decode())
+
+	pending := client.PendingTransactions()[0]
+	assert.Equal(t, stun.MethodAllocate, pending.Method)
+	assert.Equal(t, msg.TransactionID, pending.TransactionID)
+	assert.Equal(t, blackHole.LocalAddr().String(), pending.To.String())
+	assert.True(t, pending.Age > 0)
+
+	// The request returns right away instead of after all retransmissions
+	assert.Equal(t, 1, client.CancelAll())
+	assert.True(t, errors.Is(<-allocateErr, ErrTransactionCanceled))
+	assert.Empty(t, client.PendingTransactions())
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, blackHole.Close())
+}
+
+func TestClientPeerKeepalive(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.Error(t, client.SetPeerKeepalive(peerConn.LocalAddr(), time.Second, nil))
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	// Keepalives are sent periodically without any application data
+	assert.NoError(t, client.SetPeerKeepalive(peerConn.LocalAddr(), 50*time.Millisecond, []byte("ka")))
+	buf := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, peerConn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, from, readErr := peerConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, "ka", string(buf[:n]))
+		assert.Equal(t, relayConn.LocalAddr().String(), from.String())
+	}
+
+	// A keepalive may be empty
+	assert.NoError(t, client.SetPeerKeepalive(peerConn.LocalAddr(), 50*time.Millisecond, nil))
+	assert.Eventually(t, func() bool {
+		assert.NoError(t, peerConn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, readErr := peerConn.ReadFrom(buf)
+		return readErr == nil && n == 0
+	}, 5*time.Second, time.Millisecond)
+
+	// Once disabled nothing more is sent
+	assert.NoError(t, client.SetPeerKeepalive(peerConn.LocalAddr(), 0, nil))
+	for {
+		// Drain a keepalive that was already in flight
+		assert.NoError(t, peerConn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		if _, _, err = peerConn.ReadFrom(buf); err != nil {
+			break
+		}
+	}
+
+	assert.NoError(t, client.SetPeerKeepalive(peerConn.LocalAddr(), 50*time.Millisecond, nil))
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestAttributes(t *testing.T) {
+	peer := net.IPv4(127, 0, 0, 1)
+	m, err := stun.Build(stun.TransactionID, SendIndicationType,
+		XORPeerAddress{IP: peer, Port: 5000},
+		Data("Hello"),
+		Lifetime{Duration: DefaultLifetime},
+		DontFragment{},
+	)
+	assert.NoError(t, err)
+
+	decoded := &stun.Message{Raw: m.Raw}
+	assert.NoError(t, decoded.Decode())
+	assert.Equal(t, SendIndicationType, decoded.Type)
+
+	var peerAddr PeerAddress
+	assert.NoError(t, peerAddr.GetFrom(decoded))
+	assert.True(t, peer.Equal(peerAddr.IP))
+	assert.Equal(t, 5000, peerAddr.Port)
+
+	var data Data
+	assert.NoError(t, data.GetFrom(decoded))
+	assert.Equal(t, "Hello", string(data))
+
+	var lifetime Lifetime
+	assert.NoError(t, lifetime.GetFrom(decoded))
+	assert.Equal(t, DefaultLifetime, lifetime.Duration)
+
+	assert.True(t, DontFragment{}.IsSet(decoded))
+
+	channelData := &ChannelData{Number: MinChannelNumber, Data: []byte("Hello")}
+	channelData.Encode()
+	assert.True(t, IsChannelData(channelData.Raw))
+	assert.False(t, IsChannelData(m.Raw))
+}
+
+// passwordAlgorithmServer challenges Allocate requests with nonce and the offered PASSWORD-ALGORITHMS,
+// and answers the requests authenticated with the key derived by the expected PasswordAlgorithm.
+// It stands in for an RFC 8489 server, the Server of this package doesn't negotiate the algorithm
+func passwordAlgorithmServer(t *testing.T, conn net.PacketConn, nonce string, offered proto.PasswordAlgorithms, expected PasswordAlgorithm) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		m := &stun.Message{Raw: buf[:n]}
+		assert.NoError(t, m.Decode())
+
+		if !m.Contains(stun.AttrMessageIntegrity) && !m.Contains(proto.AttrMessageIntegritySHA256) {
+			setters := []stun.Setter{m, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+				&stun.ErrorCodeAttribute{Code: stun.CodeUnauthorized}, stun.NewNonce(nonce), stun.NewRealm("pion.ly")}
+			if len(offered) > 0 {
+				setters = append(setters, offered)
+			}
+			res, err := stun.Build(setters...)
+			assert.NoError(t, err)
+			if _, err = conn.WriteTo(res.Raw, from); err != nil {
+				return
+			}
+			continue
+		}
+
+		var algorithm proto.PasswordAlgorithm
+		if expected == PasswordAlgorithmSHA256 {
+			assert.NoError(t, algorithm.GetFrom(m))
+			assert.Equal(t, proto.PasswordAlgorithmSHA256, algorithm)
+			assert.NoError(t, proto.NewLongTermIntegritySHA256("user", "pion.ly", "pass").Check(m))
+			assert.False(t, m.Contains(stun.AttrMessageIntegrity))
+		} else {
+			assert.Equal(t, len(offered) > 0, algorithm.GetFrom(m) == nil)
+			assert.NoError(t, stun.NewLongTermIntegrity("user", "pion.ly", "pass").Check(m))
+		}
+
+		setters := []stun.Setter{m, stun.NewType(m.Type.Method, stun.ClassSuccessResponse)}
+		if m.Type.Method == stun.MethodAllocate {
+			setters = append(setters, proto.RelayedAddress{IP: net.IPv4(127, 0, 0, 1), Port: 5000},
+				proto.Lifetime{Duration: time.Minute})
+		}
+
+		res, err := stun.Build(setters...)
+		assert.NoError(t, err)
+		if _, err = conn.WriteTo(res.Raw, from); err != nil {
+			return
+		}
+	}
+}
+
+func TestClientPasswordAlgorithm(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	for _, tc := range []struct {
+		name     string
+		nonce    string
+		offered  proto.PasswordAlgorithms
+		expected PasswordAlgorithm
+	}{
+		{"SHA256", "obMatJos2AAABnonce", proto.PasswordAlgorithms{proto.PasswordAlgorithmMD5, proto.PasswordAlgorithmSHA256}, PasswordAlgorithmSHA256},
+		{"MD5", "obMatJos2AAABnonce", proto.PasswordAlgorithms{proto.PasswordAlgorithmMD5}, PasswordAlgorithmMD5},
+		{"NoNonceCookie", "nonce", nil, PasswordAlgorithmMD5},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			assert.NoError(t, err)
+			go passwordAlgorithmServer(t, serverConn, tc.nonce, tc.offered, tc.expected)
+
+			conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			assert.NoError(t, err)
+
+			client, err := NewClient(&ClientConfig{
+				TURNServerAddr: serverConn.LocalAddr().String(),
+				Username:       "user",
+				Password:       "pass",
+				Conn:           conn,
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, client.Listen())
+
+			relayConn, err := client.Allocate()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, client.PasswordAlgorithm())
+
+			// The Refresh deleting the allocation is authenticated the same way
+			assert.NoError(t, relayConn.Close())
+
+			client.Close()
+			assert.NoError(t, conn.Close())
+			assert.NoError(t, serverConn.Close())
+		})
+	}
+
+	// The Server of this package is authenticated with MD5
+	t.Run("Server", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler:       turntest.MockAuthHandler(map[string]string{"user": "pass"}),
+			PacketConnConfigs: []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: &turntest.LoopbackRelayGenerator{}}},
+			Realm:             "pion.ly",
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       "user",
+			Password:       "pass",
+			Conn:           conn,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		assert.Equal(t, PasswordAlgorithmMD5, client.PasswordAlgorithm())
+		assert.NoError(t, relayConn.Close())
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	})
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	binding := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	res, err := client.RoundTrip(binding)
+	assert.NoError(t, err)
+	assert.Equal(t, stun.BindingSuccess, res.Type)
+	assert.Equal(t, binding.TransactionID, res.TransactionID)
+
+	var reflAddr stun.XORMappedAddress
+	assert.NoError(t, reflAddr.GetFrom(res))
+	assert.Equal(t, conn.LocalAddr().String(), reflAddr.String())
+
+	// Error responses are returned as is
+	res, err = client.RoundTrip(stun.MustBuild(stun.TransactionID, AllocateRequestType,
+		RequestedTransport{Protocol: ProtoUDP}, stun.Fingerprint))
+	assert.NoError(t, err)
+	var code stun.ErrorCodeAttribute
+	assert.NoError(t, code.GetFrom(res))
+	assert.Equal(t, stun.CodeUnauthorized, code.Code)
+
+	_, err = client.RoundTrip(&stun.Message{})
+	assert.Equal(t, errEmptyMessage, err)
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+// scopeRecordingLoggerFactory records the scopes loggers are created for
+type scopeRecordingLoggerFactory struct {
+	*logging.DefaultLoggerFactory
+	scopes []string
+}
+
+func (f *scopeRecordingLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	f.scopes = append(f.scopes, scope)
+	return f.DefaultLoggerFactory.NewLogger(scope)
+}
+
+func TestClientLoggerFactory(t *testing.T) {
+	logs := &logBuffer{}
+	loggerFactory := &scopeRecordingLoggerFactory{DefaultLoggerFactory: logging.NewDefaultLoggerFactory()}
+	loggerFactory.Writer = logs
+	loggerFactory.DefaultLogLevel = logging.LogLevelDebug
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: "127.0.0.1:3478",
+		Conn:           conn,
+		LoggerFactory:  loggerFactory,
+		CorrelationID:  "call-42",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"turnc"}, loggerFactory.scopes)
+	assert.Contains(t, logs.String(), "[call-42] resolving 127.0.0.1:3478")
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+}
+
+func TestClientOnUnknownPeerData(t *testing.T) {
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	trusted := net.IPv4(10, 0, 0, 3)
+	var unknownPeers []string
+	c, err := NewClient(&ClientConfig{
+		TURNServerAddr: serverConn.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+		OnUnknownPeerData: func(peer net.Addr) bool {
+			unknownPeers = append(unknownPeers, peer.String())
+			return peer.(*net.UDPAddr).IP.Equal(trusted)
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Listen())
+
+	integrity := stun.NewLongTermIntegrity("user", "pion.ly", "pass")
+
+	// The fake server answers the Allocate handshake, then relays data from two
+	// peers the client never created a permission for
+	allocated := make(chan struct{})
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+
+		read := func() (*stun.Message, net.Addr) {
+			buf := make([]byte, 1500)
+			n, from, readErr := serverConn.ReadFrom(buf)
+			assert.NoError(t, readErr)
+
+			m := &stun.Message{Raw: buf[:n]}
+			assert.NoError(t, m.Decode())
+			return m, from
+		}
+		send := func(to net.Addr, setters ...stun.Setter) {
+			m, buildErr := stun.Build(setters...)
+			assert.NoError(t, buildErr)
+			_, writeErr := serverConn.WriteTo(m.Raw, to)
+			assert.NoError(t, writeErr)
+		}
+
+		m, from := read()
+		send(from, m, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse),
+			&stun.ErrorCodeAttribute{Code: stun.CodeUnauthorized}, stun.NewNonce("nonce"), stun.NewRealm("pion.ly"))
+
+		m, from = read()
+		send(from, m, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+			&proto.RelayedAddress{IP: net.IPv4(10, 0, 0, 1), Port: 5000},
+			&proto.Lifetime{Duration: time.Hour},
+			&stun.XORMappedAddress{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+			integrity)
+		<-allocated
+
+		dataIndication := stun.NewType(stun.MethodData, stun.ClassIndication)
+		send(from, stun.TransactionID, dataIndication, &proto.PeerAddress{IP: net.IPv4(10, 0, 0, 2), Port: 6000}, proto.Data("Dropped"))
+		send(from, stun.TransactionID, dataIndication, &proto.PeerAddress{IP: trusted, Port: 6000}, proto.Data("Delivered"))
+	}()
+
+	relayConn, err := c.Allocate()
+	assert.NoError(t, err)
+	close(allocated)
+	<-serverDone
+
+	assert.NoError(t, relayConn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1500)
+	n, from, err := relayConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Delivered", string(buf[:n]))
+	assert.Equal(t, "10.0.0.3:6000", from.String())
+	assert.Equal(t, []string{"10.0.0.2:6000", "10.0.0.3:6000"}, unknownPeers)
+
+	assert.NoError(t, relayConn.Close())
+	c.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, serverConn.Close())
+}
+
+func TestClientCredentialProvider(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	// Every realm has its own user
+	credentials := map[string][2]string{
+		"a.pion.ly": {"alice", "secret-a"},
+		"b.pion.ly": {"bob", "secret-b"},
+	}
+
+	for realm, userPass := range credentials {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				if credentials[realm][0] != username {
+					return nil, false
+				}
+				return GenerateAuthKey(username, realm, credentials[realm][1]), true
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "127.0.0.1",
+					},
+				},
+			},
+			Realm: realm,
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		var providedFor []string
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Conn:           conn,
+			CredentialProvider: func(realm string) (string, string) {
+				providedFor = append(providedFor, realm)
+				return credentials[realm][0], credentials[realm][1]
+			},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{realm}, providedFor)
+		assert.Equal(t, userPass[0], client.Username().String())
+
+		assert.NoError(t, relayConn.Close())
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	}
+}
+
+func TestClientConcurrentUse(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: turntest.MockAuthHandler(map[string]string{"user": "pass"}),
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: &turntest.LoopbackRelayGenerator{},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		STUNServerAddr: udpListener.LocalAddr().String(),
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	// Only one of concurrent Allocate calls allocates, the others fail
+	relayConns := make(chan net.PacketConn, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(relayConns); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if relayConn, err := client.Allocate(); err == nil {
+				relayConns <- relayConn
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, relayConns, 1)
+	relayConn := <-relayConns
+
+	peers := make([]net.PacketConn, 2)
+	for i := range peers {
+		peers[i], err = net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+	}
+
+	// Media, ICE checks and the application use the client and the relayed conn at once
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				peer := peers[(g+i)%len(peers)].LocalAddr()
+				switch (g + i) % 4 {
+				case 0:
+					_, err := relayConn.WriteTo([]byte("Hello"), peer)
+					assert.NoError(t, err)
+				case 1:
+					assert.NoError(t, client.CreatePermission(peer))
+				case 2:
+					_, err := client.SendBindingRequest()
+					assert.NoError(t, err)
+				case 3:
+					_ = client.Realm()
+					_ = client.Username()
+					_ = client.AllocationExpiry()
+					_ = client.Stats()
+				}
+			}
+		}(g)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 1500)
+		assert.NoError(t, relayConn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		for {
+			if _, _, err := relayConn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Each peer answers the relay, so reads run alongside the writes
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer net.PacketConn) {
+			defer wg.Done()
+			buf := make([]byte, 1500)
+			assert.NoError(t, peer.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+			for {
+				n, from, err := peer.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, _ = peer.WriteTo(buf[:n], from)
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	for _, peer := range peers {
+		assert.NoError(t, peer.Close())
+	}
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestClientRelaySelfTest(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	selfTest := func(t *testing.T, generator RelayAddressGenerator, run func(client *Client)) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: turntest.MockAuthHandler(map[string]string{"user": "pass"}),
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn:            udpListener,
+					RelayAddressGenerator: generator,
+				},
+			},
+			Realm: "pion.ly",
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       "user",
+			Password:       "pass",
+			Conn:           conn,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		run(client)
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	}
+
+	t.Run("Relaying", func(t *testing.T) {
+		selfTest(t, &turntest.LoopbackRelayGenerator{}, func(client *Client) {
+			// The allocation made for the test is deleted, the application can allocate after it
+			assert.NoError(t, client.RelaySelfTest(5*time.Second))
+			assert.True(t, client.AllocationExpiry().IsZero())
+
+			relayConn, err := client.Allocate()
+			assert.NoError(t, err)
+
+			// The existing allocation is tested and kept
+			assert.NoError(t, client.RelaySelfTest(5*time.Second))
+			assert.False(t, client.AllocationExpiry().IsZero())
+			assert.NoError(t, relayConn.Close())
+		})
+	})
+
+	t.Run("NotRelaying", func(t *testing.T) {
+		// The relays are bound on an in-memory network, the probe never reaches the client
+		selfTest(t, &inMemoryRelayAddressGenerator{network: turntest.NewNetwork()}, func(client *Client) {
+			err := client.RelaySelfTest(100 * time.Millisecond)
+			assert.True(t, errors.Is(err, errRelaySelfTestFailed), "unexpected error: %v", err)
+			assert.Contains(t, err.Error(), "didn't arrive")
+		})
+	})
+}
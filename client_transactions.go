@@ -0,0 +1,64 @@
+package turn
+
+import (
+	b64 "encoding/base64"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/client"
+)
+
+// PendingTransaction is a request of the Client still waiting for its response
+type PendingTransaction struct {
+	Method        stun.Method
+	TransactionID [stun.TransactionIDSize]byte
+	To            net.Addr
+
+	// Age is how long ago the request was first sent, Retransmissions
+	// how many times it was sent again since
+	Age             time.Duration
+	Retransmissions int
+}
+
+// PendingTransactions returns the requests of the Client waiting for a response, e.g. to
+// find out which server stopped answering while gathering candidates hangs
+func (c *Client) PendingTransactions() []PendingTransaction {
+	c.mutexTrMap.Lock()
+	defer c.mutexTrMap.Unlock()
+
+	now := time.Now()
+	trs := c.trMap.All()
+	pending := make([]PendingTransaction, 0, len(trs))
+	for _, tr := range trs {
+		p := PendingTransaction{
+			Method:          tr.Method,
+			To:              tr.To,
+			Age:             now.Sub(tr.Start),
+			Retransmissions: tr.Retries(),
+		}
+		if id, err := b64.StdEncoding.DecodeString(tr.Key); err == nil {
+			copy(p.TransactionID[:], id)
+		}
+		pending = append(pending, p)
+	}
+	return pending
+}
+
+// CancelAll cancels every pending transaction and returns how many there were. The
+// requests waiting on them return ErrTransactionCanceled right away, a response that
+// arrives afterwards is ignored. Unlike Close the Client stays usable
+func (c *Client) CancelAll() int {
+	c.mutexTrMap.Lock()
+	defer c.mutexTrMap.Unlock()
+
+	trs := c.trMap.All()
+	for _, tr := range trs {
+		c.trMap.Delete(tr.Key)
+		tr.StopRtxTimer()
+		if !tr.WriteResult(client.TransactionResult{Err: ErrTransactionCanceled}) {
+			c.log.Debug("no listener for transaction")
+		}
+	}
+	return len(trs)
+}
@@ -0,0 +1,134 @@
+package turn
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+)
+
+const (
+	defaultTURNPort  = 3478
+	defaultTURNSPort = 5349
+)
+
+// turnServerURI is a ClientConfig.TURNServerAddr given as a turn: or turns: URI,
+// see RFC 7065. A plain address is relayed over UDP like a turn: URI without transport
+type turnServerURI struct {
+	secure bool
+	tcp    bool
+	host   string
+	addr   string
+}
+
+// parseTURNServerURI parses a turn: or turns: URI, the transport defaults to UDP for
+// turn: and to TCP, i.e. TLS, for turns:. Addresses without a scheme are returned as is
+func parseTURNServerURI(s string) (turnServerURI, error) {
+	var uri turnServerURI
+	port := defaultTURNPort
+	switch {
+	case strings.HasPrefix(s, "turns:"):
+		uri.secure, uri.tcp = true, true
+		port = defaultTURNSPort
+		s = strings.TrimPrefix(s, "turns:")
+	case strings.HasPrefix(s, "turn:"):
+		s = strings.TrimPrefix(s, "turn:")
+	default:
+		uri.addr = s
+		return uri, nil
+	}
+
+	if i := strings.Index(s, "?"); i != -1 {
+		switch s[i+1:] {
+		case "transport=tcp":
+			uri.tcp = true
+		case "transport=udp":
+			uri.tcp = false
+		default:
+			return turnServerURI{}, fmt.Errorf("%w: unknown %s", errInvalidTURNServerURI, s[i+1:])
+		}
+		s = s[:i]
+	}
+
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		// The port is optional, the host may then be a bare IPv6 address in brackets
+		host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		portStr = strconv.Itoa(port)
+	}
+	if host == "" {
+		return turnServerURI{}, fmt.Errorf("%w: no host in %s", errInvalidTURNServerURI, s)
+	}
+
+	uri.host = host
+	uri.addr = net.JoinHostPort(host, portStr)
+	return uri, nil
+}
+
+// dialed returns true when the client has to establish the transport to the server itself
+func (u turnServerURI) dialed() bool {
+	return u.secure || u.tcp
+}
+
+// dialTURNServer establishes the transport to the server of uri and returns it framed as a
+// net.PacketConn, with the address the server's messages are read from
+func dialTURNServer(uri turnServerURI, tlsConfig *tls.Config) (net.PacketConn, net.Addr, error) {
+	if !uri.tcp {
+		raddr, err := net.ResolveUDPAddr("udp", uri.addr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		conn, err := dtls.Dial("udp", raddr, dtlsClientConfig(uri.host, tlsConfig))
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewDatagramConn(conn), conn.RemoteAddr(), nil
+	}
+
+	conn, err := net.Dial("tcp", uri.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if uri.secure {
+		tlsConn := tls.Client(conn, tlsClientConfig(uri.host, tlsConfig))
+		if err = tlsConn.Handshake(); err != nil {
+			if closeErr := conn.Close(); closeErr != nil {
+				return nil, nil, fmt.Errorf("%v, failed to close conn: %v", err, closeErr)
+			}
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+	return NewSTUNConn(conn), conn.RemoteAddr(), nil
+}
+
+// tlsClientConfig returns tlsConfig with its ServerName defaulting to host
+func tlsClientConfig(host string, tlsConfig *tls.Config) *tls.Config {
+	if tlsConfig == nil {
+		return &tls.Config{ServerName: host}
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	return tlsConfig
+}
+
+// dtlsClientConfig returns the dtls.Config with the certificates and verification
+// settings of tlsConfig
+func dtlsClientConfig(host string, tlsConfig *tls.Config) *dtls.Config {
+	tlsConfig = tlsClientConfig(host, tlsConfig)
+	return &dtls.Config{
+		Certificates:          tlsConfig.Certificates,
+		RootCAs:               tlsConfig.RootCAs,
+		ServerName:            tlsConfig.ServerName,
+		InsecureSkipVerify:    tlsConfig.InsecureSkipVerify,
+		VerifyPeerCertificate: tlsConfig.VerifyPeerCertificate,
+	}
+}
@@ -0,0 +1,352 @@
+// +build linux
+
+package turn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/server"
+)
+
+var errWouldBlock = errors.New("turn: read would block")
+
+const (
+	pollEvents    = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+	pollBatchSize = 128
+)
+
+type connHandler func(p net.PacketConn, addr net.Addr, buf []byte, allocationManager *allocation.Manager, transactionCache *server.TransactionCache)
+
+// connPoller serves accepted connections with a fixed number of workers instead of
+// a goroutine per connection. Connections are registered with epoll, once one is
+// readable it is handed to a worker that reads from it without blocking.
+//
+// Connections are registered as EPOLLONESHOT, a connection is served by a single
+// worker at a time and is re-armed once the worker drained it.
+type connPoller struct {
+	epfd  int
+	wakeR int
+	wakeW int
+
+	lock  sync.Mutex
+	conns map[int]*polledConn
+
+	ready     chan *polledConn
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	log    logging.LeveledLogger
+	handle connHandler
+	stats  *connStats
+
+	// bufferSize is the read buffer of each worker, drop is called for frames that don't fit
+	bufferSize int
+	drop       func(net.Addr)
+
+	// partialTimeout is how long a connection may stall in the middle of a frame, see reap
+	partialTimeout time.Duration
+}
+
+type polledConn struct {
+	// EPOLLONESHOT already hands pc to one worker at a time, the lock makes the
+	// hand over between workers visible to the Go memory model
+	lock sync.Mutex
+
+	conn              net.Conn
+	fd                int
+	stunConn          *STUNConn
+	allocationManager *allocation.Manager
+	release           func()
+	removed           bool
+}
+
+// nonblockingConn reads from a connection without waiting for data, errWouldBlock
+// is returned when nothing is available
+type nonblockingConn struct {
+	net.Conn
+	raw syscall.RawConn
+}
+
+func (c *nonblockingConn) Read(p []byte) (n int, err error) {
+	if rawErr := c.raw.Read(func(fd uintptr) bool {
+		n, err = syscall.Read(int(fd), p)
+		return true
+	}); rawErr != nil {
+		return 0, rawErr
+	}
+
+	switch {
+	case err == syscall.EAGAIN:
+		return 0, errWouldBlock
+	case err != nil:
+		return 0, err
+	case n == 0:
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func newConnPoller(workers, bufferSize int, partialTimeout time.Duration, log logging.LeveledLogger, handle connHandler, drop func(net.Addr), stats *connStats) (*connPoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	// Writing to the pipe wakes up the poll loop on close
+	var wake [2]int
+	if err = syscall.Pipe2(wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		_ = syscall.Close(epfd)
+		return nil, err
+	}
+	if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, wake[0], &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(wake[0])}); err != nil {
+		_ = syscall.Close(epfd)
+		_ = syscall.Close(wake[0])
+		_ = syscall.Close(wake[1])
+		return nil, err
+	}
+
+	p := &connPoller{
+		epfd:   epfd,
+		wakeR:  wake[0],
+		wakeW:  wake[1],
+		conns:  map[int]*polledConn{},
+		ready:  make(chan *polledConn, workers),
+		done:   make(chan struct{}),
+		log:    log,
+		handle: handle,
+		stats:  stats,
+
+		bufferSize:     bufferSize,
+		drop:           drop,
+		partialTimeout: partialTimeout,
+	}
+
+	p.wg.Add(workers + 1)
+	go p.poll()
+	if partialTimeout > 0 {
+		p.wg.Add(1)
+		go p.reap()
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p, nil
+}
+
+// add registers conn, false is returned if conn can't be polled and must be
+// served from its own goroutine. release is called once conn has been closed
+func (p *connPoller) add(conn net.Conn, allocationManager *allocation.Manager, release func()) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	fd := -1
+	if err = raw.Control(func(f uintptr) {
+		fd = int(f)
+	}); err != nil {
+		return false
+	}
+
+	pc := &polledConn{
+		conn:              conn,
+		fd:                fd,
+		stunConn:          NewSTUNConn(&countingConn{Conn: &nonblockingConn{Conn: conn, raw: raw}, stats: p.stats}),
+		allocationManager: allocationManager,
+		release:           release,
+	}
+	pc.stunConn.partialTimeout = p.partialTimeout
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+
+	if err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: pollEvents, Fd: int32(fd)}); err != nil {
+		p.log.Warnf("failed to poll connection from %s: %v", conn.RemoteAddr(), err)
+		return false
+	}
+	p.conns[fd] = pc
+
+	return true
+}
+
+// poll hands readable connections to the workers
+func (p *connPoller) poll() {
+	defer p.wg.Done()
+
+	events := make([]syscall.EpollEvent, pollBatchSize)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			p.log.Errorf("exit poll loop on error: %v", err)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == p.wakeR {
+				return
+			}
+
+			p.lock.Lock()
+			pc := p.conns[fd]
+			p.lock.Unlock()
+			if pc == nil {
+				continue
+			}
+
+			select {
+			case p.ready <- pc:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+func (p *connPoller) work() {
+	defer p.wg.Done()
+
+	buf := make([]byte, p.bufferSize)
+	for {
+		select {
+		case pc := <-p.ready:
+			p.serve(pc, buf)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// reap closes the connections that stalled in the middle of a frame. Reads never block
+// the workers, a stalled connection just isn't readable again, so it is checked periodically
+func (p *connPoller) reap() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.partialTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			p.lock.Lock()
+			conns := make([]*polledConn, 0, len(p.conns))
+			for _, pc := range p.conns {
+				conns = append(conns, pc)
+			}
+			p.lock.Unlock()
+
+			for _, pc := range conns {
+				pc.lock.Lock()
+				if !pc.removed && pc.stunConn.stalled(now) {
+					p.log.Debugf("closing connection from %s, it stalled in the middle of a frame", pc.conn.RemoteAddr())
+					p.remove(pc)
+				}
+				pc.lock.Unlock()
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// serve handles every frame available on pc, then re-arms it
+func (p *connPoller) serve(pc *polledConn, buf []byte) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	// pc may have been reaped while waiting for a worker
+	if pc.removed {
+		return
+	}
+
+	for {
+		n, addr, err := pc.stunConn.ReadFrom(buf)
+		if err == errWouldBlock {
+			break
+		} else if err == errTURNFrameTooLarge {
+			p.drop(addr)
+			continue
+		} else if err != nil {
+			p.log.Debugf("closing connection from %s on error: %v", pc.conn.RemoteAddr(), err)
+			p.remove(pc)
+			return
+		}
+
+		p.handle(pc.stunConn, addr, buf[:n], pc.allocationManager, nil)
+	}
+
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, pc.fd, &syscall.EpollEvent{Events: pollEvents, Fd: int32(pc.fd)}); err != nil {
+		p.log.Errorf("failed to re-arm connection from %s: %v", pc.conn.RemoteAddr(), err)
+		p.remove(pc)
+	}
+}
+
+// remove stops polling pc, closes it and releases it. The caller
+// holds pc.lock, or the workers were stopped
+func (p *connPoller) remove(pc *polledConn) {
+	pc.removed = true
+
+	p.lock.Lock()
+	delete(p.conns, pc.fd)
+	p.lock.Unlock()
+
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil); err != nil {
+		p.log.Debugf("failed to stop polling connection from %s: %v", pc.conn.RemoteAddr(), err)
+	}
+	if err := pc.conn.Close(); err != nil {
+		p.log.Debugf("Failed to close conn: %s", err.Error())
+	}
+	pc.release()
+}
+
+// close stops the workers and closes every polled connection
+func (p *connPoller) close() {
+	p.closeOnce.Do(func() {
+		p.lock.Lock()
+		close(p.done)
+		p.lock.Unlock()
+
+		if _, err := syscall.Write(p.wakeW, []byte{0}); err != nil {
+			p.log.Errorf("failed to wake up poll loop: %v", err)
+		}
+		p.wg.Wait()
+
+		p.lock.Lock()
+		conns := make([]*polledConn, 0, len(p.conns))
+		for _, pc := range p.conns {
+			conns = append(conns, pc)
+		}
+		p.lock.Unlock()
+
+		for _, pc := range conns {
+			p.remove(pc)
+		}
+
+		for _, fd := range []int{p.epfd, p.wakeR, p.wakeW} {
+			if err := syscall.Close(fd); err != nil {
+				p.log.Debugf("failed to close poller fd: %v", err)
+			}
+		}
+	})
+}
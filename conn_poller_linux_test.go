@@ -0,0 +1,282 @@
+// +build linux
+
+package turn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/test"
+	"github.com/pion/turn/v2/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newConnWorkersServer(tb testing.TB, connWorkers int) (*Server, net.Listener) {
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(tb, err)
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.DefaultLogLevel = logging.LogLevelWarn
+
+	server, err := NewServer(ServerConfig{
+		ListenerConfigs: []ListenerConfig{
+			{
+				Listener: tcpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+		ConnWorkers:   connWorkers,
+	})
+	assert.NoError(tb, err)
+
+	return server, tcpListener
+}
+
+// tcpBinding sends a Binding request on conn, the request is written in chunks of chunkSize
+func tcpBinding(tb testing.TB, conn net.Conn, chunkSize int) bool {
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	assert.NoError(tb, err)
+
+	for raw := msg.Raw; len(raw) != 0; {
+		n := chunkSize
+		if n > len(raw) {
+			n = len(raw)
+		}
+		if _, err = conn.Write(raw[:n]); err != nil {
+			return false
+		}
+		if raw = raw[n:]; len(raw) != 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	assert.NoError(tb, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, inboundMTU)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return false
+	}
+
+	res := &stun.Message{Raw: buf[:n]}
+	return res.Decode() == nil && res.TransactionID == msg.TransactionID
+}
+
+func TestServerConnWorkers(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	server, tcpListener := newConnWorkersServer(t, 2)
+	assert.NotNil(t, server.connPoller)
+
+	conns := make([]net.Conn, 10)
+	for i := range conns {
+		conn, err := net.Dial("tcp4", tcpListener.Addr().String())
+		assert.NoError(t, err)
+		conns[i] = conn
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, conn := range conns {
+			assert.True(t, tcpBinding(t, conn, inboundMTU))
+		}
+	}
+
+	// A request split over several reads is buffered until it is complete
+	assert.True(t, tcpBinding(t, conns[0], 7))
+
+	// Connections closed by the client are removed
+	assert.NoError(t, conns[0].Close())
+	assert.Eventually(t, func() bool {
+		server.connPoller.lock.Lock()
+		defer server.connPoller.lock.Unlock()
+		return len(server.connPoller.conns) == len(conns)-1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return server.ConnStats().Closed == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	stats := server.ConnStats()
+	assert.Equal(t, int64(len(conns)-1), stats.Active)
+	assert.Equal(t, uint64(len(conns)), stats.Accepted)
+	assert.NotZero(t, stats.BytesReceived)
+	assert.NotZero(t, stats.BytesSent)
+	assert.True(t, tcpBinding(t, conns[1], inboundMTU))
+
+	// Close closes the remaining connections
+	assert.NoError(t, server.Close())
+	for _, conn := range conns[1:] {
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err := conn.Read(make([]byte, inboundMTU))
+		assert.Error(t, err)
+		assert.NoError(t, conn.Close())
+	}
+}
+
+// Frames larger than the read buffer are skipped, with or without ConnWorkers
+func TestServerOversizedFrame(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	for _, connWorkers := range []int{0, 2} {
+		server, tcpListener := newConnWorkersServer(t, connWorkers)
+
+		conn, err := net.Dial("tcp4", tcpListener.Addr().String())
+		assert.NoError(t, err)
+
+		// A ChannelData frame with a payload of 2 * inboundMTU bytes
+		frame := make([]byte, 4+2*inboundMTU)
+		binary.BigEndian.PutUint16(frame[0:], proto.MinChannelNumber)
+		binary.BigEndian.PutUint16(frame[2:], 2*inboundMTU)
+		_, err = conn.Write(frame)
+		assert.NoError(t, err)
+
+		// The connection keeps being served
+		assert.True(t, tcpBinding(t, conn, inboundMTU))
+		assert.Equal(t, uint64(1), server.OversizedPayloads())
+
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	}
+}
+
+// Connections that stall in the middle of a frame are closed, with or without ConnWorkers
+func TestServerPartialMessageTimeout(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_, err = NewServer(ServerConfig{
+		ListenerConfigs:       []ListenerConfig{{Listener: tcpListener, RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"}}},
+		PartialMessageTimeout: -time.Second,
+	})
+	assert.Equal(t, errPartialMessageTimeoutInvalid, err)
+	assert.NoError(t, tcpListener.Close())
+
+	for _, connWorkers := range []int{0, 2} {
+		tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			ListenerConfigs: []ListenerConfig{
+				{
+					Listener: tcpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "127.0.0.1",
+					},
+				},
+			},
+			Realm:                 "pion.ly",
+			ConnWorkers:           connWorkers,
+			PartialMessageTimeout: 200 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+
+		stalledConn, err := net.Dial("tcp4", tcpListener.Addr().String())
+		assert.NoError(t, err)
+		idleConn, err := net.Dial("tcp4", tcpListener.Addr().String())
+		assert.NoError(t, err)
+		assert.True(t, tcpBinding(t, idleConn, inboundMTU))
+
+		// A STUN header announcing 1000 bytes that never follow
+		msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		assert.NoError(t, err)
+		header := append([]byte{}, msg.Raw[:20]...)
+		binary.BigEndian.PutUint16(header[2:], 1000)
+		_, err = stalledConn.Write(header)
+		assert.NoError(t, err)
+
+		assert.NoError(t, stalledConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = stalledConn.Read(make([]byte, inboundMTU))
+		assert.Equal(t, io.EOF, err, "stalled connection should be closed by the server")
+		assert.Eventually(t, func() bool {
+			return server.ConnStats().Closed == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// Idle connections without a pending frame are kept
+		assert.True(t, tcpBinding(t, idleConn, inboundMTU))
+		assert.Equal(t, int64(1), server.ConnStats().Active)
+
+		assert.NoError(t, stalledConn.Close())
+		assert.NoError(t, idleConn.Close())
+		assert.NoError(t, server.Close())
+	}
+}
+
+// BenchmarkServerConns compares a goroutine per connection with ConnWorkers. It reports
+// the memory and goroutines used per idle connection, and the cost of a Binding request
+func BenchmarkServerConns(b *testing.B) {
+	var rlimit syscall.Rlimit
+	assert.NoError(b, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit))
+
+	for _, connCount := range []int{1000, 10000} {
+		for _, connWorkers := range []int{0, 4} {
+			b.Run(fmt.Sprintf("Conns%d/Workers%d", connCount, connWorkers), func(b *testing.B) {
+				// Both ends of every connection are open in this process
+				if uint64(2*connCount+64) > rlimit.Cur {
+					b.Skipf("needs %d file descriptors, RLIMIT_NOFILE is %d", 2*connCount+64, rlimit.Cur)
+				}
+
+				server, tcpListener := newConnWorkersServer(b, connWorkers)
+
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				goroutinesBefore := runtime.NumGoroutine()
+
+				conns := make([]net.Conn, connCount)
+				for i := range conns {
+					conn, err := net.Dial("tcp4", tcpListener.Addr().String())
+					assert.NoError(b, err)
+					conns[i] = conn
+				}
+				// Every connection is served once, so it has been accepted
+				for _, conn := range conns {
+					assert.True(b, tcpBinding(b, conn, inboundMTU))
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				goroutinesPerConn := float64(runtime.NumGoroutine()-goroutinesBefore) / float64(connCount)
+				bytesPerConn := float64(int64(after.HeapInuse+after.StackInuse)-int64(before.HeapInuse+before.StackInuse)) / float64(connCount)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !tcpBinding(b, conns[i%connCount], inboundMTU) {
+						b.Fatal("Binding request failed")
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(goroutinesPerConn, "goroutines/conn")
+				b.ReportMetric(bytesPerConn, "bytes/conn")
+
+				for _, conn := range conns {
+					assert.NoError(b, conn.Close())
+				}
+				assert.NoError(b, server.Close())
+			})
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// +build !linux
+
+package turn
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/server"
+)
+
+var errConnWorkersUnsupported = errors.New("turn: ConnWorkers is only supported on linux")
+
+type connHandler func(p net.PacketConn, addr net.Addr, buf []byte, allocationManager *allocation.Manager, transactionCache *server.TransactionCache)
+
+// connPoller is only implemented on linux, see conn_poller_linux.go
+type connPoller struct{}
+
+func newConnPoller(workers, bufferSize int, partialTimeout time.Duration, log logging.LeveledLogger, handle connHandler, drop func(net.Addr), stats *connStats) (*connPoller, error) {
+	return nil, errConnWorkersUnsupported
+}
+
+func (p *connPoller) add(conn net.Conn, allocationManager *allocation.Manager, release func()) bool {
+	return false
+}
+
+func (p *connPoller) close() {}
@@ -0,0 +1,71 @@
+package turn
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// ConnStats describes the connections accepted by the ListenerConfigs, e.g. TURN over
+// TCP or TLS. A connection carries the control messages of an allocation as well as its
+// ChannelData, so these are independent of the allocations.
+//
+// The counters only ever grow, the churn rate is the difference between two snapshots of
+// Accepted and Closed. Bytes per connection can be derived from the byte counters.
+type ConnStats struct {
+	// Active is the number of connections currently open
+	Active int64
+
+	// Accepted is the number of connections accepted, including the Rejected ones
+	Accepted uint64
+
+	// Rejected is the number of connections closed right away because
+	// MaxConcurrentConnections was reached
+	Rejected uint64
+
+	// Closed is the number of connections that were served and have been closed
+	Closed uint64
+
+	// BytesReceived and BytesSent are the bytes read from and written to all connections
+	BytesReceived uint64
+	BytesSent     uint64
+}
+
+// connStats holds the counters behind ConnStats, it is only accessed atomically
+type connStats struct {
+	active        int64
+	accepted      uint64
+	rejected      uint64
+	closed        uint64
+	bytesReceived uint64
+	bytesSent     uint64
+}
+
+// ConnStats returns a snapshot of the connection counters
+func (s *Server) ConnStats() ConnStats {
+	return ConnStats{
+		Active:        atomic.LoadInt64(&s.connStats.active),
+		Accepted:      atomic.LoadUint64(&s.connStats.accepted),
+		Rejected:      atomic.LoadUint64(&s.connStats.rejected),
+		Closed:        atomic.LoadUint64(&s.connStats.closed),
+		BytesReceived: atomic.LoadUint64(&s.connStats.bytesReceived),
+		BytesSent:     atomic.LoadUint64(&s.connStats.bytesSent),
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	stats *connStats
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.stats.bytesReceived, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.stats.bytesSent, uint64(n))
+	return n, err
+}
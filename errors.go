@@ -1,12 +1,63 @@
 package turn
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/pion/turn/v2/internal/client"
+)
 
 var (
-	errRelayAddressInvalid        = errors.New("turn: RelayAddress must be valid IP to use RelayAddressGeneratorStatic")
-	errNoAvailableConns           = errors.New("turn: PacketConnConfigs and ConnConfigs are empty, unable to proceed")
-	errConnUnset                  = errors.New("turn: PacketConnConfig must have a non-nil Conn")
-	errListenerUnset              = errors.New("turn: ListenerConfig must have a non-nil Listener")
-	errListeningAddressInvalid    = errors.New("turn: RelayAddressGenerator has invalid ListeningAddress")
-	errRelayAddressGeneratorUnset = errors.New("turn: RelayAddressGenerator in RelayConfig is unset")
+	errRelayAddressInvalid          = errors.New("turn: RelayAddress must be valid IP to use RelayAddressGeneratorStatic")
+	errNoAvailableConns             = errors.New("turn: PacketConnConfigs and ConnConfigs are empty, unable to proceed")
+	errConnUnset                    = errors.New("turn: PacketConnConfig must have a non-nil Conn")
+	errListenerUnset                = errors.New("turn: ListenerConfig must have a non-nil Listener")
+	errListeningAddressInvalid      = errors.New("turn: RelayAddressGenerator has invalid ListeningAddress")
+	errRelayAddressGeneratorUnset   = errors.New("turn: RelayAddressGenerator in RelayConfig is unset")
+	errExpiryJitterInvalid          = errors.New("turn: ExpiryJitter must not exceed 0.25")
+	errMaxSessionDurationInvalid    = errors.New("turn: MaxSessionDuration must be between 0 and 24 hours")
+	errSecurityFeaturesInvalid      = errors.New("turn: SecurityFeatures must fit in 24 bits")
+	errPasswordAlgorithmsFeature    = errors.New("turn: SecurityFeaturePasswordAlgorithms isn't supported by the server")
+	errRelayReadGoroutinesInvalid   = errors.New("turn: RelayReadGoroutines must not be negative")
+	errRelayMTUInvalid              = errors.New("turn: RelayMTU must be between 0 and 65507")
+	errAdvertisedPortInvalid        = errors.New("turn: AdvertisedPort returned an invalid port")
+	errFreeBindUnsupported          = errors.New("turn: FreeBind is only supported on linux")
+	errFreeBindVirtualNet           = errors.New("turn: FreeBind can't be used with a virtual Net")
+	errMaxBytesPerAllocationInvalid = errors.New("turn: MaxBytesPerAllocation must not be negative")
+	errMaxPermissionsInvalid        = errors.New("turn: MaxPermissions must not be negative")
+	errMinAllocationLifetimeInvalid = errors.New("turn: MinAllocationLifetime must be between 0 and 1 hour")
+	errPartialMessageTimeoutInvalid = errors.New("turn: PartialMessageTimeout must not be negative")
+	errBindingRateBurstInvalid      = errors.New("turn: BindingRateBurst must not be negative")
+	errEventsBufferSizeInvalid      = errors.New("turn: EventsBufferSize must not be negative")
+	errRequestPanicked              = errors.New("turn: panic handling request")
+	errServerClosed                 = errors.New("turn: server is closed")
+	errListenerNotFound             = errors.New("turn: listener is not served by the server")
+	errRealmQuotaUnknownRealm       = errors.New("turn: RealmQuotas must only have entries for the Realm or the AdditionalRealms")
+	errRealmQuotaInvalid            = errors.New("turn: RealmQuota must not be negative")
+	errAuthHandlersConflict         = errors.New("turn: TenantAuthHandler and ContextAuthHandler can't both be set")
+	errInvalidTURNServerURI         = errors.New("turn: invalid TURNServerAddr URI")
+	errTURNServerURIWithConn        = errors.New("turn: Conn and LocalPort must be unset when TURNServerAddr is a TCP, TLS or DTLS URI")
+	errTURNServerURIWithSTUNServer  = errors.New("turn: STUNServerAddr must be unset when TURNServerAddr is a TCP, TLS or DTLS URI")
+	errRedirectOverConnection       = errors.New("turn: ALTERNATE-SERVER redirects can't be followed over a TCP, TLS or DTLS connection")
+	errTooManyRedirects             = errors.New("turn: too many ALTERNATE-SERVER redirects")
+	errEmptyMessage                 = errors.New("turn: message must be encoded before it is sent")
+	errRelaySelfTestFailed          = errors.New("turn: relay self-test failed")
+	errRelaySelfTestOverConnection  = errors.New("turn: relay self-test needs the TURN server to be reached over UDP")
 )
+
+// ErrAddressFamilyNotSupported is returned by Client.Allocate when the server can't relay
+// the ClientConfig.RequestedAddressFamily
+var ErrAddressFamilyNotSupported = errors.New("turn: server does not support the requested address family")
+
+// ErrPeerAddressFamilyMismatch is returned by the WriteTo and CreatePermissions of the
+// relayed net.PacketConn when the peer isn't of the address family of the relayed
+// address. Dual-stack allocations aren't supported, a peer of the other family needs an
+// allocation of its own, see ClientConfig.RequestedAddressFamily
+var ErrPeerAddressFamilyMismatch = client.ErrPeerAddressFamilyMismatch
+
+// ErrCloseTimeout is returned by Server.CloseWithTimeout when sockets of the Server were
+// still closing once the timeout passed
+var ErrCloseTimeout = errors.New("turn: timed out closing the server")
+
+// ErrTransactionCanceled is returned by the requests of a Client whose transaction
+// was canceled by Client.CancelAll
+var ErrTransactionCanceled = errors.New("turn: transaction canceled")
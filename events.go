@@ -0,0 +1,178 @@
+package turn
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/turn/v2/internal/allocation"
+)
+
+const defaultEventsBufferSize = 64
+
+// EventType is the kind of Event delivered by Server.Events
+type EventType int
+
+const (
+	// EventAllocationCreated is delivered after an allocation has been created
+	EventAllocationCreated EventType = iota + 1
+
+	// EventAllocationDeleted is delivered after an allocation has been removed,
+	// Event.DeletionReason tells why
+	EventAllocationDeleted
+
+	// EventAuthFailure is delivered when a request carries credentials that
+	// are rejected, either by the AuthHandler or by the MESSAGE-INTEGRITY check
+	EventAuthFailure
+
+	// EventRateLimited is delivered when a Binding request is dropped because its
+	// source IP exceeded ServerConfig.BindingRateLimit
+	EventRateLimited
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventAllocationCreated:
+		return "AllocationCreated"
+	case EventAllocationDeleted:
+		return "AllocationDeleted"
+	case EventAuthFailure:
+		return "AuthFailure"
+	case EventRateLimited:
+		return "RateLimited"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event describes something that happened inside of the Server.
+// Fields that don't apply to the Type are left empty
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// SrcAddr and DstAddr are the client and server side of the 5-tuple
+	SrcAddr net.Addr
+	DstAddr net.Addr
+
+	// RelayAddr is set for allocation events, it is the relayed address advertised to the client
+	RelayAddr net.Addr
+
+	// RelaySocketAddr is set for allocation events, it is the local address the relay socket
+	// is bound to, including the port assigned by the OS. It differs from RelayAddr when the
+	// RelayAddressGenerator advertises another address, e.g. the public address of a NAT
+	RelaySocketAddr net.Addr
+
+	// Context is set for allocation events, it is what the ContextAuthHandler returned
+	// for the user that created the allocation
+	Context interface{}
+
+	// Username and Realm are set for auth events
+	Username string
+	Realm    string
+
+	// DeletionReason and Summary are set for EventAllocationDeleted
+	DeletionReason DeletionReason
+	Summary        AllocationSummary
+}
+
+// AllocationSummary rolls up an allocation once it is deleted, e.g. to build histograms of
+// session sizes for capacity planning. It is logged at info level as well
+type AllocationSummary struct {
+	// Duration is how long the allocation existed
+	Duration time.Duration
+
+	// BytesToPeers and BytesFromPeers are the payload bytes relayed to and from peers, i.e.
+	// sent and received by the client, without the ChannelData or STUN framing
+	BytesToPeers   uint64
+	BytesFromPeers uint64
+
+	// PeakPermissions is the largest number of peers the allocation had a permission for at once
+	PeakPermissions int
+}
+
+// DeletionReason tells why an allocation was deleted
+type DeletionReason int
+
+const (
+	// DeletionReasonExpired is an allocation whose lifetime ran out without a Refresh
+	DeletionReasonExpired = DeletionReason(allocation.DeletionReasonExpired)
+
+	// DeletionReasonDeallocated is an allocation the client deleted with a Refresh
+	// carrying a LIFETIME of 0
+	DeletionReasonDeallocated = DeletionReason(allocation.DeletionReasonDeallocated)
+
+	// DeletionReasonRelayError is an allocation whose relay socket failed
+	DeletionReasonRelayError = DeletionReason(allocation.DeletionReasonRelayError)
+
+	// DeletionReasonClosed is an allocation deleted because the Server was closed
+	DeletionReasonClosed = DeletionReason(allocation.DeletionReasonClosed)
+
+	// DeletionReasonByteQuota is an allocation that relayed more than
+	// ServerConfig.MaxBytesPerAllocation
+	DeletionReasonByteQuota = DeletionReason(allocation.DeletionReasonByteQuota)
+)
+
+func (r DeletionReason) String() string {
+	return allocation.DeletionReason(r).String()
+}
+
+// Events returns the channel Events are delivered on.
+//
+// The channel is buffered (see ServerConfig.EventsBufferSize) and is written to
+// without blocking, so a slow consumer never back-pressures the relay path. When
+// the buffer is full new Events are dropped and counted, see DroppedEvents.
+// The channel is never closed, consumers should stop reading after calling Close.
+func (s *Server) Events() <-chan Event {
+	return s.events
+}
+
+// DroppedEvents returns how many Events were discarded because the buffer was full
+func (s *Server) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&s.droppedEvents)
+}
+
+func (s *Server) emitEvent(e Event) {
+	e.Time = time.Now()
+
+	select {
+	case s.events <- e:
+	default:
+		atomic.AddUint64(&s.droppedEvents, 1)
+	}
+}
+
+func (s *Server) onAllocationCreated(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{}) {
+	s.emitEvent(Event{
+		Type:            EventAllocationCreated,
+		SrcAddr:         srcAddr,
+		DstAddr:         dstAddr,
+		RelayAddr:       relayAddr,
+		RelaySocketAddr: relaySocketAddr,
+		Context:         context,
+	})
+}
+
+func (s *Server) onAllocationDeleted(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{}, reason allocation.DeletionReason, summary allocation.Summary) {
+	s.emitEvent(Event{
+		Type:            EventAllocationDeleted,
+		SrcAddr:         srcAddr,
+		DstAddr:         dstAddr,
+		RelayAddr:       relayAddr,
+		RelaySocketAddr: relaySocketAddr,
+		Context:         context,
+		DeletionReason:  DeletionReason(reason),
+		Summary:         AllocationSummary(summary),
+	})
+}
+
+func (s *Server) onAuthFailure(username, realm string, srcAddr net.Addr) {
+	if r, ok := s.realms[realm]; ok {
+		atomic.AddUint64(&r.authFailures, 1)
+	}
+	s.emitEvent(Event{Type: EventAuthFailure, SrcAddr: srcAddr, Username: username, Realm: realm})
+}
+
+func (s *Server) onBindingRateLimited(srcAddr net.Addr) {
+	s.emitEvent(Event{Type: EventRateLimited, SrcAddr: srcAddr})
+}
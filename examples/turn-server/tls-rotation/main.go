@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"syscall"
+
+	"github.com/pion/turn/v2"
+)
+
+// listenTLS loads the certificate and key and starts a TLS listener on port
+func listenTLS(port int, certFile, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.Listen("tcp4", "0.0.0.0:"+strconv.Itoa(port), &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	})
+}
+
+func main() {
+	publicIP := flag.String("public-ip", "", "IP Address that TURN can be contacted by.")
+	port := flag.Int("port", 5349, "Listening port.")
+	users := flag.String("users", "", "List of username and password (e.g. \"user=pass,user=pass\")")
+	realm := flag.String("realm", "pion.ly", "Realm (defaults to \"pion.ly\")")
+	certFile := flag.String("cert", "server.crt", "Certificate (defaults to \"server.crt\")")
+	keyFile := flag.String("key", "server.key", "Key (defaults to \"server.key\")")
+	flag.Parse()
+
+	if len(*publicIP) == 0 {
+		log.Fatalf("'public-ip' is required")
+	} else if len(*users) == 0 {
+		log.Fatalf("'users' is required")
+	}
+
+	tlsListener, err := listenTLS(*port, *certFile, *keyFile)
+	if err != nil {
+		log.Panicf("Failed to create TURN server listener: %s", err)
+	}
+
+	// Cache -users flag for easy lookup later
+	// If passwords are stored they should be saved to your DB hashed using turn.GenerateAuthKey
+	usersMap := map[string][]byte{}
+	for _, kv := range regexp.MustCompile(`(\w+)=(\w+)`).FindAllStringSubmatch(*users, -1) {
+		usersMap[kv[1]] = turn.GenerateAuthKey(kv[1], *realm, kv[2])
+	}
+
+	relayAddressGenerator := &turn.RelayAddressGeneratorStatic{
+		RelayAddress: net.ParseIP(*publicIP),
+		Address:      "0.0.0.0",
+	}
+
+	s, err := turn.NewServer(turn.ServerConfig{
+		Realm: *realm,
+		AuthHandler: func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+			if key, ok := usersMap[username]; ok {
+				return key, true
+			}
+			return nil, false
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              tlsListener,
+				RelayAddressGenerator: relayAddressGenerator,
+			},
+		},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// SIGHUP rotates the certificate, e.g. after it was renewed on disk. The old listener is
+	// removed first to free the port, the connections it accepted keep being served with their
+	// allocations until the clients close them. Only new connections use the new certificate,
+	// the few that arrive while the port is rebound are refused and retried by the client.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		if err = s.RemoveListener(tlsListener); err != nil {
+			log.Printf("Failed to remove TLS listener: %s", err)
+		}
+		if tlsListener, err = listenTLS(*port, *certFile, *keyFile); err != nil {
+			log.Panicf("Failed to create TURN server listener: %s", err)
+		}
+		if err = s.AddListener(turn.ListenerConfig{Listener: tlsListener, RelayAddressGenerator: relayAddressGenerator}); err != nil {
+			log.Panic(err)
+		}
+		log.Printf("Rotated the certificate of %s", tlsListener.Addr())
+	}
+
+	if err = s.Close(); err != nil {
+		log.Panic(err)
+	}
+}
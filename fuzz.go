@@ -0,0 +1,75 @@
+// +build gofuzz
+
+package turn
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/pion/turn/v2/internal/server"
+)
+
+// FuzzSTUNConn feeds data to a STUNConn as a TCP stream, in chunks of the size given by the
+// first byte, and every frame read from it to the request handler. Reading must end with the
+// stream, a frame must never be longer than what was left of it. Build it with
+// go-fuzz-build -tags gofuzz -func FuzzSTUNConn, FuzzHandleRequest of internal/server fuzzes
+// the handler with UDP datagrams
+func FuzzSTUNConn(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+
+	chunkSize := int(data[0]) + 1
+	conn := NewSTUNConn(&fuzzStreamConn{data: data[1:], chunkSize: chunkSize})
+	buf := make([]byte, inboundMTU)
+	remaining := len(data) - 1
+	frames := 0
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err == errTURNFrameTooLarge {
+			continue
+		} else if err != nil {
+			break
+		}
+		if n > remaining {
+			panic("frame is longer than the stream")
+		}
+		remaining -= n
+		frames++
+
+		server.FuzzHandleRequest(buf[:n])
+	}
+	if frames == 0 {
+		return 0
+	}
+	return 1
+}
+
+// fuzzStreamConn is a net.Conn that returns data in chunks, then io.EOF
+type fuzzStreamConn struct {
+	net.Conn
+
+	data      []byte
+	chunkSize int
+}
+
+func (c *fuzzStreamConn) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+
+	n := c.chunkSize
+	if n > len(c.data) {
+		n = len(c.data)
+	}
+	n = copy(p, c.data[:n])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *fuzzStreamConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+}
+
+func (c *fuzzStreamConn) SetReadDeadline(t time.Time) error { return nil }
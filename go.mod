@@ -3,6 +3,7 @@ module github.com/pion/turn/v2
 go 1.13
 
 require (
+	github.com/pion/dtls/v2 v2.0.1
 	github.com/pion/logging v0.2.2
 	github.com/pion/stun v0.3.3
 	github.com/pion/transport v0.10.0
@@ -2,9 +2,12 @@
 package allocation
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pion/logging"
@@ -16,6 +19,15 @@ import (
 // Allocation is tied to a FiveTuple and relays traffic
 // use CreateAllocation and GetAllocation to operate
 type Allocation struct {
+	relayWriteErrors  uint64 // accessed atomically, kept first for 64-bit alignment
+	oversizedPayloads uint64 // accessed atomically, kept first for 64-bit alignment
+	relayedBytes      uint64 // accessed atomically, kept first for 64-bit alignment
+
+	unpermittedPayloads uint64 // accessed atomically, kept first for 64-bit alignment
+
+	bytesToPeers   uint64 // accessed atomically, kept first for 64-bit alignment
+	bytesFromPeers uint64 // accessed atomically, kept first for 64-bit alignment
+
 	RelayAddr           net.Addr
 	Protocol            Protocol
 	TurnSocket          net.PacketConn
@@ -23,11 +35,58 @@ type Allocation struct {
 	fiveTuple           *FiveTuple
 	permissionsLock     sync.RWMutex
 	permissions         map[string]*Permission
+	peakPermissions     int
+	permissionLifetime  time.Duration
 	channelBindingsLock sync.RWMutex
 	channelBindings     []*ChannelBind
 	lifetimeTimer       *time.Timer
 	closed              chan interface{}
 	log                 logging.LeveledLogger
+	created             time.Time
+
+	consecutiveWriteErrorsLock sync.Mutex
+	consecutiveWriteErrors     int
+
+	// expiryJitter extends the lifetime of timers by up to this fraction, see ManagerConfig.ExpiryJitter
+	expiryJitter float64
+
+	// recorder copies relayed payloads to the sink from ManagerConfig.RecordingSink, nil when not recording
+	recorder *recorder
+
+	// permissionLimit counts the permissions of the allocation, see ManagerConfig.PermissionLimit
+	permissionLimit *PermissionLimit
+
+	// expiredPermissions are the fingerprints of the peers whose permission expired, they
+	// are forgotten once a permission is added again. Guarded by permissionsLock
+	expiredPermissions map[string]struct{}
+
+	// relayMTU is the largest payload relayed, see ManagerConfig.RelayMTU
+	relayMTU           int
+	onOversizedPayload func()
+
+	// onUnpermittedPayload is called for every datagram from a peer without a permission
+	onUnpermittedPayload func()
+
+	// maxRelayedBytes is the byte quota of the allocation, see ManagerConfig.MaxBytesPerAllocation
+	maxRelayedBytes uint64
+
+	// quota is the Quota of the group the allocation belongs to, nil when it has none
+	quota *Quota
+
+	// context is the application data the allocation was created with, see Context
+	context interface{}
+
+	// username authenticated the Allocate request, see Username
+	username string
+
+	// store is written the Record of the allocation, see ManagerConfig.Store
+	store Store
+
+	// allocateResponse is the success response to the Allocate request with allocateTransactionID
+	// that created the allocation, see SetAllocateResponse
+	allocateResponseLock  sync.RWMutex
+	allocateTransactionID [stun.TransactionIDSize]byte
+	allocateResponse      []byte
 }
 
 func addr2IPFingerprint(addr net.Addr) string {
@@ -48,6 +107,11 @@ func NewAllocation(turnSocket net.PacketConn, fiveTuple *FiveTuple, log logging.
 		permissions: make(map[string]*Permission, 64),
 		closed:      make(chan interface{}),
 		log:         log,
+		relayMTU:    rtpMTU,
+		created:     time.Now(),
+
+		permissionLifetime: permissionTimeout,
+		expiredPermissions: map[string]struct{}{},
 	}
 }
 
@@ -59,63 +123,126 @@ func (a *Allocation) GetPermission(addr net.Addr) *Permission {
 	return a.permissions[addr2IPFingerprint(addr)]
 }
 
-// AddPermission adds a new permission to the allocation
-func (a *Allocation) AddPermission(p *Permission) {
+// AddPermission adds a new permission to the allocation, or refreshes the one of the
+// same IP. ErrPermissionLimitReached is returned when the PermissionLimit has no room
+// for a new one, ErrAllocationExpired when the allocation was closed
+func (a *Allocation) AddPermission(p *Permission) error {
 	fingerprint := addr2IPFingerprint(p.Addr)
 
-	a.permissionsLock.RLock()
-	existedPermission, ok := a.permissions[fingerprint]
-	a.permissionsLock.RUnlock()
+	a.permissionsLock.Lock()
+	if existedPermission, ok := a.permissions[fingerprint]; ok {
+		a.permissionsLock.Unlock()
+		existedPermission.refresh(addJitter(a.permissionLifetime, a.expiryJitter))
+		return nil
+	}
 
-	if ok {
-		existedPermission.refresh(permissionTimeout)
-		return
+	select {
+	case <-a.closed:
+		a.permissionsLock.Unlock()
+		return ErrAllocationExpired
+	default:
+	}
+
+	if !a.permissionLimit.acquire() {
+		a.permissionsLock.Unlock()
+		return ErrPermissionLimitReached
 	}
 
 	p.allocation = a
-	a.permissionsLock.Lock()
 	a.permissions[fingerprint] = p
+	delete(a.expiredPermissions, fingerprint)
+	if len(a.permissions) > a.peakPermissions {
+		a.peakPermissions = len(a.permissions)
+	}
+	p.start(addJitter(a.permissionLifetime, a.expiryJitter))
 	a.permissionsLock.Unlock()
-
-	p.start(permissionTimeout)
+	return nil
 }
 
 // RemovePermission removes the net.Addr's fingerprint from the allocation's permissions
 func (a *Allocation) RemovePermission(addr net.Addr) {
 	a.permissionsLock.Lock()
 	defer a.permissionsLock.Unlock()
-	delete(a.permissions, addr2IPFingerprint(addr))
+	a.deletePermission(addr2IPFingerprint(addr))
+}
+
+// expirePermission removes the permission of addr, whose lifetime ran out without a refresh
+func (a *Allocation) expirePermission(addr net.Addr) {
+	fingerprint := addr2IPFingerprint(addr)
+
+	a.permissionsLock.Lock()
+	defer a.permissionsLock.Unlock()
+	if a.deletePermission(fingerprint) {
+		a.expiredPermissions[fingerprint] = struct{}{}
+	}
+}
+
+// deletePermission deletes the permission of fingerprint and uncounts it from the
+// PermissionLimit, it returns false when there is none. permissionsLock must be held
+func (a *Allocation) deletePermission(fingerprint string) bool {
+	if _, ok := a.permissions[fingerprint]; !ok {
+		return false
+	}
+	delete(a.permissions, fingerprint)
+	a.permissionLimit.release(1)
+	return true
+}
+
+// PermissionExpired returns true if addr has no permission because its permission expired,
+// rather than because it never had one
+func (a *Allocation) PermissionExpired(addr net.Addr) bool {
+	a.permissionsLock.RLock()
+	defer a.permissionsLock.RUnlock()
+
+	fingerprint := addr2IPFingerprint(addr)
+	if _, ok := a.permissions[fingerprint]; ok {
+		return false
+	}
+	_, expired := a.expiredPermissions[fingerprint]
+	return expired
 }
 
 // AddChannelBind adds a new ChannelBind to the allocation, it also updates the
-// permissions needed for this ChannelBind
+// permissions needed for this ChannelBind. Binding a channel again to the peer it
+// is bound to refreshes the binding. ErrChannelNumberInUse or ErrChannelPeerInUse
+// is returned when the channel or the peer is bound to another peer or channel
 func (a *Allocation) AddChannelBind(c *ChannelBind, lifetime time.Duration) error {
+	lifetime = addJitter(lifetime, a.expiryJitter)
+
+	// The checks and the update are done under the lock, concurrent binds of
+	// the same channel or peer must not both succeed
+	a.channelBindingsLock.Lock()
+	defer a.channelBindingsLock.Unlock()
+
 	// Check that this channel id isn't bound to another transport address, and
 	// that this transport address isn't bound to another channel number.
-	channelByNumber := a.GetChannelByNumber(c.Number)
-
-	if channelByNumber != a.GetChannelByAddr(c.Peer) {
-		return fmt.Errorf("you cannot use the same channel number with different peer")
+	channelByNumber := a.channelByNumber(c.Number)
+	channelByAddr := a.channelByAddr(c.Peer)
+	switch {
+	case channelByNumber != nil && channelByNumber != channelByAddr:
+		return fmt.Errorf("%w: %d is bound to %v", ErrChannelNumberInUse, c.Number, channelByNumber.Peer)
+	case channelByAddr != nil && channelByAddr != channelByNumber:
+		return fmt.Errorf("%w: %v is bound to %d", ErrChannelPeerInUse, c.Peer, channelByAddr.Number)
 	}
 
-	// Add or refresh this channel.
-	if channelByNumber == nil {
-		a.channelBindingsLock.Lock()
-		defer a.channelBindingsLock.Unlock()
-
-		c.allocation = a
-		a.channelBindings = append(a.channelBindings, c)
-		c.start(lifetime)
-
-		// Channel binds also refresh permissions.
-		a.AddPermission(NewPermission(c.Peer, a.log))
-	} else {
-		channelByNumber.refresh(lifetime)
+	// Refresh this channel. A binding whose timer already fired is being removed,
+	// it is replaced by the new one instead of being kept past its expiry
+	if channelByNumber != nil {
+		if channelByNumber.refresh(lifetime) {
+			// Channel binds also refresh permissions.
+			return a.AddPermission(NewPermission(channelByNumber.Peer, a.log))
+		}
+		a.removeChannelBind(channelByNumber)
+	}
 
-		// Channel binds also refresh permissions.
-		a.AddPermission(NewPermission(channelByNumber.Peer, a.log))
+	// Channel binds also refresh permissions, a channel isn't bound without one
+	if err := a.AddPermission(NewPermission(c.Peer, a.log)); err != nil {
+		return err
 	}
 
+	c.allocation = a
+	a.channelBindings = append(a.channelBindings, c)
+	c.start(lifetime)
 	return nil
 }
 
@@ -124,13 +251,29 @@ func (a *Allocation) RemoveChannelBind(number proto.ChannelNumber) bool {
 	a.channelBindingsLock.Lock()
 	defer a.channelBindingsLock.Unlock()
 
+	if c := a.channelByNumber(number); c != nil {
+		return a.removeChannelBind(c)
+	}
+	return false
+}
+
+// removeExpiredChannelBind removes c once its lifetime ran out. c may have been
+// replaced by a new binding of the same channel in the meantime, which is kept
+func (a *Allocation) removeExpiredChannelBind(c *ChannelBind) bool {
+	a.channelBindingsLock.Lock()
+	defer a.channelBindingsLock.Unlock()
+
+	return a.removeChannelBind(c)
+}
+
+// removeChannelBind removes c, the caller holds channelBindingsLock
+func (a *Allocation) removeChannelBind(c *ChannelBind) bool {
 	for i := len(a.channelBindings) - 1; i >= 0; i-- {
-		if a.channelBindings[i].Number == number {
+		if a.channelBindings[i] == c {
 			a.channelBindings = append(a.channelBindings[:i], a.channelBindings[i+1:]...)
 			return true
 		}
 	}
-
 	return false
 }
 
@@ -138,6 +281,18 @@ func (a *Allocation) RemoveChannelBind(number proto.ChannelNumber) bool {
 func (a *Allocation) GetChannelByNumber(number proto.ChannelNumber) *ChannelBind {
 	a.channelBindingsLock.RLock()
 	defer a.channelBindingsLock.RUnlock()
+	return a.channelByNumber(number)
+}
+
+// GetChannelByAddr gets the ChannelBind from this allocation by net.Addr
+func (a *Allocation) GetChannelByAddr(addr net.Addr) *ChannelBind {
+	a.channelBindingsLock.RLock()
+	defer a.channelBindingsLock.RUnlock()
+	return a.channelByAddr(addr)
+}
+
+// channelByNumber is GetChannelByNumber, the caller holds channelBindingsLock
+func (a *Allocation) channelByNumber(number proto.ChannelNumber) *ChannelBind {
 	for _, cb := range a.channelBindings {
 		if cb.Number == number {
 			return cb
@@ -146,10 +301,8 @@ func (a *Allocation) GetChannelByNumber(number proto.ChannelNumber) *ChannelBind
 	return nil
 }
 
-// GetChannelByAddr gets the ChannelBind from this allocation by net.Addr
-func (a *Allocation) GetChannelByAddr(addr net.Addr) *ChannelBind {
-	a.channelBindingsLock.RLock()
-	defer a.channelBindingsLock.RUnlock()
+// channelByAddr is GetChannelByAddr, the caller holds channelBindingsLock
+func (a *Allocation) channelByAddr(addr net.Addr) *ChannelBind {
 	for _, cb := range a.channelBindings {
 		if ipnet.AddrEqual(cb.Peer, addr) {
 			return cb
@@ -158,10 +311,72 @@ func (a *Allocation) GetChannelByAddr(addr net.Addr) *ChannelBind {
 	return nil
 }
 
+// SetAllocateResponse remembers the success response sent to the Allocate request with
+// transactionID that created the allocation
+func (a *Allocation) SetAllocateResponse(transactionID [stun.TransactionIDSize]byte, response []byte) {
+	a.allocateResponseLock.Lock()
+	defer a.allocateResponseLock.Unlock()
+
+	a.allocateTransactionID = transactionID
+	a.allocateResponse = response
+}
+
+// AllocateResponse returns the success response to the Allocate request that created the
+// allocation if its transaction ID is transactionID, i.e. if a request with transactionID
+// is a retransmit of it
+func (a *Allocation) AllocateResponse(transactionID [stun.TransactionIDSize]byte) ([]byte, bool) {
+	a.allocateResponseLock.RLock()
+	defer a.allocateResponseLock.RUnlock()
+
+	if a.allocateResponse == nil || a.allocateTransactionID != transactionID {
+		return nil, false
+	}
+	return a.allocateResponse, true
+}
+
 // Refresh updates the allocations lifetime
-func (a *Allocation) Refresh(lifetime time.Duration) {
-	if !a.lifetimeTimer.Reset(lifetime) {
-		a.log.Errorf("Failed to reset allocation timer for %v", a.fiveTuple)
+func (a *Allocation) Refresh(lifetime time.Duration) error {
+	// If the timer already fired the allocation is being deleted, don't re-arm it
+	if !a.lifetimeTimer.Reset(addJitter(lifetime, a.expiryJitter)) {
+		a.lifetimeTimer.Stop()
+		return ErrAllocationExpired
+	}
+
+	// Close may have run concurrently, it stops the timer after marking the allocation closed
+	select {
+	case <-a.closed:
+		a.lifetimeTimer.Stop()
+		return ErrAllocationExpired
+	default:
+	}
+
+	a.storeRecord(lifetime, true)
+	return nil
+}
+
+// storeRecord writes the Record of the allocation to the Store, it is an update
+// of the one written on creation when update is set. Store errors are only logged
+func (a *Allocation) storeRecord(lifetime time.Duration, update bool) {
+	if a.store == nil {
+		return
+	}
+
+	r := Record{
+		FiveTuple: *a.fiveTuple,
+		Username:  a.username,
+		RelayAddr: a.RelayAddr,
+		Lifetime:  lifetime,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+
+	var err error
+	if update {
+		err = a.store.Update(r)
+	} else {
+		err = a.store.Create(r)
+	}
+	if err != nil {
+		a.log.Warnf("Failed to store allocation of %v: %v", a.fiveTuple.SrcAddr, err)
 	}
 }
 
@@ -176,11 +391,15 @@ func (a *Allocation) Close() error {
 
 	a.lifetimeTimer.Stop()
 
-	a.permissionsLock.RLock()
+	// The permissions are forgotten so that a timer that fired concurrently doesn't
+	// uncount its permission from the PermissionLimit a second time
+	a.permissionsLock.Lock()
 	for _, p := range a.permissions {
 		p.lifetimeTimer.Stop()
 	}
-	a.permissionsLock.RUnlock()
+	a.permissionLimit.release(len(a.permissions))
+	a.permissions = map[string]*Permission{}
+	a.permissionsLock.Unlock()
 
 	a.channelBindingsLock.RLock()
 	for _, c := range a.channelBindings {
@@ -188,9 +407,213 @@ func (a *Allocation) Close() error {
 	}
 	a.channelBindingsLock.RUnlock()
 
+	if a.recorder != nil {
+		a.recorder.close()
+	}
+
 	return a.RelaySocket.Close()
 }
 
+// maxConsecutiveRelayWriteErrors is how many writes to peers may fail in a row,
+// other than for ENOBUFS, before the relay socket is considered broken
+const maxConsecutiveRelayWriteErrors = 16
+
+// RelaySocketAddr returns the address the relay socket is bound to. It differs from
+// RelayAddr when the address advertised to the client isn't the bound one, e.g. behind a NAT
+func (a *Allocation) RelaySocketAddr() net.Addr {
+	return a.RelaySocket.LocalAddr()
+}
+
+// RelayWriteErrors returns how many writes to peers failed on the relay socket
+func (a *Allocation) RelayWriteErrors() uint64 {
+	return atomic.LoadUint64(&a.relayWriteErrors)
+}
+
+// OversizedPayloads returns how many payloads to or from peers were dropped because they
+// exceed the relay MTU
+func (a *Allocation) OversizedPayloads() uint64 {
+	return atomic.LoadUint64(&a.oversizedPayloads)
+}
+
+// dropOversized counts a payload of size bytes to or from peer that exceeds the relay MTU
+func (a *Allocation) dropOversized(peer net.Addr, size int) {
+	atomic.AddUint64(&a.oversizedPayloads, 1)
+	if a.onOversizedPayload != nil {
+		a.onOversizedPayload()
+	}
+	a.log.Debugf("dropping %d bytes payload for %v, larger than the relay MTU of %d", size, peer, a.relayMTU)
+}
+
+// UnpermittedPayloads returns how many datagrams the relay socket received from peers
+// without a permission, they were dropped without being relayed or counted as relayed
+func (a *Allocation) UnpermittedPayloads() uint64 {
+	return atomic.LoadUint64(&a.unpermittedPayloads)
+}
+
+// dropUnpermitted counts a datagram of size bytes from peer, which has no permission
+func (a *Allocation) dropUnpermitted(peer net.Addr, size int) {
+	atomic.AddUint64(&a.unpermittedPayloads, 1)
+	if a.onUnpermittedPayload != nil {
+		a.onUnpermittedPayload()
+	}
+	a.log.Debugf("dropping %d bytes payload from %v, no permission or channel exists on allocation %v", size, peer, a.RelayAddr)
+}
+
+// Username returns the user that authenticated the Allocate request, the allocation's
+// other requests must be authenticated by the same user. It is empty for allocations
+// created with CreateAllocation
+func (a *Allocation) Username() string {
+	return a.username
+}
+
+// Context returns the application data the allocation was created with, nil if it has none
+func (a *Allocation) Context() interface{} {
+	return a.context
+}
+
+// RelayedBytes returns the payload bytes relayed to and from peers, it doesn't count
+// the ChannelData or STUN framing
+func (a *Allocation) RelayedBytes() uint64 {
+	return atomic.LoadUint64(&a.relayedBytes)
+}
+
+// Summary rolls up what an allocation relayed, for capacity planning
+type Summary struct {
+	// Duration is how long the allocation existed, up to when Summary was called
+	Duration time.Duration
+
+	// BytesToPeers and BytesFromPeers are the payload bytes relayed to and from peers,
+	// i.e. sent and received by the client
+	BytesToPeers   uint64
+	BytesFromPeers uint64
+
+	// PeakPermissions is the largest number of permissions the allocation had at once
+	PeakPermissions int
+}
+
+// Summary returns the Summary of the allocation so far, the Manager logs it and passes it
+// to OnAllocationDeleted when the allocation is deleted
+func (a *Allocation) Summary() Summary {
+	a.permissionsLock.RLock()
+	peakPermissions := a.peakPermissions
+	a.permissionsLock.RUnlock()
+
+	return Summary{
+		Duration:        time.Since(a.created),
+		BytesToPeers:    atomic.LoadUint64(&a.bytesToPeers),
+		BytesFromPeers:  atomic.LoadUint64(&a.bytesFromPeers),
+		PeakPermissions: peakPermissions,
+	}
+}
+
+// PermissionInfo describes a permission of an allocation, see Allocation.Peers
+type PermissionInfo struct {
+	// Peer is the address the permission was created for, it permits every port of its IP
+	Peer net.Addr
+
+	// ExpiresAt is when the permission expires unless it is refreshed
+	ExpiresAt time.Time
+}
+
+// ChannelBindInfo describes a channel binding of an allocation, see Allocation.Peers
+type ChannelBindInfo struct {
+	Number proto.ChannelNumber
+	Peer   net.Addr
+
+	// ExpiresAt is when the binding expires unless it is refreshed
+	ExpiresAt time.Time
+}
+
+// Peers returns the permissions and channel bindings of the allocation. Each list is
+// copied under its lock, so it is consistent while peers are added, refreshed or expire
+func (a *Allocation) Peers() ([]PermissionInfo, []ChannelBindInfo) {
+	a.permissionsLock.RLock()
+	permissions := make([]PermissionInfo, 0, len(a.permissions))
+	for _, p := range a.permissions {
+		permissions = append(permissions, PermissionInfo{Peer: p.Addr, ExpiresAt: p.ExpiresAt()})
+	}
+	a.permissionsLock.RUnlock()
+
+	a.channelBindingsLock.RLock()
+	channelBinds := make([]ChannelBindInfo, 0, len(a.channelBindings))
+	for _, c := range a.channelBindings {
+		channelBinds = append(channelBinds, ChannelBindInfo{Number: c.Number, Peer: c.Peer, ExpiresAt: c.expiresAt})
+	}
+	a.channelBindingsLock.RUnlock()
+
+	return permissions, channelBinds
+}
+
+// FiveTuple returns the 5-tuple of the client the allocation relays for
+func (a *Allocation) FiveTuple() *FiveTuple {
+	return a.fiveTuple
+}
+
+// countRelayed adds size bytes to RelayedBytes and those of the Quota, it returns false
+// when they exceed either byte quota and the payload must not be relayed
+func (a *Allocation) countRelayed(size int) bool {
+	relayed := atomic.AddUint64(&a.relayedBytes, uint64(size))
+	withinQuota := a.quota.countRelayed(size)
+	return withinQuota && (a.maxRelayedBytes == 0 || relayed <= a.maxRelayedBytes)
+}
+
+// RecordsDropped returns how many relayed payloads were not written to the recording sink,
+// either because the sink fell behind or because writing to it failed
+func (a *Allocation) RecordsDropped() uint64 {
+	if a.recorder == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&a.recorder.dropped)
+}
+
+// WriteToPeer sends p to peer on the relay socket. Every failed write is counted.
+// ENOBUFS is transient, the packet is dropped and nil is returned. EMSGSIZE, or p
+// exceeding the relay MTU, is returned as ErrPacketTooLarge. Once too many writes
+// failed in a row ErrRelaySocketFailing is returned and the allocation should be deleted.
+// ErrByteQuotaExceeded is returned, and p isn't sent, once the allocation relayed more
+// than its byte quota, the allocation should be deleted as well.
+func (a *Allocation) WriteToPeer(p []byte, peer net.Addr) error {
+	if len(p) > a.relayMTU {
+		a.dropOversized(peer, len(p))
+		return fmt.Errorf("%w: %d bytes to %v exceed the relay MTU of %d", ErrPacketTooLarge, len(p), peer, a.relayMTU)
+	}
+	if !a.countRelayed(len(p)) {
+		return fmt.Errorf("%w: %d bytes relayed", ErrByteQuotaExceeded, a.RelayedBytes())
+	}
+
+	n, err := a.RelaySocket.WriteTo(p, peer)
+	if err == nil && n != len(p) {
+		err = fmt.Errorf("packet write smaller than packet %d != %d (expected)", n, len(p))
+	}
+
+	a.consecutiveWriteErrorsLock.Lock()
+	defer a.consecutiveWriteErrorsLock.Unlock()
+
+	if err == nil {
+		a.consecutiveWriteErrors = 0
+		atomic.AddUint64(&a.bytesToPeers, uint64(n))
+		if a.recorder != nil {
+			a.recorder.record(DirectionToPeer, peer, p)
+		}
+		return nil
+	}
+	atomic.AddUint64(&a.relayWriteErrors, 1)
+
+	switch {
+	case errors.Is(err, syscall.ENOBUFS):
+		a.log.Debugf("dropping packet to %v, relay socket is out of buffers", peer)
+		return nil
+	case errors.Is(err, syscall.EMSGSIZE):
+		a.consecutiveWriteErrors = 0
+		return fmt.Errorf("%w: %d bytes to %v", ErrPacketTooLarge, len(p), peer)
+	}
+
+	if a.consecutiveWriteErrors++; a.consecutiveWriteErrors >= maxConsecutiveRelayWriteErrors {
+		return fmt.Errorf("%w: %v", ErrRelaySocketFailing, err)
+	}
+	return fmt.Errorf("failed writing to socket: %v", err)
+}
+
 //  https://tools.ietf.org/html/rfc5766#section-10.3
 //  When the server receives a UDP datagram at a currently allocated
 //  relayed transport address, the server looks up the allocation
@@ -210,25 +633,57 @@ func (a *Allocation) Close() error {
 //  datagram, and the XOR-PEER-ADDRESS attribute is set to the source
 //  transport address of the received UDP datagram.  The Data indication
 //  is then sent on the 5-tuple associated with the allocation.
+//
+// Datagrams are relayed as they are, whatever they contain. A STUN Binding request a
+// peer sends to the relayed address, e.g. an ICE connectivity check of a relay candidate,
+// is relayed to the client like any other payload. It is the client's ICE agent that
+// answers it through the allocation, the server never does.
 
 const rtpMTU = 1500
 
 func (a *Allocation) packetHandler(m *Manager) {
-	buffer := make([]byte, rtpMTU)
+	// One spare byte tells a datagram that was truncated to the buffer apart from one that fits
+	buffer := make([]byte, a.relayMTU+1)
 
 	for {
 		n, srcAddr, err := a.RelaySocket.ReadFrom(buffer)
 		if err != nil {
-			m.DeleteAllocation(a.fiveTuple)
+			// A no-op when the allocation was deleted, which closed the socket. Otherwise the
+			// relay is dead and the allocation is deleted rather than left to expire, the client
+			// learns about it from the 437 answering its next request
+			select {
+			case <-a.closed:
+			default:
+				a.log.Warnf("relay socket %v of the allocation of %v failed: %v", a.RelayAddr, a.fiveTuple.SrcAddr, err)
+			}
+			m.deleteIfSame(a, DeletionReasonRelayError)
+			return
+		} else if n > a.relayMTU {
+			a.dropOversized(srcAddr, n)
+			continue
+		}
+
+		// The relay socket isn't connected to the peers, anyone can send to it. Datagrams
+		// from peers without a permission, e.g. with a spoofed source address, are dropped
+		// before they count against the byte quota
+		channel := a.GetChannelByAddr(srcAddr)
+		if channel == nil && a.GetPermission(srcAddr) == nil {
+			a.dropUnpermitted(srcAddr, n)
+			continue
+		} else if !a.countRelayed(n) {
+			a.log.Infof("allocation relayed on %v exceeded its byte quota after %d bytes", a.RelayAddr, a.RelayedBytes())
+			m.deleteIfSame(a, DeletionReasonByteQuota)
 			return
 		}
 
+		atomic.AddUint64(&a.bytesFromPeers, uint64(n))
+
 		a.log.Debugf("relay socket %s received %d bytes from %s",
 			a.RelaySocket.LocalAddr().String(),
 			n,
 			srcAddr.String())
 
-		if channel := a.GetChannelByAddr(srcAddr); channel != nil {
+		if channel != nil {
 			channelData := &proto.ChannelData{
 				Data:   buffer[:n],
 				Number: channel.Number,
@@ -237,24 +692,31 @@ func (a *Allocation) packetHandler(m *Manager) {
 
 			if _, err = a.TurnSocket.WriteTo(channelData.Raw, a.fiveTuple.SrcAddr); err != nil {
 				a.log.Errorf("Failed to send ChannelData from allocation %v %v", srcAddr, err)
+			} else if a.recorder != nil {
+				a.recorder.record(DirectionToClient, srcAddr, buffer[:n])
+			}
+		} else {
+			srcIP, srcPort, err := ipnet.AddrIPPort(srcAddr)
+			if err != nil {
+				a.log.Errorf("Failed to send DataIndication from allocation %v %v", srcAddr, err)
+				continue
 			}
-		} else if p := a.GetPermission(srcAddr); p != nil {
-			udpAddr := srcAddr.(*net.UDPAddr)
-			peerAddressAttr := proto.PeerAddress{IP: udpAddr.IP, Port: udpAddr.Port}
+			peerAddressAttr := proto.PeerAddress{IP: srcIP, Port: srcPort}
 			dataAttr := proto.Data(buffer[:n])
 
 			msg, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodData, stun.ClassIndication), peerAddressAttr, dataAttr)
 			if err != nil {
 				a.log.Errorf("Failed to send DataIndication from allocation %v %v", srcAddr, err)
+				continue
 			}
 			a.log.Debugf("relaying message from %s to client at %s",
 				srcAddr.String(),
 				a.fiveTuple.SrcAddr.String())
 			if _, err = a.TurnSocket.WriteTo(msg.Raw, a.fiveTuple.SrcAddr); err != nil {
 				a.log.Errorf("Failed to send DataIndication from allocation %v %v", srcAddr, err)
+			} else if a.recorder != nil {
+				a.recorder.record(DirectionToClient, srcAddr, buffer[:n])
 			}
-		} else {
-			a.log.Infof("No Permission or Channel exists for %v on allocation %v", srcAddr, a.RelayAddr.String())
 		}
 	}
 }
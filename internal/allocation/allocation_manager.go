@@ -2,11 +2,14 @@ package allocation
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/turn/v2/internal/ipnet"
+	"github.com/pion/turn/v2/internal/proto"
 )
 
 // ManagerConfig a bag of config params for Manager.
@@ -14,6 +17,61 @@ type ManagerConfig struct {
 	LeveledLogger      logging.LeveledLogger
 	AllocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error)
 	AllocateConn       func(network string, requestedPort int) (net.Conn, net.Addr, error)
+
+	// OnAllocationCreated and OnAllocationDeleted are optional, they are called
+	// when an allocation is added to or removed from the Manager. relaySocketAddr
+	// is the address the relay socket is bound to, see Allocation.RelaySocketAddr,
+	// context is the one the allocation was created with and summary what it relayed
+	OnAllocationCreated func(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{})
+	OnAllocationDeleted func(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{}, reason DeletionReason, summary Summary)
+
+	// RelayPoolSize is the number of relay sockets to keep bound ahead of time, 0 disables pooling
+	RelayPoolSize int
+
+	// ExpiryJitter extends the lifetime timers of allocations, permissions and channel binds
+	// by a random duration of up to this fraction of the lifetime, 0 disables jitter
+	ExpiryJitter float64
+
+	// RecordingSink is optional, it is called for every new allocation. When it returns a
+	// non-nil io.Writer, every payload relayed by the allocation is written to it as a record,
+	// see EncodeRecord. Records are written from another goroutine and dropped when the writer
+	// falls behind. If the writer is an io.Closer it is closed after the allocation is deleted
+	RecordingSink func(srcAddr, dstAddr, relayAddr net.Addr) io.Writer
+
+	// RelayReadGoroutines is the number of goroutines reading the relay socket of each
+	// allocation, they share the socket. Values below 1 mean a single reader
+	RelayReadGoroutines int
+
+	// RelayMTU is the largest payload relayed to or from peers, defaults to 1500. Larger
+	// payloads are dropped and reported to OnOversizedPayload, which is optional
+	RelayMTU           int
+	OnOversizedPayload func()
+
+	// OnUnpermittedPayload is optional, it is called for every datagram a relay socket
+	// received from a peer without a permission, which is dropped
+	OnUnpermittedPayload func()
+
+	// MaxBytesPerAllocation caps the payload bytes an allocation relays to and from peers,
+	// counted together. The allocation is deleted with DeletionReasonByteQuota once a payload
+	// would exceed it. Zero means unlimited
+	MaxBytesPerAllocation int64
+
+	// Store is optional, the metadata of the allocations created, refreshed and deleted
+	// is written to it, see Store
+	Store Store
+
+	// PortReuseQuarantine is how long the port of a deleted allocation's relay socket is
+	// not handed out again, sockets AllocatePacketConn binds to it are closed and another
+	// one is bound. Zero disables the quarantine
+	PortReuseQuarantine time.Duration
+
+	// PermissionLifetime is how long a permission lasts unless it is refreshed, defaults to
+	// the 5 minutes of RFC 5766 Section 8
+	PermissionLifetime time.Duration
+
+	// PermissionLimit is optional, it counts and caps the permissions of the allocations
+	// of every Manager it is shared with
+	PermissionLimit *PermissionLimit
 }
 
 type reservation struct {
@@ -31,6 +89,31 @@ type Manager struct {
 
 	allocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error)
 	allocateConn       func(network string, requestedPort int) (net.Conn, net.Addr, error)
+
+	onAllocationCreated func(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{})
+	onAllocationDeleted func(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{}, reason DeletionReason, summary Summary)
+
+	relayPool *relayPool
+
+	expiryJitter float64
+
+	recordingSink func(srcAddr, dstAddr, relayAddr net.Addr) io.Writer
+
+	relayReadGoroutines int
+
+	relayMTU           int
+	onOversizedPayload func()
+
+	onUnpermittedPayload func()
+
+	maxBytesPerAllocation int64
+
+	store Store
+
+	portQuarantine *portQuarantine
+
+	permissionLifetime time.Duration
+	permissionLimit    *PermissionLimit
 }
 
 // NewManager creates a new instance of Manager.
@@ -44,12 +127,38 @@ func NewManager(config ManagerConfig) (*Manager, error) {
 		return nil, fmt.Errorf("LeveledLogger must be set")
 	}
 
-	return &Manager{
-		log:                config.LeveledLogger,
-		allocations:        make(map[string]*Allocation, 64),
-		allocatePacketConn: config.AllocatePacketConn,
-		allocateConn:       config.AllocateConn,
-	}, nil
+	m := &Manager{
+		log:                 config.LeveledLogger,
+		allocations:         make(map[string]*Allocation, 64),
+		allocatePacketConn:  config.AllocatePacketConn,
+		allocateConn:        config.AllocateConn,
+		onAllocationCreated: config.OnAllocationCreated,
+		onAllocationDeleted: config.OnAllocationDeleted,
+		expiryJitter:        config.ExpiryJitter,
+		recordingSink:       config.RecordingSink,
+		relayReadGoroutines: config.RelayReadGoroutines,
+		relayMTU:            config.RelayMTU,
+		onOversizedPayload:  config.OnOversizedPayload,
+
+		onUnpermittedPayload: config.OnUnpermittedPayload,
+
+		maxBytesPerAllocation: config.MaxBytesPerAllocation,
+
+		store: config.Store,
+
+		permissionLifetime: config.PermissionLifetime,
+		permissionLimit:    config.PermissionLimit,
+	}
+
+	if config.PortReuseQuarantine > 0 {
+		m.portQuarantine = newPortQuarantine(config.PortReuseQuarantine)
+	}
+
+	if config.RelayPoolSize > 0 {
+		m.relayPool = newRelayPool(config.RelayPoolSize, config.AllocatePacketConn, config.LeveledLogger)
+	}
+
+	return m, nil
 }
 
 // GetAllocation fetches the allocation matching the passed FiveTuple
@@ -59,21 +168,60 @@ func (m *Manager) GetAllocation(fiveTuple *FiveTuple) *Allocation {
 	return m.allocations[fiveTuple.Fingerprint()]
 }
 
+// Allocations returns the allocations of the Manager
+func (m *Manager) Allocations() []*Allocation {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	allocations := make([]*Allocation, 0, len(m.allocations))
+	for _, a := range m.allocations {
+		allocations = append(allocations, a)
+	}
+	return allocations
+}
+
+// AllocatePacketConn returns the func relays are allocated with when CreateAllocationWithRelay
+// is passed none, the ManagerConfig.AllocatePacketConn or the relay pool in front of it
+func (m *Manager) AllocatePacketConn() func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if m.relayPool != nil {
+		return m.relayPool.get
+	}
+	return m.allocatePacketConn
+}
+
 // Close closes the manager and closes all allocations it manages
 func (m *Manager) Close() error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	for _, a := range m.allocations {
+	if m.relayPool != nil {
+		if err := m.relayPool.close(); err != nil {
+			m.log.Errorf("Failed to close relay pool: %v", err)
+		}
+	}
+
+	for fingerprint, a := range m.allocations {
+		delete(m.allocations, fingerprint)
 		if err := a.Close(); err != nil {
 			return err
 		}
+		m.allocationDeleted(a, DeletionReasonClosed)
 	}
 	return nil
 }
 
 // CreateAllocation creates a new allocation and starts relaying
-func (m *Manager) CreateAllocation(fiveTuple *FiveTuple, turnSocket net.PacketConn, requestedPort int, lifetime time.Duration) (*Allocation, error) {
+func (m *Manager) CreateAllocation(fiveTuple *FiveTuple, turnSocket net.PacketConn, requestedPort int, lifetime time.Duration, addressFamily proto.RequestedAddressFamily) (*Allocation, error) {
+	return m.CreateAllocationWithRelay(fiveTuple, turnSocket, requestedPort, lifetime, addressFamily, nil, nil, "", nil)
+}
+
+// CreateAllocationWithRelay creates a new allocation with its relay allocated by allocatePacketConn
+// instead of ManagerConfig.AllocatePacketConn. A nil allocatePacketConn behaves like CreateAllocation.
+// The allocation is counted in quota until it is deleted, ErrAllocationQuotaReached is returned
+// when quota has no room for it. quota may be nil. username owns the allocation and is written
+// to the Store, see Allocation.Username. context is kept by the allocation, see Allocation.Context
+func (m *Manager) CreateAllocationWithRelay(fiveTuple *FiveTuple, turnSocket net.PacketConn, requestedPort int, lifetime time.Duration, addressFamily proto.RequestedAddressFamily,
+	allocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error), quota *Quota, username string, context interface{}) (_ *Allocation, err error) {
 	switch {
 	case fiveTuple == nil:
 		return nil, fmt.Errorf("allocations must not be created with nil FivTuple")
@@ -90,32 +238,147 @@ func (m *Manager) CreateAllocation(fiveTuple *FiveTuple, turnSocket net.PacketCo
 	if a := m.GetAllocation(fiveTuple); a != nil {
 		return nil, fmt.Errorf("allocation attempt created with duplicate FiveTuple %v", fiveTuple)
 	}
+
+	if !quota.acquire() {
+		return nil, ErrAllocationQuotaReached
+	}
+	defer func() {
+		if err != nil {
+			quota.release()
+		}
+	}()
+
 	a := NewAllocation(turnSocket, fiveTuple, m.log)
+	a.quota = quota
+	a.context = context
+	a.username = username
+	a.store = m.store
+
+	network := "udp4"
+	if addressFamily == proto.RequestedFamilyIPv6 {
+		network = "udp6"
+	}
+
+	if allocatePacketConn == nil {
+		allocatePacketConn = m.AllocatePacketConn()
+	}
 
-	conn, relayAddr, err := m.allocatePacketConn("udp4", requestedPort)
+	conn, relayAddr, err := m.allocateUnquarantined(allocatePacketConn, network, requestedPort)
 	if err != nil {
 		return nil, err
+	} else if conn == nil || relayAddr == nil {
+		m.log.Errorf("Failed to allocate relay for %v: %v", fiveTuple, ErrRelaySocketInvalid)
+		if conn != nil {
+			if closeErr := conn.Close(); closeErr != nil {
+				m.log.Errorf("Failed to close relay socket: %v", closeErr)
+			}
+		}
+		return nil, ErrRelaySocketInvalid
+	}
+
+	// The advertised address may differ from the bound one, e.g. behind a port forward,
+	// but clients must be able to reach it
+	if _, relayPort, err := ipnet.AddrIPPort(relayAddr); err == nil && (relayPort <= 0 || relayPort > 0xFFFF) {
+		m.log.Errorf("Failed to allocate relay for %v: %v %v", fiveTuple, ErrRelaySocketInvalid, relayAddr)
+		if closeErr := conn.Close(); closeErr != nil {
+			m.log.Errorf("Failed to close relay socket: %v", closeErr)
+		}
+		return nil, ErrRelaySocketInvalid
+	}
+
+	// https://tools.ietf.org/html/rfc6156#section-4.2
+	// The relayed transport address MUST be of the family the client asked for
+	if relayIP, _, err := ipnet.AddrIPPort(relayAddr); err == nil && ipnet.AddressFamily(relayIP) != addressFamily {
+		if closeErr := conn.Close(); closeErr != nil {
+			m.log.Errorf("Failed to close relay socket: %v", closeErr)
+		}
+		return nil, ErrAddressFamilyMismatch
 	}
 
 	a.RelaySocket = conn
 	a.RelayAddr = relayAddr
 
-	m.log.Debugf("listening on relay addr: %s", a.RelayAddr.String())
-
-	a.lifetimeTimer = time.AfterFunc(lifetime, func() {
-		m.DeleteAllocation(a.fiveTuple)
+	a.expiryJitter = m.expiryJitter
+	a.onOversizedPayload = m.onOversizedPayload
+	a.onUnpermittedPayload = m.onUnpermittedPayload
+	if m.relayMTU > 0 {
+		a.relayMTU = m.relayMTU
+	}
+	if m.permissionLifetime > 0 {
+		a.permissionLifetime = m.permissionLifetime
+	}
+	a.permissionLimit = m.permissionLimit
+	if m.maxBytesPerAllocation > 0 {
+		a.maxRelayedBytes = uint64(m.maxBytesPerAllocation)
+	}
+	if m.recordingSink != nil {
+		if sink := m.recordingSink(fiveTuple.SrcAddr, fiveTuple.DstAddr, a.RelayAddr); sink != nil {
+			a.recorder = newRecorder(sink, m.log)
+		}
+	}
+	a.lifetimeTimer = time.AfterFunc(addJitter(lifetime, a.expiryJitter), func() {
+		m.deleteIfSame(a, DeletionReasonExpired)
 	})
 
 	m.lock.Lock()
 	m.allocations[fiveTuple.Fingerprint()] = a
 	m.lock.Unlock()
+	quota.created()
+	a.storeRecord(lifetime, false)
 
 	go a.packetHandler(m)
+	for i := 1; i < m.relayReadGoroutines; i++ {
+		go a.packetHandler(m)
+	}
+
+	// The one line operators need to check firewall and NAT rules, both relay addresses
+	// are logged as the advertised one may be forwarded to the bound one
+	m.log.Infof("Created allocation of %v on %v for %q relayed on %v, bound to %v",
+		fiveTuple.SrcAddr, fiveTuple.DstAddr, username, a.RelayAddr, a.RelaySocketAddr())
+
+	if m.onAllocationCreated != nil {
+		m.onAllocationCreated(fiveTuple.SrcAddr, fiveTuple.DstAddr, a.RelayAddr, a.RelaySocketAddr(), a.context)
+	}
 	return a, nil
 }
 
-// DeleteAllocation removes an allocation
-func (m *Manager) DeleteAllocation(fiveTuple *FiveTuple) {
+// allocateUnquarantined allocates a relay with allocatePacketConn whose socket isn't bound to
+// a quarantined port. Sockets bound to one are held until another relay was allocated, so
+// the same port isn't bound again, and closed afterwards
+func (m *Manager) allocateUnquarantined(allocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error),
+	network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if m.portQuarantine == nil {
+		return allocatePacketConn(network, requestedPort)
+	}
+
+	var quarantined []net.PacketConn
+	defer func() {
+		for _, conn := range quarantined {
+			if err := conn.Close(); err != nil {
+				m.log.Errorf("Failed to close relay socket: %v", err)
+			}
+		}
+	}()
+
+	for i := 0; i < maxQuarantineRetries; i++ {
+		conn, relayAddr, err := allocatePacketConn(network, requestedPort)
+		if err != nil || conn == nil || !m.portQuarantine.contains(conn.LocalAddr()) {
+			return conn, relayAddr, err
+		}
+
+		m.log.Debugf("Relay socket bound to quarantined %v, binding another one", conn.LocalAddr())
+		quarantined = append(quarantined, conn)
+
+		// A requested port is bound to the same port every time
+		if requestedPort != 0 {
+			break
+		}
+	}
+	return nil, nil, ErrPortQuarantined
+}
+
+// DeleteAllocation removes an allocation, reason is logged and passed to OnAllocationDeleted
+func (m *Manager) DeleteAllocation(fiveTuple *FiveTuple, reason DeletionReason) {
 	fingerprint := fiveTuple.Fingerprint()
 
 	m.lock.Lock()
@@ -126,10 +389,54 @@ func (m *Manager) DeleteAllocation(fiveTuple *FiveTuple) {
 	if allocation == nil {
 		return
 	}
+	m.closeDeleted(allocation, reason)
+}
+
+// deleteIfSame deletes a unless its 5-tuple belongs to another allocation by now, e.g. the
+// client deleted a and allocated again before the relay of a failed
+func (m *Manager) deleteIfSame(a *Allocation, reason DeletionReason) {
+	fingerprint := a.fiveTuple.Fingerprint()
+
+	m.lock.Lock()
+	if m.allocations[fingerprint] != a {
+		m.lock.Unlock()
+		return
+	}
+	delete(m.allocations, fingerprint)
+	m.lock.Unlock()
 
-	if err := allocation.Close(); err != nil {
+	m.closeDeleted(a, reason)
+}
+
+// closeDeleted closes an allocation that was removed and reports it
+func (m *Manager) closeDeleted(a *Allocation, reason DeletionReason) {
+	// The relay socket of an allocation deleted for a relay error may already be closed
+	if err := a.Close(); err != nil && reason != DeletionReasonRelayError {
 		m.log.Errorf("Failed to close allocation: %v", err)
 	}
+	m.allocationDeleted(a, reason)
+}
+
+// allocationDeleted reports an allocation that was removed and closed
+func (m *Manager) allocationDeleted(a *Allocation, reason DeletionReason) {
+	summary := a.Summary()
+	m.log.Infof("Deleted allocation of %v relayed on %v: %s, summary: duration=%v bytes_to_peers=%d bytes_from_peers=%d peak_permissions=%d",
+		a.fiveTuple.SrcAddr, a.RelayAddr, reason, summary.Duration, summary.BytesToPeers, summary.BytesFromPeers, summary.PeakPermissions)
+	a.quota.release()
+
+	if m.portQuarantine != nil && a.RelaySocket != nil {
+		m.portQuarantine.add(a.RelaySocket.LocalAddr())
+	}
+
+	if m.store != nil {
+		if err := m.store.Delete(*a.fiveTuple); err != nil {
+			m.log.Warnf("Failed to delete allocation of %v from store: %v", a.fiveTuple.SrcAddr, err)
+		}
+	}
+
+	if m.onAllocationDeleted != nil {
+		m.onAllocationDeleted(a.fiveTuple.SrcAddr, a.fiveTuple.DstAddr, a.RelayAddr, a.RelaySocketAddr(), a.context, reason, summary)
+	}
 }
 
 // CreateReservation stores the reservation for the token+port
@@ -173,14 +480,14 @@ func (m *Manager) GetRandomEvenPort() (int, error) {
 		return 0, err
 	}
 
-	udpAddr, ok := addr.(*net.UDPAddr)
-	if !ok {
-		return 0, fmt.Errorf("failed to cast net.Addr to *net.UDPAddr")
+	_, port, err := ipnet.AddrIPPort(addr)
+	if err != nil {
+		return 0, err
 	} else if err := conn.Close(); err != nil {
 		return 0, err
-	} else if udpAddr.Port%2 == 1 {
+	} else if port%2 == 1 {
 		return m.GetRandomEvenPort()
 	}
 
-	return udpAddr.Port, nil
+	return port, nil
 }
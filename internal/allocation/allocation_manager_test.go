@@ -3,14 +3,19 @@
 package allocation
 
 import (
+	"errors"
 	"io"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/pion/turn/v2/internal/proto"
 	"github.com/stretchr/testify/assert"
 )
@@ -26,6 +31,16 @@ func TestManager(t *testing.T) {
 		{"DeleteAllocation", subTestDeleteAllocation},
 		{"AllocationTimeout", subTestAllocationTimeout},
 		{"Close", subTestManagerClose},
+		{"RelayPool", subTestRelayPool},
+		{"RecordingSink", subTestRecordingSink},
+		{"RelayReadGoroutines", subTestRelayReadGoroutines},
+		{"DeletionReason", subTestDeletionReason},
+		{"RelayErrorAfterReallocation", subTestRelayErrorAfterReallocation},
+		{"ByteQuota", subTestByteQuota},
+		{"Quota", subTestQuota},
+		{"UnpermittedPayload", subTestUnpermittedPayload},
+		{"Store", subTestStore},
+		{"PortQuarantine", subTestPortQuarantine},
 	}
 
 	network := "udp4"
@@ -47,13 +62,13 @@ func subTestCreateInvalidAllocation(t *testing.T, turnSocket net.PacketConn) {
 	m, err := newTestManager()
 	assert.NoError(t, err)
 
-	if a, err := m.CreateAllocation(nil, turnSocket, 0, proto.DefaultLifetime); a != nil || err == nil {
+	if a, err := m.CreateAllocation(nil, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4); a != nil || err == nil {
 		t.Errorf("Illegally created allocation with nil FiveTuple")
 	}
-	if a, err := m.CreateAllocation(randomFiveTuple(), nil, 0, proto.DefaultLifetime); a != nil || err == nil {
+	if a, err := m.CreateAllocation(randomFiveTuple(), nil, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4); a != nil || err == nil {
 		t.Errorf("Illegally created allocation with nil turnSocket")
 	}
-	if a, err := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, 0); a != nil || err == nil {
+	if a, err := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, 0, proto.RequestedFamilyIPv4); a != nil || err == nil {
 		t.Errorf("Illegally created allocation with 0 lifetime")
 	}
 }
@@ -64,7 +79,7 @@ func subTestCreateAllocation(t *testing.T, turnSocket net.PacketConn) {
 	assert.NoError(t, err)
 
 	fiveTuple := randomFiveTuple()
-	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime); a == nil || err != nil {
+	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4); a == nil || err != nil {
 		t.Errorf("Failed to create allocation %v %v", a, err)
 	}
 
@@ -79,11 +94,11 @@ func subTestCreateAllocationDuplicateFiveTuple(t *testing.T, turnSocket net.Pack
 	assert.NoError(t, err)
 
 	fiveTuple := randomFiveTuple()
-	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime); a == nil || err != nil {
+	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4); a == nil || err != nil {
 		t.Errorf("Failed to create allocation %v %v", a, err)
 	}
 
-	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime); a != nil || err == nil {
+	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4); a != nil || err == nil {
 		t.Errorf("Was able to create allocation with same FiveTuple twice")
 	}
 }
@@ -93,7 +108,7 @@ func subTestDeleteAllocation(t *testing.T, turnSocket net.PacketConn) {
 	assert.NoError(t, err)
 
 	fiveTuple := randomFiveTuple()
-	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime); a == nil || err != nil {
+	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4); a == nil || err != nil {
 		t.Errorf("Failed to create allocation %v %v", a, err)
 	}
 
@@ -101,7 +116,7 @@ func subTestDeleteAllocation(t *testing.T, turnSocket net.PacketConn) {
 		t.Errorf("Failed to get allocation right after creation")
 	}
 
-	m.DeleteAllocation(fiveTuple)
+	m.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
 	if a := m.GetAllocation(fiveTuple); a != nil {
 		t.Errorf("Get allocation with %v should be nil after delete", fiveTuple)
 	}
@@ -118,7 +133,7 @@ func subTestAllocationTimeout(t *testing.T, turnSocket net.PacketConn) {
 	for index := range allocations {
 		fiveTuple := randomFiveTuple()
 
-		a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, lifetime)
+		a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, lifetime, proto.RequestedFamilyIPv4)
 		if err != nil {
 			t.Errorf("Failed to create allocation with %v", fiveTuple)
 		}
@@ -135,6 +150,238 @@ func subTestAllocationTimeout(t *testing.T, turnSocket net.PacketConn) {
 	}
 }
 
+// test that every deletion is reported once, with the reason of the deletion
+func subTestDeletionReason(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+
+	reasons := make(chan DeletionReason, 4)
+	m.onAllocationDeleted = func(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{}, reason DeletionReason, summary Summary) {
+		reasons <- reason
+	}
+
+	_, err = m.CreateAllocation(randomFiveTuple(), turnSocket, 0, 100*time.Millisecond, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	assert.Equal(t, DeletionReasonExpired, <-reasons)
+
+	fiveTuple := randomFiveTuple()
+	_, err = m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	m.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
+	assert.Equal(t, DeletionReasonDeallocated, <-reasons)
+
+	// The relay socket failing deletes the allocation
+	a, err := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	assert.NoError(t, a.RelaySocket.Close())
+	assert.Equal(t, DeletionReasonRelayError, <-reasons)
+
+	_, err = m.CreateAllocation(randomFiveTuple(), turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Close())
+	assert.Equal(t, DeletionReasonClosed, <-reasons)
+
+	// The relay sockets closed by the deletions don't report them again
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, reasons)
+	assert.Equal(t, "Unknown", DeletionReason(0).String())
+}
+
+// lateFailingConn is a relay socket whose reads fail once fail is closed, rather than when
+// it is closed, like a relay the failure of which is noticed late
+type lateFailingConn struct {
+	net.PacketConn
+	fail chan struct{}
+}
+
+func (c *lateFailingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	<-c.fail
+	return 0, nil, errors.New("relay failed")
+}
+
+// test that the relay of a deleted allocation failing doesn't delete the allocation that
+// replaced it on the same 5-tuple
+func subTestRelayErrorAfterReallocation(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+
+	reasons := make(chan DeletionReason, 4)
+	m.onAllocationDeleted = func(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{}, reason DeletionReason, summary Summary) {
+		reasons <- reason
+	}
+
+	relay, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	failing := &lateFailingConn{PacketConn: relay, fail: make(chan struct{})}
+
+	fiveTuple := randomFiveTuple()
+	_, err = m.CreateAllocationWithRelay(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4,
+		func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			return failing, relay.LocalAddr(), nil
+		}, nil, "", nil)
+	assert.NoError(t, err)
+	m.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
+	assert.Equal(t, DeletionReasonDeallocated, <-reasons)
+
+	reallocated, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+
+	// The old relay fails once the client allocated again
+	close(failing.fail)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, reallocated, m.GetAllocation(fiveTuple))
+	assert.Empty(t, reasons)
+
+	assert.NoError(t, m.Close())
+	assert.Equal(t, DeletionReasonClosed, <-reasons)
+}
+
+func subTestByteQuota(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+	m.maxBytesPerAllocation = 10
+
+	reasons := make(chan DeletionReason, 2)
+	m.onAllocationDeleted = func(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{}, reason DeletionReason, summary Summary) {
+		reasons <- reason
+	}
+
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	fiveTuple := &FiveTuple{SrcAddr: clientConn.LocalAddr(), DstAddr: turnSocket.LocalAddr(), Protocol: UDP}
+	a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	a.AddPermission(NewPermission(peerConn.LocalAddr(), m.log))
+
+	// Both directions count against the quota, up to the quota is relayed
+	assert.NoError(t, a.WriteToPeer([]byte("Hello"), peerConn.LocalAddr()))
+	relayAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.RelaySocketAddr().(*net.UDPAddr).Port}
+	_, err = peerConn.WriteTo([]byte("World"), relayAddr)
+	assert.NoError(t, err)
+
+	buf := make([]byte, rtpMTU)
+	assert.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = clientConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), a.RelayedBytes())
+
+	// The client going past the quota is refused
+	assert.True(t, errors.Is(a.WriteToPeer([]byte("!"), peerConn.LocalAddr()), ErrByteQuotaExceeded))
+
+	// The peer going past the quota deletes the allocation
+	_, err = peerConn.WriteTo([]byte("!"), relayAddr)
+	assert.NoError(t, err)
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, DeletionReasonByteQuota, reason)
+		assert.Equal(t, "ByteQuota", reason.String())
+	case <-time.After(time.Second):
+		t.Fatal("allocation past its byte quota was not deleted")
+	}
+	assert.Nil(t, m.GetAllocation(fiveTuple))
+
+	assert.NoError(t, clientConn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, m.Close())
+}
+
+func subTestQuota(t *testing.T, turnSocket net.PacketConn) {
+	// The Quota is shared by the allocations of both Managers
+	quota := &Quota{MaxAllocations: 2, MaxRelayedBytes: 8}
+	m1, err := newTestManager()
+	assert.NoError(t, err)
+	m2, err := newTestManager()
+	assert.NoError(t, err)
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	a1, err := m1.CreateAllocationWithRelay(randomFiveTuple(), turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4, nil, quota, "", nil)
+	assert.NoError(t, err)
+	fiveTuple := randomFiveTuple()
+	a2, err := m2.CreateAllocationWithRelay(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4, nil, quota, "", nil)
+	assert.NoError(t, err)
+
+	_, err = m1.CreateAllocationWithRelay(randomFiveTuple(), turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4, nil, quota, "", nil)
+	assert.Equal(t, ErrAllocationQuotaReached, err)
+	assert.Equal(t, int64(2), quota.Allocations())
+
+	// Allocations without a Quota aren't capped by it
+	_, err = m1.CreateAllocation(randomFiveTuple(), turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+
+	// The bytes of both allocations count against the Quota
+	assert.NoError(t, a1.WriteToPeer([]byte("Hello"), peerConn.LocalAddr()))
+	assert.True(t, errors.Is(a2.WriteToPeer([]byte("World"), peerConn.LocalAddr()), ErrByteQuotaExceeded))
+	assert.Equal(t, uint64(10), quota.RelayedBytes())
+	assert.Equal(t, uint64(5), a1.RelayedBytes())
+
+	// A deleted allocation makes room for a new one
+	m2.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
+	assert.Equal(t, int64(1), quota.Allocations())
+	_, err = m2.CreateAllocationWithRelay(randomFiveTuple(), turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4, nil, quota, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), quota.AllocationsCreated())
+
+	assert.NoError(t, m1.Close())
+	assert.NoError(t, m2.Close())
+	assert.Equal(t, int64(0), quota.Allocations())
+	assert.NoError(t, peerConn.Close())
+}
+
+func subTestUnpermittedPayload(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+	m.maxBytesPerAllocation = 5
+	unpermitted := make(chan struct{}, 1)
+	m.onUnpermittedPayload = func() {
+		unpermitted <- struct{}{}
+	}
+
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	// Permissions are installed by IP, the other peer needs an address of its own
+	spoofedConn, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	assert.NoError(t, err)
+
+	fiveTuple := &FiveTuple{SrcAddr: clientConn.LocalAddr(), DstAddr: turnSocket.LocalAddr(), Protocol: UDP}
+	a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	a.AddPermission(NewPermission(peerConn.LocalAddr(), m.log))
+	relayAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.RelaySocketAddr().(*net.UDPAddr).Port}
+
+	// A peer without a permission is dropped, its payload doesn't count against the quota
+	_, err = spoofedConn.WriteTo([]byte("Spoof"), relayAddr)
+	assert.NoError(t, err)
+	select {
+	case <-unpermitted:
+	case <-time.After(time.Second):
+		t.Fatal("payload of a peer without a permission was not dropped")
+	}
+	assert.Equal(t, uint64(1), a.UnpermittedPayloads())
+	assert.Equal(t, uint64(0), a.RelayedBytes())
+
+	// The permitted peer is still relayed within the quota
+	_, err = peerConn.WriteTo([]byte("Hello"), relayAddr)
+	assert.NoError(t, err)
+	buf := make([]byte, rtpMTU)
+	assert.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = clientConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), a.RelayedBytes())
+	assert.Equal(t, uint64(1), a.UnpermittedPayloads())
+
+	assert.NoError(t, clientConn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, spoofedConn.Close())
+	assert.NoError(t, m.Close())
+}
+
 // test for manager close
 func subTestManagerClose(t *testing.T, turnSocket net.PacketConn) {
 	m, err := newTestManager()
@@ -142,9 +389,9 @@ func subTestManagerClose(t *testing.T, turnSocket net.PacketConn) {
 
 	allocations := make([]*Allocation, 2)
 
-	a1, _ := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, time.Second)
+	a1, _ := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, time.Second, proto.RequestedFamilyIPv4)
 	allocations[0] = a1
-	a2, _ := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, time.Minute)
+	a2, _ := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, time.Minute, proto.RequestedFamilyIPv4)
 	allocations[1] = a2
 
 	// make a1 timeout
@@ -161,6 +408,90 @@ func subTestManagerClose(t *testing.T, turnSocket net.PacketConn) {
 	}
 }
 
+// test that allocations are served from the pre-bound relays and the pool is drained on close
+func subTestRelayPool(t *testing.T, turnSocket net.PacketConn) {
+	var lock sync.Mutex
+	var bound []net.PacketConn
+
+	m, err := NewManager(ManagerConfig{
+		LeveledLogger: logging.NewDefaultLoggerFactory().NewLogger("test"),
+		AllocatePacketConn: func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				return nil, nil, err
+			}
+
+			lock.Lock()
+			bound = append(bound, conn)
+			lock.Unlock()
+			return conn, conn.LocalAddr(), nil
+		},
+		AllocateConn:  func(network string, requestedPort int) (net.Conn, net.Addr, error) { return nil, nil, nil },
+		RelayPoolSize: 2,
+	})
+	assert.NoError(t, err)
+
+	// wait for the pool to be filled
+	assert.Eventually(t, func() bool {
+		return len(m.relayPool.relays) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	lock.Lock()
+	pooled := append([]net.PacketConn{}, bound...)
+	lock.Unlock()
+
+	a, err := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	assert.Contains(t, pooled, a.RelaySocket, "allocation should use a pre-bound relay")
+
+	// the pool is refilled in the background
+	assert.Eventually(t, func() bool {
+		return len(m.relayPool.relays) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, m.Close())
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 3, len(bound))
+	for _, conn := range bound {
+		assert.True(t, isClose(conn), "pooled relays should be closed")
+	}
+}
+
+func benchmarkCreateAllocation(b *testing.B, relayPoolSize int) {
+	turnSocket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(b, err)
+
+	m, err := newTestManagerWithPool(relayPoolSize)
+	assert.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fiveTuple := randomFiveTuple()
+		if _, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		m.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
+		b.StartTimer()
+	}
+	b.StopTimer()
+
+	assert.NoError(b, m.Close())
+	assert.NoError(b, turnSocket.Close())
+}
+
+func BenchmarkCreateAllocation(b *testing.B) {
+	b.Run("NoPool", func(b *testing.B) {
+		benchmarkCreateAllocation(b, 0)
+	})
+	b.Run("Pool", func(b *testing.B) {
+		benchmarkCreateAllocation(b, 16)
+	})
+}
+
 func randomFiveTuple() *FiveTuple {
 	/* #nosec */
 	return &FiveTuple{
@@ -169,7 +500,330 @@ func randomFiveTuple() *FiveTuple {
 	}
 }
 
+// test that relayed payloads are copied to the RecordingSink in both directions
+func subTestRecordingSink(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+
+	sink := newTestSink()
+	m.recordingSink = func(srcAddr, dstAddr, relayAddr net.Addr) io.Writer {
+		return sink
+	}
+
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	fiveTuple := &FiveTuple{SrcAddr: clientConn.LocalAddr(), DstAddr: turnSocket.LocalAddr(), Protocol: UDP}
+	a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	a.AddPermission(NewPermission(peerConn.LocalAddr(), m.log))
+
+	buf := make([]byte, rtpMTU)
+	assert.NoError(t, a.WriteToPeer([]byte("ping"), peerConn.LocalAddr()))
+	_, _, err = peerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	relayAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.RelaySocketAddr().(*net.UDPAddr).Port}
+	_, err = peerConn.WriteTo([]byte("pong"), relayAddr)
+	assert.NoError(t, err)
+	_, _, err = clientConn.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	// The sink is closed once the allocation is deleted
+	m.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
+	<-sink.closed
+
+	for _, expected := range []struct {
+		direction byte
+		data      string
+	}{
+		{DirectionToPeer, "ping"},
+		{DirectionToClient, "pong"},
+	} {
+		direction, _, peer, data, err := ReadRecord(&sink.buf)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.direction, direction)
+		assert.Equal(t, peerConn.LocalAddr().String(), peer)
+		assert.Equal(t, expected.data, string(data))
+	}
+	assert.Equal(t, uint64(0), a.RecordsDropped())
+
+	assert.NoError(t, clientConn.Close())
+	assert.NoError(t, peerConn.Close())
+}
+
+// test that an allocation read by several goroutines relays everything and is deleted once
+func subTestRelayReadGoroutines(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+	m.relayReadGoroutines = 4
+
+	var deleted int32
+	m.onAllocationDeleted = func(srcAddr, dstAddr, relayAddr, relaySocketAddr net.Addr, context interface{}, reason DeletionReason, summary Summary) {
+		atomic.AddInt32(&deleted, 1)
+	}
+
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	fiveTuple := &FiveTuple{SrcAddr: clientConn.LocalAddr(), DstAddr: turnSocket.LocalAddr(), Protocol: UDP}
+	a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	a.AddPermission(NewPermission(peerConn.LocalAddr(), m.log))
+
+	relayAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.RelaySocketAddr().(*net.UDPAddr).Port}
+	received := map[string]bool{}
+	buf := make([]byte, rtpMTU)
+	for i := 0; i < 16; i++ {
+		_, err = peerConn.WriteTo([]byte{byte(i)}, relayAddr)
+		assert.NoError(t, err)
+
+		assert.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, readErr := clientConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+
+		msg := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		assert.NoError(t, msg.Decode())
+		var data proto.Data
+		assert.NoError(t, data.GetFrom(msg))
+		received[string(data)] = true
+	}
+	assert.Len(t, received, 16)
+
+	// Every reader sees the relay socket close, the allocation is only deleted once
+	m.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deleted))
+
+	assert.NoError(t, m.Close())
+	assert.NoError(t, clientConn.Close())
+	assert.NoError(t, peerConn.Close())
+}
+
+// benchmarkRelayReadGoroutines relays b.N Data indications from several peers to the client.
+// Peers send in bursts and wait for the client to receive them, blasting datagrams would only
+// measure how many the socket buffers drop
+func benchmarkRelayReadGoroutines(b *testing.B, readers int) {
+	const (
+		peers       = 4
+		burst       = 32
+		payloadSize = 1200
+	)
+
+	m, err := newTestManager()
+	assert.NoError(b, err)
+	m.relayReadGoroutines = readers
+
+	turnSocket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(b, err)
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(b, err)
+
+	fiveTuple := &FiveTuple{SrcAddr: clientConn.LocalAddr(), DstAddr: turnSocket.LocalAddr(), Protocol: UDP}
+	a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
+	assert.NoError(b, err)
+	relayAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.RelaySocketAddr().(*net.UDPAddr).Port}
+
+	peerConns := make([]net.PacketConn, peers)
+	acks := make([]chan struct{}, peers)
+	for i := range peerConns {
+		peerConns[i], err = net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(b, err)
+		a.AddPermission(NewPermission(peerConns[i].LocalAddr(), m.log))
+		acks[i] = make(chan struct{}, burst)
+	}
+
+	// The payload is the last attribute of the Data indication, its first byte is the peer
+	var received uint64
+	go func() {
+		buf := make([]byte, rtpMTU)
+		for {
+			n, _, err := clientConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < payloadSize {
+				continue
+			}
+			atomic.AddUint64(&received, 1)
+			select {
+			case acks[buf[n-payloadSize]] <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	b.SetBytes(payloadSize)
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for i := range peerConns {
+		wg.Add(1)
+		go func(peer int, n int) {
+			defer wg.Done()
+
+			payload := make([]byte, payloadSize)
+			payload[0] = byte(peer)
+			for n > 0 {
+				k := burst
+				if n < k {
+					k = n
+				}
+				n -= k
+
+				for j := 0; j < k; j++ {
+					if _, err := peerConns[peer].WriteTo(payload, relayAddr); err != nil {
+						return
+					}
+				}
+				for j := 0; j < k; j++ {
+					select {
+					case <-acks[peer]:
+					case <-time.After(10 * time.Millisecond):
+						j = k // the rest of the burst was dropped
+					}
+				}
+			}
+		}(i, b.N/peers+1)
+	}
+	wg.Wait()
+
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadUint64(&received))/float64(peers*(b.N/peers+1)), "delivered")
+
+	assert.NoError(b, m.Close())
+	for _, conn := range peerConns {
+		assert.NoError(b, conn.Close())
+	}
+	assert.NoError(b, clientConn.Close())
+	assert.NoError(b, turnSocket.Close())
+}
+
+func BenchmarkRelayReadGoroutines(b *testing.B) {
+	for _, readers := range []int{1, 2, 4, 8} {
+		readers := readers
+		b.Run(strconv.Itoa(readers), func(b *testing.B) {
+			benchmarkRelayReadGoroutines(b, readers)
+		})
+	}
+}
+
+// testStore is a Store that records the operations written to it
+type testStore struct {
+	lock       sync.Mutex
+	operations []string
+	records    []Record
+	err        error
+}
+
+func (s *testStore) write(operation string, r Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.operations = append(s.operations, operation)
+	s.records = append(s.records, r)
+	return s.err
+}
+
+func (s *testStore) Create(r Record) error { return s.write("Create", r) }
+
+func (s *testStore) Update(r Record) error { return s.write("Update", r) }
+
+func (s *testStore) Delete(fiveTuple FiveTuple) error {
+	return s.write("Delete", Record{FiveTuple: fiveTuple})
+}
+
+func subTestStore(t *testing.T, turnSocket net.PacketConn) {
+	for _, storeErr := range []error{nil, errors.New("store failed")} {
+		store := &testStore{err: storeErr}
+		m, err := newTestManager()
+		assert.NoError(t, err)
+		m.store = store
+
+		fiveTuple := randomFiveTuple()
+		a, err := m.CreateAllocationWithRelay(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4, nil, nil, "user", nil)
+		assert.NoError(t, err)
+		assert.NoError(t, a.Refresh(time.Minute))
+
+		// A failing Store doesn't affect the allocation
+		assert.NotNil(t, m.GetAllocation(fiveTuple))
+		m.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
+
+		assert.Equal(t, []string{"Create", "Update", "Delete"}, store.operations)
+		assert.True(t, fiveTuple.Equal(&store.records[0].FiveTuple))
+		assert.Equal(t, "user", store.records[0].Username)
+		assert.Equal(t, a.RelayAddr, store.records[0].RelayAddr)
+		assert.Equal(t, proto.DefaultLifetime, store.records[0].Lifetime)
+		assert.Equal(t, time.Minute, store.records[1].Lifetime)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), store.records[1].ExpiresAt, time.Second)
+		assert.True(t, fiveTuple.Equal(&store.records[2].FiveTuple))
+
+		assert.NoError(t, m.Close())
+	}
+}
+
+func subTestPortQuarantine(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+	m.portQuarantine = newPortQuarantine(200 * time.Millisecond)
+
+	// The relay is bound to the port that was freed last whenever it is available,
+	// like an OS handing out the same ephemeral port again
+	var freedPort int32
+	allocatePacketConn := func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+		if port := atomic.LoadInt32(&freedPort); port != 0 || requestedPort != 0 {
+			if requestedPort != 0 {
+				port = int32(requestedPort)
+			}
+			if conn, listenErr := net.ListenPacket("udp4", "127.0.0.1:"+strconv.Itoa(int(port))); listenErr == nil {
+				return conn, conn.LocalAddr(), nil
+			}
+		}
+		conn, listenErr := net.ListenPacket("udp4", "127.0.0.1:0")
+		if listenErr != nil {
+			return nil, nil, listenErr
+		}
+		return conn, conn.LocalAddr(), nil
+	}
+	allocate := func() (*FiveTuple, int) {
+		fiveTuple := randomFiveTuple()
+		a, allocErr := m.CreateAllocationWithRelay(fiveTuple, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4, allocatePacketConn, nil, "", nil)
+		assert.NoError(t, allocErr)
+		return fiveTuple, a.RelayAddr.(*net.UDPAddr).Port
+	}
+
+	fiveTuple, port := allocate()
+	m.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
+	atomic.StoreInt32(&freedPort, int32(port))
+
+	// The freed port isn't reallocated during the quarantine, the socket bound to it is closed
+	fiveTuple, otherPort := allocate()
+	assert.NotEqual(t, port, otherPort)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:"+strconv.Itoa(port))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	// A requested port that is quarantined can't be allocated
+	m.DeleteAllocation(fiveTuple, DeletionReasonDeallocated)
+	_, err = m.CreateAllocationWithRelay(randomFiveTuple(), turnSocket, otherPort, proto.DefaultLifetime, proto.RequestedFamilyIPv4, allocatePacketConn, nil, "", nil)
+	assert.Equal(t, ErrPortQuarantined, err)
+
+	// Once the quarantine elapsed the port is handed out again
+	time.Sleep(200 * time.Millisecond)
+	_, port2 := allocate()
+	assert.Equal(t, port, port2)
+
+	assert.NoError(t, m.Close())
+}
+
 func newTestManager() (*Manager, error) {
+	return newTestManagerWithPool(0)
+}
+
+func newTestManagerWithPool(relayPoolSize int) (*Manager, error) {
 	loggerFactory := logging.NewDefaultLoggerFactory()
 
 	config := ManagerConfig{
@@ -182,7 +836,8 @@ func newTestManager() (*Manager, error) {
 
 			return conn, conn.LocalAddr(), nil
 		},
-		AllocateConn: func(network string, requestedPort int) (net.Conn, net.Addr, error) { return nil, nil, nil },
+		AllocateConn:  func(network string, requestedPort int) (net.Conn, net.Addr, error) { return nil, nil, nil },
+		RelayPoolSize: relayPoolSize,
 	}
 	return NewManager(config)
 }
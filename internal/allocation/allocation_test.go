@@ -3,12 +3,16 @@
 package allocation
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/pion/turn/v2/internal/ipnet"
 	"github.com/pion/turn/v2/internal/proto"
@@ -24,12 +28,14 @@ func TestAllocation(t *testing.T) {
 		{"AddPermission", subTestAddPermission},
 		{"RemovePermission", subTestRemovePermission},
 		{"AddChannelBind", subTestAddChannelBind},
+		{"RefreshChannelBind", subTestRefreshChannelBind},
 		{"GetChannelByNumber", subTestGetChannelByNumber},
 		{"GetChannelByAddr", subTestGetChannelByAddr},
 		{"RemoveChannelBind", subTestRemoveChannelBind},
 		{"Refresh", subTestAllocationRefresh},
 		{"Close", subTestAllocationClose},
 		{"packetHandler", subTestPacketHandler},
+		{"WriteToPeer", subTestWriteToPeer},
 	}
 
 	for _, tc := range tt {
@@ -117,12 +123,57 @@ func subTestAddChannelBind(t *testing.T) {
 
 	c2 := NewChannelBind(proto.MinChannelNumber+1, addr, nil)
 	err = a.AddChannelBind(c2, proto.DefaultLifetime)
-	assert.NotNil(t, err, "should failed with conflicted peer address")
+	assert.True(t, errors.Is(err, ErrChannelPeerInUse), "should fail with conflicted peer address: %v", err)
 
 	addr2, _ := net.ResolveUDPAddr("udp", "127.0.0.1:3479")
 	c3 := NewChannelBind(proto.MinChannelNumber, addr2, nil)
 	err = a.AddChannelBind(c3, proto.DefaultLifetime)
-	assert.NotNil(t, err, "should fail with conflicted number.")
+	assert.True(t, errors.Is(err, ErrChannelNumberInUse), "should fail with conflicted number: %v", err)
+
+	// Binding a channel bound to one peer to another that is bound to another channel
+	c4 := NewChannelBind(proto.MinChannelNumber+1, addr2, nil)
+	assert.NoError(t, a.AddChannelBind(c4, proto.DefaultLifetime))
+	err = a.AddChannelBind(NewChannelBind(proto.MinChannelNumber, addr2, nil), proto.DefaultLifetime)
+	assert.True(t, errors.Is(err, ErrChannelNumberInUse), "should fail with conflicted number: %v", err)
+
+	// The failed binds left the bindings alone
+	assert.Equal(t, c, a.GetChannelByNumber(proto.MinChannelNumber))
+	assert.Equal(t, c4, a.GetChannelByNumber(proto.MinChannelNumber+1))
+}
+
+func subTestRefreshChannelBind(t *testing.T) {
+	log := logging.NewDefaultLoggerFactory().NewLogger("test")
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:3478")
+
+	t.Run("Refresh", func(t *testing.T) {
+		a := NewAllocation(nil, nil, log)
+		c := NewChannelBind(proto.MinChannelNumber, addr, log)
+		assert.NoError(t, a.AddChannelBind(c, 200*time.Millisecond))
+
+		// Binding the same channel to the same peer restarts the lifetime of the binding
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, a.AddChannelBind(NewChannelBind(proto.MinChannelNumber, addr, log), time.Minute))
+		time.Sleep(300 * time.Millisecond)
+		assert.Equal(t, c, a.GetChannelByNumber(proto.MinChannelNumber))
+	})
+
+	t.Run("NearExpiry", func(t *testing.T) {
+		a := NewAllocation(nil, nil, log)
+		c := NewChannelBind(proto.MinChannelNumber, addr, log)
+		assert.NoError(t, a.AddChannelBind(c, 10*time.Millisecond))
+
+		// The lifetime runs out while the binding can't be removed yet, the bind
+		// racing the removal must not be undone by it
+		a.channelBindingsLock.Lock()
+		time.Sleep(100 * time.Millisecond)
+		a.channelBindingsLock.Unlock()
+
+		c2 := NewChannelBind(proto.MinChannelNumber, addr, log)
+		assert.NoError(t, a.AddChannelBind(c2, time.Minute))
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, c2, a.GetChannelByNumber(proto.MinChannelNumber))
+		assert.Equal(t, c2, a.GetChannelByAddr(addr))
+	})
 }
 
 func subTestGetChannelByNumber(t *testing.T) {
@@ -181,11 +232,15 @@ func subTestAllocationRefresh(t *testing.T) {
 	a.lifetimeTimer = time.AfterFunc(proto.DefaultLifetime, func() {
 		wg.Done()
 	})
-	a.Refresh(0)
+	assert.NoError(t, a.Refresh(0))
 	wg.Wait()
 
 	// lifetimeTimer has expired
 	assert.False(t, a.lifetimeTimer.Stop())
+
+	// refreshing after expiry must not re-arm the timer
+	assert.Equal(t, ErrAllocationExpired, a.Refresh(proto.DefaultLifetime))
+	assert.False(t, a.lifetimeTimer.Stop())
 }
 
 func subTestAllocationClose(t *testing.T) {
@@ -248,7 +303,7 @@ func subTestPacketHandler(t *testing.T) {
 	a, err := m.CreateAllocation(&FiveTuple{
 		SrcAddr: clientListener.LocalAddr(),
 		DstAddr: turnSocket.LocalAddr(),
-	}, turnSocket, 0, proto.DefaultLifetime)
+	}, turnSocket, 0, proto.DefaultLifetime, proto.RequestedFamilyIPv4)
 
 	assert.Nil(t, err, "should succeed")
 
@@ -311,3 +366,66 @@ func subTestPacketHandler(t *testing.T) {
 	_ = peerListener1.Close()
 	_ = peerListener2.Close()
 }
+
+// writeErrorConn is a net.PacketConn whose WriteTo fails with err
+type writeErrorConn struct {
+	net.PacketConn
+	err error
+}
+
+func (c *writeErrorConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.err != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: os.NewSyscallError("sendto", c.err)}
+	}
+	return len(p), nil
+}
+
+func subTestWriteToPeer(t *testing.T) {
+	conn := &writeErrorConn{}
+	a := NewAllocation(nil, nil, logging.NewDefaultLoggerFactory().NewLogger("test"))
+	a.RelaySocket = conn
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	assert.NoError(t, a.WriteToPeer([]byte("Hello"), peer))
+	assert.Equal(t, uint64(0), a.RelayWriteErrors())
+
+	// ENOBUFS is counted and dropped
+	conn.err = syscall.ENOBUFS
+	for i := 0; i < maxConsecutiveRelayWriteErrors*2; i++ {
+		assert.NoError(t, a.WriteToPeer([]byte("Hello"), peer))
+	}
+	assert.Equal(t, uint64(maxConsecutiveRelayWriteErrors*2), a.RelayWriteErrors())
+
+	// EMSGSIZE is surfaced
+	conn.err = syscall.EMSGSIZE
+	err := a.WriteToPeer([]byte("Hello"), peer)
+	assert.True(t, errors.Is(err, ErrPacketTooLarge), "unexpected error: %v", err)
+
+	// Other errors fail the relay socket once they happen too often in a row
+	conn.err = syscall.ENETUNREACH
+	for i := 0; i < maxConsecutiveRelayWriteErrors-1; i++ {
+		err = a.WriteToPeer([]byte("Hello"), peer)
+		assert.Error(t, err)
+		assert.False(t, errors.Is(err, ErrRelaySocketFailing))
+	}
+
+	// A successful write resets the count
+	conn.err = nil
+	assert.NoError(t, a.WriteToPeer([]byte("Hello"), peer))
+
+	conn.err = syscall.ENETUNREACH
+	for i := 0; i < maxConsecutiveRelayWriteErrors-1; i++ {
+		assert.False(t, errors.Is(a.WriteToPeer([]byte("Hello"), peer), ErrRelaySocketFailing))
+	}
+	err = a.WriteToPeer([]byte("Hello"), peer)
+	assert.True(t, errors.Is(err, ErrRelaySocketFailing), "unexpected error: %v", err)
+	assert.Equal(t, uint64(maxConsecutiveRelayWriteErrors*4), a.RelayWriteErrors())
+
+	// Payloads up to the relay MTU are written, larger ones are dropped before the socket
+	conn.err = nil
+	assert.NoError(t, a.WriteToPeer(make([]byte, rtpMTU), peer))
+	err = a.WriteToPeer(make([]byte, rtpMTU+1), peer)
+	assert.True(t, errors.Is(err, ErrPacketTooLarge), "unexpected error: %v", err)
+	assert.Equal(t, uint64(1), a.OversizedPayloads())
+	assert.Equal(t, uint64(maxConsecutiveRelayWriteErrors*4), a.RelayWriteErrors())
+}
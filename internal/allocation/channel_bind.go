@@ -17,6 +17,9 @@ type ChannelBind struct {
 	allocation    *Allocation
 	lifetimeTimer *time.Timer
 	log           logging.LeveledLogger
+
+	// expiresAt is when the lifetime runs out, guarded by the channelBindingsLock of allocation
+	expiresAt time.Time
 }
 
 // NewChannelBind creates a new ChannelBind
@@ -29,15 +32,22 @@ func NewChannelBind(number proto.ChannelNumber, peer net.Addr, log logging.Level
 }
 
 func (c *ChannelBind) start(lifetime time.Duration) {
+	c.expiresAt = time.Now().Add(lifetime)
 	c.lifetimeTimer = time.AfterFunc(lifetime, func() {
-		if !c.allocation.RemoveChannelBind(c.Number) {
-			c.log.Errorf("Failed to remove ChannelBind for %v %x %v", c.Number, c.Peer, c.allocation.fiveTuple)
+		// A bind that raced the expiry already replaced the binding
+		if !c.allocation.removeExpiredChannelBind(c) {
+			c.log.Debugf("ChannelBind for %v %v %v was replaced before it expired", c.Number, c.Peer, c.allocation.fiveTuple)
 		}
 	})
 }
 
-func (c *ChannelBind) refresh(lifetime time.Duration) {
-	if !c.lifetimeTimer.Reset(lifetime) {
-		c.log.Errorf("Failed to reset ChannelBind timer for %v %x %v", c.Number, c.Peer, c.allocation.fiveTuple)
+// refresh restarts the lifetime of the binding, it returns false if the lifetime
+// already ran out and the binding is being removed
+func (c *ChannelBind) refresh(lifetime time.Duration) bool {
+	if !c.lifetimeTimer.Stop() {
+		return false
 	}
+	c.lifetimeTimer.Reset(lifetime)
+	c.expiresAt = time.Now().Add(lifetime)
+	return true
 }
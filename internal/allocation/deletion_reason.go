@@ -0,0 +1,41 @@
+package allocation
+
+// DeletionReason tells why an allocation was deleted
+type DeletionReason int
+
+const (
+	// DeletionReasonExpired is an allocation whose lifetime ran out without a Refresh
+	DeletionReasonExpired DeletionReason = iota + 1
+
+	// DeletionReasonDeallocated is an allocation the client deleted with a Refresh
+	// carrying a LIFETIME of 0
+	DeletionReasonDeallocated
+
+	// DeletionReasonRelayError is an allocation whose relay socket failed, either
+	// reading from it or writing to peers kept failing
+	DeletionReasonRelayError
+
+	// DeletionReasonClosed is an allocation deleted because its Manager was closed
+	DeletionReasonClosed
+
+	// DeletionReasonByteQuota is an allocation that relayed more than
+	// ManagerConfig.MaxBytesPerAllocation
+	DeletionReasonByteQuota
+)
+
+func (r DeletionReason) String() string {
+	switch r {
+	case DeletionReasonExpired:
+		return "Expired"
+	case DeletionReasonDeallocated:
+		return "Deallocated"
+	case DeletionReasonRelayError:
+		return "RelayError"
+	case DeletionReasonClosed:
+		return "Closed"
+	case DeletionReasonByteQuota:
+		return "ByteQuota"
+	default:
+		return "Unknown"
+	}
+}
@@ -0,0 +1,48 @@
+package allocation
+
+import "errors"
+
+// ErrAddressFamilyMismatch is returned when the relay address handed back
+// by AllocatePacketConn doesn't match the REQUESTED-ADDRESS-FAMILY
+var ErrAddressFamilyMismatch = errors.New("relay address family does not match requested address family")
+
+// ErrAllocationQuotaReached is returned when creating an allocation would exceed the
+// Quota.MaxAllocations of its group
+var ErrAllocationQuotaReached = errors.New("allocation quota reached")
+
+// ErrChannelNumberInUse is returned when binding a channel number that is bound to another peer
+var ErrChannelNumberInUse = errors.New("channel number is bound to another peer")
+
+// ErrChannelPeerInUse is returned when binding a peer that is bound to another channel number
+var ErrChannelPeerInUse = errors.New("peer is bound to another channel number")
+
+// ErrAllocationExpired is returned when refreshing an allocation that has
+// already expired or been deleted
+var ErrAllocationExpired = errors.New("allocation has expired")
+
+// ErrByteQuotaExceeded is returned when a payload would take the bytes relayed by the
+// allocation past ManagerConfig.MaxBytesPerAllocation, or the ones relayed by its group
+// past Quota.MaxRelayedBytes, the allocation should be deleted
+var ErrByteQuotaExceeded = errors.New("allocation exceeded its byte quota")
+
+// ErrPacketTooLarge is returned when the relay socket refused a packet
+// because it is larger than the path MTU (EMSGSIZE)
+var ErrPacketTooLarge = errors.New("packet too large for relay socket")
+
+// ErrRelaySocketFailing is returned when writes to peers keep failing, the
+// allocation can no longer relay and should be deleted
+var ErrRelaySocketFailing = errors.New("relay socket keeps failing")
+
+// ErrPortQuarantined is returned when every relay socket AllocatePacketConn bound for an
+// allocation is bound to the port of an allocation deleted less than
+// ManagerConfig.PortReuseQuarantine ago
+var ErrPortQuarantined = errors.New("relay port is quarantined")
+
+// ErrRelaySocketInvalid is returned when AllocatePacketConn returned neither an error
+// nor a relay socket and a usable address, e.g. one without a port, which is a bug in
+// the RelayAddressGenerator
+var ErrRelaySocketInvalid = errors.New("AllocatePacketConn returned an invalid relay socket or address")
+
+// ErrPermissionLimitReached is returned when adding a permission would exceed the
+// PermissionLimit.MaxPermissions shared by the allocations
+var ErrPermissionLimitReached = errors.New("permission limit reached")
@@ -0,0 +1,16 @@
+package allocation
+
+import (
+	"math/rand"
+	"time"
+)
+
+// addJitter extends d by a random duration of up to jitter*d. Timers are only
+// ever extended, nothing expires before the lifetime granted to the client
+func addJitter(d time.Duration, jitter float64) time.Duration {
+	maxJitter := int64(float64(d) * jitter)
+	if maxJitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(maxJitter+1))
+}
@@ -0,0 +1,25 @@
+package allocation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddJitter(t *testing.T) {
+	lifetime := 10 * time.Minute
+
+	assert.Equal(t, lifetime, addJitter(lifetime, 0))
+	assert.Equal(t, lifetime, addJitter(lifetime, -0.1))
+	assert.Equal(t, time.Duration(0), addJitter(0, 0.05))
+
+	var jittered bool
+	for i := 0; i < 100; i++ {
+		d := addJitter(lifetime, 0.05)
+		assert.GreaterOrEqual(t, int64(d), int64(lifetime), "must never expire early")
+		assert.LessOrEqual(t, int64(d), int64(lifetime+lifetime/20))
+		jittered = jittered || d != lifetime
+	}
+	assert.True(t, jittered)
+}
@@ -2,6 +2,7 @@ package allocation
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
@@ -13,6 +14,8 @@ const permissionTimeout = time.Duration(5) * time.Minute
 // filtering mechanism of NATs that comply with [RFC4787].
 // https://tools.ietf.org/html/rfc5766#section-2.3
 type Permission struct {
+	expiresAt int64 // UnixNano, accessed atomically, kept first for 64-bit alignment
+
 	Addr          net.Addr
 	allocation    *Allocation
 	lifetimeTimer *time.Timer
@@ -28,13 +31,56 @@ func NewPermission(addr net.Addr, log logging.LeveledLogger) *Permission {
 }
 
 func (p *Permission) start(lifetime time.Duration) {
+	atomic.StoreInt64(&p.expiresAt, time.Now().Add(lifetime).UnixNano())
 	p.lifetimeTimer = time.AfterFunc(lifetime, func() {
-		p.allocation.RemovePermission(p.Addr)
+		p.allocation.expirePermission(p.Addr)
 	})
 }
 
 func (p *Permission) refresh(lifetime time.Duration) {
+	atomic.StoreInt64(&p.expiresAt, time.Now().Add(lifetime).UnixNano())
 	if !p.lifetimeTimer.Reset(lifetime) {
 		p.log.Errorf("Failed to reset permission timer for %v %v", p.Addr, p.allocation.fiveTuple)
 	}
 }
+
+// ExpiresAt returns when the permission expires unless it is refreshed
+func (p *Permission) ExpiresAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.expiresAt))
+}
+
+// PermissionLimit is shared by the allocations of all Managers, it counts their permissions
+// and caps them. A nil PermissionLimit counts nothing and caps nothing
+type PermissionLimit struct {
+	permissions int64 // accessed atomically, kept first for 64-bit alignment
+
+	// MaxPermissions caps the permissions, more are refused with ErrPermissionLimitReached.
+	// Zero means unlimited
+	MaxPermissions int64
+}
+
+// Permissions returns the number of permissions of all allocations
+func (l *PermissionLimit) Permissions() int64 {
+	return atomic.LoadInt64(&l.permissions)
+}
+
+// acquire counts a new permission, it returns false when MaxPermissions is reached
+// and the permission must not be added
+func (l *PermissionLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	if permissions := atomic.AddInt64(&l.permissions, 1); l.MaxPermissions > 0 && permissions > l.MaxPermissions {
+		atomic.AddInt64(&l.permissions, -1)
+		return false
+	}
+	return true
+}
+
+// release uncounts n permissions counted by acquire
+func (l *PermissionLimit) release(n int) {
+	if l != nil {
+		atomic.AddInt64(&l.permissions, -int64(n))
+	}
+}
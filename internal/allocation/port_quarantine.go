@@ -0,0 +1,66 @@
+package allocation
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v2/internal/ipnet"
+)
+
+// maxQuarantineRetries is how many relay sockets are bound looking for one whose port
+// isn't quarantined, before the allocation fails with ErrPortQuarantined
+const maxQuarantineRetries = 8
+
+// portQuarantine holds the relay ports of deleted allocations until they may be bound
+// again, so packets still on their way to the old allocation don't reach a new one
+type portQuarantine struct {
+	lock     sync.Mutex
+	duration time.Duration
+	ports    map[int]time.Time // port to when it is released
+}
+
+func newPortQuarantine(duration time.Duration) *portQuarantine {
+	return &portQuarantine{
+		duration: duration,
+		ports:    map[int]time.Time{},
+	}
+}
+
+// add quarantines the port of addr
+func (q *portQuarantine) add(addr net.Addr) {
+	_, port, err := ipnet.AddrIPPort(addr)
+	if err != nil {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	q.prune(now)
+	q.ports[port] = now.Add(q.duration)
+}
+
+// contains returns true if the port of addr is quarantined
+func (q *portQuarantine) contains(addr net.Addr) bool {
+	_, port, err := ipnet.AddrIPPort(addr)
+	if err != nil {
+		return false
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.prune(time.Now())
+	_, ok := q.ports[port]
+	return ok
+}
+
+func (q *portQuarantine) prune(now time.Time) {
+	for addr, until := range q.ports {
+		if !now.Before(until) {
+			delete(q.ports, addr)
+		}
+	}
+}
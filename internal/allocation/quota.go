@@ -0,0 +1,75 @@
+package allocation
+
+import "sync/atomic"
+
+// Quota is shared by a group of allocations, e.g. the ones of a realm, across Managers.
+// It counts the allocations of the group and the payload bytes they relayed, and caps
+// them. A nil Quota counts nothing and caps nothing
+type Quota struct {
+	relayedBytes       uint64 // accessed atomically, kept first for 64-bit alignment
+	allocationsCreated uint64 // accessed atomically, kept first for 64-bit alignment
+	allocations        int64  // accessed atomically, kept first for 64-bit alignment
+
+	// MaxAllocations caps the allocations of the group, more are refused with
+	// ErrAllocationQuotaReached. Zero means unlimited
+	MaxAllocations int64
+
+	// MaxRelayedBytes caps the payload bytes relayed by the group, to and from peers
+	// counted together. An allocation whose payload would exceed it is deleted with
+	// DeletionReasonByteQuota. Zero means unlimited
+	MaxRelayedBytes uint64
+}
+
+// Allocations returns the number of allocations of the group
+func (q *Quota) Allocations() int64 {
+	return atomic.LoadInt64(&q.allocations)
+}
+
+// AllocationsCreated returns the number of allocations the group created
+func (q *Quota) AllocationsCreated() uint64 {
+	return atomic.LoadUint64(&q.allocationsCreated)
+}
+
+// RelayedBytes returns the payload bytes relayed by the allocations of the group
+func (q *Quota) RelayedBytes() uint64 {
+	return atomic.LoadUint64(&q.relayedBytes)
+}
+
+// acquire counts a new allocation, it returns false when MaxAllocations is reached
+// and the allocation must not be created
+func (q *Quota) acquire() bool {
+	if q == nil {
+		return true
+	}
+
+	if allocations := atomic.AddInt64(&q.allocations, 1); q.MaxAllocations > 0 && allocations > q.MaxAllocations {
+		atomic.AddInt64(&q.allocations, -1)
+		return false
+	}
+	return true
+}
+
+// created counts an allocation acquired for that was created
+func (q *Quota) created() {
+	if q != nil {
+		atomic.AddUint64(&q.allocationsCreated, 1)
+	}
+}
+
+// release uncounts an allocation counted by acquire
+func (q *Quota) release() {
+	if q != nil {
+		atomic.AddInt64(&q.allocations, -1)
+	}
+}
+
+// countRelayed adds size bytes to RelayedBytes, it returns false when they exceed
+// MaxRelayedBytes and the payload must not be relayed
+func (q *Quota) countRelayed(size int) bool {
+	if q == nil {
+		return true
+	}
+
+	relayed := atomic.AddUint64(&q.relayedBytes, uint64(size))
+	return q.MaxRelayedBytes == 0 || relayed <= q.MaxRelayedBytes
+}
@@ -0,0 +1,146 @@
+package allocation
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/logging"
+)
+
+// Direction of a relayed payload, as written in a record
+const (
+	DirectionToPeer   byte = 1
+	DirectionToClient byte = 2
+)
+
+// recorderQueueSize is how many records may wait for the sink before new ones are dropped
+const recorderQueueSize = 256
+
+// recordHeaderSize is the length, direction, timestamp and peer address length
+const recordHeaderSize = 2 + 1 + 8 + 1
+
+var errRecordInvalid = errors.New("invalid relay record")
+
+// EncodeRecord builds the record of a relayed payload:
+//
+//	length    uint16, big endian, of everything that follows
+//	direction byte, DirectionToPeer or DirectionToClient
+//	time      int64, big endian, Unix nanoseconds
+//	peer      byte length followed by the peer address as a string
+//	data      the payload
+func EncodeRecord(direction byte, t time.Time, peer net.Addr, data []byte) []byte {
+	peerAddr := peer.String()
+	if len(peerAddr) > 255 {
+		peerAddr = peerAddr[:255]
+	}
+
+	record := make([]byte, recordHeaderSize+len(peerAddr)+len(data))
+	binary.BigEndian.PutUint16(record[0:], uint16(len(record)-2))
+	record[2] = direction
+	binary.BigEndian.PutUint64(record[3:], uint64(t.UnixNano()))
+	record[11] = byte(len(peerAddr))
+	copy(record[recordHeaderSize:], peerAddr)
+	copy(record[recordHeaderSize+len(peerAddr):], data)
+
+	return record
+}
+
+// ReadRecord reads the next record written by EncodeRecord from r
+func ReadRecord(r io.Reader) (direction byte, t time.Time, peer string, data []byte, err error) {
+	var length [2]byte
+	if _, err = io.ReadFull(r, length[:]); err != nil {
+		return
+	}
+
+	record := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(r, record); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	if len(record) < recordHeaderSize-2 || len(record) < recordHeaderSize-2+int(record[9]) {
+		err = errRecordInvalid
+		return
+	}
+
+	direction = record[0]
+	t = time.Unix(0, int64(binary.BigEndian.Uint64(record[1:])))
+	peer = string(record[10 : 10+int(record[9])])
+	data = record[10+int(record[9]):]
+	return
+}
+
+// recorder copies relayed payloads to a sink. The relay never waits for the sink,
+// records are queued and written from their own goroutine, they are dropped when
+// the queue is full
+type recorder struct {
+	dropped uint64 // accessed atomically, kept first for 64-bit alignment
+
+	sink io.Writer
+	log  logging.LeveledLogger
+
+	lock   sync.RWMutex
+	queue  chan []byte
+	closed bool
+}
+
+func newRecorder(sink io.Writer, log logging.LeveledLogger) *recorder {
+	r := &recorder{
+		sink:  sink,
+		log:   log,
+		queue: make(chan []byte, recorderQueueSize),
+	}
+	go r.writeLoop()
+
+	return r
+}
+
+// record queues a copy of data, it never blocks
+func (r *recorder) record(direction byte, peer net.Addr, data []byte) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if r.closed {
+		return
+	}
+
+	select {
+	case r.queue <- EncodeRecord(direction, time.Now(), peer, data):
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+	}
+}
+
+func (r *recorder) writeLoop() {
+	for record := range r.queue {
+		if _, err := r.sink.Write(record); err != nil {
+			atomic.AddUint64(&r.dropped, 1)
+			r.log.Warnf("failed to write relay record: %v", err)
+		}
+	}
+
+	if closer, ok := r.sink.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			r.log.Warnf("failed to close relay recording sink: %v", err)
+		}
+	}
+}
+
+// close writes the queued records and closes the sink if it is an io.Closer,
+// it doesn't wait for the sink
+func (r *recorder) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+}
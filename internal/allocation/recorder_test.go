@@ -0,0 +1,124 @@
+package allocation
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSink is an io.WriteCloser that blocks writes until unblock is closed
+type testSink struct {
+	lock    sync.Mutex
+	buf     bytes.Buffer
+	err     error
+	unblock chan struct{}
+	closed  chan struct{}
+}
+
+func newTestSink() *testSink {
+	s := &testSink{unblock: make(chan struct{}), closed: make(chan struct{})}
+	close(s.unblock)
+	return s
+}
+
+func (s *testSink) Write(p []byte) (int, error) {
+	<-s.unblock
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.buf.Write(p)
+}
+
+func (s *testSink) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func TestRecord(t *testing.T) {
+	now := time.Now()
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+	var buf bytes.Buffer
+	buf.Write(EncodeRecord(DirectionToPeer, now, peer, []byte("Hello")))
+	buf.Write(EncodeRecord(DirectionToClient, now, peer, nil))
+
+	direction, recordTime, recordPeer, data, err := ReadRecord(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, DirectionToPeer, direction)
+	assert.True(t, now.Equal(recordTime))
+	assert.Equal(t, peer.String(), recordPeer)
+	assert.Equal(t, []byte("Hello"), data)
+
+	direction, _, _, data, err = ReadRecord(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, DirectionToClient, direction)
+	assert.Empty(t, data)
+
+	_, _, _, _, err = ReadRecord(&buf)
+	assert.Equal(t, io.EOF, err)
+
+	// Truncated records are reported
+	record := EncodeRecord(DirectionToPeer, now, peer, []byte("Hello"))
+	_, _, _, _, err = ReadRecord(bytes.NewReader(record[:len(record)-1]))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, _, _, _, err = ReadRecord(bytes.NewReader([]byte{0, 1, byte(DirectionToPeer)}))
+	assert.Equal(t, errRecordInvalid, err)
+}
+
+func TestRecorder(t *testing.T) {
+	log := logging.NewDefaultLoggerFactory().NewLogger("test")
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+	t.Run("SlowSink", func(t *testing.T) {
+		sink := newTestSink()
+		sink.unblock = make(chan struct{})
+		r := newRecorder(sink, log)
+
+		// The relay isn't held up by a sink that doesn't keep up
+		for i := 0; i < recorderQueueSize*2; i++ {
+			r.record(DirectionToPeer, peer, []byte("Hello"))
+		}
+		assert.GreaterOrEqual(t, r.dropped, uint64(recorderQueueSize-1))
+
+		close(sink.unblock)
+		r.close()
+		<-sink.closed
+
+		// Queued records are written before the sink is closed
+		var records uint64
+		for {
+			if _, _, _, _, err := ReadRecord(&sink.buf); err != nil {
+				assert.Equal(t, io.EOF, err)
+				break
+			}
+			records++
+		}
+		assert.Equal(t, uint64(recorderQueueSize*2), records+r.dropped)
+
+		// Nothing is recorded after close
+		r.record(DirectionToPeer, peer, []byte("Hello"))
+	})
+
+	t.Run("FailingSink", func(t *testing.T) {
+		sink := newTestSink()
+		sink.err = errors.New("sink failed")
+		r := newRecorder(sink, log)
+
+		r.record(DirectionToPeer, peer, []byte("Hello"))
+		r.record(DirectionToClient, peer, []byte("Hello"))
+		r.close()
+		<-sink.closed
+
+		assert.Equal(t, uint64(2), r.dropped)
+	})
+}
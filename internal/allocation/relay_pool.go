@@ -0,0 +1,118 @@
+package allocation
+
+import (
+	"net"
+
+	"github.com/pion/logging"
+)
+
+type pooledRelay struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+// relayPool keeps a number of relay sockets bound ahead of time, so creating
+// an allocation doesn't pay for the bind on the hot path. Only IPv4 relays
+// without a requested port are pooled, everything else is allocated directly
+type relayPool struct {
+	allocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error)
+	log                logging.LeveledLogger
+
+	relays chan pooledRelay
+	refill chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func newRelayPool(size int, allocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error), log logging.LeveledLogger) *relayPool {
+	p := &relayPool{
+		allocatePacketConn: allocatePacketConn,
+		log:                log,
+		relays:             make(chan pooledRelay, size),
+		refill:             make(chan struct{}, 1),
+		closed:             make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+
+	go p.run()
+	return p
+}
+
+// get returns a pre-bound relay if possible, falling back to binding a new one
+func (p *relayPool) get(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if network != "udp4" || requestedPort != 0 {
+		return p.allocatePacketConn(network, requestedPort)
+	}
+
+	select {
+	case r := <-p.relays:
+		select {
+		case p.refill <- struct{}{}:
+		default:
+		}
+		return r.conn, r.addr, nil
+	default:
+		p.log.Debug("relay pool is empty, binding relay on demand")
+		return p.allocatePacketConn(network, requestedPort)
+	}
+}
+
+// run fills the pool in the background each time a relay is taken out of it
+func (p *relayPool) run() {
+	defer close(p.done)
+
+	for {
+		p.fill()
+
+		select {
+		case <-p.refill:
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *relayPool) fill() {
+	for len(p.relays) < cap(p.relays) {
+		conn, addr, err := p.allocatePacketConn("udp4", 0)
+		if err != nil {
+			p.log.Warnf("Failed to fill relay pool: %v", err)
+			return
+		} else if conn == nil || addr == nil {
+			p.log.Errorf("Failed to fill relay pool: %v", ErrRelaySocketInvalid)
+			if conn != nil {
+				if err := conn.Close(); err != nil {
+					p.log.Errorf("Failed to close relay: %v", err)
+				}
+			}
+			return
+		}
+
+		select {
+		case p.relays <- pooledRelay{conn: conn, addr: addr}:
+		default:
+			if err := conn.Close(); err != nil {
+				p.log.Errorf("Failed to close relay: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// close stops refilling the pool and closes all the relays it still holds
+func (p *relayPool) close() error {
+	close(p.closed)
+	<-p.done
+
+	var err error
+	for {
+		select {
+		case r := <-p.relays:
+			if closeErr := r.conn.Close(); closeErr != nil {
+				err = closeErr
+			}
+		default:
+			return err
+		}
+	}
+}
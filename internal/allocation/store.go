@@ -0,0 +1,29 @@
+package allocation
+
+import (
+	"net"
+	"time"
+)
+
+// Record is the metadata of an allocation written to a Store. Only metadata is
+// externalized, the relay itself stays with the Manager that created the allocation
+type Record struct {
+	FiveTuple FiveTuple
+	Username  string
+	RelayAddr net.Addr
+
+	// Lifetime is the lifetime the allocation was created or last refreshed with,
+	// ExpiresAt is when it runs out without another refresh
+	Lifetime  time.Duration
+	ExpiresAt time.Time
+}
+
+// Store is written the allocations a Manager creates, refreshes and deletes, e.g. to
+// inspect them from a control plane. Its methods are called from the goroutine handling
+// the request and should return quickly. Errors are logged and otherwise ignored, the
+// allocation is not affected by a failing Store
+type Store interface {
+	Create(r Record) error
+	Update(r Record) error
+	Delete(fiveTuple FiveTuple) error
+}
@@ -15,6 +15,13 @@ const (
 	maxChannelNumber uint16 = 0x7fff
 )
 
+// A channel binding lasts 10 minutes on the server unless it is refreshed, it is
+// refreshed by the first write after half of that
+const (
+	bindingLifetime        = 10 * time.Minute
+	bindingRefreshInterval = 5 * time.Minute
+)
+
 type bindingState int32
 
 const (
@@ -143,6 +150,17 @@ func (mgr *bindingManager) deleteByNumber(number uint16) bool {
 	return true
 }
 
+func (mgr *bindingManager) all() []*binding {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+
+	bindings := make([]*binding, 0, len(mgr.chanMap))
+	for _, b := range mgr.chanMap {
+		bindings = append(bindings, b)
+	}
+	return bindings
+}
+
 func (mgr *bindingManager) size() int {
 	mgr.mutex.RLock()
 	defer mgr.mutex.RUnlock()
@@ -17,6 +17,7 @@ import (
 const (
 	maxReadQueueSize    = 1024
 	permRefreshInterval = 120 * time.Second
+	permIdleTimeout     = 300 * time.Second // permission lifetime on the server (RFC 5766 Section 8)
 	maxRetryAttempts    = 3
 )
 
@@ -44,26 +45,58 @@ type UDPConnObserver interface {
 	OnDeallocated(relayedAddr net.Addr)
 }
 
-// UDPConnConfig is a set of configuration params use by NewUDPConn
+// UDPConnConfig is a set of configuration params use by NewUDPConn. Integrity authenticates
+// the requests of the allocation, a MESSAGE-INTEGRITY with an empty key when it is nil
 type UDPConnConfig struct {
 	Observer    UDPConnObserver
 	RelayedAddr net.Addr
-	Integrity   stun.MessageIntegrity
+	Integrity   stun.Setter
 	Nonce       stun.Nonce
 	Lifetime    time.Duration
 	Log         logging.LeveledLogger
+
+	// DisablePermissionRefresh stops the periodic refresh of permissions,
+	// the owner is then responsible for calling CreatePermissions
+	DisablePermissionRefresh bool
+
+	// DisableFingerprint stops adding FINGERPRINT to outgoing messages
+	DisableFingerprint bool
+
+	// Reallocate is called when the server answers with a 437 (Allocation Mismatch), i.e. it
+	// lost the allocation, to allocate again. When nil the UDPConn is left without an allocation
+	Reallocate func() (relayedAddr net.Addr, nonce stun.Nonce, lifetime time.Duration, err error)
+
+	// OnReallocated is called with the new relayed address once Reallocate succeeded and the
+	// permissions and channel bindings were installed again
+	OnReallocated func(relayedAddr net.Addr)
+}
+
+// noFingerprint is used in place of stun.Fingerprint when FINGERPRINT is disabled
+type noFingerprint struct{}
+
+func (noFingerprint) AddTo(m *stun.Message) error {
+	return nil
+}
+
+// FingerprintSetter returns stun.Fingerprint, or a setter adding nothing if disabled
+func FingerprintSetter(disabled bool) stun.Setter {
+	if disabled {
+		return noFingerprint{}
+	}
+	return stun.Fingerprint
 }
 
 // UDPConn is the implementation of the Conn and PacketConn interfaces for UDP network connections.
 // comatible with net.PacketConn and net.Conn
 type UDPConn struct {
 	obs               UDPConnObserver       // read-only
-	relayedAddr       net.Addr              // read-only
+	_relayedAddr      net.Addr              // needs mutex x, changes on reallocation
 	permMap           *permissionMap        // thread-safe
 	bindingMgr        *bindingManager       // thread-safe
-	integrity         stun.MessageIntegrity // read-only
+	integrity         stun.Setter           // read-only
 	_nonce            stun.Nonce            // needs mutex x
 	_lifetime         time.Duration         // needs mutex x
+	_expiresAt        time.Time             // needs mutex x
 	readCh            chan *inboundData     // thread-safe
 	closeCh           chan struct{}         // thread-safe
 	readTimer         *time.Timer           // thread-safe
@@ -71,22 +104,42 @@ type UDPConn struct {
 	refreshPermsTimer *PeriodicTimer        // thread-safe
 	mutex             sync.RWMutex          // thread-safe
 	log               logging.LeveledLogger // read-only
+
+	disableFingerprint bool // read-only
+
+	reallocateFn  func() (net.Addr, stun.Nonce, time.Duration, error) // read-only
+	onReallocated func(relayedAddr net.Addr)                          // read-only
+	reallocMutex  sync.Mutex                                          // thread-safe
+
+	keepalives      map[string]*peerKeepalive // needs keepalivesMutex
+	keepalivesMutex sync.Mutex                // thread-safe
 }
 
 // NewUDPConn creates a new instance of UDPConn
 func NewUDPConn(config *UDPConnConfig) *UDPConn {
+	integrity := config.Integrity
+	if integrity == nil {
+		integrity = stun.MessageIntegrity{}
+	}
+
 	c := &UDPConn{
-		obs:         config.Observer,
-		relayedAddr: config.RelayedAddr,
-		permMap:     newPermissionMap(),
-		bindingMgr:  newBindingManager(),
-		integrity:   config.Integrity,
-		_nonce:      config.Nonce,
-		_lifetime:   config.Lifetime,
-		readCh:      make(chan *inboundData, maxReadQueueSize),
-		closeCh:     make(chan struct{}),
-		readTimer:   time.NewTimer(time.Duration(math.MaxInt64)),
-		log:         config.Log,
+		obs:          config.Observer,
+		_relayedAddr: config.RelayedAddr,
+		permMap:      newPermissionMap(),
+		bindingMgr:   newBindingManager(),
+		integrity:    integrity,
+		_nonce:       config.Nonce,
+		_lifetime:    config.Lifetime,
+		_expiresAt:   time.Now().Add(config.Lifetime),
+		readCh:       make(chan *inboundData, maxReadQueueSize),
+		closeCh:      make(chan struct{}),
+		readTimer:    time.NewTimer(time.Duration(math.MaxInt64)),
+		log:          config.Log,
+
+		disableFingerprint: config.DisableFingerprint,
+		reallocateFn:       config.Reallocate,
+		onReallocated:      config.OnReallocated,
+		keepalives:         map[string]*peerKeepalive{},
 	}
 
 	c.log.Debugf("initial lifetime: %d seconds", int(c.lifetime().Seconds()))
@@ -106,7 +159,9 @@ func NewUDPConn(config *UDPConnConfig) *UDPConn {
 	if c.refreshAllocTimer.Start() {
 		c.log.Debugf("refreshAllocTimer started")
 	}
-	if c.refreshPermsTimer.Start() {
+	if config.DisablePermissionRefresh {
+		c.log.Debugf("refreshPermsTimer disabled")
+	} else if c.refreshPermsTimer.Start() {
 		c.log.Debugf("refreshPermsTimer started")
 	}
 
@@ -153,6 +208,11 @@ func (c *UDPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 }
 
 // WriteTo writes a packet with payload p to addr.
+// A permission for addr is created first if there is none. Until a channel
+// is bound to addr, p is sent in a Send indication, then as ChannelData.
+// While the channel is bound again, after it expired or the allocation was
+// replaced, p is sent in a Send indication as well so no packet is dropped.
+// It returns len(p) once the packet was sent to the server.
 // WriteTo can be made to time out and return
 // an Error with Timeout() == true after a fixed time limit;
 // see SetDeadline and SetWriteDeadline.
@@ -184,7 +244,13 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 
 		if perm.state() == permStateIdle {
 			// punch a hole! (this would block a bit..)
-			if err = c.createPermissions(addr); err != nil {
+			relayedAddr := c.LocalAddr()
+			if err = c.createPermissions(addr); err == errAllocationMismatch && c.reallocateFn != nil {
+				if err = c.reallocate(relayedAddr); err == nil {
+					return errTryAgain
+				}
+			}
+			if err != nil {
 				c.permMap.delete(addr)
 				return err
 			}
@@ -199,8 +265,9 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 		}
 	}
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("failed to create permission for %v: %w", addr, err)
 	}
+	perm.touch()
 
 	// bind channel
 	b, ok := c.bindingMgr.findByAddr(addr)
@@ -208,6 +275,16 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 		b = c.bindingMgr.create(addr)
 	}
 
+	// The server forgot a channel that wasn't refreshed within its lifetime,
+	// it is bound again as if it were new
+	if b.state() == bindingStateReady && time.Since(b.refreshedAt()) > bindingLifetime {
+		b.muBind.Lock()
+		if b.state() == bindingStateReady {
+			b.setState(bindingStateIdle)
+		}
+		b.muBind.Unlock()
+	}
+
 	bindSt := b.state()
 
 	if bindSt == bindingStateIdle || bindSt == bindingStateRequest || bindSt == bindingStateFailed {
@@ -228,6 +305,7 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 						// keep going...
 						// TODO: consider try binding again after a while
 					} else {
+						b.setRefreshedAt(time.Now())
 						b.setState(bindingStateReady)
 					}
 				}()
@@ -242,15 +320,17 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 			stun.NewType(stun.MethodSend, stun.ClassIndication),
 			proto.Data(p),
 			peerAddr,
-			stun.Fingerprint,
+			FingerprintSetter(c.disableFingerprint),
 		)
 		if err != nil {
 			return 0, err
 		}
 
 		// indication has no transaction (fire-and-forget)
-
-		return c.obs.WriteTo(msg.Raw, c.obs.TURNServerAddr())
+		if _, err = c.obs.WriteTo(msg.Raw, c.obs.TURNServerAddr()); err != nil {
+			return 0, err
+		}
+		return len(p), nil
 	}
 
 	// binding is either ready
@@ -260,7 +340,7 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 		b.muBind.Lock()
 		defer b.muBind.Unlock()
 
-		if b.state() == bindingStateReady && time.Since(b.refreshedAt()) > 5*time.Minute {
+		if b.state() == bindingStateReady && time.Since(b.refreshedAt()) > bindingRefreshInterval {
 			b.setState(bindingStateRefresh)
 			go func() {
 				err = c.bind(b)
@@ -287,20 +367,28 @@ func (c *UDPConn) Close() error {
 	c.refreshAllocTimer.Stop()
 	c.refreshPermsTimer.Stop()
 
+	c.keepalivesMutex.Lock()
 	select {
 	case <-c.closeCh:
+		c.keepalivesMutex.Unlock()
 		return fmt.Errorf("already closed")
 	default:
 		close(c.closeCh)
 	}
+	c.keepalivesMutex.Unlock()
+	c.stopKeepalives()
 
-	c.obs.OnDeallocated(c.relayedAddr)
+	c.obs.OnDeallocated(c.LocalAddr())
 	return c.refreshAllocation(0, true /* dontWait=true */)
 }
 
-// LocalAddr returns the local network address.
+// LocalAddr returns the local network address, the relayed address of the allocation.
+// It changes when the allocation is replaced, see UDPConnConfig.Reallocate
 func (c *UDPConn) LocalAddr() net.Addr {
-	return c.relayedAddr
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c._relayedAddr
 }
 
 // SetDeadline sets the read and write deadlines associated
@@ -375,7 +463,7 @@ func (c *UDPConn) createPermissions(addrs ...net.Addr) error {
 		c.obs.Realm(),
 		c.nonce(),
 		c.integrity,
-		stun.Fingerprint)
+		FingerprintSetter(c.disableFingerprint))
 
 	msg, err := stun.Build(setters...)
 	if err != nil {
@@ -392,9 +480,14 @@ func (c *UDPConn) createPermissions(addrs ...net.Addr) error {
 	if res.Type.Class == stun.ClassErrorResponse {
 		var code stun.ErrorCodeAttribute
 		if err = code.GetFrom(res); err == nil {
-			if code.Code == stun.CodeStaleNonce {
+			switch code.Code {
+			case stun.CodeStaleNonce:
 				c.setNonceFromMsg(res)
 				return errTryAgain
+			case stun.CodeAllocMismatch:
+				return errAllocationMismatch
+			case stun.CodePeerAddrFamilyMismatch:
+				return ErrPeerAddressFamilyMismatch
 			}
 			err = fmt.Errorf("%s (error %s)", res.Type, code)
 		} else {
@@ -406,8 +499,68 @@ func (c *UDPConn) createPermissions(addrs ...net.Addr) error {
 	return nil
 }
 
+// CreatePermissions installs or refreshes the permissions for the given peers
+func (c *UDPConn) CreatePermissions(addrs ...net.Addr) error {
+	var err error
+	for i := 0; i < maxRetryAttempts; i++ {
+		if err = c.createPermissions(addrs...); err != errTryAgain {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		perm, ok := c.permMap.find(addr)
+		if !ok {
+			perm = &permission{}
+			c.permMap.insert(addr, perm)
+		}
+		perm.setState(permStatePermitted)
+		perm.touch()
+	}
+	return nil
+}
+
+// RemovePermission forgets the peers with the IP of addr: their permission is no longer
+// refreshed, their channel bindings and keepalives are dropped. TURN can't delete a permission
+// on the server, it expires there unless the peer is written to again
+func (c *UDPConn) RemovePermission(addr net.Addr) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	c.permMap.delete(addr)
+	for _, b := range c.bindingMgr.all() {
+		if peer, ok := b.addr.(*net.UDPAddr); ok && peer.IP.Equal(udpAddr.IP) {
+			c.bindingMgr.deleteByAddr(b.addr)
+		}
+	}
+
+	c.keepalivesMutex.Lock()
+	defer c.keepalivesMutex.Unlock()
+	for key, k := range c.keepalives {
+		if peer, ok := k.peer.(*net.UDPAddr); ok && peer.IP.Equal(udpAddr.IP) {
+			k.stop()
+			delete(c.keepalives, key)
+		}
+	}
+}
+
+// HasPermission returns true if a permission was created for the IP of addr
+func (c *UDPConn) HasPermission(addr net.Addr) bool {
+	_, ok := c.permMap.find(addr)
+	return ok
+}
+
 // HandleInbound passes inbound data in UDPConn
 func (c *UDPConn) HandleInbound(data []byte, from net.Addr) {
+	if perm, ok := c.permMap.find(from); ok {
+		perm.touch()
+	}
+
 	// copy data
 	copied := make([]byte, len(data))
 	copy(copied, data)
@@ -449,7 +602,7 @@ func (c *UDPConn) refreshAllocation(lifetime time.Duration, dontWait bool) error
 		c.obs.Realm(),
 		c.nonce(),
 		c.integrity,
-		stun.Fingerprint,
+		FingerprintSetter(c.disableFingerprint),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to build refresh request: %s", err.Error())
@@ -472,11 +625,14 @@ func (c *UDPConn) refreshAllocation(lifetime time.Duration, dontWait bool) error
 	if res.Type.Class == stun.ClassErrorResponse {
 		var code stun.ErrorCodeAttribute
 		if err = code.GetFrom(res); err == nil {
-			if code.Code == stun.CodeStaleNonce {
+			switch code.Code {
+			case stun.CodeStaleNonce:
 				c.setNonceFromMsg(res)
 				return errTryAgain
+			case stun.CodeAllocMismatch:
+				return errAllocationMismatch
 			}
-			return err
+			return fmt.Errorf("%s (error %s)", res.Type, code)
 		}
 		return fmt.Errorf("%s", res.Type)
 	}
@@ -493,6 +649,12 @@ func (c *UDPConn) refreshAllocation(lifetime time.Duration, dontWait bool) error
 }
 
 func (c *UDPConn) refreshPermissions() error {
+	// Only peers that are still in use are kept alive, the permissions
+	// of idle peers are left to expire on the server
+	for _, addr := range c.permMap.deleteIdle(time.Now().Add(-permIdleTimeout)) {
+		c.log.Debugf("permission for %s is idle, no longer refreshing it", addr.String())
+	}
+
 	addrs := c.permMap.addrs()
 	if len(addrs) == 0 {
 		c.log.Debug("no permission to refresh")
@@ -519,7 +681,7 @@ func (c *UDPConn) bind(b *binding) error {
 		c.obs.Realm(),
 		c.nonce(),
 		c.integrity,
-		stun.Fingerprint,
+		FingerprintSetter(c.disableFingerprint),
 	}
 
 	msg, err := stun.Build(setters...)
@@ -551,14 +713,18 @@ func (c *UDPConn) sendChannelData(data []byte, chNum uint16) (int, error) {
 		Number: proto.ChannelNumber(chNum),
 	}
 	chData.Encode()
-	return c.obs.WriteTo(chData.Raw, c.obs.TURNServerAddr())
+	if _, err := c.obs.WriteTo(chData.Raw, c.obs.TURNServerAddr()); err != nil {
+		return 0, err
+	}
+	return len(data), nil
 }
 
 func (c *UDPConn) onRefreshTimers(id int) {
 	c.log.Debugf("refresh timer %d expired", id)
+	relayedAddr := c.LocalAddr()
+	var err error
 	switch id {
 	case timerIDRefreshAlloc:
-		var err error
 		lifetime := c.lifetime()
 		// limit the max retries on errTryAgain to 3
 		// when stale nonce returns, sencond retry should succeed
@@ -569,10 +735,9 @@ func (c *UDPConn) onRefreshTimers(id int) {
 			}
 		}
 		if err != nil {
-			c.log.Warnf("refresh allocation failed")
+			c.log.Warnf("refresh allocation failed: %s", err.Error())
 		}
 	case timerIDRefreshPerms:
-		var err error
 		for i := 0; i < maxRetryAttempts; i++ {
 			err = c.refreshPermissions()
 			if err != errTryAgain {
@@ -583,6 +748,70 @@ func (c *UDPConn) onRefreshTimers(id int) {
 			c.log.Warnf("refresh permissions failed")
 		}
 	}
+
+	if err == errAllocationMismatch && c.reallocateFn != nil {
+		if err = c.reallocate(relayedAddr); err != nil {
+			c.log.Errorf("%s", err.Error())
+		}
+	}
+}
+
+// reallocate replaces the allocation on lost, the relayed address the server no longer
+// knows, with a new one from UDPConnConfig.Reallocate. The permissions and channel
+// bindings are installed again on the new allocation
+func (c *UDPConn) reallocate(lost net.Addr) error {
+	c.reallocMutex.Lock()
+	defer c.reallocMutex.Unlock()
+
+	// Another caller ran into the mismatch as well and already replaced the allocation
+	if c.LocalAddr().String() != lost.String() {
+		return nil
+	}
+
+	relayedAddr, nonce, lifetime, err := c.reallocateFn()
+	if err != nil {
+		return fmt.Errorf("failed to reallocate %s: %w", lost, err)
+	}
+
+	c.mutex.Lock()
+	c._relayedAddr = relayedAddr
+	c._nonce = nonce
+	c._lifetime = lifetime
+	c._expiresAt = time.Now().Add(lifetime)
+	c.mutex.Unlock()
+	c.log.Infof("allocation on %s was lost, reallocated on %s", lost, relayedAddr)
+
+	if addrs := c.permMap.addrs(); len(addrs) != 0 {
+		for i := 0; i < maxRetryAttempts; i++ {
+			if err = c.createPermissions(addrs...); err != errTryAgain {
+				break
+			}
+		}
+		if err != nil {
+			c.log.Warnf("failed to create permissions after reallocation: %s", err.Error())
+		}
+	}
+
+	for _, b := range c.bindingMgr.all() {
+		if b.state() != bindingStateReady {
+			continue
+		}
+		// The new allocation drops ChannelData until the channel is bound, WriteTo
+		// sends Send indications meanwhile
+		b.setState(bindingStateRequest)
+		if err = c.bind(b); err != nil {
+			c.log.Warnf("bind() after reallocation failed: %s", err.Error())
+			b.setState(bindingStateFailed)
+		} else {
+			b.setRefreshedAt(time.Now())
+			b.setState(bindingStateReady)
+		}
+	}
+
+	if c.onReallocated != nil {
+		c.onReallocated(relayedAddr)
+	}
+	return nil
 }
 
 func (c *UDPConn) nonce() stun.Nonce {
@@ -612,4 +841,14 @@ func (c *UDPConn) setLifetime(lifetime time.Duration) {
 	defer c.mutex.Unlock()
 
 	c._lifetime = lifetime
+	c._expiresAt = time.Now().Add(lifetime)
+}
+
+// ExpiresAt returns when the allocation expires unless it is refreshed, the lifetime
+// granted by the last successful Allocate or Refresh counted from its response
+func (c *UDPConn) ExpiresAt() time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c._expiresAt
 }
@@ -1,11 +1,17 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pion/logging"
 	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/proto"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -67,6 +73,7 @@ func TestUDPConn(t *testing.T) {
 		conn := UDPConn{
 			obs:        obs,
 			bindingMgr: bm,
+			integrity:  stun.MessageIntegrity{},
 		}
 
 		err := conn.bind(b)
@@ -74,4 +81,486 @@ func TestUDPConn(t *testing.T) {
 		assert.Equal(t, 0, len(bm.chanMap), "should be 0")
 		assert.Equal(t, 0, len(bm.addrMap), "should be 0")
 	})
+
+	t.Run("refreshPermissions()", func(t *testing.T) {
+		// The refresh timer is driven by hand so traffic can be simulated past
+		// the 5 minute permission lifetime without waiting for it
+		var refreshed []string
+		obs := &dummyUDPConnObserver{
+			_performTransaction: func(msg *stun.Message, to net.Addr, dontWait bool) (TransactionResult, error) {
+				refreshed = refreshed[:0]
+				assert.NoError(t, msg.ForEach(stun.AttrXORPeerAddress, func(m *stun.Message) error {
+					var peerAddr proto.PeerAddress
+					if err := peerAddr.GetFrom(m); err != nil {
+						return err
+					}
+					refreshed = append(refreshed, peerAddr.IP.String())
+					return nil
+				}))
+
+				return TransactionResult{
+					Msg: &stun.Message{Type: stun.NewType(stun.MethodCreatePermission, stun.ClassSuccessResponse)},
+				}, nil
+			},
+		}
+
+		conn := UDPConn{
+			obs:       obs,
+			permMap:   newPermissionMap(),
+			integrity: stun.MessageIntegrity{},
+			log:       logging.NewDefaultLoggerFactory().NewLogger("test"),
+		}
+
+		activePeer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+		idlePeer := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1234}
+		for _, addr := range []net.Addr{activePeer, idlePeer} {
+			assert.NoError(t, conn.CreatePermissions(addr))
+		}
+
+		// The idle peer was last used before the permission lifetime ran out
+		idlePerm, ok := conn.permMap.find(idlePeer)
+		assert.True(t, ok)
+		idlePerm.lastActiveAt = time.Now().Add(-2 * permIdleTimeout).UnixNano()
+
+		// Inbound traffic keeps the active peer alive
+		conn.readCh = make(chan *inboundData, 1)
+		conn.HandleInbound([]byte("Hello"), activePeer)
+
+		conn.onRefreshTimers(timerIDRefreshPerms)
+		assert.Equal(t, []string{"127.0.0.1"}, refreshed)
+
+		_, ok = conn.permMap.find(idlePeer)
+		assert.False(t, ok, "idle permission should no longer be tracked")
+
+		conn.onRefreshTimers(timerIDRefreshPerms)
+		assert.Equal(t, []string{"127.0.0.1"}, refreshed)
+	})
+
+	t.Run("RemovePermission()", func(t *testing.T) {
+		var refreshed []string
+		obs := &dummyUDPConnObserver{
+			_performTransaction: func(msg *stun.Message, to net.Addr, dontWait bool) (TransactionResult, error) {
+				refreshed = refreshed[:0]
+				assert.NoError(t, msg.ForEach(stun.AttrXORPeerAddress, func(m *stun.Message) error {
+					var peerAddr proto.PeerAddress
+					if err := peerAddr.GetFrom(m); err != nil {
+						return err
+					}
+					refreshed = append(refreshed, peerAddr.IP.String())
+					return nil
+				}))
+
+				return TransactionResult{
+					Msg: &stun.Message{Type: stun.NewType(stun.MethodCreatePermission, stun.ClassSuccessResponse)},
+				}, nil
+			},
+		}
+
+		conn := UDPConn{
+			obs:        obs,
+			permMap:    newPermissionMap(),
+			bindingMgr: newBindingManager(),
+			integrity:  stun.MessageIntegrity{},
+			log:        logging.NewDefaultLoggerFactory().NewLogger("test"),
+			keepalives: map[string]*peerKeepalive{},
+			closeCh:    make(chan struct{}),
+		}
+
+		keptPeer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+		removedPeer := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1234}
+		assert.NoError(t, conn.CreatePermissions(keptPeer, removedPeer))
+		conn.bindingMgr.create(removedPeer)
+		conn.SetPeerKeepalive(removedPeer, time.Hour, nil)
+
+		conn.onRefreshTimers(timerIDRefreshPerms)
+		assert.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2"}, refreshed)
+
+		// Any port of the peer's IP removes it
+		conn.RemovePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5678})
+		assert.False(t, conn.HasPermission(removedPeer))
+		assert.True(t, conn.HasPermission(keptPeer))
+		assert.Equal(t, 0, conn.bindingMgr.size())
+		assert.Empty(t, conn.keepalives)
+
+		conn.onRefreshTimers(timerIDRefreshPerms)
+		assert.Equal(t, []string{"127.0.0.1"}, refreshed)
+	})
+
+	t.Run("DisableFingerprint", func(t *testing.T) {
+		for _, disabled := range []bool{false, true} {
+			var sent *stun.Message
+			obs := &dummyUDPConnObserver{
+				_performTransaction: func(msg *stun.Message, to net.Addr, dontWait bool) (TransactionResult, error) {
+					sent = &stun.Message{Raw: append([]byte{}, msg.Raw...)}
+					return TransactionResult{
+						Msg: &stun.Message{Type: stun.NewType(stun.MethodCreatePermission, stun.ClassSuccessResponse)},
+					}, nil
+				},
+			}
+
+			conn := UDPConn{
+				obs:                obs,
+				permMap:            newPermissionMap(),
+				integrity:          stun.MessageIntegrity{},
+				log:                logging.NewDefaultLoggerFactory().NewLogger("test"),
+				disableFingerprint: disabled,
+			}
+			assert.NoError(t, conn.CreatePermissions(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}))
+
+			assert.NoError(t, sent.Decode())
+			assert.Equal(t, !disabled, sent.Contains(stun.AttrFingerprint))
+		}
+	})
+
+	t.Run("WriteTo", func(t *testing.T) {
+		allowed := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+		forbidden := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1234}
+
+		sent := make(chan *stun.Message, 1)
+		obs := &dummyUDPConnObserver{
+			_writeTo: func(data []byte, to net.Addr) (int, error) {
+				sent <- &stun.Message{Raw: append([]byte{}, data...)}
+				return len(data), nil
+			},
+			_performTransaction: func(msg *stun.Message, to net.Addr, dontWait bool) (TransactionResult, error) {
+				// Channels are never bound, data keeps being sent in Send indications
+				var peerAddr proto.PeerAddress
+				if msg.Type.Method == stun.MethodChannelBind || (peerAddr.GetFrom(msg) == nil && peerAddr.IP.Equal(forbidden.IP)) {
+					return TransactionResult{Msg: &stun.Message{Type: stun.NewType(msg.Type.Method, stun.ClassErrorResponse)}}, nil
+				}
+				return TransactionResult{Msg: &stun.Message{Type: stun.NewType(msg.Type.Method, stun.ClassSuccessResponse)}}, nil
+			},
+		}
+
+		conn := NewUDPConn(&UDPConnConfig{
+			Observer: obs,
+			Lifetime: time.Minute,
+			Log:      logging.NewDefaultLoggerFactory().NewLogger("test"),
+		})
+
+		n, err := conn.WriteTo([]byte("Hello"), allowed)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+
+		msg := <-sent
+		assert.NoError(t, msg.Decode())
+		assert.Equal(t, stun.NewType(stun.MethodSend, stun.ClassIndication), msg.Type)
+		var data proto.Data
+		assert.NoError(t, data.GetFrom(msg))
+		assert.Equal(t, "Hello", string(data))
+		var peerAddr proto.PeerAddress
+		assert.NoError(t, peerAddr.GetFrom(msg))
+		assert.Equal(t, allowed.String(), (&net.UDPAddr{IP: peerAddr.IP, Port: peerAddr.Port}).String())
+
+		// Nothing is sent to a peer the server refused a permission for
+		n, err = conn.WriteTo([]byte("Hello"), forbidden)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to create permission")
+		assert.Equal(t, 0, n)
+		assert.Empty(t, sent)
+		_, ok := conn.permMap.find(forbidden)
+		assert.False(t, ok)
+
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("PeerAddressFamilyMismatch", func(t *testing.T) {
+		obs := &dummyUDPConnObserver{
+			_performTransaction: func(msg *stun.Message, to net.Addr, dontWait bool) (TransactionResult, error) {
+				res, err := stun.Build(stun.NewType(msg.Type.Method, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodePeerAddrFamilyMismatch})
+				return TransactionResult{Msg: res}, err
+			},
+		}
+
+		conn := NewUDPConn(&UDPConnConfig{
+			Observer: obs,
+			Lifetime: time.Minute,
+			Log:      logging.NewDefaultLoggerFactory().NewLogger("test"),
+		})
+
+		peer := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1234}
+		assert.Equal(t, ErrPeerAddressFamilyMismatch, conn.CreatePermissions(peer))
+
+		_, err := conn.WriteTo([]byte("Hello"), peer)
+		assert.True(t, errors.Is(err, ErrPeerAddressFamilyMismatch), "unexpected error: %v", err)
+		_, ok := conn.permMap.find(peer)
+		assert.False(t, ok)
+
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("Reallocate", func(t *testing.T) {
+		lostAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+		newAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5001}
+		peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1234}
+
+		// The server lost the allocation, Refresh is answered with a 437
+		lost := true
+		var methods []stun.Method
+		obs := &dummyUDPConnObserver{
+			_performTransaction: func(msg *stun.Message, to net.Addr, dontWait bool) (TransactionResult, error) {
+				methods = append(methods, msg.Type.Method)
+				if lost && msg.Type.Method == stun.MethodRefresh {
+					res, err := stun.Build(stun.NewType(stun.MethodRefresh, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAllocMismatch})
+					assert.NoError(t, err)
+					return TransactionResult{Msg: res}, nil
+				}
+				return TransactionResult{
+					Msg: &stun.Message{Type: stun.NewType(msg.Type.Method, stun.ClassSuccessResponse)},
+				}, nil
+			},
+		}
+
+		var reallocated []net.Addr
+		conn := NewUDPConn(&UDPConnConfig{
+			Observer:    obs,
+			RelayedAddr: lostAddr,
+			Lifetime:    time.Minute,
+			Log:         logging.NewDefaultLoggerFactory().NewLogger("test"),
+			Reallocate: func() (net.Addr, stun.Nonce, time.Duration, error) {
+				lost = false
+				return newAddr, stun.NewNonce("nonce"), time.Minute, nil
+			},
+			OnReallocated: func(relayedAddr net.Addr) {
+				reallocated = append(reallocated, relayedAddr)
+			},
+		})
+
+		assert.NoError(t, conn.CreatePermissions(peer))
+		conn.bindingMgr.create(peer).setState(bindingStateReady)
+
+		// The permission and the channel binding are installed again on the new allocation
+		methods = nil
+		conn.onRefreshTimers(timerIDRefreshAlloc)
+		assert.Equal(t, []stun.Method{stun.MethodRefresh, stun.MethodCreatePermission, stun.MethodChannelBind}, methods)
+		assert.Equal(t, []net.Addr{newAddr}, reallocated)
+		assert.Equal(t, newAddr, conn.LocalAddr())
+		assert.Equal(t, stun.NewNonce("nonce"), conn.nonce())
+
+		// A mismatch on an allocation that was already replaced doesn't reallocate again
+		assert.NoError(t, conn.reallocate(lostAddr))
+		assert.Len(t, reallocated, 1)
+
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("ExpiresAt", func(t *testing.T) {
+		obs := &dummyUDPConnObserver{
+			_performTransaction: func(msg *stun.Message, to net.Addr, dontWait bool) (TransactionResult, error) {
+				res, err := stun.Build(stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse), proto.Lifetime{Duration: time.Hour})
+				assert.NoError(t, err)
+				return TransactionResult{Msg: res}, nil
+			},
+		}
+
+		start := time.Now()
+		conn := NewUDPConn(&UDPConnConfig{
+			Observer: obs,
+			Lifetime: time.Minute,
+			Log:      logging.NewDefaultLoggerFactory().NewLogger("test"),
+		})
+		expiresAt := conn.ExpiresAt()
+		assert.False(t, expiresAt.Before(start.Add(time.Minute)))
+		assert.False(t, expiresAt.After(time.Now().Add(time.Minute)))
+
+		// The lifetime granted by the Refresh extends the allocation from the time of the response
+		start = time.Now()
+		assert.NoError(t, conn.refreshAllocation(time.Hour, false))
+		assert.Equal(t, time.Hour, conn.lifetime())
+		expiresAt = conn.ExpiresAt()
+		assert.False(t, expiresAt.Before(start.Add(time.Hour)))
+		assert.False(t, expiresAt.After(time.Now().Add(time.Hour)))
+
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("Concurrency", func(t *testing.T) {
+		// Every other request is answered with a 438 to update the nonce concurrently as well
+		var requests uint32
+		obs := &dummyUDPConnObserver{
+			_performTransaction: func(msg *stun.Message, to net.Addr, dontWait bool) (TransactionResult, error) {
+				var res *stun.Message
+				var err error
+				if atomic.AddUint32(&requests, 1)%2 == 0 {
+					res, err = stun.Build(stun.NewType(msg.Type.Method, stun.ClassErrorResponse),
+						&stun.ErrorCodeAttribute{Code: stun.CodeStaleNonce}, stun.NewNonce("nonce"))
+				} else {
+					res, err = stun.Build(stun.NewType(msg.Type.Method, stun.ClassSuccessResponse), proto.Lifetime{Duration: time.Minute})
+				}
+				return TransactionResult{Msg: res}, err
+			},
+		}
+
+		conn := NewUDPConn(&UDPConnConfig{
+			Observer:    obs,
+			RelayedAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000},
+			Lifetime:    time.Minute,
+			Log:         logging.NewDefaultLoggerFactory().NewLogger("test"),
+		})
+
+		peer := func(i int) net.Addr {
+			return &net.UDPAddr{IP: net.IPv4(127, 0, 0, byte(1+i%4)), Port: 1234}
+		}
+
+		// Like a WebRTC stack, media, ICE checks and the refresh timers use the conn at once
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					switch (g + i) % 6 {
+					case 0:
+						_, _ = conn.WriteTo([]byte("Hello"), peer(i))
+					case 1:
+						_ = conn.CreatePermissions(peer(i))
+					case 2:
+						conn.onRefreshTimers(timerIDRefreshAlloc)
+						conn.onRefreshTimers(timerIDRefreshPerms)
+					case 3:
+						conn.HandleInbound([]byte("Hello"), peer(i))
+						_ = conn.HasPermission(peer(i))
+					case 4:
+						conn.SetPeerKeepalive(peer(i), time.Hour, nil)
+						conn.RemovePermission(peer(i))
+					case 5:
+						_ = conn.ExpiresAt()
+						_ = conn.LocalAddr()
+						_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+					}
+				}
+			}(g)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1500)
+			for i := 0; i < 50; i++ {
+				_, _, _ = conn.ReadFrom(buf)
+			}
+		}()
+
+		wg.Wait()
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("SendFallback", func(t *testing.T) {
+		// Every ChannelBind waits for a token so writes run into a pending binding
+		bindGate := make(chan struct{})
+		var lock sync.Mutex
+		var kinds []string
+		var payloads []string
+		obs := &dummyUDPConnObserver{
+			_writeTo: func(data []byte, to net.Addr) (int, error) {
+				lock.Lock()
+				defer lock.Unlock()
+
+				if proto.IsChannelData(data) {
+					chData := &proto.ChannelData{Raw: append([]byte{}, data...)}
+					assert.NoError(t, chData.Decode())
+					kinds = append(kinds, "ChannelData")
+					payloads = append(payloads, string(chData.Data))
+					return len(data), nil
+				}
+
+				msg := &stun.Message{Raw: append([]byte{}, data...)}
+				assert.NoError(t, msg.Decode())
+				assert.Equal(t, stun.NewType(stun.MethodSend, stun.ClassIndication), msg.Type)
+				var payload proto.Data
+				assert.NoError(t, payload.GetFrom(msg))
+				kinds = append(kinds, "Send")
+				payloads = append(payloads, string(payload))
+				return len(data), nil
+			},
+			_performTransaction: func(msg *stun.Message, to net.Addr, dontWait bool) (TransactionResult, error) {
+				if msg.Type.Method == stun.MethodChannelBind {
+					<-bindGate
+				}
+				return TransactionResult{
+					Msg: &stun.Message{Type: stun.NewType(msg.Type.Method, stun.ClassSuccessResponse)},
+				}, nil
+			},
+		}
+
+		conn := NewUDPConn(&UDPConnConfig{
+			Observer:    obs,
+			RelayedAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000},
+			Lifetime:    time.Minute,
+			Log:         logging.NewDefaultLoggerFactory().NewLogger("test"),
+		})
+
+		peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1234}
+		written := 0
+		write := func() {
+			_, err := conn.WriteTo([]byte(fmt.Sprint(written)), peer)
+			assert.NoError(t, err)
+			written++
+		}
+
+		// Writes continue while the channel is bound, and for a while after
+		crossBind := func() {
+			for i := 0; i < 10; i++ {
+				write()
+			}
+			bindGate <- struct{}{}
+			b, ok := conn.bindingMgr.findByAddr(peer)
+			assert.True(t, ok)
+			for b.state() != bindingStateReady {
+				write()
+			}
+			for i := 0; i < 10; i++ {
+				write()
+			}
+		}
+
+		crossBind()
+
+		// The channel expired on the server while the peer was idle
+		b, ok := conn.bindingMgr.findByAddr(peer)
+		assert.True(t, ok)
+		b.setRefreshedAt(time.Now().Add(-bindingLifetime - time.Minute))
+		crossBind()
+
+		assert.NoError(t, conn.Close())
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		// Not a packet is lost, every one is sent in order in a Send indication
+		// until the channel is bound and as ChannelData afterwards
+		assert.Len(t, payloads, written)
+		for i, payload := range payloads {
+			assert.Equal(t, fmt.Sprint(i), payload)
+		}
+		var phases []string
+		for _, kind := range kinds {
+			if len(phases) == 0 || phases[len(phases)-1] != kind {
+				phases = append(phases, kind)
+			}
+		}
+		assert.Equal(t, []string{"Send", "ChannelData", "Send", "ChannelData"}, phases)
+		channelData := 0
+		for _, kind := range kinds {
+			if kind == "ChannelData" {
+				channelData++
+			}
+		}
+		assert.Equal(t, 20, channelData)
+	})
+
+	t.Run("DisablePermissionRefresh", func(t *testing.T) {
+		for _, disabled := range []bool{false, true} {
+			conn := NewUDPConn(&UDPConnConfig{
+				Observer:                 &dummyUDPConnObserver{},
+				Lifetime:                 time.Minute,
+				Log:                      logging.NewDefaultLoggerFactory().NewLogger("test"),
+				DisablePermissionRefresh: disabled,
+			})
+
+			assert.Equal(t, !disabled, conn.refreshPermsTimer.IsRunning())
+			assert.True(t, conn.refreshAllocTimer.IsRunning())
+			assert.NoError(t, conn.Close())
+		}
+	})
 }
@@ -6,6 +6,14 @@ import (
 
 var errTryAgain = errors.New("try again")
 
+// errAllocationMismatch is a 437 (Allocation Mismatch), the server doesn't know the allocation
+var errAllocationMismatch = errors.New("allocation mismatch")
+
+// ErrPeerAddressFamilyMismatch is a 443 (Peer Address Family Mismatch), the peer isn't of
+// the address family of the relayed address. Allocations relay a single address family,
+// a peer of the other family can't be reached through them
+var ErrPeerAddressFamilyMismatch = errors.New("turn: peer address family mismatch")
+
 type timeoutError struct {
 	msg string
 }
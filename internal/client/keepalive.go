@@ -0,0 +1,83 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// peerKeepalive sends payload to a peer every interval, see UDPConn.SetPeerKeepalive
+type peerKeepalive struct {
+	mutex    sync.Mutex
+	timer    *time.Timer
+	peer     net.Addr
+	interval time.Duration
+	payload  []byte
+	stopped  bool
+}
+
+func (k *peerKeepalive) stop() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.stopped = true
+	k.timer.Stop()
+}
+
+// SetPeerKeepalive sends payload to peer through the relay every interval, to keep the
+// NAT in front of the peer open while no application data is sent to it. payload may be
+// empty. Calling it again for the same peer replaces its keepalive, an interval of zero
+// or less stops it. Keepalives stop when the UDPConn is closed
+func (c *UDPConn) SetPeerKeepalive(peer net.Addr, interval time.Duration, payload []byte) {
+	key := peer.String()
+
+	c.keepalivesMutex.Lock()
+	defer c.keepalivesMutex.Unlock()
+
+	if k, ok := c.keepalives[key]; ok {
+		k.stop()
+		delete(c.keepalives, key)
+	}
+
+	select {
+	case <-c.closeCh:
+		return
+	default:
+	}
+	if interval <= 0 {
+		return
+	}
+
+	k := &peerKeepalive{
+		peer:     peer,
+		interval: interval,
+		payload:  append([]byte{}, payload...),
+	}
+
+	// The timer may fire before it is assigned
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.timer = time.AfterFunc(interval, func() {
+		if _, err := c.WriteTo(k.payload, peer); err != nil {
+			c.log.Debugf("failed to send keepalive to %s: %s", peer, err.Error())
+		}
+
+		k.mutex.Lock()
+		defer k.mutex.Unlock()
+		if !k.stopped {
+			k.timer.Reset(k.interval)
+		}
+	})
+	c.keepalives[key] = k
+}
+
+// stopKeepalives stops the keepalives of all peers
+func (c *UDPConn) stopKeepalives() {
+	c.keepalivesMutex.Lock()
+	defer c.keepalivesMutex.Unlock()
+
+	for key, k := range c.keepalives {
+		k.stop()
+		delete(c.keepalives, key)
+	}
+}
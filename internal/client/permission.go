@@ -4,6 +4,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type permState int32
@@ -14,8 +15,9 @@ const (
 )
 
 type permission struct {
-	st    permState    // thread-safe (atomic op)
-	mutex sync.RWMutex // thread-safe
+	lastActiveAt int64        // thread-safe (atomic op), unix nanoseconds
+	st           permState    // thread-safe (atomic op)
+	mutex        sync.RWMutex // thread-safe
 }
 
 func (p *permission) setState(state permState) {
@@ -26,6 +28,15 @@ func (p *permission) state() permState {
 	return permState(atomic.LoadInt32((*int32)(&p.st)))
 }
 
+// touch records that data was sent to or received from the peer
+func (p *permission) touch() {
+	atomic.StoreInt64(&p.lastActiveAt, time.Now().UnixNano())
+}
+
+func (p *permission) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastActiveAt))
+}
+
 // Thread-safe permission map
 type permissionMap struct {
 	permMap map[string]*permission
@@ -70,6 +81,24 @@ func (m *permissionMap) delete(addr net.Addr) {
 	delete(m.permMap, udpAddr.IP.String())
 }
 
+// deleteIdle removes the permissions that haven't been active since the
+// given time and returns their addresses
+func (m *permissionMap) deleteIdle(since time.Time) []net.Addr {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	addrs := []net.Addr{}
+	for k, p := range m.permMap {
+		if p.lastActive().Before(since) {
+			delete(m.permMap, k)
+			addrs = append(addrs, &net.UDPAddr{
+				IP: net.ParseIP(k),
+			})
+		}
+	}
+	return addrs
+}
+
 func (m *permissionMap) addrs() []net.Addr {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -24,6 +24,7 @@ type TransactionResult struct {
 // TransactionConfig is a set of config params used by NewTransaction
 type TransactionConfig struct {
 	Key          string
+	Method       stun.Method
 	Raw          []byte
 	To           net.Addr
 	Interval     time.Duration
@@ -33,8 +34,10 @@ type TransactionConfig struct {
 // Transaction represents a transaction
 type Transaction struct {
 	Key      string                 // read-only
+	Method   stun.Method            // read-only
 	Raw      []byte                 // read-only
 	To       net.Addr               // read-only
+	Start    time.Time              // read-only, when the transaction was created
 	nRtx     int                    // modified only by the timer thread
 	interval time.Duration          // modified only by the timer thread
 	timer    *time.Timer            // thread-safe, set only by the creator, and stopper
@@ -44,15 +47,18 @@ type Transaction struct {
 
 // NewTransaction creates a new instance of Transaction
 func NewTransaction(config *TransactionConfig) *Transaction {
+	// The result is buffered so the read loop delivering it never waits on the caller
 	var resultCh chan TransactionResult
 	if !config.IgnoreResult {
-		resultCh = make(chan TransactionResult)
+		resultCh = make(chan TransactionResult, 1)
 	}
 
 	return &Transaction{
 		Key:      config.Key,      // read-only
+		Method:   config.Method,   // read-only
 		Raw:      config.Raw,      // read-only
 		To:       config.To,       // read-only
+		Start:    time.Now(),      // read-only
 		interval: config.Interval, // modified only by the timer thread
 		resultCh: resultCh,        // thread-safe
 	}
@@ -179,6 +185,18 @@ func (m *TransactionMap) CloseAndDeleteAll() {
 	}
 }
 
+// All returns the transactions in the map
+func (m *TransactionMap) All() []*Transaction {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	trs := make([]*Transaction, 0, len(m.trMap))
+	for _, tr := range m.trMap {
+		trs = append(trs, tr)
+	}
+	return trs
+}
+
 // Size returns the length of the transaction map
 func (m *TransactionMap) Size() int {
 	m.mutex.RLock()
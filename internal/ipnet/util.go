@@ -4,6 +4,8 @@ package ipnet
 import (
 	"fmt"
 	"net"
+
+	"github.com/pion/turn/v2/internal/proto"
 )
 
 // AddrIPPort extracts the IP and Port from a net.Addr
@@ -36,3 +38,12 @@ func AddrEqual(a, b net.Addr) bool {
 
 	return aUDP.IP.Equal(bUDP.IP) && aUDP.Port == bUDP.Port
 }
+
+// AddressFamily returns the REQUESTED-ADDRESS-FAMILY value an IP belongs to.
+// IPv4-mapped IPv6 addresses are considered IPv4
+func AddressFamily(ip net.IP) proto.RequestedAddressFamily {
+	if ip.To4() != nil {
+		return proto.RequestedFamilyIPv4
+	}
+	return proto.RequestedFamilyIPv6
+}
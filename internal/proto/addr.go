@@ -3,6 +3,9 @@ package proto
 import (
 	"fmt"
 	"net"
+	"strconv"
+
+	"github.com/pion/stun"
 )
 
 // Addr is ip:port.
@@ -34,7 +37,7 @@ func (a Addr) EqualIP(b Addr) bool {
 }
 
 func (a Addr) String() string {
-	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
 }
 
 // FiveTuple represents 5-TUPLE value.
@@ -63,3 +66,41 @@ func (t FiveTuple) Equal(b FiveTuple) bool {
 	}
 	return true
 }
+
+// XOR-MAPPED-ADDRESS value is 1 byte reserved, 1 byte family, 2 bytes port
+// followed by the address itself.
+const xorAddrHeaderSize = 4
+
+const (
+	familyIPv4 byte = 0x01
+	familyIPv6 byte = 0x02
+)
+
+// getXORAddr decodes an attribute of type t encoded like XOR-MAPPED-ADDRESS.
+//
+// The value size is checked against the address family before decoding,
+// the stun decoder panics on values shorter than the header and zero
+// pads IPv6 addresses that are truncated.
+func getXORAddr(a *stun.XORMappedAddress, m *stun.Message, t stun.AttrType) error {
+	v, err := m.Get(t)
+	if err != nil {
+		return err
+	}
+	if len(v) < xorAddrHeaderSize {
+		return stun.ErrAttributeSizeInvalid
+	}
+
+	switch v[1] {
+	case familyIPv4:
+		err = stun.CheckSize(t, len(v), xorAddrHeaderSize+net.IPv4len)
+	case familyIPv6:
+		err = stun.CheckSize(t, len(v), xorAddrHeaderSize+net.IPv6len)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Never decode into a caller owned IP, GetFromAs reuses its backing array
+	a.IP = nil
+	return a.GetFromAs(m, t)
+}
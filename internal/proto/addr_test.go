@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"net"
 	"testing"
+
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestAddr_FromUDPAddr(t *testing.T) {
@@ -95,3 +98,97 @@ func TestFiveTuple_String(t *testing.T) {
 		t.Error("unexpected stringer output")
 	}
 }
+
+func TestAddr_StringIPv6(t *testing.T) {
+	a := Addr{
+		IP:   net.ParseIP("2001:db8::1"),
+		Port: 1337,
+	}
+	if a.String() != "[2001:db8::1]:1337" {
+		t.Errorf("unexpected string %s", a)
+	}
+}
+
+func TestXORAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ip   net.IP
+	}{
+		{"IPv4", net.IPv4(111, 11, 1, 2)},
+		{"IPv4Short", net.IPv4(111, 11, 1, 2).To4()},
+		{"IPv4MappedIPv6", net.ParseIP("::ffff:111.11.1.2")},
+		{"IPv6", net.ParseIP("2001:db8::68")},
+		{"IPv6LinkLocal", net.ParseIP("fe80::1ff:fe23:4567:890a")},
+		{"IPv6Loopback", net.IPv6loopback},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			m := new(stun.Message)
+			m.TransactionID = [stun.TransactionIDSize]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+			m.WriteHeader()
+
+			assert.NoError(t, PeerAddress{IP: tc.ip, Port: 4000}.AddTo(m))
+			assert.NoError(t, RelayedAddress{IP: tc.ip, Port: 5000}.AddTo(m))
+			assert.NoError(t, stun.XORMappedAddress{IP: tc.ip, Port: 6000}.AddTo(m))
+
+			decoded := new(stun.Message)
+			_, err := decoded.Write(m.Raw)
+			assert.NoError(t, err)
+
+			var peer PeerAddress
+			assert.NoError(t, peer.GetFrom(decoded))
+			assert.True(t, peer.IP.Equal(tc.ip), "%s != %s", peer.IP, tc.ip)
+			assert.Equal(t, 4000, peer.Port)
+
+			var relayed RelayedAddress
+			assert.NoError(t, relayed.GetFrom(decoded))
+			assert.True(t, relayed.IP.Equal(tc.ip), "%s != %s", relayed.IP, tc.ip)
+			assert.Equal(t, 5000, relayed.Port)
+
+			var mapped stun.XORMappedAddress
+			assert.NoError(t, mapped.GetFrom(decoded))
+			assert.True(t, mapped.IP.Equal(tc.ip), "%s != %s", mapped.IP, tc.ip)
+			assert.Equal(t, 6000, mapped.Port)
+
+			// IPv4-mapped addresses are sent as IPv4, everything else keeps its family
+			if tc.ip.To4() != nil {
+				assert.Equal(t, net.IPv4len, len(peer.IP))
+			} else {
+				assert.Equal(t, net.IPv6len, len(peer.IP))
+			}
+		})
+	}
+
+	t.Run("DoesNotReuseIP", func(t *testing.T) {
+		m := new(stun.Message)
+		m.WriteHeader()
+		assert.NoError(t, PeerAddress{IP: net.ParseIP("2001:db8::68"), Port: 4000}.AddTo(m))
+
+		owned := net.ParseIP("2001:db8::1")
+		peer := PeerAddress{IP: owned}
+		assert.NoError(t, peer.GetFrom(m))
+		assert.Equal(t, "2001:db8::1", owned.String())
+	})
+
+	t.Run("BadSize", func(t *testing.T) {
+		for _, v := range [][]byte{
+			{},
+			{0, 1},
+			{0, 1, 0, 0},
+			{0, 1, 0, 0, 1, 2, 3},
+			{0, 2, 0, 0, 1, 2, 3, 4},
+			{0, 2, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+		} {
+			m := new(stun.Message)
+			m.WriteHeader()
+			m.Add(stun.AttrXORPeerAddress, v)
+			m.Add(stun.AttrXORRelayedAddress, v)
+
+			var peer PeerAddress
+			assert.Error(t, peer.GetFrom(m), "%v", v)
+
+			var relayed RelayedAddress
+			assert.Error(t, relayed.GetFrom(m), "%v", v)
+		}
+	})
+}
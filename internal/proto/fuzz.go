@@ -3,6 +3,7 @@
 package proto
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"github.com/pion/stun"
@@ -87,7 +88,12 @@ func FuzzSetters(data []byte) int {
 
 var d = &ChannelData{}
 
+var bin = binary.BigEndian
+
 func FuzzChannelData(data []byte) int {
+	if len(data) < channelDataHeaderSize {
+		return 0
+	}
 	d.Reset()
 	if b := bin.Uint16(data[0:4]); b > 20000 {
 		bin.PutUint16(data[0:4], MinChannelNumber-1)
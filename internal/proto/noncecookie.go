@@ -0,0 +1,50 @@
+package proto
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// nonceCookie starts the NONCEs of a server that supports the STUN Security Features,
+// see RFC 8489 Section 9.2
+const nonceCookie = "obMatJos2"
+
+// SecurityFeatures is the 24-bit Security Feature Set advertised in the nonce cookie,
+// see RFC 8489 Section 18.1. Bit 0 is the least significant bit, as in the test vectors
+// of RFC 8489 Appendix B.1
+type SecurityFeatures uint32
+
+// STUN Security Features, RFC 8489 Section 18.1
+const (
+	SecurityFeaturePasswordAlgorithms SecurityFeatures = 1 << 0
+	SecurityFeatureUsernameAnonymity  SecurityFeatures = 1 << 1
+
+	// SecurityFeaturesMask are the 24 bits of the Security Feature Set
+	SecurityFeaturesMask SecurityFeatures = 1<<24 - 1
+)
+
+// NonceCookie returns the nonce cookie followed by the Security Feature Set encoded as
+// 4 characters of base64, or an empty string when no features are set
+func (f SecurityFeatures) NonceCookie() string {
+	if f&SecurityFeaturesMask == 0 {
+		return ""
+	}
+
+	set := []byte{byte(f >> 16), byte(f >> 8), byte(f)}
+	return nonceCookie + base64.StdEncoding.EncodeToString(set)
+}
+
+// ParseNonceCookie returns the Security Feature Set of nonce, ok is false when nonce
+// doesn't start with a nonce cookie
+func ParseNonceCookie(nonce string) (f SecurityFeatures, ok bool) {
+	const cookieLen = len(nonceCookie) + 4
+	if len(nonce) < cookieLen || !strings.HasPrefix(nonce, nonceCookie) {
+		return 0, false
+	}
+
+	set, err := base64.StdEncoding.DecodeString(nonce[len(nonceCookie):cookieLen])
+	if err != nil {
+		return 0, false
+	}
+	return SecurityFeatures(set[0])<<16 | SecurityFeatures(set[1])<<8 | SecurityFeatures(set[2]), true
+}
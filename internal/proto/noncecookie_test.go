@@ -0,0 +1,23 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceCookie(t *testing.T) {
+	assert.Equal(t, "", SecurityFeatures(0).NonceCookie())
+	assert.Equal(t, "obMatJos2AAAB", SecurityFeaturePasswordAlgorithms.NonceCookie())
+	assert.Equal(t, "obMatJos2AAAD", (SecurityFeaturePasswordAlgorithms | SecurityFeatureUsernameAnonymity).NonceCookie())
+
+	// NONCE of the test vector in RFC 8489 Appendix B.1
+	features, ok := ParseNonceCookie("obMatJos2AAACf//499k954d6OL34oL9FSTvy64sA")
+	assert.True(t, ok)
+	assert.Equal(t, SecurityFeatureUsernameAnonymity, features)
+
+	for _, nonce := range []string{"", "obMatJos2", "obMatJos2AA", "0123456789abcdef", "obMatJos2!!!!"} {
+		_, ok = ParseNonceCookie(nonce)
+		assert.False(t, ok, nonce)
+	}
+}
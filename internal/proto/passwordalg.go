@@ -0,0 +1,207 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/pion/stun"
+)
+
+// Attributes of the password algorithm negotiation, RFC 8489 Section 18.3
+const (
+	AttrMessageIntegritySHA256 stun.AttrType = 0x001C
+	AttrPasswordAlgorithm      stun.AttrType = 0x001D
+	AttrPasswordAlgorithms     stun.AttrType = 0x8002
+)
+
+// PasswordAlgorithm represents PASSWORD-ALGORITHM attribute.
+//
+// The PASSWORD-ALGORITHM attribute is present only in requests. It contains
+// the algorithm that the server must use to derive a key from the long-term
+// password. Both algorithms defined by RFC 8489 have no parameters.
+//
+// RFC 8489 Section 14.12
+type PasswordAlgorithm uint16
+
+// Password algorithms, RFC 8489 Section 18.5
+const (
+	PasswordAlgorithmMD5    PasswordAlgorithm = 0x0001
+	PasswordAlgorithmSHA256 PasswordAlgorithm = 0x0002
+)
+
+func (a PasswordAlgorithm) String() string {
+	switch a {
+	case PasswordAlgorithmMD5:
+		return "MD5"
+	case PasswordAlgorithmSHA256:
+		return "SHA-256"
+	default:
+		return strconv.Itoa(int(a))
+	}
+}
+
+const passwordAlgorithmSize = 4 // 16 bits of algorithm + 16 bits of parameters length
+
+// ErrBadPasswordAlgorithms means that a PASSWORD-ALGORITHM or PASSWORD-ALGORITHMS attribute is malformed
+var ErrBadPasswordAlgorithms = errors.New("malformed password algorithm attribute")
+
+// AddTo adds PASSWORD-ALGORITHM to message.
+func (a PasswordAlgorithm) AddTo(m *stun.Message) error {
+	v := make([]byte, passwordAlgorithmSize)
+	binary.BigEndian.PutUint16(v, uint16(a))
+	m.Add(AttrPasswordAlgorithm, v)
+	return nil
+}
+
+// GetFrom decodes PASSWORD-ALGORITHM from message.
+func (a *PasswordAlgorithm) GetFrom(m *stun.Message) error {
+	v, err := m.Get(AttrPasswordAlgorithm)
+	if err != nil {
+		return err
+	}
+	algorithms, err := decodePasswordAlgorithms(v)
+	if err != nil {
+		return err
+	}
+	if len(algorithms) != 1 {
+		return ErrBadPasswordAlgorithms
+	}
+	*a = algorithms[0]
+	return nil
+}
+
+// PasswordAlgorithms represents PASSWORD-ALGORITHMS attribute.
+//
+// The PASSWORD-ALGORITHMS attribute may be present in requests and
+// responses. It contains the list of algorithms that the server can use
+// to derive the long-term password, in order of preference.
+//
+// RFC 8489 Section 14.11
+type PasswordAlgorithms []PasswordAlgorithm
+
+// AddTo adds PASSWORD-ALGORITHMS to message.
+func (a PasswordAlgorithms) AddTo(m *stun.Message) error {
+	v := make([]byte, passwordAlgorithmSize*len(a))
+	for i, algorithm := range a {
+		binary.BigEndian.PutUint16(v[i*passwordAlgorithmSize:], uint16(algorithm))
+	}
+	m.Add(AttrPasswordAlgorithms, v)
+	return nil
+}
+
+// GetFrom decodes PASSWORD-ALGORITHMS from message.
+func (a *PasswordAlgorithms) GetFrom(m *stun.Message) error {
+	v, err := m.Get(AttrPasswordAlgorithms)
+	if err != nil {
+		return err
+	}
+	algorithms, err := decodePasswordAlgorithms(v)
+	if err != nil {
+		return err
+	}
+	*a = algorithms
+	return nil
+}
+
+// Contains returns true if algorithm is one of a
+func (a PasswordAlgorithms) Contains(algorithm PasswordAlgorithm) bool {
+	for _, v := range a {
+		if v == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// decodePasswordAlgorithms decodes a list of algorithms, the parameters of every
+// algorithm are padded to 4 bytes and skipped
+func decodePasswordAlgorithms(v []byte) ([]PasswordAlgorithm, error) {
+	var algorithms []PasswordAlgorithm
+	for len(v) > 0 {
+		if len(v) < passwordAlgorithmSize {
+			return nil, ErrBadPasswordAlgorithms
+		}
+		paramsLength := nearestPaddedValueLength(int(binary.BigEndian.Uint16(v[2:])))
+		if len(v) < passwordAlgorithmSize+paramsLength {
+			return nil, ErrBadPasswordAlgorithms
+		}
+		algorithms = append(algorithms, PasswordAlgorithm(binary.BigEndian.Uint16(v)))
+		v = v[passwordAlgorithmSize+paramsLength:]
+	}
+	return algorithms, nil
+}
+
+// MessageIntegritySHA256 represents MESSAGE-INTEGRITY-SHA256 attribute, it is
+// the HMAC-SHA256 of the message keyed with the long-term or short-term key.
+//
+// RFC 8489 Section 14.6
+type MessageIntegritySHA256 []byte
+
+// NewLongTermIntegritySHA256 returns a MessageIntegritySHA256 keyed with the long-term
+// credentials, the key is derived with PasswordAlgorithmSHA256. Username, realm and
+// password must be SASL-prepared.
+//
+// RFC 8489 Section 9.2.2
+func NewLongTermIntegritySHA256(username, realm, password string) MessageIntegritySHA256 {
+	key := sha256.Sum256([]byte(strings.Join([]string{username, realm, password}, ":")))
+	return MessageIntegritySHA256(key[:])
+}
+
+const (
+	messageHeaderSize   = 20
+	attributeHeaderSize = 4
+)
+
+// AddTo adds MESSAGE-INTEGRITY-SHA256 to message, like MESSAGE-INTEGRITY it must
+// precede FINGERPRINT.
+func (i MessageIntegritySHA256) AddTo(m *stun.Message) error {
+	if m.Contains(stun.AttrFingerprint) {
+		return stun.ErrFingerprintBeforeIntegrity
+	}
+
+	// The HMAC covers the message up to the attribute, with a length that includes it
+	length := m.Length
+	m.Length += sha256.Size + attributeHeaderSize
+	m.WriteLength()
+	mac := hmac.New(sha256.New, i)
+	_, _ = mac.Write(m.Raw)
+	m.Length = length
+
+	m.Add(AttrMessageIntegritySHA256, mac.Sum(nil))
+	return nil
+}
+
+// Check checks MESSAGE-INTEGRITY-SHA256 of message.
+func (i MessageIntegritySHA256) Check(m *stun.Message) error {
+	v, err := m.Get(AttrMessageIntegritySHA256)
+	if err != nil {
+		return err
+	}
+
+	// The HMAC covers the attributes before MESSAGE-INTEGRITY-SHA256, with a length
+	// that excludes the ones after it
+	offset := messageHeaderSize
+	for _, a := range m.Attributes {
+		if a.Type == AttrMessageIntegritySHA256 {
+			break
+		}
+		offset += attributeHeaderSize + nearestPaddedValueLength(int(a.Length))
+	}
+
+	length := m.Length
+	m.Length = uint32(offset - messageHeaderSize + attributeHeaderSize + len(v))
+	m.WriteLength()
+	mac := hmac.New(sha256.New, i)
+	_, _ = mac.Write(m.Raw[:offset])
+	m.Length = length
+	m.WriteLength()
+
+	if !hmac.Equal(v, mac.Sum(nil)) {
+		return stun.ErrIntegrityMismatch
+	}
+	return nil
+}
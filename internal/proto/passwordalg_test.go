@@ -0,0 +1,56 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordAlgorithms(t *testing.T) {
+	m, err := stun.Build(stun.BindingRequest,
+		PasswordAlgorithms{PasswordAlgorithmSHA256, PasswordAlgorithmMD5},
+		PasswordAlgorithmSHA256,
+	)
+	assert.NoError(t, err)
+
+	var algorithms PasswordAlgorithms
+	assert.NoError(t, algorithms.GetFrom(m))
+	assert.Equal(t, PasswordAlgorithms{PasswordAlgorithmSHA256, PasswordAlgorithmMD5}, algorithms)
+	assert.True(t, algorithms.Contains(PasswordAlgorithmMD5))
+	assert.False(t, algorithms.Contains(PasswordAlgorithm(3)))
+
+	var algorithm PasswordAlgorithm
+	assert.NoError(t, algorithm.GetFrom(m))
+	assert.Equal(t, PasswordAlgorithmSHA256, algorithm)
+	assert.Equal(t, "SHA-256", algorithm.String())
+
+	// The parameters of unknown algorithms are skipped
+	m = stun.New()
+	m.Add(AttrPasswordAlgorithms, []byte{0x00, 0x03, 0x00, 0x01, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00})
+	assert.NoError(t, algorithms.GetFrom(m))
+	assert.Equal(t, PasswordAlgorithms{3, PasswordAlgorithmSHA256}, algorithms)
+
+	m = stun.New()
+	m.Add(AttrPasswordAlgorithms, []byte{0x00, 0x03, 0x00, 0x08, 0xFF, 0x00, 0x00, 0x00})
+	assert.Equal(t, ErrBadPasswordAlgorithms, algorithms.GetFrom(m))
+}
+
+func TestMessageIntegritySHA256(t *testing.T) {
+	integrity := NewLongTermIntegritySHA256("user", "realm", "pass")
+	m, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+		stun.NewUsername("user"),
+		integrity,
+		stun.Fingerprint,
+	)
+	assert.NoError(t, err)
+
+	decoded := &stun.Message{Raw: append([]byte(nil), m.Raw...)}
+	assert.NoError(t, decoded.Decode())
+	assert.NoError(t, integrity.Check(decoded))
+	assert.NoError(t, stun.Fingerprint.Check(decoded))
+	assert.Equal(t, stun.ErrIntegrityMismatch, NewLongTermIntegritySHA256("user", "realm", "wrong").Check(decoded))
+
+	_, err = stun.Build(stun.BindingRequest, stun.Fingerprint, integrity)
+	assert.Equal(t, stun.ErrFingerprintBeforeIntegrity, err)
+}
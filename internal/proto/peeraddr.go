@@ -29,7 +29,7 @@ func (a PeerAddress) AddTo(m *stun.Message) error {
 
 // GetFrom decodes XOR-PEER-ADDRESS from message.
 func (a *PeerAddress) GetFrom(m *stun.Message) error {
-	return (*stun.XORMappedAddress)(a).GetFromAs(m, stun.AttrXORPeerAddress)
+	return getXORAddr((*stun.XORMappedAddress)(a), m, stun.AttrXORPeerAddress)
 }
 
 // XORPeerAddress implements XOR-PEER-ADDRESS attribute.
@@ -28,7 +28,7 @@ func (a RelayedAddress) AddTo(m *stun.Message) error {
 
 // GetFrom decodes XOR-PEER-ADDRESS from message.
 func (a *RelayedAddress) GetFrom(m *stun.Message) error {
-	return (*stun.XORMappedAddress)(a).GetFromAs(m, stun.AttrXORRelayedAddress)
+	return getXORAddr((*stun.XORMappedAddress)(a), m, stun.AttrXORRelayedAddress)
 }
 
 // XORRelayedAddress implements XOR-RELAYED-ADDRESS attribute.
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v2/internal/ipnet"
+)
+
+// DefaultAuthKeyCacheSize is the number of keys an AuthKeyCache keeps when no size is given
+const DefaultAuthKeyCacheSize = 4096
+
+// authKey identifies a user of a client, the source address is kept as an IP and port
+// rather than a string so looking a key up doesn't allocate
+type authKey struct {
+	ip       [net.IPv6len]byte
+	port     int
+	realm    string
+	username string
+}
+
+type authKeyEntry struct {
+	key     []byte
+	user    user
+	expires time.Time
+}
+
+// AuthKeyCache remembers the keys the AuthHandler, TenantAuthHandler or ContextAuthHandler
+// returned for the users of each client, keyed by source address, realm and username. The
+// Refresh, CreatePermission and ChannelBind requests that follow an Allocate are checked with
+// the cached key instead of calling the handler, which usually derives the key from a password
+// or looks it up in a database, every time.
+//
+// Keys are forgotten ttl after they were returned, and as soon as a request fails the integrity
+// check with them. The cache holds at most size keys, keys aren't cached while it is full of
+// unexpired ones.
+type AuthKeyCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[authKey]authKeyEntry
+}
+
+// NewAuthKeyCache creates an AuthKeyCache, a size of 0 or less uses DefaultAuthKeyCacheSize
+func NewAuthKeyCache(size int, ttl time.Duration) *AuthKeyCache {
+	if size <= 0 {
+		size = DefaultAuthKeyCacheSize
+	}
+
+	return &AuthKeyCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[authKey]authKeyEntry{},
+	}
+}
+
+func newAuthKey(srcAddr net.Addr, realm, username string) authKey {
+	k := authKey{realm: realm, username: username}
+	if ip, port, err := ipnet.AddrIPPort(srcAddr); err == nil {
+		copy(k.ip[:], ip.To16())
+		k.port = port
+	}
+	return k
+}
+
+func (c *AuthKeyCache) get(k authKey) ([]byte, user, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[k]
+	if !ok {
+		return nil, user{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, k)
+		return nil, user{}, false
+	}
+	return entry.key, entry.user, true
+}
+
+func (c *AuthKeyCache) put(k authKey, key []byte, u user) {
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.entries) >= c.size {
+		for other, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, other)
+			}
+		}
+		if len(c.entries) >= c.size {
+			return
+		}
+	}
+	c.entries[k] = authKeyEntry{key: key, user: u, expires: now.Add(c.ttl)}
+}
+
+func (c *AuthKeyCache) remove(k authKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.entries, k)
+}
@@ -0,0 +1,89 @@
+// +build !js
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthKeyCache(t *testing.T) {
+	srcAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+	t.Run("TTL", func(t *testing.T) {
+		c := NewAuthKeyCache(0, 10*time.Millisecond)
+		assert.Equal(t, DefaultAuthKeyCacheSize, c.size)
+
+		c.put(newAuthKey(srcAddr, "pion.ly", "user"), []byte("key"), user{username: "user", tenant: "tenant"})
+		key, u, ok := c.get(newAuthKey(srcAddr, "pion.ly", "user"))
+		assert.True(t, ok)
+		assert.Equal(t, []byte("key"), key)
+		assert.Equal(t, "tenant", u.tenant)
+
+		// Keys are per source address, realm and username
+		_, _, ok = c.get(newAuthKey(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5001}, "pion.ly", "user"))
+		assert.False(t, ok)
+		_, _, ok = c.get(newAuthKey(srcAddr, "other.pion.ly", "user"))
+		assert.False(t, ok)
+
+		time.Sleep(20 * time.Millisecond)
+		_, _, ok = c.get(newAuthKey(srcAddr, "pion.ly", "user"))
+		assert.False(t, ok)
+		assert.Empty(t, c.entries)
+	})
+
+	t.Run("Size", func(t *testing.T) {
+		c := NewAuthKeyCache(1, time.Minute)
+		c.put(newAuthKey(srcAddr, "pion.ly", "a"), []byte("a"), user{username: "a"})
+		c.put(newAuthKey(srcAddr, "pion.ly", "b"), []byte("b"), user{username: "b"})
+
+		_, _, ok := c.get(newAuthKey(srcAddr, "pion.ly", "a"))
+		assert.True(t, ok)
+		_, _, ok = c.get(newAuthKey(srcAddr, "pion.ly", "b"))
+		assert.False(t, ok)
+	})
+}
+
+func TestHandleRequestAuthKeyCache(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+	r.AuthKeyCache = NewAuthKeyCache(0, time.Minute)
+
+	calls := 0
+	password := "user"
+	r.AuthHandler = func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+		calls++
+		return []byte(password), true
+	}
+
+	request := func(method stun.Method, setters ...stun.Setter) {
+		setters = append([]stun.Setter{stun.TransactionID, stun.NewType(method, stun.ClassRequest)}, setters...)
+		m, err := stun.Build(append(setters,
+			stun.NewUsername("user"), stun.NewRealm("pion.ly"), stun.NewNonce(testNonce),
+			stun.MessageIntegrity(password))...)
+		assert.NoError(t, err)
+
+		r.Buff = m.Raw
+		assert.NoError(t, HandleRequest(r))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+	}
+
+	// The requests that follow the Allocate are checked with the cached key
+	request(stun.MethodAllocate, proto.RequestedTransport{Protocol: proto.ProtoUDP})
+	assert.Equal(t, 1, calls)
+	request(stun.MethodRefresh)
+	request(stun.MethodCreatePermission, proto.PeerAddress{IP: net.IPv4(127, 0, 0, 2), Port: 5000})
+	assert.Equal(t, 1, calls)
+
+	// A request the cached key doesn't match asks the AuthHandler again
+	password = "changed"
+	request(stun.MethodRefresh)
+	assert.Equal(t, 2, calls)
+	request(stun.MethodRefresh)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,47 @@
+package server
+
+// AuthResult is the outcome of authenticating a request, see Request.OnAuthResult
+type AuthResult int
+
+const (
+	// AuthResultSuccess is a request with valid credentials
+	AuthResultSuccess AuthResult = iota + 1
+
+	// AuthResultMissingIntegrity is a request without MESSAGE-INTEGRITY, answered with a
+	// 401 carrying the NONCE to authenticate with. Every first Allocate is one
+	AuthResultMissingIntegrity
+
+	// AuthResultBadIntegrity is a request of a known user whose MESSAGE-INTEGRITY doesn't
+	// match, e.g. because of a wrong password, answered with a 401
+	AuthResultBadIntegrity
+
+	// AuthResultStaleNonce is a request with a NONCE the server didn't issue, that expired or
+	// whose session outlived MaxSessionDuration, answered with a 438
+	AuthResultStaleNonce
+
+	// AuthResultUnknownUser is a request of a user the AuthHandler doesn't know, answered with a 401
+	AuthResultUnknownUser
+
+	// AuthResultRejected is a request with a REALM that isn't served, a username refused by
+	// the UsernameValidator or a NONCE the NonceHandler found invalid, answered with a 401
+	AuthResultRejected
+)
+
+func (r AuthResult) String() string {
+	switch r {
+	case AuthResultSuccess:
+		return "Success"
+	case AuthResultMissingIntegrity:
+		return "MissingIntegrity"
+	case AuthResultBadIntegrity:
+		return "BadIntegrity"
+	case AuthResultStaleNonce:
+		return "StaleNonce"
+	case AuthResultUnknownUser:
+		return "UnknownUser"
+	case AuthResultRejected:
+		return "Rejected"
+	default:
+		return "Unknown"
+	}
+}
@@ -0,0 +1,167 @@
+// +build gofuzz
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/allocation"
+)
+
+// fuzzKey is the key of every user, requests of the fuzzer with a USERNAME are
+// signed with it so the handlers behind the authentication are reached
+var fuzzKey = stun.MessageIntegrity("fuzz")
+
+// FuzzHandleRequest feeds data to HandleRequest as UDP datagrams from the same client, data
+// is split into datagrams at the lengths in the STUN and ChannelData headers so a sequence of
+// requests, e.g. an Allocate followed by a ChannelBind, reaches the handlers of an allocation.
+// A STUN message with a USERNAME is signed again with the key of the user, with a fresh
+// FINGERPRINT, so the fuzzer can reach the TURN methods without computing HMACs. It must
+// never panic or block. Build it with go-fuzz-build -tags gofuzz -func FuzzHandleRequest
+func FuzzHandleRequest(data []byte) int {
+	r, closeRequest := newFuzzRequest()
+	defer closeRequest()
+
+	handled := 0
+	for _, datagram := range splitFuzzDatagrams(data) {
+		r.Buff = signFuzzMessage(datagram)
+		if err := HandleRequest(r); err == nil {
+			handled = 1
+		}
+	}
+	return handled
+}
+
+// splitFuzzDatagrams splits data after every STUN or ChannelData message, what doesn't
+// make up a complete message is the last datagram
+func splitFuzzDatagrams(data []byte) [][]byte {
+	var datagrams [][]byte
+	for len(data) >= 4 {
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if data[0]&0xC0 == 0x40 {
+			length = 4 + (length+3)/4*4
+		} else {
+			length += 20
+		}
+		if length > len(data) {
+			break
+		}
+		datagrams = append(datagrams, data[:length])
+		data = data[length:]
+	}
+	if len(data) > 0 {
+		datagrams = append(datagrams, data)
+	}
+	return datagrams
+}
+
+// newFuzzRequest returns a Request with every optional feature enabled, relayed and answered
+// over in-memory connections. The returned func releases the allocations it created
+func newFuzzRequest() (Request, func()) {
+	log := logging.NewDefaultLoggerFactory().NewLogger("fuzz")
+	log.(*logging.DefaultLeveledLogger).SetLevel(logging.LogLevelDisabled)
+
+	allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
+		AllocatePacketConn: func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			conn := newFuzzConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 49152})
+			return conn, conn.LocalAddr(), nil
+		},
+		AllocateConn: func(network string, requestedPort int) (net.Conn, net.Addr, error) {
+			return nil, nil, fmt.Errorf("TCP relays are not fuzzed")
+		},
+		LeveledLogger: log,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	conn := newFuzzConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478})
+	r := Request{
+		Conn:              conn,
+		SrcAddr:           &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000},
+		AllocationManager: allocationManager,
+		Nonces:            &sync.Map{},
+		AuthHandler: func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return fuzzKey, true
+		},
+		NonceHandler:       fuzzNonceHandler{},
+		Log:                log,
+		Realm:              "pion.ly",
+		ChannelBindTimeout: time.Minute,
+		TransactionCache:   NewTransactionCache(16, time.Minute),
+		BindingRateLimiter: NewRateLimiter(1000, 1000),
+		Sessions:           NewSessions(),
+		MaxSessionDuration: time.Hour,
+	}
+
+	return r, func() {
+		_ = allocationManager.Close()
+		_ = conn.Close()
+	}
+}
+
+// signFuzzMessage signs a STUN message with a USERNAME with fuzzKey, other data is returned as is
+func signFuzzMessage(data []byte) []byte {
+	m := &stun.Message{Raw: append([]byte{}, data...)}
+	if m.Decode() != nil || !m.Contains(stun.AttrUsername) {
+		return data
+	}
+
+	signed := &stun.Message{Type: m.Type, TransactionID: m.TransactionID}
+	signed.WriteHeader()
+	for _, a := range m.Attributes {
+		if a.Type != stun.AttrMessageIntegrity && a.Type != stun.AttrFingerprint {
+			signed.Add(a.Type, a.Value)
+		}
+	}
+	if fuzzKey.AddTo(signed) != nil || stun.Fingerprint.AddTo(signed) != nil {
+		return data
+	}
+	return signed.Raw
+}
+
+// fuzzNonceHandler accepts every NONCE
+type fuzzNonceHandler struct{}
+
+func (fuzzNonceHandler) Generate(srcAddr net.Addr) string { return "fuzz" }
+
+func (fuzzNonceHandler) Validate(srcAddr net.Addr, nonce string) (ok bool, stale bool) {
+	return true, false
+}
+
+// fuzzConn is a net.PacketConn that drops what is written to it and blocks reads until closed
+type fuzzConn struct {
+	addr      net.Addr
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFuzzConn(addr net.Addr) *fuzzConn {
+	return &fuzzConn{addr: addr, closed: make(chan struct{})}
+}
+
+func (c *fuzzConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	<-c.closed
+	return 0, nil, io.EOF
+}
+
+func (c *fuzzConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+func (c *fuzzConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fuzzConn) LocalAddr() net.Addr                { return c.addr }
+func (c *fuzzConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
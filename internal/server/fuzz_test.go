@@ -0,0 +1,47 @@
+// +build gofuzz,!js
+
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/test"
+)
+
+// fuzzCorpus returns the inputs in fuzz/<function>/<typ>, the layout of go-fuzz
+func fuzzCorpus(t *testing.T, function, typ string) map[string][]byte {
+	dir := filepath.Join("fuzz", function, typ)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corpus := map[string][]byte{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		corpus[f.Name()] = data
+	}
+	return corpus
+}
+
+// TestFuzzHandleRequestCorpus runs the seed corpus of FuzzHandleRequest, every input
+// must be handled without panicking or blocking. Run it with go test -tags gofuzz
+func TestFuzzHandleRequestCorpus(t *testing.T) {
+	lim := test.TimeOut(time.Second * 10)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	for name, data := range fuzzCorpus(t, "handle-request", "corpus") {
+		t.Run(name, func(t *testing.T) {
+			FuzzHandleRequest(data)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// rateLimiterPruneInterval is how often buckets that refilled are forgotten
+	rateLimiterPruneInterval = time.Minute
+
+	// rateLimiterFullPruneInterval is how often a full RateLimiter looks for buckets that
+	// refilled, rather than going through all of them for every request of a new IP
+	rateLimiterFullPruneInterval = time.Second
+)
+
+// DefaultRateLimiterMaxIPs is the number of source IPs a RateLimiter keeps a bucket for
+const DefaultRateLimiterMaxIPs = 65536
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the rate of requests per source IP with a token bucket per IP.
+// Every IP may send burst requests at once, and rate requests per second after that.
+// At most DefaultRateLimiterMaxIPs buckets are kept, so a flood from spoofed source IPs
+// can't grow it without bound: once it is full, requests of IPs without a bucket are
+// refused until buckets refill and are forgotten. It is safe for concurrent use
+type RateLimiter struct {
+	dropped uint64 // accessed atomically, kept first for 64-bit alignment
+
+	lock       sync.Mutex
+	rate       float64
+	burst      float64
+	maxBuckets int
+	buckets    map[string]*rateBucket
+	lastPrune  time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing rate requests per second and bursts of burst requests per IP
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		maxBuckets: DefaultRateLimiterMaxIPs,
+		buckets:    map[string]*rateBucket{},
+		lastPrune:  time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of ip, it returns false when the bucket is
+// empty and the request must be dropped
+func (l *RateLimiter) Allow(ip string) bool {
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastPrune) >= rateLimiterPruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		if len(l.buckets) >= l.maxBuckets && now.Sub(l.lastPrune) >= rateLimiterFullPruneInterval {
+			l.prune(now)
+		}
+		if len(l.buckets) >= l.maxBuckets {
+			atomic.AddUint64(&l.dropped, 1)
+			return false
+		}
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		atomic.AddUint64(&l.dropped, 1)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Dropped returns the number of requests Allow refused
+func (l *RateLimiter) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// prune forgets the buckets that are full again, a new bucket starts out full
+func (l *RateLimiter) prune(now time.Time) {
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+	l.lastPrune = now
+}
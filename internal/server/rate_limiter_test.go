@@ -0,0 +1,56 @@
+// +build !js
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(10, 3)
+
+	// A burst is allowed, every IP has a bucket of its own
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow("127.0.0.1"))
+	}
+	assert.False(t, l.Allow("127.0.0.1"))
+	assert.True(t, l.Allow("127.0.0.2"))
+	assert.Equal(t, uint64(1), l.Dropped())
+
+	// The bucket refills at rate
+	l.buckets["127.0.0.1"].last = time.Now().Add(-150 * time.Millisecond)
+	assert.True(t, l.Allow("127.0.0.1"))
+	assert.False(t, l.Allow("127.0.0.1"))
+
+	// Buckets that refilled are forgotten
+	l.buckets["127.0.0.2"].last = time.Now().Add(-time.Second)
+	l.lastPrune = time.Now().Add(-rateLimiterPruneInterval)
+	assert.False(t, l.Allow("127.0.0.1"))
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestRateLimiterMaxIPs(t *testing.T) {
+	l := NewRateLimiter(10, 3)
+	l.maxBuckets = 2
+
+	// Once full, IPs without a bucket are refused while the others keep theirs
+	assert.True(t, l.Allow("127.0.0.1"))
+	assert.True(t, l.Allow("127.0.0.2"))
+	for i := 0; i < 10; i++ {
+		assert.False(t, l.Allow(fmt.Sprintf("10.0.0.%d", i)))
+	}
+	assert.True(t, l.Allow("127.0.0.1"))
+	assert.Len(t, l.buckets, 2)
+	assert.Equal(t, uint64(10), l.Dropped())
+
+	// A full RateLimiter forgets the buckets that refilled without waiting for the prune interval
+	l.buckets["127.0.0.2"].last = time.Now().Add(-time.Second)
+	l.lastPrune = time.Now().Add(-rateLimiterFullPruneInterval)
+	assert.True(t, l.Allow("10.0.0.1"))
+	assert.Len(t, l.buckets, 2)
+	assert.NotContains(t, l.buckets, "127.0.0.2")
+}
@@ -15,7 +15,7 @@ import (
 
 // Request contains all the state needed to process a single incoming datagram
 type Request struct {
-	// Current Request State
+	// Current Request State, the request was read from Conn and is answered on it
 	Conn    net.PacketConn
 	SrcAddr net.Addr
 	Buff    []byte
@@ -26,20 +26,103 @@ type Request struct {
 
 	// User Configuration
 	AuthHandler        func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool)
+	TenantAuthHandler  func(username string, realm string, srcAddr net.Addr) (key []byte, tenant string, ok bool)
+	ContextAuthHandler func(username string, realm string, srcAddr net.Addr) (key []byte, context interface{}, ok bool)
+	TenantRelays       map[string]func(network string, requestedPort int) (net.PacketConn, net.Addr, error)
+	OnAuthFailure      func(username string, realm string, srcAddr net.Addr)
+	UsernameValidator  func(username string) bool
 	Log                logging.LeveledLogger
 	Realm              string
+	AdditionalRealms   []string
 	ChannelBindTimeout time.Duration
+	STUNOnly           bool
+	DisableFingerprint bool
+
+	// TransactionCache deduplicates retransmitted requests, nil disables it
+	TransactionCache *TransactionCache
+
+	// BindingRateLimiter drops the Binding requests of source IPs sending too many, nil disables it
+	BindingRateLimiter *RateLimiter
+
+	// AuthKeyCache caches the keys returned by the auth handlers per client, nil disables it
+	AuthKeyCache *AuthKeyCache
+
+	// Sessions holds the start of every authenticated session, a session is
+	// answered with a 438 (Stale Nonce) once it is older than MaxSessionDuration.
+	// Zero or a nil Sessions disables it
+	Sessions           *Sessions
+	MaxSessionDuration time.Duration
+
+	// NonceHandler generates and validates NONCEs instead of Nonces when set
+	NonceHandler NonceHandler
+
+	// SecurityFeatures are advertised in a nonce cookie every NONCE starts with, none
+	// are advertised and NONCEs have no cookie when it is 0
+	SecurityFeatures proto.SecurityFeatures
+
+	// OnAuthResult is called with the outcome of every authenticated request, malformed
+	// requests answered with a 400 aren't counted. Optional
+	OnAuthResult func(result AuthResult)
+
+	// ShadowAuthHandler decides every request with credentials again next to the AuthHandler,
+	// TenantAuthHandler or ContextAuthHandler, without affecting the response. Its decisions
+	// that differ are logged and reported to OnShadowAuthDiscrepancy. Optional
+	ShadowAuthHandler       func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool)
+	OnShadowAuthDiscrepancy func()
+
+	// RealmQuota returns the allocation.Quota the allocations of a realm are counted in
+	// and capped by, nil for none. Optional
+	RealmQuota func(realm string) *allocation.Quota
+
+	// RequestTimeout bounds how long handling the request may wait on blocking work, i.e.
+	// allocating a relay. The request is answered with a 500 (Server Error) once it passed,
+	// zero or a negative value disables it
+	RequestTimeout time.Duration
+
+	// OnExpiredPermissionDrop is called for every Send indication dropped because the
+	// permission of its peer expired. They are logged at debug level when
+	// LogExpiredPermissionDrops is set. Optional
+	OnExpiredPermissionDrop   func()
+	LogExpiredPermissionDrops bool
+
+	// OnBindingRateLimited is called for every Binding request the BindingRateLimiter drops. Optional
+	OnBindingRateLimited func(srcAddr net.Addr)
+
+	// MinAllocationLifetime is the shortest lifetime granted by Allocate and Refresh requests,
+	// shorter ones are raised to it. A LIFETIME of 0 still deletes the allocation. Zero disables it
+	MinAllocationLifetime time.Duration
+
+	// AllowedTransports are the REQUESTED-TRANSPORTs an Allocate may ask for, among the
+	// implemented ones. Only UDP is implemented, so it is the only transport this can
+	// restrict. Nil allows every implemented transport
+	AllowedTransports []proto.Protocol
+}
+
+// NonceHandler generates the NONCEs clients are challenged with and validates the
+// ones they authenticate with, it must be safe for concurrent use
+type NonceHandler interface {
+	Generate(srcAddr net.Addr) string
+	Validate(srcAddr net.Addr, nonce string) (ok bool, stale bool)
 }
 
 // HandleRequest processes the give Request
 func HandleRequest(r Request) error {
 	r.Log.Debugf("received %d bytes of udp from %s on %s", len(r.Buff), r.SrcAddr.String(), r.Conn.LocalAddr().String())
 
-	if proto.IsChannelData(r.Buff) {
+	// https://tools.ietf.org/html/rfc5766#section-11
+	// The first two bits are 0b00 for STUN and 0b01 for ChannelData. A packet is
+	// only ever parsed as what they say it is, a malformed ChannelData message
+	// must not be handled as STUN and the other way around
+	switch {
+	case len(r.Buff) == 0:
+		return fmt.Errorf("empty packet from %v", r.SrcAddr)
+	case r.Buff[0]&0xC0 == 0x40:
 		return handleDataPacket(r)
+	case r.Buff[0]&0xC0 == 0x00:
+		return handleTURNPacket(r)
+	default:
+		return fmt.Errorf("packet from %v is neither STUN nor ChannelData, first byte %#x", r.SrcAddr, r.Buff[0])
 	}
-
-	return handleTURNPacket(r)
 }
 
 func handleDataPacket(r Request) error {
@@ -64,12 +147,20 @@ func handleTURNPacket(r Request) error {
 		return fmt.Errorf("failed to create stun message from packet: %v", err)
 	}
 
+	if r.STUNOnly && m.Type.Method != stun.MethodBinding {
+		return rejectTURNMessage(r, m)
+	}
+
 	h, err := getMessageHandler(m.Type.Class, m.Type.Method)
 	if err != nil {
-		return fmt.Errorf("unhandled STUN packet %v-%v from %v: %v", m.Type.Method, m.Type.Class, r.SrcAddr, err)
+		return handleUnknownMessage(r, m, err)
 	}
 
-	err = h(r, m)
+	if r.TransactionCache != nil && m.Type.Class == stun.ClassRequest {
+		err = handleCachedRequest(r, m, h)
+	} else {
+		err = h(r, m)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to handle %v-%v from %v: %v", m.Type.Method, m.Type.Class, r.SrcAddr, err)
 	}
@@ -77,6 +168,37 @@ func handleTURNPacket(r Request) error {
 	return nil
 }
 
+// codeMethodNotAllowed isn't registered for STUN, like the HTTP status it is named after it
+// tells the client that the server doesn't serve the method rather than refusing the user
+const codeMethodNotAllowed stun.ErrorCode = 405
+
+// rejectTURNMessage refuses TURN methods when the server is configured to only answer
+// Binding requests. Requests get a 405 (Method Not Allowed), indications are dropped
+func rejectTURNMessage(r Request, m *stun.Message) error {
+	err := fmt.Errorf("refusing %v-%v from %v, server is STUN only", m.Type.Method, m.Type.Class, r.SrcAddr)
+	if m.Type.Class != stun.ClassRequest {
+		return err
+	}
+
+	msg := buildMsg(m.TransactionID, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+		&stun.ErrorCodeAttribute{Code: codeMethodNotAllowed, Reason: []byte("Method Not Allowed")})
+	return buildAndSendErr(r.Conn, r.SrcAddr, err, msg...)
+}
+
+// handleUnknownMessage answers a request of a method the server doesn't implement with a
+// 400 (Bad Request), indications and responses are dropped. Neither is an error of the
+// server, clients may use STUN extensions it doesn't know about
+func handleUnknownMessage(r Request, m *stun.Message, err error) error {
+	r.Log.Debugf("unhandled STUN packet %v-%v from %v: %v", m.Type.Method, m.Type.Class, r.SrcAddr, err)
+	if m.Type.Class != stun.ClassRequest {
+		return nil
+	}
+
+	msg := buildMsg(m.TransactionID, stun.NewType(m.Type.Method, stun.ClassErrorResponse),
+		&stun.ErrorCodeAttribute{Code: stun.CodeBadRequest, Reason: []byte("Unknown Method")})
+	return buildAndSend(r.Conn, r.SrcAddr, msg...)
+}
+
 func getMessageHandler(class stun.MessageClass, method stun.Method) (func(r Request, m *stun.Message) error, error) {
 	switch class {
 	case stun.ClassIndication:
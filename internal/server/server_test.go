@@ -0,0 +1,251 @@
+// +build !js
+
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleRequestSTUNOnly(t *testing.T) {
+	for _, stunOnly := range []bool{false, true} {
+		r, clientConn := newTestRequest(t, nil)
+		r.STUNOnly = stunOnly
+
+		// Binding is answered in both modes
+		bindingRequest, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		assert.NoError(t, err)
+
+		r.Buff = bindingRequest.Raw
+		assert.NoError(t, HandleRequest(r))
+
+		res := readTestResponse(t, clientConn)
+		assert.Equal(t, stun.BindingSuccess, res.Type)
+
+		var mappedAddr stun.XORMappedAddress
+		assert.NoError(t, mappedAddr.GetFrom(res))
+		assert.Equal(t, clientConn.LocalAddr().String(), (&net.UDPAddr{IP: mappedAddr.IP, Port: mappedAddr.Port}).String())
+
+		// Allocate starts the auth handshake in mixed mode, and is refused in STUN only mode
+		allocateRequest, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest), proto.RequestedTransport{Protocol: proto.ProtoUDP})
+		assert.NoError(t, err)
+
+		r.Buff = allocateRequest.Raw
+		if stunOnly {
+			assert.Error(t, HandleRequest(r))
+			assertErrorCode(t, readTestResponse(t, clientConn), codeMethodNotAllowed)
+		} else {
+			assert.NoError(t, HandleRequest(r))
+			assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeUnauthorized)
+		}
+
+		closeTestRequest(t, r, clientConn)
+	}
+}
+
+func TestHandleRequestUnknownMethod(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+
+	const unknownMethod = stun.Method(0x0123)
+
+	// A request is answered with a 400
+	request, err := stun.Build(stun.TransactionID, stun.NewType(unknownMethod, stun.ClassRequest), stun.Fingerprint)
+	assert.NoError(t, err)
+
+	r.Buff = request.Raw
+	assert.NoError(t, HandleRequest(r))
+
+	res := readTestResponse(t, clientConn)
+	assert.Equal(t, stun.NewType(unknownMethod, stun.ClassErrorResponse), res.Type)
+	assert.Equal(t, request.TransactionID, res.TransactionID)
+	assertErrorCode(t, res, stun.CodeBadRequest)
+
+	// An indication is dropped without an answer
+	indication, err := stun.Build(stun.TransactionID, stun.NewType(unknownMethod, stun.ClassIndication), stun.Fingerprint)
+	assert.NoError(t, err)
+
+	r.Buff = indication.Raw
+	assert.NoError(t, HandleRequest(r))
+
+	assert.NoError(t, clientConn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, _, err = clientConn.ReadFrom(make([]byte, 1500))
+	assert.Error(t, err)
+}
+
+// ICE connectivity checks carry attributes the server doesn't know, some of them
+// comprehension-required, and short-term credentials it can't check
+func TestHandleRequestICEBinding(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+	r.ChannelBindTimeout = time.Minute
+
+	buildCheck := func() *stun.Message {
+		m, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("remote:local"),
+			stun.RawAttribute{Type: stun.AttrPriority, Value: []byte{0x6e, 0x00, 0x1e, 0xff}},
+			stun.RawAttribute{Type: stun.AttrUseCandidate},
+			stun.RawAttribute{Type: stun.AttrICEControlling, Value: make([]byte, 8)},
+			stun.NewShortTermIntegrity("password"),
+			stun.Fingerprint,
+		)
+		assert.NoError(t, err)
+		return m
+	}
+
+	// A check sent to the server is answered with the mapped address of the sender
+	check := buildCheck()
+	r.Buff = check.Raw
+	assert.NoError(t, HandleRequest(r))
+
+	res := readTestResponse(t, clientConn)
+	assert.Equal(t, stun.BindingSuccess, res.Type)
+	assert.Equal(t, check.TransactionID, res.TransactionID)
+
+	var mappedAddr stun.XORMappedAddress
+	assert.NoError(t, mappedAddr.GetFrom(res))
+	assert.Equal(t, clientConn.LocalAddr().String(), (&net.UDPAddr{IP: mappedAddr.IP, Port: mappedAddr.Port}).String())
+
+	// A check a peer sends to the relay is for the client, it is relayed as is and not answered
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, peerConn.Close())
+	}()
+	peerAddr := peerConn.LocalAddr().(*net.UDPAddr)
+
+	assert.NoError(t, handleAllocateRequest(r, buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP})))
+	assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+	assert.NoError(t, handleChannelBindRequest(r, buildTestRequest(t, stun.MethodChannelBind, "user", proto.ChannelNumber(proto.MinChannelNumber), proto.PeerAddress{IP: peerAddr.IP, Port: peerAddr.Port})))
+	assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+
+	a := r.AllocationManager.GetAllocation(&allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP})
+	assert.NotNil(t, a)
+
+	check = buildCheck()
+	_, err = peerConn.WriteTo(check.Raw, a.RelaySocketAddr())
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	assert.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := clientConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	data := &proto.ChannelData{Raw: buf[:n]}
+	assert.NoError(t, data.Decode())
+	assert.Equal(t, check.Raw, data.Data)
+
+	assert.NoError(t, peerConn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, _, err = peerConn.ReadFrom(buf)
+	assert.Error(t, err)
+}
+
+func TestHandleRequestDisableFingerprint(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		r, clientConn := newTestRequest(t, nil)
+		r.DisableFingerprint = disabled
+
+		bindingRequest, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		assert.NoError(t, err)
+
+		r.Buff = bindingRequest.Raw
+		assert.NoError(t, HandleRequest(r))
+
+		res := readTestResponse(t, clientConn)
+		assert.Equal(t, stun.BindingSuccess, res.Type)
+		assert.Equal(t, !disabled, res.Contains(stun.AttrFingerprint))
+		if !disabled {
+			assert.NoError(t, stun.Fingerprint.Check(res))
+		}
+
+		closeTestRequest(t, r, clientConn)
+	}
+}
+
+// The first two bits tell STUN from ChannelData, a packet must never be handled as the other
+func TestHandleRequestDemux(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, peerConn.Close())
+	}()
+
+	fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+	a, err := r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+	a.AddPermission(allocation.NewPermission(peerConn.LocalAddr(), r.Log))
+	assert.NoError(t, a.AddChannelBind(allocation.NewChannelBind(proto.MinChannelNumber, peerConn.LocalAddr(), r.Log), time.Hour))
+
+	channelData := func(number uint16, length uint16, data []byte) []byte {
+		buf := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint16(buf[0:2], number)
+		binary.BigEndian.PutUint16(buf[2:4], length)
+		return append(buf, data...)
+	}
+	readPeer := func() []byte {
+		assert.NoError(t, peerConn.SetReadDeadline(time.Now().Add(time.Second)))
+		buf := make([]byte, 1500)
+		n, _, readErr := peerConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		return buf[:n]
+	}
+
+	bindingRequest, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	assert.NoError(t, err)
+
+	t.Run("STUN", func(t *testing.T) {
+		r.Buff = bindingRequest.Raw
+		assert.NoError(t, HandleRequest(r))
+		assert.Equal(t, stun.BindingSuccess, readTestResponse(t, clientConn).Type)
+	})
+
+	t.Run("ChannelBoundary", func(t *testing.T) {
+		r.Buff = channelData(0x4000, 5, []byte("Hello"))
+		assert.NoError(t, HandleRequest(r))
+		assert.Equal(t, []byte("Hello"), readPeer())
+
+		// 0x3FFF starts with 0b00, it is STUN without a magic cookie
+		r.Buff = channelData(0x3FFF, 16, make([]byte, 16))
+		err := HandleRequest(r)
+		assert.Error(t, err)
+		assert.True(t, strings.Contains(err.Error(), "stun message"), err.Error())
+	})
+
+	t.Run("ChannelDataCarryingSTUN", func(t *testing.T) {
+		// The payload has the STUN magic cookie where a STUN header would have it,
+		// it is relayed to the peer instead of being answered
+		r.Buff = channelData(0x4000, uint16(len(bindingRequest.Raw)), bindingRequest.Raw)
+		assert.NoError(t, HandleRequest(r))
+		assert.Equal(t, bindingRequest.Raw, readPeer())
+	})
+
+	t.Run("MalformedChannelData", func(t *testing.T) {
+		// A ChannelData message announcing more than it carries is dropped,
+		// not parsed as STUN, even with a magic cookie in it
+		buf := channelData(0x4000, 64, nil)
+		r.Buff = append(buf, bindingRequest.Raw[4:8]...)
+		err := HandleRequest(r)
+		assert.Error(t, err)
+		assert.True(t, strings.Contains(err.Error(), "channel data"), err.Error())
+
+		r.Buff = channelData(0x4001, 5, []byte("Hello"))
+		assert.Error(t, HandleRequest(r))
+	})
+
+	t.Run("Neither", func(t *testing.T) {
+		for _, buf := range [][]byte{nil, channelData(0x8000, 5, []byte("Hello")), channelData(0xC000, 0, nil)} {
+			r.Buff = buf
+			assert.Error(t, HandleRequest(r))
+		}
+	})
+}
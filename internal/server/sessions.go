@@ -0,0 +1,65 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// sessionPruneInterval is how often the sessions of clients that went away are forgotten
+const sessionPruneInterval = time.Minute
+
+type session struct {
+	start    time.Time
+	lastSeen time.Time
+}
+
+// Sessions holds the start of the authenticated session of every client, keyed by source
+// address, realm and username. Sessions not seen for longer than a nonce lives are
+// forgotten, the nonce of the client is stale by then and its next request starts a new
+// session. It is safe for concurrent use
+type Sessions struct {
+	lock      sync.Mutex
+	sessions  map[string]*session
+	lastPrune time.Time
+}
+
+// NewSessions creates an empty Sessions
+func NewSessions() *Sessions {
+	return &Sessions{
+		sessions:  map[string]*session{},
+		lastPrune: timeNow(),
+	}
+}
+
+// expired returns true if the session of key started maxDuration or longer before now, it is
+// forgotten then. A key without a session starts one
+func (s *Sessions) expired(key string, now time.Time, maxDuration time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if now.Sub(s.lastPrune) >= sessionPruneInterval {
+		s.prune(now)
+	}
+
+	sess, ok := s.sessions[key]
+	if !ok {
+		s.sessions[key] = &session{start: now, lastSeen: now}
+		return false
+	}
+	if now.Sub(sess.start) >= maxDuration {
+		delete(s.sessions, key)
+		return true
+	}
+	sess.lastSeen = now
+	return false
+}
+
+// prune forgets the sessions that weren't seen for longer than a nonce lives
+func (s *Sessions) prune(now time.Time) {
+	for key, sess := range s.sessions {
+		if now.Sub(sess.lastSeen) > nonceLifetime {
+			delete(s.sessions, key)
+		}
+	}
+	s.lastPrune = now
+}
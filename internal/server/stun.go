@@ -5,6 +5,9 @@ import (
 	"github.com/pion/turn/v2/internal/ipnet"
 )
 
+// handleBindingRequest answers with the mapped address of the sender. Every other
+// attribute is ignored, so ICE connectivity checks carrying PRIORITY, USE-CANDIDATE,
+// ICE-CONTROLLING and short-term credentials are answered as well
 func handleBindingRequest(r Request, m *stun.Message) error {
 	r.Log.Debugf("received BindingRequest from %s", r.SrcAddr.String())
 
@@ -13,10 +16,23 @@ func handleBindingRequest(r Request, m *stun.Message) error {
 		return err
 	}
 
+	// Excess requests are dropped without an answer, answering them is what
+	// makes the server useful to scan or amplify traffic
+	if r.BindingRateLimiter != nil && !r.BindingRateLimiter.Allow(ip.String()) {
+		r.Log.Debugf("dropping BindingRequest from %s, rate limit exceeded", r.SrcAddr.String())
+		if r.OnBindingRateLimited != nil {
+			r.OnBindingRateLimited(r.SrcAddr)
+		}
+		return nil
+	}
+
 	attrs := buildMsg(m.TransactionID, stun.BindingSuccess, &stun.XORMappedAddress{
 		IP:   ip,
 		Port: port,
-	}, stun.Fingerprint)
+	})
+	if !r.DisableFingerprint {
+		attrs = append(attrs, stun.Fingerprint)
+	}
 
 	return buildAndSend(r.Conn, r.SrcAddr, attrs...)
 }
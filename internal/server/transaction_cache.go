@@ -0,0 +1,146 @@
+package server
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// DefaultTransactionCacheSize is the number of responses a TransactionCache
+// keeps when no size is given
+const DefaultTransactionCacheSize = 1024
+
+type transactionKey struct {
+	local         string
+	remote        string
+	transactionID [stun.TransactionIDSize]byte
+}
+
+type transactionEntry struct {
+	key      transactionKey
+	response []byte
+	expires  time.Time
+}
+
+// TransactionCache remembers the responses sent to recent requests, keyed by
+// transaction ID and source. A retransmitted request is answered with the
+// response sent the first time instead of being processed again.
+//
+// The cache holds at most size responses, the least recently used one is
+// evicted to make room. Responses are forgotten ttl after they were sent.
+type TransactionCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[transactionKey]*list.Element
+	lru     *list.List
+}
+
+// NewTransactionCache creates a TransactionCache, a size of 0 or less uses DefaultTransactionCacheSize
+func NewTransactionCache(size int, ttl time.Duration) *TransactionCache {
+	if size <= 0 {
+		size = DefaultTransactionCacheSize
+	}
+
+	return &TransactionCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[transactionKey]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func newTransactionKey(r Request, m *stun.Message) transactionKey {
+	return transactionKey{
+		local:         r.Conn.LocalAddr().String(),
+		remote:        r.SrcAddr.String(),
+		transactionID: m.TransactionID,
+	}
+}
+
+func (c *TransactionCache) get(key transactionKey) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*transactionEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry.response, true
+}
+
+func (c *TransactionCache) put(key transactionKey, response []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+	}
+
+	c.entries[key] = c.lru.PushFront(&transactionEntry{
+		key:      key,
+		response: response,
+		expires:  time.Now().Add(c.ttl),
+	})
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*transactionEntry).key)
+	}
+}
+
+// responseRecorder keeps a copy of the first datagram written to dst
+type responseRecorder struct {
+	net.PacketConn
+	dst      net.Addr
+	response []byte
+}
+
+func (c *responseRecorder) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err == nil && c.response == nil && addr.String() == c.dst.String() {
+		c.response = append([]byte{}, p[:n]...)
+	}
+	return n, err
+}
+
+// unwrapConn returns the net.PacketConn a request was received on, without the
+// responseRecorder. Allocations must not hold on to the recorder
+func unwrapConn(conn net.PacketConn) net.PacketConn {
+	if rec, ok := conn.(*responseRecorder); ok {
+		return rec.PacketConn
+	}
+	return conn
+}
+
+// handleCachedRequest answers a retransmitted request from the TransactionCache, other
+// requests are handled by h and their response is cached
+func handleCachedRequest(r Request, m *stun.Message, h func(r Request, m *stun.Message) error) error {
+	key := newTransactionKey(r, m)
+	if response, ok := r.TransactionCache.get(key); ok {
+		r.Log.Debugf("answering retransmitted %v-%v from %v with cached response", m.Type.Method, m.Type.Class, r.SrcAddr)
+		_, err := r.Conn.WriteTo(response, r.SrcAddr)
+		return err
+	}
+
+	rec := &responseRecorder{PacketConn: r.Conn, dst: r.SrcAddr}
+	r.Conn = rec
+	err := h(r, m)
+	if rec.response != nil {
+		r.TransactionCache.put(key, rec.response)
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+// +build !js
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionCache(t *testing.T) {
+	key := func(i byte) transactionKey {
+		return transactionKey{local: "127.0.0.1:3478", remote: "127.0.0.1:5000", transactionID: [stun.TransactionIDSize]byte{i}}
+	}
+
+	t.Run("LRU", func(t *testing.T) {
+		c := NewTransactionCache(2, time.Minute)
+		c.put(key(1), []byte{1})
+		c.put(key(2), []byte{2})
+
+		// Using 1 makes 2 the least recently used
+		_, ok := c.get(key(1))
+		assert.True(t, ok)
+
+		c.put(key(3), []byte{3})
+		_, ok = c.get(key(2))
+		assert.False(t, ok)
+
+		for _, i := range []byte{1, 3} {
+			response, ok := c.get(key(i))
+			assert.True(t, ok)
+			assert.Equal(t, []byte{i}, response)
+		}
+		assert.Equal(t, 2, c.lru.Len())
+		assert.Equal(t, 2, len(c.entries))
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		c := NewTransactionCache(0, 10*time.Millisecond)
+		assert.Equal(t, DefaultTransactionCacheSize, c.size)
+
+		c.put(key(1), []byte{1})
+		_, ok := c.get(key(1))
+		assert.True(t, ok)
+
+		time.Sleep(20 * time.Millisecond)
+		_, ok = c.get(key(1))
+		assert.False(t, ok)
+		assert.Equal(t, 0, c.lru.Len())
+	})
+}
+
+func TestHandleRequestRetransmit(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+	r.TransactionCache = NewTransactionCache(0, time.Minute)
+
+	allocateRequest := buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP})
+
+	// A retransmitted Allocate is answered with the same success response instead of a 437 (Allocation Mismatch)
+	var first *stun.Message
+	for i := 0; i < 5; i++ {
+		r.Buff = allocateRequest.Raw
+		assert.NoError(t, HandleRequest(r))
+
+		res := readTestResponse(t, clientConn)
+		assert.Equal(t, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse), res.Type)
+		if first == nil {
+			first = res
+		} else {
+			assert.Equal(t, first.Raw, res.Raw)
+		}
+	}
+
+	// A new transaction is processed again
+	r.Buff = buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP}).Raw
+	assert.Error(t, HandleRequest(r))
+	assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeAllocMismatch)
+
+	// The allocation holds on to the conn the request was received on
+	a := r.AllocationManager.GetAllocation(&allocation.FiveTuple{
+		SrcAddr:  r.SrcAddr,
+		DstAddr:  r.Conn.LocalAddr(),
+		Protocol: allocation.UDP,
+	})
+	assert.NotNil(t, a)
+	assert.Equal(t, r.Conn, a.TurnSocket)
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 
@@ -19,11 +21,22 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 	//    mechanism of [https://tools.ietf.org/html/rfc5389#section-10.2.2]
 	//    unless the client and server agree to use another mechanism through
 	//    some procedure outside the scope of this document.
-	messageIntegrity, hasAuth, err := authenticateRequest(r, m, stun.MethodAllocate)
+	messageIntegrity, u, hasAuth, err := authenticateUser(r, m, stun.MethodAllocate)
 	if !hasAuth {
 		return err
 	}
 
+	// Users of a tenant are relayed by the tenant's relay, a tenant without
+	// one is refused rather than relayed from an address it may not use
+	var allocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error)
+	if u.tenant != "" {
+		var ok bool
+		if allocatePacketConn, ok = r.TenantRelays[u.tenant]; !ok {
+			msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeForbidden})
+			return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("no relay configured for tenant %s", u.tenant), msg...)
+		}
+	}
+
 	fiveTuple := &allocation.FiveTuple{
 		SrcAddr:  r.SrcAddr,
 		DstAddr:  r.Conn.LocalAddr(),
@@ -38,7 +51,17 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 	// 2. The server checks if the 5-tuple is currently in use by an
 	//    existing allocation.  If yes, the server rejects the request with
 	//    a 437 (Allocation Mismatch) error.
+	//
+	// A retransmit of the Allocate request that created the allocation isn't a
+	// conflict, its success response may have been lost. It is sent again, even
+	// when the TransactionCache is disabled or has forgotten it
 	if alloc := r.AllocationManager.GetAllocation(fiveTuple); alloc != nil {
+		if response, ok := alloc.AllocateResponse(m.TransactionID); ok {
+			r.Log.Debugf("answering retransmitted AllocateRequest from %s with the original response", r.SrcAddr.String())
+			_, err = r.Conn.WriteTo(response, r.SrcAddr)
+			return err
+		}
+
 		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAllocMismatch})
 		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("relay already allocated for 5-TUPLE"), msg...)
 	}
@@ -52,11 +75,27 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 	var requestedTransport proto.RequestedTransport
 	if err = requestedTransport.GetFrom(m); err != nil {
 		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+	} else if !r.transportAllowed(requestedTransport.Protocol) {
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeUnsupportedTransProto})
+		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("RequestedTransport %v is not allowed", requestedTransport.Protocol), msg...)
 	} else if requestedTransport.Protocol != proto.ProtoUDP {
 		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeUnsupportedTransProto})
 		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("RequestedTransport must be UDP"), msg...)
 	}
 
+	// https://tools.ietf.org/html/rfc6156#section-4.2
+	// If the REQUESTED-ADDRESS-FAMILY attribute is absent the server MUST
+	// allocate an IPv4 relayed transport address. If the attribute contains
+	// a family the server does not support it MUST reply with a 440
+	// (Address Family not Supported) error.
+	addressFamily := proto.RequestedFamilyIPv4
+	if m.Contains(stun.AttrRequestedAddressFamily) {
+		if err = addressFamily.GetFrom(m); err != nil {
+			msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAddrFamilyNotSupported})
+			return buildAndSendErr(r.Conn, r.SrcAddr, err, msg...)
+		}
+	}
+
 	// 4. The request may contain a DONT-FRAGMENT attribute.  If it does,
 	//    but the server does not support sending UDP datagrams with the DF
 	//    bit set to 1 (see Section 12), then the server treats the DONT-
@@ -106,18 +145,60 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 	//    server is free to define this allocation quota any way it wishes,
 	//    but SHOULD define it based on the username used to authenticate
 	//    the request, and not on the client's transport address.
+	var quota *allocation.Quota
+	if r.RealmQuota != nil {
+		var realm stun.Realm
+		if err = realm.GetFrom(m); err != nil {
+			return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		}
+		quota = r.RealmQuota(realm.String())
+	}
 
 	// 8. Also at any point, the server MAY choose to reject the request
 	//    with a 300 (Try Alternate) error if it wishes to redirect the
 	//    client to a different server.  The use of this error code and
 	//    attribute follow the specification in [RFC5389].
-	lifetimeDuration := allocationLifeTime(m)
-	a, err := r.AllocationManager.CreateAllocation(
+	lifetimeDuration, err := allocationLifeTime(m)
+	if err != nil {
+		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+	} else if lifetimeDuration == 0 {
+		// A LIFETIME of 0 only deletes allocations on Refresh
+		lifetimeDuration = proto.DefaultLifetime
+	}
+	lifetimeDuration = r.minimumLifetime(lifetimeDuration)
+
+	// Allocating the relay may block, e.g. on a RelayAddressGenerator resolving or dialing
+	// something, the request gives up on it once it took RequestTimeout
+	if r.RequestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), r.RequestTimeout)
+		defer cancel()
+
+		if allocatePacketConn == nil {
+			allocatePacketConn = r.AllocationManager.AllocatePacketConn()
+		}
+		allocatePacketConn = allocateWithContext(ctx, r.Log, allocatePacketConn)
+	}
+
+	a, err := r.AllocationManager.CreateAllocationWithRelay(
 		fiveTuple,
-		r.Conn,
+		unwrapConn(r.Conn),
 		requestedPort,
-		lifetimeDuration)
-	if err != nil {
+		lifetimeDuration,
+		addressFamily,
+		allocatePacketConn,
+		quota,
+		u.username,
+		u.context)
+	if err == allocation.ErrAllocationQuotaReached {
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAllocQuotaReached})
+		return buildAndSendErr(r.Conn, r.SrcAddr, err, msg...)
+	} else if err == allocation.ErrAddressFamilyMismatch {
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAddrFamilyNotSupported})
+		return buildAndSendErr(r.Conn, r.SrcAddr, err, msg...)
+	} else if err == allocation.ErrRelaySocketInvalid || err == context.DeadlineExceeded {
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeServerError})
+		return buildAndSendErr(r.Conn, r.SrcAddr, err, msg...)
+	} else if err != nil {
 		return buildAndSendErr(r.Conn, r.SrcAddr, err, insufficentCapacityMsg...)
 	}
 
@@ -161,34 +242,56 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 		responseAttrs = append(responseAttrs, proto.ReservationToken([]byte(reservationToken)))
 	}
 
-	msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse), append(responseAttrs, messageIntegrity)...)
-	return buildAndSend(r.Conn, r.SrcAddr, msg...)
+	res, err := stun.Build(buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse), append(responseAttrs, messageIntegrity)...)...)
+	if err != nil {
+		return err
+	}
+	a.SetAllocateResponse(m.TransactionID, res.Raw)
+
+	_, err = r.Conn.WriteTo(res.Raw, r.SrcAddr)
+	return err
 }
 
 func handleRefreshRequest(r Request, m *stun.Message) error {
 	r.Log.Debugf("received RefreshRequest from %s", r.SrcAddr.String())
 
-	messageIntegrity, hasAuth, err := authenticateRequest(r, m, stun.MethodRefresh)
+	messageIntegrity, u, hasAuth, err := authenticateUser(r, m, stun.MethodRefresh)
 	if !hasAuth {
 		return err
 	}
 
-	lifetimeDuration := allocationLifeTime(m)
+	lifetimeDuration, err := allocationLifeTime(m)
+	if err != nil {
+		badRequestMsg := buildMsg(m.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeBadRequest})
+		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+	}
+	lifetimeDuration = r.minimumLifetime(lifetimeDuration)
+
 	fiveTuple := &allocation.FiveTuple{
 		SrcAddr:  r.SrcAddr,
 		DstAddr:  r.Conn.LocalAddr(),
 		Protocol: allocation.UDP,
 	}
 
-	if lifetimeDuration != 0 {
-		a := r.AllocationManager.GetAllocation(fiveTuple)
+	// The allocation may have expired, possibly while this request was in
+	// flight. Either way the client is told with a 437 (Allocation Mismatch)
+	allocMismatchMsg := buildMsg(m.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAllocMismatch})
+
+	a := r.AllocationManager.GetAllocation(fiveTuple)
+	if a == nil {
+		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("no allocation found for %v:%v", r.SrcAddr, r.Conn.LocalAddr()), allocMismatchMsg...)
+	}
+
+	if owned, err := ownedBy(r, m, a, u); !owned {
+		return err
+	}
 
-		if a == nil {
-			return fmt.Errorf("no allocation found for %v:%v", r.SrcAddr, r.Conn.LocalAddr())
+	if lifetimeDuration != 0 {
+		if err = a.Refresh(lifetimeDuration); err != nil {
+			return buildAndSendErr(r.Conn, r.SrcAddr, err, allocMismatchMsg...)
 		}
-		a.Refresh(lifetimeDuration)
 	} else {
-		r.AllocationManager.DeleteAllocation(fiveTuple)
+		r.AllocationManager.DeleteAllocation(fiveTuple, allocation.DeletionReasonDeallocated)
 	}
 
 	return buildAndSend(r.Conn, r.SrcAddr, buildMsg(m.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse), []stun.Setter{
@@ -208,14 +311,50 @@ func handleCreatePermissionRequest(r Request, m *stun.Message) error {
 		Protocol: allocation.UDP,
 	})
 	if a == nil {
-		return fmt.Errorf("no allocation found for %v:%v", r.SrcAddr, r.Conn.LocalAddr())
+		// A 437 (Allocation Mismatch) tells the client the allocation is gone, e.g. because the server restarted
+		allocMismatchMsg := buildMsg(m.TransactionID, stun.NewType(stun.MethodCreatePermission, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAllocMismatch})
+		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("no allocation found for %v:%v", r.SrcAddr, r.Conn.LocalAddr()), allocMismatchMsg...)
 	}
 
-	messageIntegrity, hasAuth, err := authenticateRequest(r, m, stun.MethodCreatePermission)
+	messageIntegrity, u, hasAuth, err := authenticateUser(r, m, stun.MethodCreatePermission)
 	if !hasAuth {
 		return err
 	}
 
+	if owned, err := ownedBy(r, m, a, u); !owned {
+		return err
+	}
+
+	// https://tools.ietf.org/html/rfc6156#section-6.2
+	// If any XOR-PEER-ADDRESS attribute contains an address of an address
+	// family different from that of the relayed transport address, the
+	// server MUST generate an error response with the 443 (Peer Address
+	// Family Mismatch) response code.
+	familyMismatch := false
+	var invalidPeer *proto.PeerAddress
+	_ = m.ForEach(stun.AttrXORPeerAddress, func(m *stun.Message) error {
+		var peerAddress proto.PeerAddress
+		if err := peerAddress.GetFrom(m); err != nil {
+			return nil
+		}
+		if !peerAddressFamilyMatches(a, peerAddress.IP) {
+			familyMismatch = true
+		} else if !peerAddressValid(peerAddress) {
+			invalidPeer = &peerAddress
+		}
+		return nil
+	})
+	if familyMismatch {
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodCreatePermission, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodePeerAddrFamilyMismatch})
+		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("peer address family mismatch"), msg...)
+	}
+
+	// A permission for a peer nothing can be relayed to is never useful, no permission is installed
+	if invalidPeer != nil {
+		badRequestMsg := buildMsg(m.TransactionID, stun.NewType(stun.MethodCreatePermission, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeBadRequest})
+		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("invalid peer address %s", invalidPeer), badRequestMsg...)
+	}
+
 	addCount := 0
 
 	if err := m.ForEach(stun.AttrXORPeerAddress, func(m *stun.Message) error {
@@ -224,18 +363,23 @@ func handleCreatePermissionRequest(r Request, m *stun.Message) error {
 			return err
 		}
 
-		r.Log.Debugf("adding permission for %s", fmt.Sprintf("%s:%d",
-			peerAddress.IP.String(), peerAddress.Port))
-		a.AddPermission(allocation.NewPermission(
+		r.Log.Debugf("adding permission for %s", peerAddress)
+		if err := a.AddPermission(allocation.NewPermission(
 			&net.UDPAddr{
 				IP:   peerAddress.IP,
 				Port: peerAddress.Port,
 			},
 			r.Log,
-		))
+		)); err != nil {
+			return err
+		}
 		addCount++
 		return nil
-	}); err != nil {
+	}); errors.Is(err, allocation.ErrPermissionLimitReached) {
+		// The permissions of all allocations are capped, see allocation.PermissionLimit
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodCreatePermission, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeInsufficientCapacity})
+		return buildAndSendErr(r.Conn, r.SrcAddr, err, msg...)
+	} else if err != nil {
 		addCount = 0
 	}
 
@@ -269,15 +413,25 @@ func handleSendIndication(r Request, m *stun.Message) error {
 	}
 
 	msgDst := &net.UDPAddr{IP: peerAddress.IP, Port: peerAddress.Port}
-	if perm := a.GetPermission(msgDst); perm == nil {
+	if !peerAddressFamilyMatches(a, peerAddress.IP) {
+		return fmt.Errorf("unable to handle send-indication, peer address family mismatch: %v", msgDst)
+	} else if !peerAddressValid(peerAddress) {
+		return fmt.Errorf("unable to handle send-indication, invalid peer address: %v", msgDst)
+	} else if perm := a.GetPermission(msgDst); perm == nil {
+		// A client that keeps sending to peers whose permission expired fails to refresh them
+		if a.PermissionExpired(msgDst) {
+			if r.OnExpiredPermissionDrop != nil {
+				r.OnExpiredPermissionDrop()
+			}
+			if r.LogExpiredPermissionDrops {
+				r.Log.Debugf("dropping send-indication from %v, the permission for %v expired", r.SrcAddr, msgDst)
+			}
+			return fmt.Errorf("unable to handle send-indication, permission expired: %v", msgDst)
+		}
 		return fmt.Errorf("unable to handle send-indication, no permission added: %v", msgDst)
 	}
 
-	l, err := a.RelaySocket.WriteTo(dataAttr, msgDst)
-	if l != len(dataAttr) {
-		return fmt.Errorf("packet write smaller than packet %d != %d (expected) err: %v", l, len(dataAttr), err)
-	}
-	return err
+	return relayToPeer(r, a, dataAttr, msgDst)
 }
 
 func handleChannelBindRequest(r Request, m *stun.Message) error {
@@ -289,16 +443,22 @@ func handleChannelBindRequest(r Request, m *stun.Message) error {
 		Protocol: allocation.UDP,
 	})
 	if a == nil {
-		return fmt.Errorf("no allocation found for %v:%v", r.SrcAddr, r.Conn.LocalAddr())
+		// A 437 (Allocation Mismatch) tells the client the allocation is gone, e.g. because the server restarted
+		allocMismatchMsg := buildMsg(m.TransactionID, stun.NewType(stun.MethodChannelBind, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAllocMismatch})
+		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("no allocation found for %v:%v", r.SrcAddr, r.Conn.LocalAddr()), allocMismatchMsg...)
 	}
 
 	badRequestMsg := buildMsg(m.TransactionID, stun.NewType(stun.MethodChannelBind, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeBadRequest})
 
-	messageIntegrity, hasAuth, err := authenticateRequest(r, m, stun.MethodChannelBind)
+	messageIntegrity, u, hasAuth, err := authenticateUser(r, m, stun.MethodChannelBind)
 	if !hasAuth {
 		return err
 	}
 
+	if owned, err := ownedBy(r, m, a, u); !owned {
+		return err
+	}
+
 	var channel proto.ChannelNumber
 	if err = channel.GetFrom(m); err != nil {
 		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
@@ -309,15 +469,23 @@ func handleChannelBindRequest(r Request, m *stun.Message) error {
 		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
 	}
 
-	r.Log.Debugf("binding channel %d to %s",
-		channel,
-		fmt.Sprintf("%s:%d", peerAddr.IP.String(), peerAddr.Port))
+	if !peerAddressFamilyMatches(a, peerAddr.IP) {
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodChannelBind, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodePeerAddrFamilyMismatch})
+		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("peer address family mismatch"), msg...)
+	} else if !peerAddressValid(peerAddr) {
+		return buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("invalid peer address %s", peerAddr), badRequestMsg...)
+	}
+
+	r.Log.Debugf("binding channel %d to %s", channel, peerAddr)
 	err = a.AddChannelBind(allocation.NewChannelBind(
 		channel,
 		&net.UDPAddr{IP: peerAddr.IP, Port: peerAddr.Port},
 		r.Log,
 	), r.ChannelBindTimeout)
-	if err != nil {
+	if errors.Is(err, allocation.ErrPermissionLimitReached) {
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodChannelBind, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeInsufficientCapacity})
+		return buildAndSendErr(r.Conn, r.SrcAddr, err, msg...)
+	} else if err != nil {
 		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
 	}
 
@@ -341,12 +509,30 @@ func handleChannelData(r Request, c *proto.ChannelData) error {
 		return fmt.Errorf("no channel bind found for %x", uint16(c.Number))
 	}
 
-	l, err := a.RelaySocket.WriteTo(c.Data, channel.Peer)
-	if err != nil {
-		return fmt.Errorf("failed writing to socket: %s", err.Error())
-	} else if l != len(c.Data) {
-		return fmt.Errorf("packet write smaller than packet %d != %d (expected)", l, len(c.Data))
+	return relayToPeer(r, a, c.Data, channel.Peer)
+}
+
+// relayToPeer writes data to peer on the allocation's relay socket, the
+// allocation is deleted if the relay socket keeps failing or it exceeded its byte quota
+func relayToPeer(r Request, a *allocation.Allocation, data []byte, peer net.Addr) error {
+	err := a.WriteToPeer(data, peer)
+
+	var reason allocation.DeletionReason
+	switch {
+	case errors.Is(err, allocation.ErrRelaySocketFailing):
+		r.Log.Warnf("deleting allocation for %v after %d relay write errors: %v", r.SrcAddr, a.RelayWriteErrors(), err)
+		reason = allocation.DeletionReasonRelayError
+	case errors.Is(err, allocation.ErrByteQuotaExceeded):
+		r.Log.Infof("deleting allocation for %v: %v", r.SrcAddr, err)
+		reason = allocation.DeletionReasonByteQuota
+	default:
+		return err
 	}
 
-	return nil
+	r.AllocationManager.DeleteAllocation(&allocation.FiveTuple{
+		SrcAddr:  r.SrcAddr,
+		DstAddr:  r.Conn.LocalAddr(),
+		Protocol: allocation.UDP,
+	}, reason)
+	return err
 }
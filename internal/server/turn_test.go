@@ -3,6 +3,7 @@
 package server
 
 import (
+	"io"
 	"net"
 	"sync"
 	"testing"
@@ -22,7 +23,8 @@ func TestAllocationLifeTime(t *testing.T) {
 		}
 
 		m := &stun.Message{}
-		lifetimeDuration := allocationLifeTime(m)
+		lifetimeDuration, err := allocationLifeTime(m)
+		assert.NoError(t, err)
 
 		if lifetimeDuration != proto.DefaultLifetime {
 			t.Errorf("Allocation lifetime should be default time duration")
@@ -30,25 +32,71 @@ func TestAllocationLifeTime(t *testing.T) {
 
 		assert.NoError(t, lifetime.AddTo(m))
 
-		lifetimeDuration = allocationLifeTime(m)
+		lifetimeDuration, err = allocationLifeTime(m)
+		assert.NoError(t, err)
 		if lifetimeDuration != lifetime.Duration {
 			t.Errorf("Expect lifetimeDuration is %s, but %s", lifetime.Duration, lifetimeDuration)
 		}
 	})
 
-	// If lifetime is bigger than maximumLifetime
+	// If lifetime is bigger than maximumLifetime it is clamped
 	t.Run("Overflow", func(t *testing.T) {
-		lifetime := proto.Lifetime{
-			Duration: maximumAllocationLifetime * 2,
+		for _, value := range [][]byte{
+			{0x00, 0x00, 0x1c, 0x20}, // 2 hours
+			{0xff, 0xff, 0xff, 0xff},
+		} {
+			m := &stun.Message{}
+			m.Add(stun.AttrLifetime, value)
+
+			lifetimeDuration, err := allocationLifeTime(m)
+			assert.NoError(t, err)
+			assert.Equal(t, maximumAllocationLifetime, lifetimeDuration)
 		}
+	})
 
-		m2 := &stun.Message{}
-		_ = lifetime.AddTo(m2)
+	t.Run("Zero", func(t *testing.T) {
+		m := &stun.Message{}
+		assert.NoError(t, proto.Lifetime{}.AddTo(m))
 
-		lifetimeDuration := allocationLifeTime(m2)
-		if lifetimeDuration != proto.DefaultLifetime {
-			t.Errorf("Expect lifetimeDuration is %s, but %s", proto.DefaultLifetime, lifetimeDuration)
+		lifetimeDuration, err := allocationLifeTime(m)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), lifetimeDuration)
+
+		// Allocate uses the default instead, a LIFETIME of 0 only deletes allocations on Refresh
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		r.Buff = buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP}, proto.Lifetime{}).Raw
+		assert.NoError(t, HandleRequest(r))
+
+		var lifetime proto.Lifetime
+		assert.NoError(t, lifetime.GetFrom(readTestResponse(t, clientConn)))
+		assert.Equal(t, proto.DefaultLifetime, lifetime.Duration)
+	})
+
+	t.Run("WrongLength", func(t *testing.T) {
+		for _, value := range [][]byte{{}, {0x00, 0x00, 0x02}, {0x00, 0x00, 0x02, 0x58, 0x00}} {
+			m := &stun.Message{}
+			m.Add(stun.AttrLifetime, value)
+
+			_, err := allocationLifeTime(m)
+			assert.Error(t, err)
 		}
+
+		// Allocate and Refresh requests are rejected with a 400 (Bad Request)
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		for _, method := range []stun.Method{stun.MethodAllocate, stun.MethodRefresh} {
+			m := buildTestRequest(t, method, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP}, stun.RawAttribute{Type: stun.AttrLifetime, Value: []byte{0x00, 0x02}})
+			r.Buff = m.Raw
+			assert.Error(t, HandleRequest(r))
+
+			res := readTestResponse(t, clientConn)
+			assert.Equal(t, method, res.Type.Method)
+			assertErrorCode(t, res, stun.CodeBadRequest)
+		}
+		assert.Nil(t, r.AllocationManager.GetAllocation(&allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}))
 	})
 
 	t.Run("DeletionZeroLifetime", func(t *testing.T) {
@@ -83,6 +131,7 @@ func TestAllocationLifeTime(t *testing.T) {
 			Conn:              l,
 			SrcAddr:           &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000},
 			Log:               logger,
+			Realm:             string(staticKey),
 			AuthHandler: func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool) {
 				return staticKey, true
 			},
@@ -91,7 +140,7 @@ func TestAllocationLifeTime(t *testing.T) {
 
 		fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
 
-		_, err = r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour)
+		_, err = r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour, proto.RequestedFamilyIPv4)
 		assert.NoError(t, err)
 
 		assert.NotNil(t, r.AllocationManager.GetAllocation(fiveTuple))
@@ -107,3 +156,894 @@ func TestAllocationLifeTime(t *testing.T) {
 		assert.Nil(t, r.AllocationManager.GetAllocation(fiveTuple))
 	})
 }
+
+const testNonce = "testNonce"
+
+// newTestRequest creates a Request backed by a real UDP listener. Relays are
+// bound on the loopback interface but advertised with relayIP when it is set
+func newTestRequest(t *testing.T, relayIP net.IP) (Request, net.PacketConn) {
+	logger := logging.NewDefaultLoggerFactory().NewLogger("turn")
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
+		AllocatePacketConn: func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			conn, listenErr := net.ListenPacket("udp4", "127.0.0.1:0")
+			if listenErr != nil {
+				return nil, nil, listenErr
+			}
+
+			relayAddr := *conn.LocalAddr().(*net.UDPAddr)
+			if relayIP != nil {
+				relayAddr.IP = relayIP
+			}
+			return conn, &relayAddr, nil
+		},
+		AllocateConn: func(network string, requestedPort int) (net.Conn, net.Addr, error) {
+			return nil, nil, nil
+		},
+		LeveledLogger: logger,
+	})
+	assert.NoError(t, err)
+
+	r := Request{
+		AllocationManager: allocationManager,
+		Nonces:            &sync.Map{},
+		Conn:              l,
+		SrcAddr:           clientConn.LocalAddr(),
+		Log:               logger,
+		Realm:             "pion.ly",
+		AuthHandler: func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return []byte(username), true
+		},
+	}
+	r.Nonces.Store(testNonce, time.Now())
+
+	return r, clientConn
+}
+
+func closeTestRequest(t *testing.T, r Request, clientConn net.PacketConn) {
+	assert.NoError(t, r.AllocationManager.Close())
+	assert.NoError(t, r.Conn.Close())
+	assert.NoError(t, clientConn.Close())
+}
+
+// buildTestRequest builds a request authenticated as username, with the key being the username itself
+func buildTestRequest(t *testing.T, method stun.Method, username string, setters ...stun.Setter) *stun.Message {
+	setters = append([]stun.Setter{stun.TransactionID, stun.NewType(method, stun.ClassRequest)}, setters...)
+	setters = append(setters,
+		stun.NewUsername(username),
+		stun.NewRealm("pion.ly"),
+		stun.NewNonce(testNonce),
+		stun.MessageIntegrity(username),
+	)
+
+	m, err := stun.Build(setters...)
+	assert.NoError(t, err)
+	return m
+}
+
+// readTestResponse reads and decodes the next STUN message sent to the client
+func readTestResponse(t *testing.T, clientConn net.PacketConn) *stun.Message {
+	assert.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	buf := make([]byte, 1500)
+	n, _, err := clientConn.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	m := &stun.Message{Raw: buf[:n]}
+	assert.NoError(t, m.Decode())
+	return m
+}
+
+func assertErrorCode(t *testing.T, m *stun.Message, code stun.ErrorCode) {
+	assert.Equal(t, stun.ClassErrorResponse, m.Type.Class)
+
+	var errorCode stun.ErrorCodeAttribute
+	assert.NoError(t, errorCode.GetFrom(m))
+	assert.Equal(t, code, errorCode.Code)
+}
+
+func TestPeerAddressFamily(t *testing.T) {
+	ipv4Peer := proto.PeerAddress{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+	ipv6Peer := proto.PeerAddress{IP: net.ParseIP("::1"), Port: 5000}
+
+	t.Run("IPv4RelayIPv6Peer", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+		_, err := r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour, proto.RequestedFamilyIPv4)
+		assert.NoError(t, err)
+
+		assert.Error(t, handleCreatePermissionRequest(r, buildTestRequest(t, stun.MethodCreatePermission, "user", ipv6Peer)))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodePeerAddrFamilyMismatch)
+
+		assert.Error(t, handleChannelBindRequest(r, buildTestRequest(t, stun.MethodChannelBind, "user", ipv6Peer, proto.ChannelNumber(proto.MinChannelNumber))))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodePeerAddrFamilyMismatch)
+
+		sendIndication, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodSend, stun.ClassIndication), ipv6Peer, proto.Data("Hello"))
+		assert.NoError(t, err)
+		assert.Error(t, handleSendIndication(r, sendIndication))
+
+		// A peer of the matching family is still accepted
+		assert.NoError(t, handleCreatePermissionRequest(r, buildTestRequest(t, stun.MethodCreatePermission, "user", ipv4Peer)))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+	})
+
+	t.Run("IPv6RelayIPv4Peer", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, net.ParseIP("::1"))
+		defer closeTestRequest(t, r, clientConn)
+
+		fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+		_, err := r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour, proto.RequestedFamilyIPv6)
+		assert.NoError(t, err)
+
+		assert.Error(t, handleCreatePermissionRequest(r, buildTestRequest(t, stun.MethodCreatePermission, "user", ipv4Peer)))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodePeerAddrFamilyMismatch)
+
+		assert.Error(t, handleChannelBindRequest(r, buildTestRequest(t, stun.MethodChannelBind, "user", ipv4Peer, proto.ChannelNumber(proto.MinChannelNumber))))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodePeerAddrFamilyMismatch)
+
+		assert.NoError(t, handleCreatePermissionRequest(r, buildTestRequest(t, stun.MethodCreatePermission, "user", ipv6Peer)))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+	})
+
+	t.Run("AllocateRelayFamilyMismatch", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		m := buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP}, proto.RequestedFamilyIPv6)
+		assert.Error(t, handleAllocateRequest(r, m))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeAddrFamilyNotSupported)
+
+		fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+		assert.Nil(t, r.AllocationManager.GetAllocation(fiveTuple))
+	})
+}
+
+func TestRefreshAllocationMismatch(t *testing.T) {
+	refresh := func(t *testing.T) *stun.Message {
+		return buildTestRequest(t, stun.MethodRefresh, "user", proto.Lifetime{Duration: proto.DefaultLifetime})
+	}
+
+	t.Run("NoAllocation", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		assert.Error(t, handleRefreshRequest(r, refresh(t)))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeAllocMismatch)
+
+		// Deleting a missing allocation is a mismatch as well
+		assert.Error(t, handleRefreshRequest(r, buildTestRequest(t, stun.MethodRefresh, "user", proto.Lifetime{})))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeAllocMismatch)
+	})
+
+	// CreatePermission and ChannelBind are refused the same way, e.g. after the server restarted
+	t.Run("NoAllocationPermission", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		peer := proto.PeerAddress{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+		assert.Error(t, handleCreatePermissionRequest(r, buildTestRequest(t, stun.MethodCreatePermission, "user", peer)))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeAllocMismatch)
+
+		assert.Error(t, handleChannelBindRequest(r, buildTestRequest(t, stun.MethodChannelBind, "user", peer, proto.ChannelNumber(proto.MinChannelNumber))))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeAllocMismatch)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+		_, err := r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Millisecond, proto.RequestedFamilyIPv4)
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			return r.AllocationManager.GetAllocation(fiveTuple) == nil
+		}, time.Second, time.Millisecond)
+
+		assert.Error(t, handleRefreshRequest(r, refresh(t)))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeAllocMismatch)
+		assert.Nil(t, r.AllocationManager.GetAllocation(fiveTuple), "refresh must not recreate the allocation")
+	})
+
+	// Refreshes racing the expiry either win and keep the allocation, or lose and get a 437
+	t.Run("ExpiryRace", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+		for i := 0; i < 50; i++ {
+			_, err := r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Duration(i%5+1)*50*time.Microsecond, proto.RequestedFamilyIPv4)
+			assert.NoError(t, err)
+
+			_ = handleRefreshRequest(r, refresh(t))
+			res := readTestResponse(t, clientConn)
+
+			if res.Type.Class == stun.ClassSuccessResponse {
+				time.Sleep(time.Millisecond)
+				assert.NotNil(t, r.AllocationManager.GetAllocation(fiveTuple), "refreshed allocation should not expire")
+			} else {
+				assertErrorCode(t, res, stun.CodeAllocMismatch)
+				assert.Eventually(t, func() bool {
+					return r.AllocationManager.GetAllocation(fiveTuple) == nil
+				}, time.Second, time.Millisecond)
+			}
+
+			r.AllocationManager.DeleteAllocation(fiveTuple, allocation.DeletionReasonDeallocated)
+		}
+	})
+}
+
+func TestAllocateRelayedAddressIPv6(t *testing.T) {
+	relayIP := net.ParseIP("2001:db8::68")
+	r, clientConn := newTestRequest(t, relayIP)
+	defer closeTestRequest(t, r, clientConn)
+
+	m := buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP}, proto.RequestedFamilyIPv6)
+	assert.NoError(t, handleAllocateRequest(r, m))
+
+	res := readTestResponse(t, clientConn)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+
+	a := r.AllocationManager.GetAllocation(&allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP})
+	assert.NotNil(t, a)
+
+	var relayed proto.RelayedAddress
+	assert.NoError(t, relayed.GetFrom(res))
+	assert.Equal(t, relayIP.String(), relayed.IP.String())
+	assert.Equal(t, a.RelayAddr.(*net.UDPAddr).Port, relayed.Port)
+
+	var mapped stun.XORMappedAddress
+	assert.NoError(t, mapped.GetFrom(res))
+	assert.Equal(t, r.SrcAddr.String(), mapped.String())
+}
+
+func TestAllocateTenantRelay(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+
+	tenants := map[string]string{"eu-user": "eu", "us-user": "us"}
+	r.TenantAuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, string, bool) {
+		return []byte(username), tenants[username], true
+	}
+	r.TenantRelays = map[string]func(network string, requestedPort int) (net.PacketConn, net.Addr, error){
+		"eu": func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				return nil, nil, err
+			}
+			return conn, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: conn.LocalAddr().(*net.UDPAddr).Port}, nil
+		},
+	}
+
+	allocate := func(username string) *stun.Message {
+		m := buildTestRequest(t, stun.MethodAllocate, username, proto.RequestedTransport{Protocol: proto.ProtoUDP})
+		_ = handleAllocateRequest(r, m)
+		return readTestResponse(t, clientConn)
+	}
+	deallocate := func() {
+		r.AllocationManager.DeleteAllocation(&allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}, allocation.DeletionReasonDeallocated)
+	}
+
+	// The tenant's relay is used
+	res := allocate("eu-user")
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+	var relayed proto.RelayedAddress
+	assert.NoError(t, relayed.GetFrom(res))
+	assert.Equal(t, "192.0.2.1", relayed.IP.String())
+	deallocate()
+
+	// A tenant without a relay is refused
+	assertErrorCode(t, allocate("us-user"), stun.CodeForbidden)
+
+	// Users without a tenant fall back to the listener's relay
+	res = allocate("user")
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+	assert.NoError(t, relayed.GetFrom(res))
+	assert.Equal(t, "127.0.0.1", relayed.IP.String())
+	deallocate()
+}
+
+func TestAllocateExistingFiveTuple(t *testing.T) {
+	t.Run("Retransmit", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		// The TransactionCache of newTestRequest is nil, the allocation answers the retransmit
+		m := buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP})
+		assert.NoError(t, handleAllocateRequest(r, m))
+		res := readTestResponse(t, clientConn)
+		assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+
+		assert.NoError(t, handleAllocateRequest(r, m))
+		retransmitRes := readTestResponse(t, clientConn)
+		assert.Equal(t, res.Raw, retransmitRes.Raw)
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		assert.NoError(t, handleAllocateRequest(r, buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP})))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+		fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+		a := r.AllocationManager.GetAllocation(fiveTuple)
+
+		// A new Allocate, with another transaction ID, on the same 5-tuple
+		assert.Error(t, handleAllocateRequest(r, buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP})))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeAllocMismatch)
+		assert.Equal(t, a, r.AllocationManager.GetAllocation(fiveTuple))
+	})
+}
+
+// A RelayAddressGenerator returning no relay, or one clients can't reach, fails the
+// Allocate instead of the server
+func TestAllocateNilRelay(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+
+	var relayConns []net.PacketConn
+	r.TenantAuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, string, bool) {
+		return []byte(username), username, true
+	}
+	r.TenantRelays = map[string]func(network string, requestedPort int) (net.PacketConn, net.Addr, error){
+		"nil-conn": func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			return nil, nil, nil
+		},
+		"nil-addr": func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			relayConns = append(relayConns, conn)
+			return conn, nil, err
+		},
+		"no-port": func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			relayConns = append(relayConns, conn)
+			return conn, &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, err
+		},
+	}
+
+	fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+	for _, username := range []string{"nil-conn", "nil-addr", "no-port"} {
+		m := buildTestRequest(t, stun.MethodAllocate, username, proto.RequestedTransport{Protocol: proto.ProtoUDP})
+		assert.Equal(t, allocation.ErrRelaySocketInvalid, handleAllocateRequest(r, m))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeServerError)
+		assert.Nil(t, r.AllocationManager.GetAllocation(fiveTuple))
+	}
+
+	// The sockets returned without a usable address aren't leaked
+	for _, relayConn := range relayConns {
+		assert.Error(t, relayConn.Close())
+	}
+}
+
+// A ChannelBind installs the permission for its peer, data flows in both
+// directions without a CreatePermission
+func TestInvalidPeerAddress(t *testing.T) {
+	ipv4Peer := proto.PeerAddress{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+	ipv6Peer := proto.PeerAddress{IP: net.ParseIP("::1"), Port: 5000}
+
+	for _, tc := range []struct {
+		name      string
+		relayIP   net.IP
+		family    proto.RequestedAddressFamily
+		peer      proto.PeerAddress
+		validPeer proto.PeerAddress
+	}{
+		{"IPv4ZeroPort", nil, proto.RequestedFamilyIPv4, proto.PeerAddress{IP: net.ParseIP("127.0.0.1"), Port: 0}, ipv4Peer},
+		{"IPv4ZeroIP", nil, proto.RequestedFamilyIPv4, proto.PeerAddress{IP: net.IPv4zero, Port: 5000}, ipv4Peer},
+		{"IPv6ZeroPort", net.ParseIP("::1"), proto.RequestedFamilyIPv6, proto.PeerAddress{IP: net.ParseIP("::1"), Port: 0}, ipv6Peer},
+		{"IPv6ZeroIP", net.ParseIP("::1"), proto.RequestedFamilyIPv6, proto.PeerAddress{IP: net.IPv6unspecified, Port: 5000}, ipv6Peer},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r, clientConn := newTestRequest(t, tc.relayIP)
+			defer closeTestRequest(t, r, clientConn)
+
+			fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+			a, err := r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour, tc.family)
+			assert.NoError(t, err)
+
+			// A valid peer next to the invalid one doesn't get a permission either
+			validAddr := &net.UDPAddr{IP: tc.validPeer.IP, Port: tc.validPeer.Port}
+			assert.Error(t, handleCreatePermissionRequest(r, buildTestRequest(t, stun.MethodCreatePermission, "user", tc.validPeer, tc.peer)))
+			assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeBadRequest)
+			assert.Nil(t, a.GetPermission(validAddr))
+
+			assert.Error(t, handleChannelBindRequest(r, buildTestRequest(t, stun.MethodChannelBind, "user", tc.peer, proto.ChannelNumber(proto.MinChannelNumber))))
+			assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeBadRequest)
+
+			sendIndication, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodSend, stun.ClassIndication), tc.peer, proto.Data("Hello"))
+			assert.NoError(t, err)
+			assert.Error(t, handleSendIndication(r, sendIndication))
+
+			assert.NoError(t, handleCreatePermissionRequest(r, buildTestRequest(t, stun.MethodCreatePermission, "user", tc.validPeer)))
+			assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+			assert.NotNil(t, a.GetPermission(validAddr))
+		})
+	}
+}
+
+func TestChannelBindInstallsPermission(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+	r.ChannelBindTimeout = time.Minute
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, peerConn.Close())
+	}()
+	peerAddr := peerConn.LocalAddr().(*net.UDPAddr)
+
+	assert.NoError(t, handleAllocateRequest(r, buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP})))
+	assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+
+	a := r.AllocationManager.GetAllocation(&allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP})
+	assert.NotNil(t, a)
+	assert.Nil(t, a.GetPermission(peerAddr))
+
+	channel := proto.ChannelNumber(proto.MinChannelNumber)
+	assert.NoError(t, handleChannelBindRequest(r, buildTestRequest(t, stun.MethodChannelBind, "user", channel, proto.PeerAddress{IP: peerAddr.IP, Port: peerAddr.Port})))
+	assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+	assert.NotNil(t, a.GetPermission(peerAddr))
+
+	buf := make([]byte, 1500)
+	assert.NoError(t, peerConn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	// Client to peer over the channel
+	data := &proto.ChannelData{Number: channel, Data: []byte("ChannelData")}
+	data.Encode()
+	r.Buff = data.Raw
+	assert.NoError(t, HandleRequest(r))
+
+	n, _, err := peerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ChannelData", string(buf[:n]))
+
+	// Send indications need the permission, which the ChannelBind installed
+	r.Buff = buildTestRequest(t, stun.MethodSend, "user", proto.PeerAddress{IP: peerAddr.IP, Port: peerAddr.Port}, proto.Data("Send")).Raw
+	send := &stun.Message{Raw: append([]byte{}, r.Buff...)}
+	assert.NoError(t, send.Decode())
+	send.Type = stun.NewType(stun.MethodSend, stun.ClassIndication)
+	send.WriteHeader()
+	r.Buff = send.Raw
+	assert.NoError(t, HandleRequest(r))
+
+	n, _, err = peerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Send", string(buf[:n]))
+
+	// Peer to client, delivered as ChannelData
+	_, err = peerConn.WriteTo([]byte("Peer"), a.RelaySocketAddr())
+	assert.NoError(t, err)
+
+	assert.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err = clientConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	received := &proto.ChannelData{Raw: buf[:n]}
+	assert.NoError(t, received.Decode())
+	assert.Equal(t, channel, received.Number)
+	assert.Equal(t, "Peer", string(received.Data))
+}
+
+func TestSendIndicationExpiredPermission(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+
+	// Permissions of the allocation expire after 50ms instead of 5 minutes
+	assert.NoError(t, r.AllocationManager.Close())
+	allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
+		AllocatePacketConn: func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			conn, listenErr := net.ListenPacket("udp4", "127.0.0.1:0")
+			if listenErr != nil {
+				return nil, nil, listenErr
+			}
+			return conn, conn.LocalAddr(), nil
+		},
+		AllocateConn: func(network string, requestedPort int) (net.Conn, net.Addr, error) {
+			return nil, nil, nil
+		},
+		LeveledLogger:      r.Log,
+		PermissionLifetime: 50 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	r.AllocationManager = allocationManager
+	defer closeTestRequest(t, r, clientConn)
+
+	var drops int
+	r.OnExpiredPermissionDrop = func() { drops++ }
+	r.LogExpiredPermissionDrops = true
+
+	fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+	a, err := r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour, proto.RequestedFamilyIPv4)
+	assert.NoError(t, err)
+
+	send := func(peer proto.PeerAddress) error {
+		sendIndication, buildErr := stun.Build(stun.TransactionID, stun.NewType(stun.MethodSend, stun.ClassIndication), peer, proto.Data("Hello"))
+		assert.NoError(t, buildErr)
+		return handleSendIndication(r, sendIndication)
+	}
+
+	peer := proto.PeerAddress{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+	peerAddr := &net.UDPAddr{IP: peer.IP, Port: peer.Port}
+	a.AddPermission(allocation.NewPermission(peerAddr, r.Log))
+	assert.NoError(t, send(peer))
+
+	// A peer that never had a permission isn't counted
+	assert.Error(t, send(proto.PeerAddress{IP: net.ParseIP("127.0.0.2"), Port: 5000}))
+	assert.Equal(t, 0, drops)
+
+	assert.Eventually(t, func() bool {
+		return a.GetPermission(peerAddr) == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, a.PermissionExpired(peerAddr))
+
+	err = send(peer)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "permission expired")
+	assert.Equal(t, 1, drops)
+
+	// A new permission is no longer expired
+	a.AddPermission(allocation.NewPermission(peerAddr, r.Log))
+	assert.False(t, a.PermissionExpired(peerAddr))
+	assert.NoError(t, send(peer))
+	assert.Equal(t, 1, drops)
+}
+
+func TestAllocationWrongCredentials(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+
+	fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+	_, err := r.AllocationManager.CreateAllocationWithRelay(fiveTuple, r.Conn, 0, time.Hour, proto.RequestedFamilyIPv4, nil, nil, "alice", nil)
+	assert.NoError(t, err)
+
+	peer := proto.PeerAddress{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+	for _, tc := range []struct {
+		name   string
+		handle func(Request, *stun.Message) error
+		method stun.Method
+		attrs  []stun.Setter
+	}{
+		{"Refresh", handleRefreshRequest, stun.MethodRefresh, []stun.Setter{proto.Lifetime{Duration: time.Hour}}},
+		{"CreatePermission", handleCreatePermissionRequest, stun.MethodCreatePermission, []stun.Setter{peer}},
+		{"ChannelBind", handleChannelBindRequest, stun.MethodChannelBind, []stun.Setter{proto.ChannelNumber(proto.MinChannelNumber), peer}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Another user's valid credentials can't use the allocation
+			assert.Error(t, tc.handle(r, buildTestRequest(t, tc.method, "bob", tc.attrs...)))
+			assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeWrongCredentials)
+
+			assert.NoError(t, tc.handle(r, buildTestRequest(t, tc.method, "alice", tc.attrs...)))
+			assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+		})
+	}
+
+	a := r.AllocationManager.GetAllocation(fiveTuple)
+	assert.NotNil(t, a)
+	assert.Equal(t, "alice", a.Username())
+}
+
+func TestMinAllocationLifetime(t *testing.T) {
+	r, clientConn := newTestRequest(t, nil)
+	defer closeTestRequest(t, r, clientConn)
+	r.MinAllocationLifetime = 10 * time.Minute
+
+	responseLifetime := func() time.Duration {
+		res := readTestResponse(t, clientConn)
+		assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+
+		var lifetime proto.Lifetime
+		assert.NoError(t, lifetime.GetFrom(res))
+		return lifetime.Duration
+	}
+
+	assert.NoError(t, handleAllocateRequest(r, buildTestRequest(t, stun.MethodAllocate, "user",
+		proto.RequestedTransport{Protocol: proto.ProtoUDP}, proto.Lifetime{Duration: time.Minute})))
+	assert.Equal(t, 10*time.Minute, responseLifetime())
+
+	assert.NoError(t, handleRefreshRequest(r, buildTestRequest(t, stun.MethodRefresh, "user", proto.Lifetime{Duration: 30 * time.Second})))
+	assert.Equal(t, 10*time.Minute, responseLifetime())
+
+	// Longer lifetimes are granted as requested
+	assert.NoError(t, handleRefreshRequest(r, buildTestRequest(t, stun.MethodRefresh, "user", proto.Lifetime{Duration: 20 * time.Minute})))
+	assert.Equal(t, 20*time.Minute, responseLifetime())
+
+	// A LIFETIME of 0 still deletes the allocation
+	assert.NoError(t, handleRefreshRequest(r, buildTestRequest(t, stun.MethodRefresh, "user", proto.Lifetime{})))
+	assert.Equal(t, time.Duration(0), responseLifetime())
+	assert.Nil(t, r.AllocationManager.GetAllocation(&allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}))
+}
+
+func TestGrantedLifetime(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		min      time.Duration
+		lifetime []stun.Setter
+		granted  time.Duration
+	}{
+		{"Default", 0, nil, proto.DefaultLifetime},
+		{"Zero", 0, []stun.Setter{proto.Lifetime{}}, proto.DefaultLifetime},
+		{"Requested", 0, []stun.Setter{proto.Lifetime{Duration: 2 * time.Minute}}, 2 * time.Minute},
+		{"AboveMaximum", 0, []stun.Setter{proto.Lifetime{Duration: 2 * time.Hour}}, maximumAllocationLifetime},
+		{"BelowMinimum", 15 * time.Minute, []stun.Setter{proto.Lifetime{Duration: time.Minute}}, 15 * time.Minute},
+		{"DefaultBelowMinimum", 15 * time.Minute, nil, 15 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, clientConn := newTestRequest(t, nil)
+			defer closeTestRequest(t, r, clientConn)
+			r.MinAllocationLifetime = tc.min
+
+			// The LIFETIME of every success response is the lifetime granted, not the one requested
+			granted := func() time.Duration {
+				res := readTestResponse(t, clientConn)
+				assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+
+				var lifetime proto.Lifetime
+				assert.NoError(t, lifetime.GetFrom(res))
+				return lifetime.Duration
+			}
+
+			allocateAttrs := append([]stun.Setter{proto.RequestedTransport{Protocol: proto.ProtoUDP}}, tc.lifetime...)
+			assert.NoError(t, handleAllocateRequest(r, buildTestRequest(t, stun.MethodAllocate, "user", allocateAttrs...)))
+			assert.Equal(t, tc.granted, granted())
+
+			if len(tc.lifetime) == 0 || tc.lifetime[0].(proto.Lifetime).Duration != 0 {
+				assert.NoError(t, handleRefreshRequest(r, buildTestRequest(t, stun.MethodRefresh, "user", tc.lifetime...)))
+				assert.Equal(t, tc.granted, granted())
+			}
+		})
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		expired bool
+	}{
+		{"Disabled", 0, false},
+		{"Negative", -1, false},
+		{"NotExpired", time.Minute, false},
+		{"Expired", 10 * time.Millisecond, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, clientConn := newTestRequest(t, nil)
+			defer closeTestRequest(t, r, clientConn)
+			r.RequestTimeout = tc.timeout
+
+			// The relay takes longer to allocate than the expiring timeout
+			assert.NoError(t, r.AllocationManager.Close())
+			var err error
+			r.AllocationManager, err = allocation.NewManager(allocation.ManagerConfig{
+				AllocatePacketConn: func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+					time.Sleep(100 * time.Millisecond)
+					conn, listenErr := net.ListenPacket("udp4", "127.0.0.1:0")
+					if listenErr != nil {
+						return nil, nil, listenErr
+					}
+					return conn, conn.LocalAddr(), nil
+				},
+				AllocateConn: func(network string, requestedPort int) (net.Conn, net.Addr, error) {
+					return nil, nil, nil
+				},
+				LeveledLogger: r.Log,
+			})
+			assert.NoError(t, err)
+
+			err = handleAllocateRequest(r, buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP}))
+			res := readTestResponse(t, clientConn)
+			if tc.expired {
+				assert.Error(t, err)
+				assertErrorCode(t, res, stun.CodeServerError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+			}
+		})
+	}
+}
+
+// discardConn is a net.PacketConn that drops what is written to it and blocks reads until closed
+type discardConn struct {
+	addr      net.Addr
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newDiscardConn(addr net.Addr) *discardConn {
+	return &discardConn{addr: addr, closed: make(chan struct{})}
+}
+
+func (c *discardConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	<-c.closed
+	return 0, nil, io.EOF
+}
+
+func (c *discardConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+func (c *discardConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *discardConn) LocalAddr() net.Addr                { return c.addr }
+func (c *discardConn) SetDeadline(t time.Time) error      { return nil }
+func (c *discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// benchmarkAllocate runs authenticated Allocate requests of one user from a new port every
+// time, over in-memory conns. The key of the user is derived by the AuthHandler like
+// turn.GenerateAuthKey does
+func benchmarkAllocate(b *testing.B, configure func(r *Request)) {
+	log := logging.NewDefaultLoggerFactory().NewLogger("turn")
+	log.(*logging.DefaultLeveledLogger).SetLevel(logging.LogLevelDisabled)
+
+	allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
+		AllocatePacketConn: func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+			conn := newDiscardConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 49152})
+			return conn, conn.LocalAddr(), nil
+		},
+		AllocateConn: func(network string, requestedPort int) (net.Conn, net.Addr, error) {
+			return nil, nil, nil
+		},
+		LeveledLogger: log,
+	})
+	assert.NoError(b, err)
+
+	conn := newDiscardConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478})
+	r := Request{
+		Conn:              conn,
+		AllocationManager: allocationManager,
+		Nonces:            &sync.Map{},
+		Log:               log,
+		Realm:             "pion.ly",
+		AuthHandler: func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return stun.NewLongTermIntegrity(username, realm, "pass"), true
+		},
+	}
+	r.Nonces.Store(testNonce, time.Now())
+	if configure != nil {
+		configure(&r)
+	}
+
+	m, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		proto.RequestedTransport{Protocol: proto.ProtoUDP},
+		stun.NewUsername("user"), stun.NewRealm("pion.ly"), stun.NewNonce(testNonce),
+		stun.NewLongTermIntegrity("user", "pion.ly", "pass"), stun.Fingerprint)
+	assert.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		srcAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1024 + i%60000}
+		r.SrcAddr = srcAddr
+		r.Buff = m.Raw
+		if err := HandleRequest(r); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		allocationManager.DeleteAllocation(&allocation.FiveTuple{SrcAddr: srcAddr, DstAddr: conn.LocalAddr(), Protocol: allocation.UDP}, allocation.DeletionReasonDeallocated)
+		b.StartTimer()
+	}
+	b.StopTimer()
+
+	assert.NoError(b, allocationManager.Close())
+	assert.NoError(b, conn.Close())
+}
+
+func BenchmarkAllocate(b *testing.B) {
+	benchmarkAllocate(b, nil)
+}
+
+// BenchmarkCreatePermission runs the authenticated CreatePermission requests a client
+// sends on its allocation, with and without an AuthKeyCache
+func BenchmarkCreatePermission(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		name := "AuthHandler"
+		if cached {
+			name = "AuthKeyCache"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			log := logging.NewDefaultLoggerFactory().NewLogger("turn")
+			log.(*logging.DefaultLeveledLogger).SetLevel(logging.LogLevelDisabled)
+
+			allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
+				AllocatePacketConn: func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+					conn := newDiscardConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 49152})
+					return conn, conn.LocalAddr(), nil
+				},
+				AllocateConn: func(network string, requestedPort int) (net.Conn, net.Addr, error) {
+					return nil, nil, nil
+				},
+				LeveledLogger: log,
+			})
+			assert.NoError(b, err)
+
+			conn := newDiscardConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478})
+			r := Request{
+				Conn:              conn,
+				SrcAddr:           &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000},
+				AllocationManager: allocationManager,
+				Nonces:            &sync.Map{},
+				Log:               log,
+				Realm:             "pion.ly",
+				AuthHandler: func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+					return stun.NewLongTermIntegrity(username, realm, "pass"), true
+				},
+			}
+			r.Nonces.Store(testNonce, time.Now())
+			if cached {
+				r.AuthKeyCache = NewAuthKeyCache(0, time.Hour)
+			}
+
+			fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: conn.LocalAddr(), Protocol: allocation.UDP}
+			_, err = allocationManager.CreateAllocation(fiveTuple, conn, 0, time.Hour, proto.RequestedFamilyIPv4)
+			assert.NoError(b, err)
+
+			m, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodCreatePermission, stun.ClassRequest),
+				proto.PeerAddress{IP: net.IPv4(127, 0, 0, 2), Port: 5000},
+				stun.NewUsername("user"), stun.NewRealm("pion.ly"), stun.NewNonce(testNonce),
+				stun.NewLongTermIntegrity("user", "pion.ly", "pass"), stun.Fingerprint)
+			assert.NoError(b, err)
+			r.Buff = m.Raw
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := HandleRequest(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			assert.NoError(b, allocationManager.Close())
+			assert.NoError(b, conn.Close())
+		})
+	}
+}
+
+func TestAllowedTransports(t *testing.T) {
+	const protoTCP = proto.Protocol(6)
+
+	for _, tc := range []struct {
+		name    string
+		allowed []proto.Protocol
+		udp     bool
+	}{
+		{"Default", nil, true},
+		{"UDP", []proto.Protocol{proto.ProtoUDP}, true},
+		{"TCP", []proto.Protocol{protoTCP}, false},
+		{"None", []proto.Protocol{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, clientConn := newTestRequest(t, nil)
+			defer closeTestRequest(t, r, clientConn)
+			r.AllowedTransports = tc.allowed
+
+			// TCP isn't implemented, it is refused even when allowed
+			assert.Error(t, handleAllocateRequest(r, buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: protoTCP})))
+			assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeUnsupportedTransProto)
+
+			err := handleAllocateRequest(r, buildTestRequest(t, stun.MethodAllocate, "user", proto.RequestedTransport{Protocol: proto.ProtoUDP}))
+			res := readTestResponse(t, clientConn)
+			if tc.udp {
+				assert.NoError(t, err)
+				assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+			} else {
+				assert.Error(t, err)
+				assertErrorCode(t, res, stun.CodeUnsupportedTransProto)
+			}
+		})
+	}
+}
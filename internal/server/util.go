@@ -3,15 +3,21 @@ package server
 import (
 	// #nosec
 
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/pion/logging"
 	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/ipnet"
 	"github.com/pion/turn/v2/internal/proto"
 )
 
@@ -21,6 +27,9 @@ const (
 
 )
 
+// timeNow is used for nonce and session expiry, tests replace it to advance the clock
+var timeNow = time.Now
+
 func randSeq(n int) string {
 	letters := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 	b := make([]rune, n)
@@ -64,19 +73,35 @@ func buildMsg(transactionID [stun.TransactionIDSize]byte, msgType stun.MessageTy
 	return append([]stun.Setter{&stun.Message{TransactionID: transactionID}, msgType}, additional...)
 }
 
-func authenticateRequest(r Request, m *stun.Message, callingMethod stun.Method) (stun.MessageIntegrity, bool, error) {
-	respondWithNonce := func(responseCode stun.ErrorCode) (stun.MessageIntegrity, bool, error) {
-		nonce, err := buildNonce()
-		if err != nil {
-			return nil, false, err
-		}
+// ownedBy returns true if a was allocated by the user that authenticated a request, otherwise
+// the request is answered with a 441 (Wrong Credentials) as in RFC 5766 Section 4. Allocations
+// created without a user, see Manager.CreateAllocation, may be used by everyone
+func ownedBy(r Request, m *stun.Message, a *allocation.Allocation, u user) (bool, error) {
+	if a.Username() == "" || a.Username() == u.username {
+		return true, nil
+	}
+
+	msg := buildMsg(m.TransactionID, stun.NewType(m.Type.Method, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeWrongCredentials})
+	return false, buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("%s can't use the allocation of %s", u.username, a.Username()), msg...)
+}
 
-		// Nonce has already been taken
-		if _, keyCollision := r.Nonces.LoadOrStore(nonce, time.Now()); keyCollision {
-			return nil, false, fmt.Errorf("duplicated Nonce generated, discarding request")
+// user is who authenticated a request, tenant is set by the TenantAuthHandler
+// and context by the ContextAuthHandler
+type user struct {
+	username string
+	tenant   string
+	context  interface{}
+}
+
+// authenticateUser is authenticateRequest that also returns the user
+func authenticateUser(r Request, m *stun.Message, callingMethod stun.Method) (stun.MessageIntegrity, user, bool, error) {
+	respondWithNonce := func(responseCode stun.ErrorCode) (stun.MessageIntegrity, user, bool, error) {
+		nonce, err := r.generateNonce()
+		if err != nil {
+			return nil, user{}, false, err
 		}
 
-		return nil, false, buildAndSend(r.Conn, r.SrcAddr, buildMsg(m.TransactionID,
+		return nil, user{}, false, buildAndSend(r.Conn, r.SrcAddr, buildMsg(m.TransactionID,
 			stun.NewType(callingMethod, stun.ClassErrorResponse),
 			&stun.ErrorCodeAttribute{Code: responseCode},
 			stun.NewNonce(nonce),
@@ -85,52 +110,311 @@ func authenticateRequest(r Request, m *stun.Message, callingMethod stun.Method)
 	}
 
 	if !m.Contains(stun.AttrMessageIntegrity) {
+		r.authResult(AuthResultMissingIntegrity)
 		return respondWithNonce(stun.CodeUnauthorized)
 	}
 
 	nonceAttr := &stun.Nonce{}
 	usernameAttr := &stun.Username{}
 	realmAttr := &stun.Realm{}
-	badRequestMsg := buildMsg(m.TransactionID, stun.NewType(callingMethod, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeBadRequest})
+	badRequest := func(err error) (stun.MessageIntegrity, user, bool, error) {
+		return nil, user{}, false, buildAndSendErr(r.Conn, r.SrcAddr, err, buildMsg(m.TransactionID,
+			stun.NewType(callingMethod, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeBadRequest})...)
+	}
 
 	if err := nonceAttr.GetFrom(m); err != nil {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return badRequest(err)
 	}
 
 	// Assert Nonce exists and is not expired
-	nonceCreationTime, ok := r.Nonces.Load(string(*nonceAttr))
-	if !ok || time.Since(nonceCreationTime.(time.Time)) >= nonceLifetime {
-		r.Nonces.Delete(nonceAttr)
+	if ok, stale := r.validateNonce(nonceAttr.String()); stale {
+		r.authResult(AuthResultStaleNonce)
 		return respondWithNonce(stun.CodeStaleNonce)
+	} else if !ok {
+		r.authResult(AuthResultRejected)
+		return respondWithNonce(stun.CodeUnauthorized)
 	}
 
 	if err := realmAttr.GetFrom(m); err != nil {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return badRequest(err)
 	} else if err := usernameAttr.GetFrom(m); err != nil {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return badRequest(err)
+	}
+
+	// Credentials that can't be verified are answered with a 401 carrying the
+	// REALM and a fresh NONCE, so the client can retry with the right ones
+	unauthorized := func(result AuthResult, err error) (stun.MessageIntegrity, user, bool, error) {
+		r.authResult(result)
+		r.authFailed(usernameAttr.String(), realmAttr.String())
+		if _, _, _, sendErr := respondWithNonce(stun.CodeUnauthorized); sendErr != nil {
+			err = fmt.Errorf("failed to send error message %v %v", sendErr, err)
+		}
+		return nil, user{}, false, err
+	}
+
+	if !r.realmAllowed(realmAttr.String()) {
+		return unauthorized(AuthResultRejected, fmt.Errorf("realm mismatch %s != %s", realmAttr.String(), r.Realm))
+	}
+
+	if r.UsernameValidator != nil && !r.UsernameValidator(usernameAttr.String()) {
+		return unauthorized(AuthResultRejected, fmt.Errorf("malformed username %q", usernameAttr.String()))
 	}
 
-	ourKey, ok := r.AuthHandler(usernameAttr.String(), realmAttr.String(), r.SrcAddr)
+	username, realm := usernameAttr.String(), realmAttr.String()
+	ourKey, u, verified := r.cachedUserKey(m, username, realm)
+	ok := verified
+	if !verified {
+		ourKey, u, ok = r.userKey(username, realm)
+	}
+	r.shadowAuth(m, username, realm, ourKey, ok)
 	if !ok {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("no user exists for %s", usernameAttr.String()), badRequestMsg...)
+		return unauthorized(AuthResultUnknownUser, fmt.Errorf("no user exists for %s", username))
+	}
+
+	if !verified {
+		if err := stun.MessageIntegrity(ourKey).Check(m); err != nil {
+			return unauthorized(AuthResultBadIntegrity, err)
+		}
+		if r.AuthKeyCache != nil {
+			r.AuthKeyCache.put(newAuthKey(r.SrcAddr, realm, username), ourKey, u)
+		}
 	}
 
-	if err := stun.MessageIntegrity(ourKey).Check(m); err != nil {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+	// A session that outlived MaxSessionDuration is answered with a 438 (Stale Nonce) even if
+	// the nonce is fresh, the client has to authenticate again with a new nonce
+	if r.sessionExpired(usernameAttr.String(), realmAttr.String()) {
+		r.forgetNonce(nonceAttr.String())
+		r.authResult(AuthResultStaleNonce)
+		return respondWithNonce(stun.CodeStaleNonce)
 	}
 
-	return stun.MessageIntegrity(ourKey), true, nil
+	r.authResult(AuthResultSuccess)
+	return stun.MessageIntegrity(ourKey), u, true, nil
 }
 
-func allocationLifeTime(m *stun.Message) time.Duration {
-	lifetimeDuration := proto.DefaultLifetime
+// userKey returns the key of username in realm from the auth handler, and the user with
+// the tenant or context the handler returned
+func (r Request) userKey(username, realm string) ([]byte, user, bool) {
+	var key []byte
+	u := user{username: username}
+	var ok bool
+	switch {
+	case r.TenantAuthHandler != nil:
+		key, u.tenant, ok = r.TenantAuthHandler(username, realm, r.SrcAddr)
+	case r.ContextAuthHandler != nil:
+		key, u.context, ok = r.ContextAuthHandler(username, realm, r.SrcAddr)
+	case r.AuthHandler != nil:
+		key, ok = r.AuthHandler(username, realm, r.SrcAddr)
+	}
+	return key, u, ok
+}
 
-	var lifetime proto.Lifetime
-	if err := lifetime.GetFrom(m); err == nil {
-		if lifetime.Duration < maximumAllocationLifetime {
-			lifetimeDuration = lifetime.Duration
+// cachedUserKey returns the key of username in realm from the AuthKeyCache if m passes the
+// integrity check with it. A cached key m doesn't pass it with is forgotten, the password of
+// the user may have changed since it was cached
+func (r Request) cachedUserKey(m *stun.Message, username, realm string) ([]byte, user, bool) {
+	if r.AuthKeyCache == nil {
+		return nil, user{}, false
+	}
+
+	k := newAuthKey(r.SrcAddr, realm, username)
+	key, u, ok := r.AuthKeyCache.get(k)
+	if !ok {
+		return nil, user{}, false
+	}
+	if stun.MessageIntegrity(key).Check(m) != nil {
+		r.AuthKeyCache.remove(k)
+		return nil, user{}, false
+	}
+	return key, u, true
+}
+
+// shadowAuth decides m again with the ShadowAuthHandler and logs when it disagrees with
+// the auth handler, that returned key and ok. The response only depends on the auth handler
+func (r Request) shadowAuth(m *stun.Message, username, realm string, key []byte, ok bool) {
+	if r.ShadowAuthHandler == nil {
+		return
+	}
+
+	accepted := ok && stun.MessageIntegrity(key).Check(m) == nil
+	shadowKey, shadowOK := r.ShadowAuthHandler(username, realm, r.SrcAddr)
+	shadowAccepted := shadowOK && stun.MessageIntegrity(shadowKey).Check(m) == nil
+	if accepted == shadowAccepted {
+		return
+	}
+
+	decision := map[bool]string{true: "accepted", false: "rejected"}
+	r.Log.Warnf("shadow auth discrepancy for %q in realm %q from %v: auth handler %s, shadow auth handler %s",
+		username, realm, r.SrcAddr, decision[accepted], decision[shadowAccepted])
+	if r.OnShadowAuthDiscrepancy != nil {
+		r.OnShadowAuthDiscrepancy()
+	}
+}
+
+// allocateWithContext returns allocatePacketConn giving up once ctx is done, with the error
+// of ctx. allocatePacketConn can't be interrupted, it keeps running without the request
+// waiting for it and the relay it allocates too late is closed
+func allocateWithContext(ctx context.Context, log logging.LeveledLogger, allocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error)) func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	type relay struct {
+		conn net.PacketConn
+		addr net.Addr
+		err  error
+	}
+
+	return func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+		relays := make(chan relay, 1)
+		go func() {
+			conn, addr, err := allocatePacketConn(network, requestedPort)
+			relays <- relay{conn, addr, err}
+		}()
+
+		select {
+		case r := <-relays:
+			return r.conn, r.addr, r.err
+		case <-ctx.Done():
+			go func() {
+				if r := <-relays; r.conn != nil {
+					if err := r.conn.Close(); err != nil {
+						log.Errorf("Failed to close relay socket allocated too late: %v", err)
+					}
+				}
+			}()
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// generateNonce returns a NONCE from the NonceHandler, or a random one that is stored in Nonces.
+// Either starts with the nonce cookie of the SecurityFeatures
+func (r Request) generateNonce() (string, error) {
+	cookie := r.SecurityFeatures.NonceCookie()
+	if r.NonceHandler != nil {
+		return cookie + r.NonceHandler.Generate(r.SrcAddr), nil
+	}
+
+	nonce, err := buildNonce()
+	if err != nil {
+		return "", err
+	}
+	nonce = cookie + nonce
+
+	// Nonce has already been taken
+	if _, keyCollision := r.Nonces.LoadOrStore(nonce, timeNow()); keyCollision {
+		return "", fmt.Errorf("duplicated Nonce generated, discarding request")
+	}
+	return nonce, nil
+}
+
+// validateNonce asks the NonceHandler whether nonce can be authenticated with. Without one
+// nonce has to be in Nonces, unknown and expired nonces are stale. The NonceHandler
+// validates the nonce it generated, without the nonce cookie
+func (r Request) validateNonce(nonce string) (ok bool, stale bool) {
+	if r.NonceHandler != nil {
+		return r.NonceHandler.Validate(r.SrcAddr, strings.TrimPrefix(nonce, r.SecurityFeatures.NonceCookie()))
+	}
+
+	nonceCreationTime, ok := r.Nonces.Load(nonce)
+	if !ok || timeNow().Sub(nonceCreationTime.(time.Time)) >= nonceLifetime {
+		r.Nonces.Delete(nonce)
+		return false, true
+	}
+	return true, false
+}
+
+// forgetNonce deletes nonce from Nonces, a NonceHandler keeps track of its NONCEs itself
+func (r Request) forgetNonce(nonce string) {
+	if r.NonceHandler == nil {
+		r.Nonces.Delete(nonce)
+	}
+}
+
+// realmAllowed returns true if realm is the Realm or one of the AdditionalRealms
+func (r Request) realmAllowed(realm string) bool {
+	if realm == r.Realm {
+		return true
+	}
+	for _, additionalRealm := range r.AdditionalRealms {
+		if realm == additionalRealm {
+			return true
 		}
 	}
+	return false
+}
+
+// sessionExpired returns true if the session of username from SrcAddr started more than
+// MaxSessionDuration ago. The session is forgotten, the next authenticated request starts a new one
+func (r Request) sessionExpired(username, realm string) bool {
+	if r.Sessions == nil || r.MaxSessionDuration <= 0 {
+		return false
+	}
+
+	return r.Sessions.expired(fmt.Sprintf("%s/%s/%s", r.SrcAddr, realm, username), timeNow(), r.MaxSessionDuration)
+}
+
+func (r Request) authResult(result AuthResult) {
+	if r.OnAuthResult != nil {
+		r.OnAuthResult(result)
+	}
+}
+
+func (r Request) authFailed(username, realm string) {
+	if r.OnAuthFailure != nil {
+		r.OnAuthFailure(username, realm, r.SrcAddr)
+	}
+}
+
+// transportAllowed returns true if AllowedTransports is nil or contains protocol
+func (r Request) transportAllowed(protocol proto.Protocol) bool {
+	if r.AllowedTransports == nil {
+		return true
+	}
+	for _, allowed := range r.AllowedTransports {
+		if allowed == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// minimumLifetime raises a lifetime below MinAllocationLifetime to it, a lifetime of 0
+// deletes the allocation and is kept
+func (r Request) minimumLifetime(lifetime time.Duration) time.Duration {
+	if lifetime != 0 && lifetime < r.MinAllocationLifetime {
+		return r.MinAllocationLifetime
+	}
+	return lifetime
+}
+
+// allocationLifeTime returns the lifetime requested with LIFETIME, clamped to
+// maximumAllocationLifetime. The default is used when LIFETIME is absent, a
+// LIFETIME that isn't 4 bytes long is an error
+func allocationLifeTime(m *stun.Message) (time.Duration, error) {
+	var lifetime proto.Lifetime
+	switch err := lifetime.GetFrom(m); {
+	case errors.Is(err, stun.ErrAttributeNotFound):
+		return proto.DefaultLifetime, nil
+	case err != nil:
+		return 0, fmt.Errorf("invalid LIFETIME: %w", err)
+	case lifetime.Duration > maximumAllocationLifetime:
+		return maximumAllocationLifetime, nil
+	}
+
+	return lifetime.Duration, nil
+}
+
+// peerAddressValid returns false for peer addresses nothing can be relayed to,
+// a port of 0 or an unspecified IP such as 0.0.0.0 or ::
+func peerAddressValid(peerAddress proto.PeerAddress) bool {
+	return peerAddress.Port != 0 && !peerAddress.IP.IsUnspecified()
+}
+
+// peerAddressFamilyMatches asserts that a peer IP is of the same address family as
+// the relayed transport address of the allocation. Relays that aren't IP based can't be checked
+func peerAddressFamilyMatches(a *allocation.Allocation, peerIP net.IP) bool {
+	relayIP, _, err := ipnet.AddrIPPort(a.RelayAddr)
+	if err != nil {
+		return true
+	}
 
-	return lifetimeDuration
+	return ipnet.AddressFamily(relayIP) == ipnet.AddressFamily(peerIP)
 }
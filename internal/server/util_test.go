@@ -0,0 +1,438 @@
+// +build !js
+
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// testNonceHandler issues "valid/<srcAddr>" and treats "stale" as a stale nonce
+type testNonceHandler struct{}
+
+func (testNonceHandler) Generate(srcAddr net.Addr) string {
+	return "valid/" + srcAddr.String()
+}
+
+func (testNonceHandler) Validate(srcAddr net.Addr, nonce string) (ok bool, stale bool) {
+	return nonce == "valid/"+srcAddr.String(), nonce == "stale"
+}
+
+func TestAuthenticateRequest(t *testing.T) {
+	allocate := func(t *testing.T, setters ...stun.Setter) *stun.Message {
+		setters = append([]stun.Setter{
+			stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			proto.RequestedTransport{Protocol: proto.ProtoUDP},
+		}, setters...)
+
+		m, err := stun.Build(setters...)
+		assert.NoError(t, err)
+		return m
+	}
+
+	// assertUnauthorized asserts a 401 with REALM and a usable NONCE, which is returned
+	assertUnauthorized := func(t *testing.T, r Request, res *stun.Message) stun.Nonce {
+		assertErrorCode(t, res, stun.CodeUnauthorized)
+		assert.False(t, res.Contains(stun.AttrMessageIntegrity))
+
+		var realm stun.Realm
+		assert.NoError(t, realm.GetFrom(res))
+		assert.Equal(t, r.Realm, realm.String())
+
+		var nonce stun.Nonce
+		assert.NoError(t, nonce.GetFrom(res))
+		assert.NotEmpty(t, nonce.String())
+
+		_, ok := r.Nonces.Load(nonce.String())
+		assert.True(t, ok, "nonce should be stored")
+		return nonce
+	}
+
+	credentials := func(username, realm string, nonce stun.Nonce, password string) []stun.Setter {
+		return []stun.Setter{
+			stun.NewUsername(username),
+			stun.NewRealm(realm),
+			nonce,
+			stun.NewLongTermIntegrity(username, realm, password),
+		}
+	}
+
+	t.Run("Handshake", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+		r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return stun.NewLongTermIntegrity(username, realm, "pass"), true
+		}
+
+		_ = handleAllocateRequest(r, allocate(t))
+		nonce := assertUnauthorized(t, r, readTestResponse(t, clientConn))
+
+		assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, nonce, "pass")...)))
+		res := readTestResponse(t, clientConn)
+		assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+		assert.NoError(t, stun.NewLongTermIntegrity("user", r.Realm, "pass").Check(res))
+	})
+
+	// The first Allocate carries no MESSAGE-INTEGRITY, it is challenged without being an
+	// auth failure and the client authenticates with the NONCE it was given
+	t.Run("FirstAllocate", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		var failures int
+		r.OnAuthFailure = func(username, realm string, srcAddr net.Addr) {
+			failures++
+		}
+		r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return stun.NewLongTermIntegrity(username, realm, "pass"), true
+		}
+
+		// A retransmitted first Allocate gets another nonce, both can be used
+		first := allocate(t)
+		assert.NoError(t, handleAllocateRequest(r, first))
+		nonce := assertUnauthorized(t, r, readTestResponse(t, clientConn))
+		assert.NoError(t, handleAllocateRequest(r, first))
+		retransmitNonce := assertUnauthorized(t, r, readTestResponse(t, clientConn))
+		assert.NotEqual(t, nonce, retransmitNonce)
+		assert.Equal(t, 0, failures)
+
+		// NONCE must be echoed, without it the request is malformed
+		assert.Error(t, handleAllocateRequest(r, allocate(t,
+			stun.NewUsername("user"), stun.NewRealm(r.Realm), stun.NewLongTermIntegrity("user", r.Realm, "pass"))))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeBadRequest)
+
+		// A nonce the server didn't issue is stale, the client is given a new one
+		assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, stun.NewNonce("forged"), "pass")...)))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeStaleNonce)
+		assert.Equal(t, 0, failures)
+
+		assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, nonce, "pass")...)))
+		res := readTestResponse(t, clientConn)
+		assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+		assert.NoError(t, stun.NewLongTermIntegrity("user", r.Realm, "pass").Check(res))
+
+		// The nonce stays valid for the requests that follow
+		m, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassRequest)},
+			credentials("user", r.Realm, retransmitNonce, "pass")...)...)
+		assert.NoError(t, err)
+		assert.NoError(t, handleRefreshRequest(r, m))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+		assert.Equal(t, 0, failures)
+	})
+
+	t.Run("WrongPassword", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		var failures int
+		r.OnAuthFailure = func(username, realm string, srcAddr net.Addr) {
+			failures++
+		}
+		r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return stun.NewLongTermIntegrity(username, realm, "pass"), true
+		}
+
+		_ = handleAllocateRequest(r, allocate(t))
+		nonce := assertUnauthorized(t, r, readTestResponse(t, clientConn))
+
+		assert.Error(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, nonce, "wrong")...)))
+		nonce = assertUnauthorized(t, r, readTestResponse(t, clientConn))
+		assert.Equal(t, 1, failures)
+
+		// The client may retry with the right password and the new nonce
+		assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, nonce, "pass")...)))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+	})
+
+	t.Run("UnknownUser", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+		r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return nil, false
+		}
+
+		assert.Error(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, stun.NewNonce(testNonce), "pass")...)))
+		assertUnauthorized(t, r, readTestResponse(t, clientConn))
+	})
+
+	t.Run("WrongRealm", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		assert.Error(t, handleAllocateRequest(r, allocate(t, credentials("user", "example.com", stun.NewNonce(testNonce), "pass")...)))
+		assertUnauthorized(t, r, readTestResponse(t, clientConn))
+	})
+
+	t.Run("AdditionalRealms", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+		r.AdditionalRealms = []string{"example.com", "example.org"}
+
+		var realms []string
+		r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			realms = append(realms, realm)
+			return stun.NewLongTermIntegrity(username, realm, "pass"), true
+		}
+
+		// Credentials are checked against the realm sent by the client
+		assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", "example.org", stun.NewNonce(testNonce), "pass")...)))
+		res := readTestResponse(t, clientConn)
+		assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+		assert.NoError(t, stun.NewLongTermIntegrity("user", "example.org", "pass").Check(res))
+		assert.Equal(t, []string{"example.org"}, realms)
+
+		// Realms that aren't allowed are challenged for the configured Realm
+		assert.Error(t, handleAllocateRequest(r, allocate(t, credentials("user", "example.net", stun.NewNonce(testNonce), "pass")...)))
+		assertUnauthorized(t, r, readTestResponse(t, clientConn))
+		assert.Equal(t, []string{"example.org"}, realms)
+	})
+
+	t.Run("UsernameValidator", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+		r.UsernameValidator = func(username string) bool {
+			return strings.Contains(username, ":")
+		}
+
+		var lookups, failures int
+		r.OnAuthFailure = func(username, realm string, srcAddr net.Addr) {
+			failures++
+		}
+		r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			lookups++
+			return stun.NewLongTermIntegrity(username, realm, "pass"), true
+		}
+
+		// Malformed usernames are rejected without asking the AuthHandler
+		assert.Error(t, handleAllocateRequest(r, allocate(t, credentials("garbage", r.Realm, stun.NewNonce(testNonce), "pass")...)))
+		assertUnauthorized(t, r, readTestResponse(t, clientConn))
+		assert.Equal(t, 0, lookups)
+		assert.Equal(t, 1, failures)
+
+		assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("1600000000:user", r.Realm, stun.NewNonce(testNonce), "pass")...)))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+		assert.Equal(t, 1, lookups)
+	})
+
+	t.Run("StaleNonce", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		r.Nonces.Store("expired", time.Now().Add(-nonceLifetime))
+
+		for _, nonce := range []string{"expired", "unknown"} {
+			assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, stun.NewNonce(nonce), "pass")...)))
+
+			res := readTestResponse(t, clientConn)
+			assertErrorCode(t, res, stun.CodeStaleNonce)
+
+			var realm stun.Realm
+			assert.NoError(t, realm.GetFrom(res))
+			assert.Equal(t, r.Realm, realm.String())
+
+			var newNonce stun.Nonce
+			assert.NoError(t, newNonce.GetFrom(res))
+			assert.NotEqual(t, nonce, newNonce.String())
+		}
+
+		_, ok := r.Nonces.Load("expired")
+		assert.False(t, ok, "expired nonce should be forgotten")
+	})
+
+	t.Run("MaxSessionDuration", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+		r.Sessions = NewSessions()
+		r.MaxSessionDuration = 24 * time.Hour
+		r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return stun.NewLongTermIntegrity(username, realm, "pass"), true
+		}
+
+		now := time.Now()
+		timeNow = func() time.Time { return now }
+		defer func() { timeNow = time.Now }()
+		r.Nonces.Store(testNonce, now)
+
+		assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, stun.NewNonce(testNonce), "pass")...)))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+
+		// refresh sends a Refresh with nonce, the nonce from a 438 (Stale Nonce) is returned
+		refresh := func(nonce stun.Nonce) (*stun.Message, stun.Nonce) {
+			m, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassRequest)},
+				credentials("user", r.Realm, nonce, "pass")...)...)
+			assert.NoError(t, err)
+			_ = handleRefreshRequest(r, m)
+
+			res := readTestResponse(t, clientConn)
+			if res.Type.Class == stun.ClassErrorResponse {
+				assertErrorCode(t, res, stun.CodeStaleNonce)
+
+				var newNonce stun.Nonce
+				assert.NoError(t, newNonce.GetFrom(res))
+				return res, newNonce
+			}
+			return res, nonce
+		}
+
+		nonce := stun.NewNonce(testNonce)
+		now = now.Add(30 * time.Minute)
+		res, _ := refresh(nonce)
+		assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+
+		// Nonces expire every hour, the client renews them without starting a new session
+		for i := 0; i < 23; i++ {
+			now = now.Add(nonceLifetime)
+			res, nonce = refresh(nonce)
+			assertErrorCode(t, res, stun.CodeStaleNonce)
+
+			res, nonce = refresh(nonce)
+			assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+		}
+
+		// The nonce is fresh but the session is too old
+		now = now.Add(29 * time.Minute)
+		res, _ = refresh(nonce)
+		assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+
+		now = now.Add(time.Minute)
+		res, newNonce := refresh(nonce)
+		assertErrorCode(t, res, stun.CodeStaleNonce)
+		assert.NotEqual(t, nonce, newNonce)
+		_, ok := r.Nonces.Load(nonce.String())
+		assert.False(t, ok, "nonce of the expired session should be forgotten")
+
+		// Authenticating again starts a new session
+		res, _ = refresh(newNonce)
+		assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+
+		now = now.Add(time.Hour - time.Minute)
+		res, _ = refresh(newNonce)
+		assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class)
+	})
+
+	t.Run("AuthResult", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+
+		var results []AuthResult
+		r.OnAuthResult = func(result AuthResult) {
+			results = append(results, result)
+		}
+		r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			if username != "user" {
+				return nil, false
+			}
+			return stun.NewLongTermIntegrity(username, realm, "pass"), true
+		}
+
+		_ = handleAllocateRequest(r, allocate(t))
+		nonce := assertUnauthorized(t, r, readTestResponse(t, clientConn))
+
+		_ = handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, stun.NewNonce("forged"), "pass")...))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeStaleNonce)
+
+		_ = handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, nonce, "wrong")...))
+		nonce = assertUnauthorized(t, r, readTestResponse(t, clientConn))
+
+		_ = handleAllocateRequest(r, allocate(t, credentials("nobody", r.Realm, nonce, "pass")...))
+		nonce = assertUnauthorized(t, r, readTestResponse(t, clientConn))
+
+		_ = handleAllocateRequest(r, allocate(t, credentials("user", "other.realm", nonce, "pass")...))
+		nonce = assertUnauthorized(t, r, readTestResponse(t, clientConn))
+
+		assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, nonce, "pass")...)))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+
+		assert.Equal(t, []AuthResult{
+			AuthResultMissingIntegrity,
+			AuthResultStaleNonce,
+			AuthResultBadIntegrity,
+			AuthResultUnknownUser,
+			AuthResultRejected,
+			AuthResultSuccess,
+		}, results)
+		assert.Equal(t, "StaleNonce", AuthResultStaleNonce.String())
+		assert.Equal(t, "Unknown", AuthResult(0).String())
+	})
+
+	t.Run("NonceHandler", func(t *testing.T) {
+		r, clientConn := newTestRequest(t, nil)
+		defer closeTestRequest(t, r, clientConn)
+		r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return stun.NewLongTermIntegrity(username, realm, "pass"), true
+		}
+		r.NonceHandler = testNonceHandler{}
+
+		_ = handleAllocateRequest(r, allocate(t))
+		res := readTestResponse(t, clientConn)
+		assertErrorCode(t, res, stun.CodeUnauthorized)
+		var nonce stun.Nonce
+		assert.NoError(t, nonce.GetFrom(res))
+		assert.Equal(t, "valid/"+r.SrcAddr.String(), nonce.String())
+
+		_, ok := r.Nonces.Load(nonce.String())
+		assert.False(t, ok, "nonces of a NonceHandler aren't stored")
+
+		_ = handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, stun.NewNonce("stale"), "pass")...))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeStaleNonce)
+
+		_ = handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, stun.NewNonce("forged"), "pass")...))
+		assertErrorCode(t, readTestResponse(t, clientConn), stun.CodeUnauthorized)
+
+		assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, nonce, "pass")...)))
+		assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+	})
+
+	// The NONCEs start with the nonce cookie, a NonceHandler sees them without it
+	t.Run("SecurityFeatures", func(t *testing.T) {
+		for _, nonceHandler := range []NonceHandler{nil, testNonceHandler{}} {
+			r, clientConn := newTestRequest(t, nil)
+			r.AuthHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+				return stun.NewLongTermIntegrity(username, realm, "pass"), true
+			}
+			r.NonceHandler = nonceHandler
+			r.SecurityFeatures = proto.SecurityFeatureUsernameAnonymity
+
+			_ = handleAllocateRequest(r, allocate(t))
+			res := readTestResponse(t, clientConn)
+			assertErrorCode(t, res, stun.CodeUnauthorized)
+			var nonce stun.Nonce
+			assert.NoError(t, nonce.GetFrom(res))
+			assert.True(t, strings.HasPrefix(nonce.String(), "obMatJos2AAAC"), nonce.String())
+
+			features, ok := proto.ParseNonceCookie(nonce.String())
+			assert.True(t, ok)
+			assert.Equal(t, proto.SecurityFeatureUsernameAnonymity, features)
+
+			assert.NoError(t, handleAllocateRequest(r, allocate(t, credentials("user", r.Realm, nonce, "pass")...)))
+			assert.Equal(t, stun.ClassSuccessResponse, readTestResponse(t, clientConn).Type.Class)
+			closeTestRequest(t, r, clientConn)
+		}
+	})
+}
+
+func TestSessionsPrune(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	s := NewSessions()
+	assert.False(t, s.expired("active", now, 24*time.Hour))
+	assert.False(t, s.expired("gone", now, 24*time.Hour))
+
+	// The client that went away is forgotten once its nonce went stale, the other one keeps its session
+	for i := 0; i < 3; i++ {
+		now = now.Add(nonceLifetime / 2)
+		assert.False(t, s.expired("active", now, 24*time.Hour))
+	}
+	assert.Len(t, s.sessions, 1)
+	assert.Equal(t, now.Add(-3*nonceLifetime/2), s.sessions["active"].start)
+	assert.NotContains(t, s.sessions, "gone")
+}
@@ -0,0 +1,57 @@
+package turn
+
+import "sync"
+
+// listener is a ListenerConfig served by the Server. It counts the connections it accepted
+// that are still open, a removed listener serves them until they are drained
+type listener struct {
+	ListenerConfig
+
+	lock    sync.Mutex
+	conns   int
+	removed bool
+	drained chan struct{}
+}
+
+func (l *listener) connOpened() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.conns++
+}
+
+func (l *listener) connClosed() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.conns--
+	if l.conns == 0 && l.drained != nil {
+		close(l.drained)
+		l.drained = nil
+	}
+}
+
+func (l *listener) remove() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.removed = true
+}
+
+// drain blocks until the connections of a removed listener are closed, or until
+// closed is. It returns right away for a listener that wasn't removed
+func (l *listener) drain(closed <-chan struct{}) {
+	l.lock.Lock()
+	if !l.removed || l.conns == 0 {
+		l.lock.Unlock()
+		return
+	}
+	drained := make(chan struct{})
+	l.drained = drained
+	l.lock.Unlock()
+
+	select {
+	case <-drained:
+	case <-closed:
+	}
+}
@@ -0,0 +1,109 @@
+package turn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var errQUICListenerClosed = errors.New("turn: QUICListener is closed")
+
+// QUICStream is the subset of a QUIC stream (e.g. quic.Stream of quic-go) needed to carry TURN.
+//
+// EXPERIMENTAL: TURN over QUIC isn't standardized, this API may change.
+type QUICStream interface {
+	io.Reader
+	io.Writer
+	io.Closer
+
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// quicConn adapts a QUICStream to the net.Conn used by ListenerConfig
+type quicConn struct {
+	QUICStream
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// NewQUICConn wraps a QUIC stream as a net.Conn. STUN and ChannelData framing over the
+// stream is handled by the server the same way as for TCP.
+//
+// remoteAddr should be the peer address when the stream was opened. It is what the
+// allocation is keyed on, so the allocation survives QUIC connection migration.
+//
+// EXPERIMENTAL: TURN over QUIC isn't standardized, this API may change.
+func NewQUICConn(stream QUICStream, localAddr, remoteAddr net.Addr) net.Conn {
+	return &quicConn{
+		QUICStream: stream,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+	}
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// QUICListener is a net.Listener for ListenerConfig that is fed the streams accepted from
+// QUIC sessions. The QUIC listener itself, and accepting sessions and streams from it, is up to
+// the caller, each accepted stream is handed over with Serve.
+//
+// EXPERIMENTAL: TURN over QUIC isn't standardized, this API may change.
+type QUICListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewQUICListener creates a QUICListener, addr is the address of the QUIC listener
+func NewQUICListener(addr net.Addr) *QUICListener {
+	return &QUICListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Serve hands a stream accepted from remoteAddr to the TURN server. It blocks until the
+// server accepted the stream or the listener is closed
+func (l *QUICListener) Serve(stream QUICStream, remoteAddr net.Addr) error {
+	select {
+	case l.conns <- NewQUICConn(stream, l.addr, remoteAddr):
+		return nil
+	case <-l.closed:
+		return errQUICListenerClosed
+	}
+}
+
+// Accept waits for and returns the next stream handed over with Serve
+func (l *QUICListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errQUICListenerClosed
+	}
+}
+
+// Close stops accepting streams. Streams already accepted are left open
+func (l *QUICListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the address of the QUIC listener
+func (l *QUICListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,80 @@
+package turn
+
+import (
+	"sync/atomic"
+
+	"github.com/pion/turn/v2/internal/allocation"
+)
+
+// RealmQuota caps the allocations of the clients authenticated in a realm, see
+// ServerConfig.RealmQuotas. Zero values mean unlimited
+type RealmQuota struct {
+	// MaxAllocations caps the allocations of the realm, Allocate requests past it are
+	// answered with a 486 (Allocation Quota Reached)
+	MaxAllocations int
+
+	// MaxRelayedBytes caps the payload bytes relayed by all allocations of the realm, to and
+	// from peers counted together. An allocation whose payload would exceed it is deleted
+	// with an EventAllocationDeleted carrying DeletionReasonByteQuota, the realm can't relay
+	// anything more until the Server is restarted
+	MaxRelayedBytes int64
+}
+
+// RealmStats describes the clients authenticated in a realm, the Realm or one of the
+// AdditionalRealms. The counters only ever grow except for Allocations
+type RealmStats struct {
+	// Allocations is the number of allocations of the realm currently open
+	Allocations int64
+
+	// AllocationsCreated is the number of allocations the realm created
+	AllocationsCreated uint64
+
+	// RelayedBytes is the payload bytes relayed by the allocations of the realm, to and
+	// from peers counted together
+	RelayedBytes uint64
+
+	// AuthFailures is the number of requests of the realm with credentials that couldn't be
+	// verified, e.g. because of an unknown user or a wrong password, answered with a 401
+	AuthFailures uint64
+}
+
+// realmStats holds the counters behind RealmStats, it is only accessed atomically
+type realmStats struct {
+	authFailures uint64
+	quota        allocation.Quota
+}
+
+// newRealmStats creates the realmStats of realm and the additionalRealms, capped by quotas
+func newRealmStats(realm string, additionalRealms []string, quotas map[string]RealmQuota) map[string]*realmStats {
+	realms := map[string]*realmStats{}
+	for _, r := range append([]string{realm}, additionalRealms...) {
+		quota := quotas[r]
+		realms[r] = &realmStats{quota: allocation.Quota{
+			MaxAllocations:  int64(quota.MaxAllocations),
+			MaxRelayedBytes: uint64(quota.MaxRelayedBytes),
+		}}
+	}
+	return realms
+}
+
+// RealmStats returns a snapshot of the counters of every realm the Server authenticates in
+func (s *Server) RealmStats() map[string]RealmStats {
+	stats := make(map[string]RealmStats, len(s.realms))
+	for realm, r := range s.realms {
+		stats[realm] = RealmStats{
+			Allocations:        r.quota.Allocations(),
+			AllocationsCreated: r.quota.AllocationsCreated(),
+			RelayedBytes:       r.quota.RelayedBytes(),
+			AuthFailures:       atomic.LoadUint64(&r.authFailures),
+		}
+	}
+	return stats
+}
+
+// realmQuota returns the allocation.Quota of realm, nil if the Server doesn't authenticate in it
+func (s *Server) realmQuota(realm string) *allocation.Quota {
+	if r, ok := s.realms[realm]; ok {
+		return &r.quota
+	}
+	return nil
+}
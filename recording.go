@@ -0,0 +1,63 @@
+package turn
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/pion/turn/v2/internal/allocation"
+)
+
+// RecordingSink returns the io.Writer the payloads relayed by a new allocation are
+// recorded to, or nil to not record the allocation. srcAddr and dstAddr are the client
+// and server side of the 5-tuple, relayAddr is the relayed address of the allocation
+type RecordingSink func(srcAddr, dstAddr, relayAddr net.Addr) io.Writer
+
+// RelayDirection tells whether a recorded payload was sent to or received from the peer
+type RelayDirection byte
+
+const (
+	// RelayDirectionToPeer is a payload the client sent to the peer
+	RelayDirectionToPeer = RelayDirection(allocation.DirectionToPeer)
+
+	// RelayDirectionToClient is a payload the peer sent to the client
+	RelayDirectionToClient = RelayDirection(allocation.DirectionToClient)
+)
+
+func (d RelayDirection) String() string {
+	switch d {
+	case RelayDirectionToPeer:
+		return "ToPeer"
+	case RelayDirectionToClient:
+		return "ToClient"
+	default:
+		return "Unknown"
+	}
+}
+
+// RelayRecord is a payload written to a RecordingSink
+type RelayRecord struct {
+	Direction RelayDirection
+	Time      time.Time
+
+	// Peer is the address of the peer the payload was sent to or received from
+	Peer string
+	Data []byte
+}
+
+// ReadRelayRecord reads the next RelayRecord from what was written to a RecordingSink,
+// io.EOF is returned when there are no more records. Each record is written to the sink
+// with a single call to Write
+func ReadRelayRecord(r io.Reader) (RelayRecord, error) {
+	direction, t, peer, data, err := allocation.ReadRecord(r)
+	if err != nil {
+		return RelayRecord{}, err
+	}
+
+	return RelayRecord{
+		Direction: RelayDirection(direction),
+		Time:      t,
+		Peer:      peer,
+		Data:      data,
+	}, nil
+}
@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"github.com/pion/transport/vnet"
+	"github.com/pion/turn/v2/internal/ipnet"
 )
 
 // RelayAddressGeneratorStatic can be used to return static IP address each time a relay is created.
@@ -18,6 +19,20 @@ type RelayAddressGeneratorStatic struct {
 	Address string
 
 	Net *vnet.Net
+
+	// AdvertisedPort is optional, it maps the port a relay is bound to to the port returned
+	// to the user. Use it when the relay is reached through a port forward or a 1:1 NAT that
+	// doesn't preserve ports, e.g. one shifting them by a fixed offset. When nil the bound
+	// port is returned.
+	AdvertisedPort func(boundPort int) int
+
+	// FreeBind binds relay sockets with IP_FREEBIND, so Address may be an IP that isn't
+	// assigned to an interface yet, e.g. a floating IP moved between servers by keepalived
+	// or VRRP on failover. Relays bound before the IP arrives receive nothing until it does.
+	// It also means a mistyped Address is bound without an error, and any local process can
+	// bind an address that isn't its own, so only use it for addresses the host is meant to
+	// take over. Only supported on linux, Validate fails elsewhere and with a virtual Net.
+	FreeBind bool
 }
 
 // Validate is caled on server startup and confirms the RelayAddressGenerator is properly configured
@@ -31,6 +46,10 @@ func (r *RelayAddressGeneratorStatic) Validate() error {
 		return errRelayAddressInvalid
 	case r.Address == "":
 		return errListeningAddressInvalid
+	case r.FreeBind && !freeBindSupported():
+		return errFreeBindUnsupported
+	case r.FreeBind && r.Net.IsVirtual():
+		return errFreeBindVirtualNet
 	default:
 		return nil
 	}
@@ -38,16 +57,31 @@ func (r *RelayAddressGeneratorStatic) Validate() error {
 
 // AllocatePacketConn generates a new PacketConn to receive traffic on and the IP/Port to populate the allocation response with
 func (r *RelayAddressGeneratorStatic) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
-	conn, err := r.Net.ListenPacket(network, r.Address+":"+strconv.Itoa(requestedPort))
+	listenPacket := r.Net.ListenPacket
+	if r.FreeBind {
+		listenPacket = listenPacketFreeBind
+	}
+
+	conn, err := listenPacket(network, net.JoinHostPort(r.Address, strconv.Itoa(requestedPort)))
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Replace actual listening IP with the user requested one of RelayAddressGeneratorStatic
-	relayAddr := conn.LocalAddr().(*net.UDPAddr)
-	relayAddr.IP = r.RelayAddress
+	_, port, err := ipnet.AddrIPPort(conn.LocalAddr())
+	if err == nil && r.AdvertisedPort != nil {
+		if port = r.AdvertisedPort(port); port <= 0 || port > 0xFFFF {
+			err = fmt.Errorf("%w: %d", errAdvertisedPortInvalid, port)
+		}
+	}
+	if err != nil {
+		if closeErr := conn.Close(); closeErr != nil {
+			return nil, nil, closeErr
+		}
+		return nil, nil, err
+	}
 
-	return conn, relayAddr, nil
+	return conn, &net.UDPAddr{IP: r.RelayAddress, Port: port}, nil
 }
 
 // AllocateConn generates a new Conn to receive traffic on and the IP/Port to populate the allocation response with
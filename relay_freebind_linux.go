@@ -0,0 +1,30 @@
+// +build linux
+
+package turn
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listenPacketFreeBind binds a socket with IP_FREEBIND, address doesn't have to be
+// assigned to an interface yet
+func listenPacketFreeBind(network, address string) (net.PacketConn, error) {
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return listenConfig.ListenPacket(context.Background(), network, address)
+}
+
+func freeBindSupported() bool {
+	return true
+}
@@ -0,0 +1,34 @@
+// +build linux
+
+package turn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayAddressGeneratorStaticFreeBind(t *testing.T) {
+	// 192.0.2.1 (TEST-NET-1) stands in for a floating IP that isn't on an interface yet
+	generator := &RelayAddressGeneratorStatic{
+		RelayAddress: net.ParseIP("192.0.2.1"),
+		Address:      "192.0.2.1",
+	}
+	assert.NoError(t, generator.Validate())
+
+	_, _, err := generator.AllocatePacketConn("udp4", 0)
+	assert.Error(t, err)
+
+	generator.FreeBind = true
+	conn, relayAddr, err := generator.AllocatePacketConn("udp4", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", conn.LocalAddr().(*net.UDPAddr).IP.String())
+	assert.Equal(t, conn.LocalAddr().(*net.UDPAddr).Port, relayAddr.(*net.UDPAddr).Port)
+	assert.NoError(t, conn.Close())
+
+	// A virtual Net can't bind with IP_FREEBIND
+	generator.Net = vnet.NewNet(&vnet.NetConfig{})
+	assert.Equal(t, errFreeBindVirtualNet, generator.Validate())
+}
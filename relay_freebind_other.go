@@ -0,0 +1,13 @@
+// +build !linux
+
+package turn
+
+import "net"
+
+func listenPacketFreeBind(network, address string) (net.PacketConn, error) {
+	return nil, errFreeBindUnsupported
+}
+
+func freeBindSupported() bool {
+	return false
+}
@@ -2,31 +2,133 @@
 package turn
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
 	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/ipnet"
 	"github.com/pion/turn/v2/internal/proto"
 	"github.com/pion/turn/v2/internal/server"
 )
 
 const (
-	inboundMTU = 1500
+	// inboundMTU is the default RelayMTU, maxRelayMTU is the largest UDP payload
+	inboundMTU  = 1500
+	maxRelayMTU = 65507
+
+	// inboundOverhead is room for the STUN or ChannelData framing around a payload
+	// of RelayMTU bytes, e.g. the XOR-PEER-ADDRESS and FINGERPRINT of a Send indication
+	inboundOverhead = 128
+
+	// defaultExpiryJitter extends expiry timers by up to 5% of the lifetime
+	defaultExpiryJitter = 0.05
+	maxExpiryJitter     = 0.25
+
+	// maxAllocationLifetime is the longest lifetime an allocation is granted, RFC 5766 Section 6.2
+	maxAllocationLifetime = time.Hour
+
+	// maxSessionDuration is the longest MaxSessionDuration
+	maxSessionDuration = 24 * time.Hour
+
+	// defaultPartialMessageTimeout is how long a connection may stall in the middle of a message
+	defaultPartialMessageTimeout = 10 * time.Second
+
+	// defaultBindingRateLimit and defaultBindingRateBurst are generous enough for the
+	// connectivity checks of every client behind a NAT, but not for a scan
+	defaultBindingRateLimit = 100
+	defaultBindingRateBurst = 200
+
+	// defaultPortReuseQuarantine outlasts the packets still in flight to a deleted allocation
+	defaultPortReuseQuarantine = 5 * time.Second
 )
 
 // Server is an instance of the Pion TURN Server
+//
+// Only requests received on the listeners are answered. Whatever peers send to a relayed
+// address is relayed to the client, including STUN Binding requests, e.g. the ICE
+// connectivity checks of a peer using the relayed address as a candidate. The client
+// answers those through its allocation.
 type Server struct {
+	droppedEvents       uint64    // accessed atomically, kept first for 64-bit alignment
+	connStats           connStats // accessed atomically, kept first for 64-bit alignment
+	oversizedPayloads   uint64    // accessed atomically, kept first for 64-bit alignment
+	unpermittedPayloads uint64    // accessed atomically, kept first for 64-bit alignment
+	authStats           authStats // accessed atomically, kept first for 64-bit alignment
+
+	expiredPermissionDrops uint64 // accessed atomically, kept first for 64-bit alignment
+	deniedSourcePackets    uint64 // accessed atomically, kept first for 64-bit alignment
+
 	log                logging.LeveledLogger
 	authHandler        AuthHandler
+	tenantAuthHandler  TenantAuthHandler
+	contextAuthHandler ContextAuthHandler
+	shadowAuthHandler  AuthHandler
+	usernameValidator  func(username string) bool
+	nonceHandler       NonceHandler
+	securityFeatures   proto.SecurityFeatures
+	tenantRelays       map[string]func(network string, requestedPort int) (net.PacketConn, net.Addr, error)
 	realm              string
+	additionalRealms   []string
 	channelBindTimeout time.Duration
+	stunOnly           bool
+	disableFingerprint bool
 	nonces             *sync.Map
+	events             chan Event
+	connSlots          chan struct{}
+	transactionCache   *server.TransactionCache
+	bindingRateLimiter *server.RateLimiter
+	authKeyCache       *server.AuthKeyCache
+	connPoller         *connPoller
 
 	packetConnConfigs []PacketConnConfig
-	listenerConfigs   []ListenerConfig
+
+	// listeners are guarded by listenersLock, they can be added and removed while serving
+	listenersLock sync.Mutex
+	listeners     []*listener
+	closed        chan struct{}
+	closeOnce     sync.Once
+
+	// allocationManagerConfig is the allocation.ManagerConfig shared by all listeners,
+	// without the RelayAddressGenerator of the listener
+	allocationManagerConfig allocation.ManagerConfig
+
+	sessions           *server.Sessions
+	maxSessionDuration time.Duration
+	requestTimeout     time.Duration
+
+	logExpiredPermissionDrops bool
+
+	minAllocationLifetime time.Duration
+
+	allowedTransports []proto.Protocol
+
+	relayMTU int
+
+	partialMessageTimeout time.Duration
+
+	onRequestPanic func(srcAddr net.Addr, packet []byte, err error)
+
+	// realms are the counters and quotas of the Realm and AdditionalRealms, the map is
+	// never modified after NewServer
+	realms map[string]*realmStats
+
+	allocationStore AllocationStore
+
+	// allocationManagers are the allocation.Managers of the listeners, see Allocations
+	allocationManagersLock sync.Mutex
+	allocationManagers     map[*allocation.Manager]struct{}
+
+	// deniedSourceIPs holds the []net.IPNet of ServerConfig.DeniedSourceIPs, it is
+	// replaced by SetDeniedSourceIPs while the read loops use it
+	deniedSourceIPs atomic.Value
 }
 
 // NewServer creates the Pion TURN server
@@ -43,65 +145,155 @@ func NewServer(config ServerConfig) (*Server, error) {
 	s := &Server{
 		log:                loggerFactory.NewLogger("turn"),
 		authHandler:        config.AuthHandler,
+		tenantAuthHandler:  config.TenantAuthHandler,
+		contextAuthHandler: config.ContextAuthHandler,
+		shadowAuthHandler:  config.ShadowAuthHandler,
+		usernameValidator:  config.UsernameValidator,
+		nonceHandler:       config.NonceHandler,
+		securityFeatures:   proto.SecurityFeatures(config.SecurityFeatures),
 		realm:              config.Realm,
+		additionalRealms:   config.AdditionalRealms,
 		channelBindTimeout: config.ChannelBindTimeout,
+		stunOnly:           config.STUNOnly,
+		disableFingerprint: config.DisableFingerprint,
 		packetConnConfigs:  config.PacketConnConfigs,
-		listenerConfigs:    config.ListenerConfigs,
+		closed:             make(chan struct{}),
 		nonces:             &sync.Map{},
+		sessions:           server.NewSessions(),
+		maxSessionDuration: config.MaxSessionDuration,
+		requestTimeout:     config.RequestTimeout,
+		relayMTU:           config.RelayMTU,
+
+		partialMessageTimeout: config.PartialMessageTimeout,
+
+		onRequestPanic: config.OnRequestPanic,
+
+		realms: newRealmStats(config.Realm, config.AdditionalRealms, config.RealmQuotas),
+
+		allocationStore: config.AllocationStore,
+
+		logExpiredPermissionDrops: config.LogExpiredPermissionDrops,
+
+		minAllocationLifetime: config.MinAllocationLifetime,
+
+		allowedTransports: allowedTransports(config.AllowedTransports),
+
+		allocationManagers: map[*allocation.Manager]struct{}{},
+	}
+	if s.allocationStore == nil {
+		s.allocationStore = NewMemoryAllocationStore()
+	}
+
+	if len(config.TenantRelayAddressGenerators) != 0 {
+		s.tenantRelays = map[string]func(network string, requestedPort int) (net.PacketConn, net.Addr, error){}
+		for tenant, r := range config.TenantRelayAddressGenerators {
+			s.tenantRelays[tenant] = r.AllocatePacketConn
+		}
 	}
 
 	if s.channelBindTimeout == 0 {
 		s.channelBindTimeout = proto.DefaultLifetime
 	}
 
+	if s.relayMTU == 0 {
+		s.relayMTU = inboundMTU
+	}
+
+	if s.partialMessageTimeout == 0 {
+		s.partialMessageTimeout = defaultPartialMessageTimeout
+	}
+
+	eventsBufferSize := config.EventsBufferSize
+	if eventsBufferSize == 0 {
+		eventsBufferSize = defaultEventsBufferSize
+	}
+	s.events = make(chan Event, eventsBufferSize)
+
+	if config.MaxConcurrentConnections > 0 {
+		s.connSlots = make(chan struct{}, config.MaxConcurrentConnections)
+	}
+
+	expiryJitter := config.ExpiryJitter
+	if expiryJitter == 0 {
+		expiryJitter = defaultExpiryJitter
+	}
+
+	portReuseQuarantine := config.PortReuseQuarantine
+	if portReuseQuarantine == 0 {
+		portReuseQuarantine = defaultPortReuseQuarantine
+	}
+
+	if config.ConnWorkers > 0 {
+		poller, err := newConnPoller(config.ConnWorkers, s.relayMTU+inboundOverhead, s.partialMessageTimeout, s.log, s.handleRequest, s.dropOversized, &s.connStats)
+		if err != nil {
+			s.log.Warnf("ConnWorkers unavailable, serving each connection from its own goroutine: %v", err)
+		} else {
+			s.connPoller = poller
+		}
+	}
+
+	if config.TransactionCacheTTL > 0 {
+		s.transactionCache = server.NewTransactionCache(config.TransactionCacheSize, config.TransactionCacheTTL)
+	}
+
+	if config.AuthKeyCacheTTL > 0 {
+		s.authKeyCache = server.NewAuthKeyCache(0, config.AuthKeyCacheTTL)
+	}
+
+	s.SetDeniedSourceIPs(config.DeniedSourceIPs)
+
+	if config.BindingRateLimit >= 0 {
+		bindingRateLimit, bindingRateBurst := config.BindingRateLimit, config.BindingRateBurst
+		if bindingRateLimit == 0 {
+			bindingRateLimit = defaultBindingRateLimit
+		}
+		if bindingRateBurst == 0 {
+			bindingRateBurst = defaultBindingRateBurst
+		}
+		s.bindingRateLimiter = server.NewRateLimiter(bindingRateLimit, bindingRateBurst)
+	}
+
+	s.allocationManagerConfig = allocation.ManagerConfig{
+		LeveledLogger:       s.log,
+		OnAllocationCreated: s.onAllocationCreated,
+		OnAllocationDeleted: s.onAllocationDeleted,
+		RelayPoolSize:       config.RelayPoolSize,
+		ExpiryJitter:        expiryJitter,
+		RecordingSink:       config.RecordingSink,
+		RelayReadGoroutines: config.RelayReadGoroutines,
+		RelayMTU:            s.relayMTU,
+		OnOversizedPayload:  s.onOversizedPayload,
+
+		OnUnpermittedPayload: s.onUnpermittedPayload,
+
+		MaxBytesPerAllocation: config.MaxBytesPerAllocation,
+
+		Store: allocationStore{s.allocationStore},
+
+		PortReuseQuarantine: portReuseQuarantine,
+	}
+	if config.MaxPermissions > 0 {
+		s.allocationManagerConfig.PermissionLimit = &allocation.PermissionLimit{MaxPermissions: int64(config.MaxPermissions)}
+	}
+
 	for i := range s.packetConnConfigs {
 		go func(p PacketConnConfig) {
-			allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
-				AllocatePacketConn: p.RelayAddressGenerator.AllocatePacketConn,
-				AllocateConn:       p.RelayAddressGenerator.AllocateConn,
-				LeveledLogger:      s.log,
-			})
+			allocationManager, err := s.newAllocationManager(p.RelayAddressGenerator)
 			if err != nil {
 				s.log.Errorf("exit read loop on error: %s", err.Error())
 				return
 			}
-			defer func() {
-				if err := allocationManager.Close(); err != nil {
-					s.log.Errorf("Failed to close AllocationManager: %s", err.Error())
-				}
-			}()
+			defer s.closeAllocationManager(allocationManager)
 
-			s.readLoop(p.PacketConn, allocationManager)
+			s.readLoop(p.PacketConn, allocationManager, s.transactionCache)
 		}(s.packetConnConfigs[i])
 	}
 
-	for _, listener := range s.listenerConfigs {
-		go func(l ListenerConfig) {
-			allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
-				AllocatePacketConn: l.RelayAddressGenerator.AllocatePacketConn,
-				AllocateConn:       l.RelayAddressGenerator.AllocateConn,
-				LeveledLogger:      s.log,
-			})
-			if err != nil {
-				s.log.Errorf("exit read loop on error: %s", err.Error())
-				return
-			}
-			defer func() {
-				if err := allocationManager.Close(); err != nil {
-					s.log.Errorf("Failed to close AllocationManager: %s", err.Error())
-				}
-			}()
-
-			for {
-				conn, err := l.Listener.Accept()
-				if err != nil {
-					s.log.Debugf("exit accept loop on error: %s", err.Error())
-					return
-				}
-
-				go s.readLoop(NewSTUNConn(conn), allocationManager)
-			}
-		}(listener)
+	for _, l := range config.ListenerConfigs {
+		s.listeners = append(s.listeners, &listener{ListenerConfig: l})
+	}
+	for _, l := range s.listeners {
+		go s.acceptLoop(l)
 	}
 
 	return s, nil
@@ -109,17 +301,84 @@ func NewServer(config ServerConfig) (*Server, error) {
 
 // Close stops the TURN Server. It cleans up any associated state and closes all connections it is managing
 func (s *Server) Close() error {
-	var errors []error
+	return s.CloseWithTimeout(0)
+}
+
+// closer is a socket or other resource of the Server that is closed by CloseWithTimeout
+type closer struct {
+	name  string
+	close func() error
+}
+
+// closeResult is what the Close of closers[index] returned
+type closeResult struct {
+	index int
+	err   error
+}
 
+// CloseWithTimeout is Close that doesn't wait longer than d, e.g. for a custom PacketConn
+// whose Close blocks. The sockets are closed concurrently, once d passed ErrCloseTimeout is
+// returned naming the ones still closing, they are left to close in the background. A d of
+// zero or less waits for all of them like Close
+func (s *Server) CloseWithTimeout(d time.Duration) error {
+	var closers []closer
 	for _, p := range s.packetConnConfigs {
-		if err := p.PacketConn.Close(); err != nil {
-			errors = append(errors, err)
-		}
+		closers = append(closers, closer{"PacketConn " + p.PacketConn.LocalAddr().String(), p.PacketConn.Close})
+	}
+
+	s.listenersLock.Lock()
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	for _, l := range s.listeners {
+		closers = append(closers, closer{"Listener " + l.Listener.Addr().String(), l.Listener.Close})
+	}
+	s.listeners = nil
+	s.listenersLock.Unlock()
+
+	if s.connPoller != nil {
+		closers = append(closers, closer{"conn poller", func() error {
+			s.connPoller.close()
+			return nil
+		}})
+	}
+
+	results := make(chan closeResult, len(closers))
+	for i, c := range closers {
+		go func(i int, c closer) {
+			results <- closeResult{index: i, err: c.close()}
+		}(i, c)
+	}
+
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	for _, l := range s.listenerConfigs {
-		if err := l.Listener.Close(); err != nil {
-			errors = append(errors, err)
+	var errors []error
+	closed := make([]bool, len(closers))
+	for pending := len(closers); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			closed[r.index] = true
+			if r.err != nil {
+				errors = append(errors, r.err)
+			}
+		case <-timeout:
+			var stragglers []string
+			for i, c := range closers {
+				if !closed[i] {
+					stragglers = append(stragglers, c.name)
+				}
+			}
+
+			err := fmt.Errorf("%w after %v, still closing %s", ErrCloseTimeout, d, strings.Join(stragglers, ", "))
+			for _, e := range errors {
+				err = fmt.Errorf("%w; Close error (%v) ", err, e)
+			}
+			return err
 		}
 	}
 
@@ -135,27 +394,388 @@ func (s *Server) Close() error {
 	return err
 }
 
-func (s *Server) readLoop(p net.PacketConn, allocationManager *allocation.Manager) {
-	buf := make([]byte, inboundMTU)
+// AddListener starts accepting connections on l next to the ListenerConfigs, e.g. on a TLS
+// listener with a renewed certificate that replaces one removed with RemoveListener
+func (s *Server) AddListener(l ListenerConfig) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	select {
+	case <-s.closed:
+		return errServerClosed
+	default:
+	}
+
+	added := &listener{ListenerConfig: l}
+	s.listeners = append(s.listeners, added)
+	go s.acceptLoop(added)
+	return nil
+}
+
+// RemoveListener stops accepting connections on netListener, a Listener of the ListenerConfigs
+// or of AddListener, and closes it. The connections it accepted drain: they are served and
+// keep their allocations until the client closes them, so calls in progress aren't dropped
+// while clients move to another listener. The allocations of the listener are deleted once
+// its last connection is closed, or when the Server is closed.
+func (s *Server) RemoveListener(netListener net.Listener) error {
+	s.listenersLock.Lock()
+	var removed *listener
+	for i, l := range s.listeners {
+		if l.Listener == netListener {
+			removed = l
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			break
+		}
+	}
+	s.listenersLock.Unlock()
+
+	if removed == nil {
+		return errListenerNotFound
+	}
+
+	removed.remove()
+	return removed.Listener.Close()
+}
+
+// Realm returns the realm the Server authenticates in, see ServerConfig.Realm
+func (s *Server) Realm() string {
+	return s.realm
+}
+
+// ChannelBindTimeout returns how long channel binds last, with the default applied
+// when ServerConfig.ChannelBindTimeout was unset
+func (s *Server) ChannelBindTimeout() time.Duration {
+	return s.channelBindTimeout
+}
+
+// OversizedPayloads returns how many datagrams were dropped because their payload exceeds
+// ServerConfig.RelayMTU, whether they were sent by clients or by peers
+func (s *Server) OversizedPayloads() uint64 {
+	return atomic.LoadUint64(&s.oversizedPayloads)
+}
+
+func (s *Server) onOversizedPayload() {
+	atomic.AddUint64(&s.oversizedPayloads, 1)
+}
+
+// UnpermittedPayloads returns how many datagrams relay sockets received from peers without a
+// permission or channel, e.g. with a spoofed source address. They are dropped without being
+// relayed to the client or counted against MaxBytesPerAllocation or RealmQuotas
+func (s *Server) UnpermittedPayloads() uint64 {
+	return atomic.LoadUint64(&s.unpermittedPayloads)
+}
+
+// DroppedBindingRequests returns how many Binding requests were dropped because their
+// source IP exceeded the BindingRateLimit
+func (s *Server) DroppedBindingRequests() uint64 {
+	if s.bindingRateLimiter == nil {
+		return 0
+	}
+	return s.bindingRateLimiter.Dropped()
+}
+
+// ExpiredPermissionDrops returns the number of Send indications dropped because the
+// permission of their peer expired, see ServerConfig.LogExpiredPermissionDrops
+func (s *Server) ExpiredPermissionDrops() uint64 {
+	return atomic.LoadUint64(&s.expiredPermissionDrops)
+}
+
+func (s *Server) onExpiredPermissionDrop() {
+	atomic.AddUint64(&s.expiredPermissionDrops, 1)
+}
+
+// DeniedSourcePackets returns how many datagrams and frames were dropped because their
+// source IP is in ServerConfig.DeniedSourceIPs
+func (s *Server) DeniedSourcePackets() uint64 {
+	return atomic.LoadUint64(&s.deniedSourcePackets)
+}
+
+// SetDeniedSourceIPs replaces ServerConfig.DeniedSourceIPs, e.g. to block an abusive IP without
+// restarting the server. It applies to the next packet every listener reads, allocations of a
+// source that is now denied are left to expire. nil unblocks every source
+func (s *Server) SetDeniedSourceIPs(ipNets []net.IPNet) {
+	s.deniedSourceIPs.Store(append([]net.IPNet(nil), ipNets...))
+}
+
+// sourceDenied returns true if the IP of addr is in one of the DeniedSourceIPs
+func (s *Server) sourceDenied(addr net.Addr) bool {
+	ipNets, _ := s.deniedSourceIPs.Load().([]net.IPNet)
+	if len(ipNets) == 0 {
+		return false
+	}
+
+	ip, _, err := ipnet.AddrIPPort(addr)
+	if err != nil {
+		return false
+	}
+	for i := range ipNets {
+		if ipNets[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) onUnpermittedPayload() {
+	atomic.AddUint64(&s.unpermittedPayloads, 1)
+}
+
+// dropOversized counts a datagram or frame from addr that didn't fit in the read buffer
+func (s *Server) dropOversized(addr net.Addr) {
+	s.onOversizedPayload()
+	s.log.Debugf("dropping datagram from %v larger than the RelayMTU of %d", addr, s.relayMTU)
+}
+
+// acquireConnSlot reserves one of the MaxConcurrentConnections slots shared by all
+// listeners. It never blocks, false is returned when every slot is taken
+func (s *Server) acquireConnSlot() bool {
+	if s.connSlots == nil {
+		return true
+	}
+
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseConnSlot() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
+
+// newAllocationManager creates the allocation.Manager of a listener
+func (s *Server) newAllocationManager(generator RelayAddressGenerator) (*allocation.Manager, error) {
+	config := s.allocationManagerConfig
+	config.AllocatePacketConn = generator.AllocatePacketConn
+	config.AllocateConn = generator.AllocateConn
+	allocationManager, err := allocation.NewManager(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.allocationManagersLock.Lock()
+	s.allocationManagers[allocationManager] = struct{}{}
+	s.allocationManagersLock.Unlock()
+	return allocationManager, nil
+}
+
+// closeAllocationManager closes an allocation.Manager created by newAllocationManager
+func (s *Server) closeAllocationManager(allocationManager *allocation.Manager) {
+	s.allocationManagersLock.Lock()
+	delete(s.allocationManagers, allocationManager)
+	s.allocationManagersLock.Unlock()
+
+	if err := allocationManager.Close(); err != nil {
+		s.log.Errorf("Failed to close AllocationManager: %s", err.Error())
+	}
+}
+
+// acceptLoop serves the connections accepted by l until it is closed. The allocations
+// of a removed listener are kept until its connections are drained
+func (s *Server) acceptLoop(l *listener) {
+	allocationManager, err := s.newAllocationManager(l.RelayAddressGenerator)
+	if err != nil {
+		s.log.Errorf("exit read loop on error: %s", err.Error())
+		return
+	}
+	defer func() {
+		l.drain(s.closed)
+		s.closeAllocationManager(allocationManager)
+	}()
+
 	for {
-		n, addr, err := p.ReadFrom(buf)
+		conn, err := l.Listener.Accept()
 		if err != nil {
+			s.log.Debugf("exit accept loop on error: %s", err.Error())
+			return
+		}
+		atomic.AddUint64(&s.connStats.accepted, 1)
+
+		if l.TCPKeepAlive != 0 {
+			if err := setTCPKeepAlive(conn, l.TCPKeepAlive); err != nil {
+				s.log.Warnf("Failed to set TCP keepalive of conn from %s: %s", conn.RemoteAddr(), err.Error())
+			}
+		}
+
+		if !s.acquireConnSlot() {
+			atomic.AddUint64(&s.connStats.rejected, 1)
+			s.log.Warnf("closing connection from %s, MaxConcurrentConnections reached", conn.RemoteAddr())
+			if err := conn.Close(); err != nil {
+				s.log.Errorf("Failed to close conn: %s", err.Error())
+			}
+			continue
+		}
+
+		atomic.AddInt64(&s.connStats.active, 1)
+		l.connOpened()
+		done := func() {
+			s.connDone()
+			l.connClosed()
+		}
+		if l.Datagram {
+			// Datagrams may be lost and retransmitted like over UDP
+			go s.connReadLoop(conn, NewDatagramConn(&countingConn{Conn: conn, stats: &s.connStats}), allocationManager, s.transactionCache, done)
+		} else {
+			s.serveConn(conn, allocationManager, done)
+		}
+	}
+}
+
+// setTCPKeepAlive enables the keepalives of conn with period, a negative period disables
+// them. Connections other than *net.TCPConn, e.g. TLS ones, are left as they are
+func setTCPKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if period < 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(period)
+}
+
+// connDone is called once an accepted connection has been closed
+func (s *Server) connDone() {
+	atomic.AddInt64(&s.connStats.active, -1)
+	atomic.AddUint64(&s.connStats.closed, 1)
+	s.releaseConnSlot()
+}
+
+// serveConn hands an accepted connection to the ConnWorkers, connections the
+// workers can't poll are served from their own goroutine. done is called once
+// the connection has been closed
+func (s *Server) serveConn(conn net.Conn, allocationManager *allocation.Manager, done func()) {
+	if s.connPoller != nil && s.connPoller.add(conn, allocationManager, done) {
+		return
+	}
+
+	stunConn := NewSTUNConn(&countingConn{Conn: conn, stats: &s.connStats})
+	stunConn.partialTimeout = s.partialMessageTimeout
+	go s.connReadLoop(conn, stunConn, allocationManager, nil, done)
+}
+
+// connReadLoop serves a single accepted connection read through p, the conn is closed
+// and done is called once the read loop exits
+func (s *Server) connReadLoop(conn net.Conn, p net.PacketConn, allocationManager *allocation.Manager, transactionCache *server.TransactionCache, done func()) {
+	defer done()
+	defer func() {
+		if err := conn.Close(); err != nil {
+			s.log.Debugf("Failed to close conn: %s", err.Error())
+		}
+	}()
+
+	s.readLoop(p, allocationManager, transactionCache)
+}
+
+// readLoop serves requests read from p, they are answered on p. transactionCache is only
+// set for UDP and DTLS, reliable transports don't retransmit requests
+func (s *Server) readLoop(p net.PacketConn, allocationManager *allocation.Manager, transactionCache *server.TransactionCache) {
+	// One spare byte tells a datagram that was truncated to the buffer apart from one that fits
+	buf := make([]byte, s.relayMTU+inboundOverhead+1)
+	for {
+		n, addr, err := p.ReadFrom(buf)
+		if errors.Is(err, errTURNFrameTooLarge) || (err == nil && n == len(buf)) {
+			s.dropOversized(addr)
+			continue
+		} else if err != nil {
 			s.log.Debugf("exit read loop on error: %s", err.Error())
 			return
 		}
 
-		if err := server.HandleRequest(server.Request{
-			Conn:               p,
-			SrcAddr:            addr,
-			Buff:               buf[:n],
-			Log:                s.log,
-			AuthHandler:        s.authHandler,
-			Realm:              s.realm,
-			AllocationManager:  allocationManager,
-			ChannelBindTimeout: s.channelBindTimeout,
-			Nonces:             s.nonces,
-		}); err != nil {
-			s.log.Errorf("error when handling datagram: %v", err)
+		if s.sourceDenied(addr) {
+			atomic.AddUint64(&s.deniedSourcePackets, 1)
+			continue
 		}
+
+		s.handleRequest(p, addr, buf[:n], allocationManager, transactionCache)
+	}
+}
+
+// handleRequest processes a single datagram read from p
+func (s *Server) handleRequest(p net.PacketConn, addr net.Addr, buf []byte, allocationManager *allocation.Manager, transactionCache *server.TransactionCache) {
+	defer s.recoverRequest(addr, buf)
+
+	if err := server.HandleRequest(server.Request{
+		Conn:               p,
+		SrcAddr:            addr,
+		Buff:               buf,
+		Log:                s.log,
+		AuthHandler:        s.authHandler,
+		TenantAuthHandler:  s.tenantAuthHandler,
+		ContextAuthHandler: s.contextAuthHandler,
+		TenantRelays:       s.tenantRelays,
+		OnAuthFailure:      s.onAuthFailure,
+		UsernameValidator:  s.usernameValidator,
+		Realm:              s.realm,
+		AdditionalRealms:   s.additionalRealms,
+		AllocationManager:  allocationManager,
+		ChannelBindTimeout: s.channelBindTimeout,
+		STUNOnly:           s.stunOnly,
+		DisableFingerprint: s.disableFingerprint,
+		TransactionCache:   transactionCache,
+		BindingRateLimiter: s.bindingRateLimiter,
+		AuthKeyCache:       s.authKeyCache,
+		Nonces:             s.nonces,
+		NonceHandler:       s.nonceHandler,
+		SecurityFeatures:   s.securityFeatures,
+		Sessions:           s.sessions,
+		MaxSessionDuration: s.maxSessionDuration,
+		OnAuthResult:       s.onAuthResult,
+		RealmQuota:         s.realmQuota,
+		RequestTimeout:     s.requestTimeout,
+
+		ShadowAuthHandler:       s.shadowAuthHandler,
+		OnShadowAuthDiscrepancy: s.onShadowAuthDiscrepancy,
+
+		OnExpiredPermissionDrop:   s.onExpiredPermissionDrop,
+		LogExpiredPermissionDrops: s.logExpiredPermissionDrops,
+
+		OnBindingRateLimited: s.onBindingRateLimited,
+
+		MinAllocationLifetime: s.minAllocationLifetime,
+
+		AllowedTransports: s.allowedTransports,
+	}); err != nil {
+		s.log.Errorf("error when handling datagram: %v", err)
+	}
+}
+
+// recoverRequest recovers a panic raised handling buf, one malformed packet must not
+// stop the read loop and with it the listener
+func (s *Server) recoverRequest(addr net.Addr, buf []byte) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	err := fmt.Errorf("%w: %v", errRequestPanicked, recovered)
+	s.log.Errorf("%v from %v, packet %s\n%s", err, addr, hex.EncodeToString(buf), debug.Stack())
+	if s.onRequestPanic != nil {
+		s.onRequestPanic(addr, buf, err)
+	}
+}
+
+// allowedTransports converts ServerConfig.AllowedTransports to the protocols of server.Request,
+// nil stays nil so every implemented transport is allowed
+func allowedTransports(transports []byte) []proto.Protocol {
+	if transports == nil {
+		return nil
+	}
+
+	protocols := make([]proto.Protocol, 0, len(transports))
+	for _, t := range transports {
+		protocols = append(protocols, proto.Protocol(t))
 	}
+	return protocols
 }
@@ -9,22 +9,38 @@ import (
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/turn/v2/internal/proto"
 )
 
 // RelayAddressGenerator is used to generate a RelayAddress when creating an allocation.
 // You can use one of the provided ones or provide your own.
+//
+// The server only uses the net.PacketConn interface of a relay, it never assumes a
+// *net.UDPConn. Any implementation works, like the in-memory one of the turntest package.
+// The relay address, and the source addresses returned by ReadFrom, must be a
+// *net.UDPAddr or *net.TCPAddr so they can be encoded as XOR addresses.
 type RelayAddressGenerator interface {
 	// Validate confirms that the RelayAddressGenerator is properly initialized
 	Validate() error
 
-	// Allocate a PacketConn (UDP) RelayAddress
+	// Allocate a PacketConn (UDP) RelayAddress. The PacketConn doesn't have to be a UDP socket,
+	// e.g. turntest.UnixNetwork relays over UNIX datagram sockets, but peers are addressed with
+	// IP and port as in XOR-PEER-ADDRESS: WriteTo is called with a *net.UDPAddr and ReadFrom
+	// must return one. The returned net.Addr is advertised in XOR-RELAYED-ADDRESS and must be a
+	// *net.UDPAddr too
 	AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error)
 
 	// Allocate a Conn (TCP) RelayAddress
 	AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error)
 }
 
-// PacketConnConfig is a single net.PacketConn to listen/write on. This will be used for UDP listeners
+// PacketConnConfig is a single net.PacketConn to listen/write on. This will be used for UDP listeners.
+//
+// Every PacketConn is served by its own read loop. The responses to the requests read from a
+// PacketConn, and the data relayed to the allocations created through it, are always written
+// to that same PacketConn, never to another PacketConnConfig of the server. A client behind a
+// NAT only accepts packets from the address it sent to, replying from another socket would
+// break its traversal even if both are bound to the same IP.
 type PacketConnConfig struct {
 	PacketConn net.PacketConn
 
@@ -51,6 +67,18 @@ type ListenerConfig struct {
 	// When an allocation is generated the RelayAddressGenerator
 	// creates the net.PacketConn and returns the IP/Port it is available at
 	RelayAddressGenerator RelayAddressGenerator
+
+	// Datagram must be set when the accepted connections preserve message boundaries, e.g.
+	// the DTLS associations accepted by the net.Listener of pion/dtls. Each Read is then
+	// handled as one STUN or ChannelData message, see DatagramConn, instead of the stream
+	// being split into messages as for TCP and TLS
+	Datagram bool
+
+	// TCPKeepAlive enables TCP keepalives on the accepted *net.TCPConn, sent after the
+	// connection was idle that long, so the OS detects clients that vanished behind a NAT
+	// or load balancer. 0 leaves the keepalives as the Listener set them, a negative
+	// value disables them
+	TCPKeepAlive time.Duration
 }
 
 func (c *ListenerConfig) validate() error {
@@ -68,6 +96,44 @@ func (c *ListenerConfig) validate() error {
 // AuthHandler is a callback used to handle incoming auth requests, allowing users to customize Pion TURN with custom behavior
 type AuthHandler func(username, realm string, srcAddr net.Addr) (key []byte, ok bool)
 
+// TenantAuthHandler is an AuthHandler that also returns the tenant the user belongs to.
+// Allocations of a user with a tenant are relayed by ServerConfig.TenantRelayAddressGenerators
+type TenantAuthHandler func(username, realm string, srcAddr net.Addr) (key []byte, tenant string, ok bool)
+
+// ContextAuthHandler is an AuthHandler that also returns application data, e.g. a tenant or
+// session ID, that is kept by the allocations the user creates and delivered with their Events.
+// Use a type of your own for it and assert it back when reading Event.Context:
+//
+//	session, ok := e.Context.(*Session)
+type ContextAuthHandler func(username, realm string, srcAddr net.Addr) (key []byte, context interface{}, ok bool)
+
+// NonceHandler generates the NONCEs clients are challenged with and validates the ones they
+// authenticate with. Its methods are called concurrently by every listener and must be safe
+// for concurrent use. A NonceHandler that derives its NONCEs from a secret, e.g. an HMAC of
+// srcAddr and a timestamp, needs no state and lets the servers of a cluster accept each
+// other's NONCEs
+type NonceHandler interface {
+	// Generate returns a new NONCE for the client at srcAddr
+	Generate(srcAddr net.Addr) string
+
+	// Validate reports whether nonce, sent by the client at srcAddr, can be authenticated with.
+	// A nonce that isn't ok is answered with a 438 (Stale Nonce) if it is stale, e.g. expired,
+	// and with a 401 (Unauthorized) otherwise. Both carry a new NONCE from Generate
+	Validate(srcAddr net.Addr, nonce string) (ok bool, stale bool)
+}
+
+// SecurityFeatures is the Security Feature Set of RFC 8489 the server advertises in the
+// nonce cookie its NONCEs start with, see ServerConfig.SecurityFeatures
+type SecurityFeatures uint32
+
+// STUN Security Features, RFC 8489 Section 18.1
+const (
+	// SecurityFeaturePasswordAlgorithms is refused by NewServer, the server doesn't send
+	// PASSWORD-ALGORITHMS or check MESSAGE-INTEGRITY-SHA256 yet
+	SecurityFeaturePasswordAlgorithms = SecurityFeatures(proto.SecurityFeaturePasswordAlgorithms)
+	SecurityFeatureUsernameAnonymity  = SecurityFeatures(proto.SecurityFeatureUsernameAnonymity)
+)
+
 // GenerateAuthKey is a convince function to easily generate keys in the format used by AuthHandler
 func GenerateAuthKey(username, realm, password string) []byte {
 	// #nosec
@@ -86,14 +152,233 @@ type ServerConfig struct {
 	// LoggerFactory must be set for logging from this server.
 	LoggerFactory logging.LoggerFactory
 
-	// Realm sets the realm for this server
+	// Realm sets the realm for this server, it is the realm clients are challenged with
 	Realm string
 
-	// AuthHandler is a callback used to handle incoming auth requests, allowing users to customize Pion TURN with custom behavior
+	// AdditionalRealms are accepted next to Realm. A client sending one of them in REALM has its
+	// credentials checked against that realm, the realm is passed to the AuthHandler. Requests for
+	// any other realm are rejected with a 401 (Unauthorized) challenging for Realm.
+	AdditionalRealms []string
+
+	// RealmQuotas caps the allocations of the realms, keyed by the Realm or one of the
+	// AdditionalRealms. Realms without an entry are unlimited, see Server.RealmStats for
+	// the usage of every realm
+	RealmQuotas map[string]RealmQuota
+
+	// AuthHandler is a callback used to handle incoming auth requests, allowing users to customize Pion TURN with custom behavior.
+	// It may be nil for a STUNOnly server, which never authenticates. Without an AuthHandler, TenantAuthHandler or
+	// ContextAuthHandler every authenticated request is refused with a 401 (Unauthorized)
 	AuthHandler AuthHandler
 
+	// ShadowAuthHandler is optional, it runs next to the AuthHandler, TenantAuthHandler or
+	// ContextAuthHandler in observe-only mode, e.g. to try out a new credential system before
+	// migrating to it. Every request with credentials is decided again with the key it returns,
+	// decisions that differ are logged as warnings and counted in AuthStats.ShadowDiscrepancies.
+	// It never changes a response, requests are always accepted or rejected by the AuthHandler.
+	ShadowAuthHandler AuthHandler
+
+	// TenantAuthHandler is used instead of AuthHandler when set. Allocations of users with a tenant
+	// are relayed by the tenant's TenantRelayAddressGenerators entry instead of the listener's
+	// RelayAddressGenerator, users of a tenant without an entry are refused with a 403 (Forbidden).
+	// Users without a tenant use the listener's RelayAddressGenerator.
+	TenantAuthHandler TenantAuthHandler
+
+	// ContextAuthHandler is used instead of AuthHandler when set, the context it returns is
+	// kept by the allocations of the user. It can't be combined with TenantAuthHandler.
+	ContextAuthHandler ContextAuthHandler
+
+	// TenantRelayAddressGenerators maps a tenant returned by TenantAuthHandler to the
+	// RelayAddressGenerator its allocations are relayed by, e.g. to egress from a specific IP
+	TenantRelayAddressGenerators map[string]RelayAddressGenerator
+
+	// UsernameValidator is optional, it is called with the USERNAME of a request before the
+	// AuthHandler, TenantAuthHandler or ContextAuthHandler. Usernames it returns false for are rejected with a
+	// 401 (Unauthorized) without looking up their key, e.g. everything that isn't in the
+	// timestamp:id format of the TURN REST API. All usernames are accepted when it is nil.
+	UsernameValidator func(username string) bool
+
+	// NonceHandler generates and validates the NONCEs of the long-term credential mechanism.
+	// By default NONCEs are random, kept in memory and stale after an hour.
+	NonceHandler NonceHandler
+
+	// SecurityFeatures are advertised to RFC 8489 clients in a nonce cookie, "obMatJos2" followed
+	// by the Security Feature Set, that every NONCE starts with. A NonceHandler generates and
+	// validates the NONCEs without the cookie. Only advertise the features the server and its
+	// AuthHandler implement, a client that sees one expects the server to use it. The server doesn't
+	// implement the password algorithm negotiation, SecurityFeaturePasswordAlgorithms is refused.
+	// Defaults to 0, NONCEs without a cookie as in RFC 5389.
+	SecurityFeatures SecurityFeatures
+
 	// ChannelBindTimeout sets the lifetime of channel binding. Defaults to 10 minutes.
 	ChannelBindTimeout time.Duration
+
+	// STUNOnly makes the server act as a plain STUN server. Binding requests are answered,
+	// every TURN method is refused with a 405 (Method Not Allowed). No AuthHandler is needed then.
+	// By default both STUN and TURN are served.
+	STUNOnly bool
+
+	// DisableFingerprint stops the server from adding FINGERPRINT to the Binding success
+	// responses, for interop with clients that can't handle it. They carry FINGERPRINT by
+	// default, the responses to TURN requests and error responses never do
+	DisableFingerprint bool
+
+	// RelayPoolSize is the number of relay sockets each listener keeps bound ahead of time,
+	// so an Allocate doesn't pay for the bind on the hot path. The pool is refilled in the
+	// background and drained on Close. Only IPv4 allocations without EVEN-PORT are served
+	// from the pool. Defaults to 0, which disables pooling.
+	RelayPoolSize int
+
+	// MaxConcurrentConnections bounds the number of accepted connections served at the same
+	// time, across all ListenerConfigs. Connections accepted while the bound is reached are
+	// closed right away. Defaults to 0, which means no limit.
+	MaxConcurrentConnections int
+
+	// ConnWorkers serves the connections accepted by ListenerConfigs with a fixed number of
+	// workers, woken up by epoll when a connection is readable, instead of a goroutine per
+	// connection. This saves a goroutine stack and read buffer per idle connection when serving
+	// thousands of them. Connections that don't expose a file descriptor, like TLS ones, keep
+	// their own goroutine. Only supported on linux, elsewhere every connection keeps its own
+	// goroutine. Defaults to 0, a goroutine per connection.
+	//
+	// EXPERIMENTAL: this option may change or be removed.
+	ConnWorkers int
+
+	// TransactionCacheTTL enables deduplication of retransmitted UDP requests. The response to
+	// a request is kept for TransactionCacheTTL, a request with the same transaction ID from the
+	// same source is answered with it instead of being processed again. RFC 5389 retransmits
+	// for up to 39.5 seconds by default. Defaults to 0, which disables deduplication.
+	TransactionCacheTTL time.Duration
+
+	// TransactionCacheSize bounds the number of responses kept for TransactionCacheTTL, across
+	// all PacketConnConfigs. The least recently used response is evicted when the cache is full.
+	// Defaults to 1024.
+	TransactionCacheSize int
+
+	// AuthKeyCacheTTL caches the key the AuthHandler, TenantAuthHandler or ContextAuthHandler
+	// returned for a user of a client for AuthKeyCacheTTL. The Refresh, CreatePermission and
+	// ChannelBind requests of the client are checked with it instead of calling the handler
+	// every time. A request that fails the integrity check with the cached key calls the handler
+	// again, but a user the handler would now refuse keeps being accepted until the key expires.
+	// Defaults to 0, which disables the cache.
+	AuthKeyCacheTTL time.Duration
+
+	// BindingRateLimit is the number of Binding requests per second answered for a source IP,
+	// after a burst of BindingRateBurst requests. Binding requests are unauthenticated, excess
+	// ones are dropped silently so the server can't be used to scan or amplify traffic, see
+	// Server.DroppedBindingRequests. TURN requests aren't limited by it. Defaults to 100 per
+	// second with bursts of 200, a negative BindingRateLimit disables the limit. At most 65536
+	// source IPs are tracked, e.g. during a flood from spoofed IPs, the Binding requests of
+	// other IPs are dropped until tracked ones stay below the limit for a while.
+	BindingRateLimit float64
+	BindingRateBurst int
+
+	// ExpiryJitter spreads out the expiry of allocations, permissions and channel binds that were
+	// created or refreshed at the same time, e.g. when a conference starts. Their timers are extended
+	// by a random duration of up to ExpiryJitter times the granted lifetime, they never expire early.
+	// Defaults to 0.05 (5%), must not exceed 0.25. A negative value disables jitter.
+	ExpiryJitter float64
+
+	// MaxSessionDuration limits how long a client can keep authenticating with the same username
+	// from the same address. Once exceeded its next request is answered with a 438 (Stale Nonce),
+	// even if the nonce is fresh, and the client has to authenticate again with a new nonce. This
+	// limits how long a leaked nonce and key can be used. Must not exceed 24 hours, 0 (the default)
+	// disables the limit. Sessions of clients that are idle for longer than a nonce lives, an hour,
+	// are forgotten.
+	MaxSessionDuration time.Duration
+
+	// RecordingSink is optional, it records the payloads relayed by allocations for deployments
+	// that must keep a copy of relayed media, e.g. lawful intercept or QA. It is called for every
+	// new allocation, when it returns a non-nil io.Writer every payload the allocation relays
+	// between the client and its peers is written to it, see ReadRelayRecord. Nothing is recorded
+	// when it is nil. Records are written from their own goroutine so a slow or failing writer
+	// never holds up the relay, records that can't be queued are dropped. If the writer is an
+	// io.Closer it is closed once the allocation is deleted.
+	RecordingSink RecordingSink
+
+	// RelayReadGoroutines is the number of goroutines reading the relay socket of each UDP
+	// allocation. A single reader caps the throughput of an allocation at what one core can
+	// relay, a few very high bandwidth allocations, e.g. an SFU cascade, can use more to relay
+	// in parallel. The readers share the relay socket, so datagrams from the same peer may be
+	// relayed out of order, which UDP never guaranteed. Each reader costs a goroutine and a
+	// read buffer per allocation. Defaults to 0, a single reader, must not be negative.
+	RelayReadGoroutines int
+
+	// EventsBufferSize is the capacity of the channel returned by Server.Events. Defaults to 64,
+	// must not be negative. Events that don't fit in the buffer are dropped instead of blocking
+	// the server.
+	EventsBufferSize int
+
+	// RelayMTU is the largest payload relayed between clients and peers, in bytes. Datagrams
+	// from peers and Send indication or ChannelData payloads from clients that are larger are
+	// dropped instead of being truncated, see Server.OversizedPayloads. Raise it when clients
+	// relay large datagrams, e.g. video over paths with jumbo frames. Defaults to 1500, must
+	// not exceed 65507, the largest UDP payload.
+	RelayMTU int
+
+	// MaxBytesPerAllocation caps the payload bytes an allocation relays, to and from peers
+	// counted together. The allocation is deleted once a payload would exceed it, with an
+	// EventAllocationDeleted carrying DeletionReasonByteQuota. Zero means unlimited.
+	MaxBytesPerAllocation int64
+
+	// PartialMessageTimeout is how long a connection accepted by ListenerConfigs may take to
+	// send the rest of a STUN or ChannelData message it started. A connection that stalls in
+	// the middle of a message, e.g. after announcing a length it never sends, is closed instead
+	// of holding its buffer and connection slot forever. Defaults to 10 seconds.
+	PartialMessageTimeout time.Duration
+
+	// OnRequestPanic is optional, it is called when handling a packet from srcAddr panicked.
+	// The panic is recovered and logged with the packet in hex, the listener keeps serving
+	// other packets. err wraps the recovered value, packet is only valid during the call.
+	OnRequestPanic func(srcAddr net.Addr, packet []byte, err error)
+
+	// AllocationStore is written the metadata of the allocations created, refreshed and deleted,
+	// e.g. to list the allocations of a cluster of servers. Relaying stays within the server that
+	// created the allocation. Defaults to a MemoryAllocationStore, see Server.AllocationStore.
+	AllocationStore AllocationStore
+
+	// PortReuseQuarantine is how long the relay port of a deleted allocation isn't handed out
+	// to a new allocation, so that packets peers still send to the old allocation can't leak
+	// into a new session. Relay sockets bound to a quarantined port are closed and another
+	// one is bound. Defaults to 5 seconds, a negative value disables the quarantine.
+	PortReuseQuarantine time.Duration
+
+	// RequestTimeout is how long handling a request may wait on blocking work, i.e. a
+	// RelayAddressGenerator allocating the relay of an Allocate, before it is answered with
+	// a 500 (Server Error) and the listener moves on to the next request. The relay the
+	// RelayAddressGenerator returns too late is closed. Zero, the default, or a negative value
+	// disables it; a generous value such as 10 seconds, shorter than the retransmissions of a
+	// client, only cuts off relays that hang.
+	RequestTimeout time.Duration
+
+	// LogExpiredPermissionDrops logs every Send indication dropped because the permission of
+	// its peer expired at debug level. They are counted either way, see
+	// Server.ExpiredPermissionDrops. Many of them point to a client failing to refresh its
+	// permissions rather than to an attack.
+	LogExpiredPermissionDrops bool
+
+	// MaxPermissions caps the permissions of all allocations together, so that many
+	// allocations with a few permissions each can't exhaust the memory of the server.
+	// CreatePermission and ChannelBind requests that would exceed it are refused with a
+	// 508 (Insufficient Capacity). Defaults to 0, which means no limit.
+	MaxPermissions int
+
+	// DeniedSourceIPs are networks whose datagrams and frames are dropped unanswered as soon as
+	// they are read, before they are parsed, e.g. to block known abusers. They are counted by
+	// Server.DeniedSourcePackets and can be replaced while serving with Server.SetDeniedSourceIPs.
+	DeniedSourceIPs []net.IPNet
+
+	// MinAllocationLifetime is the shortest lifetime Allocate and Refresh requests are granted,
+	// shorter LIFETIMEs are raised to it and the granted lifetime is sent back so the client
+	// refreshes less often. A LIFETIME of 0 still deletes the allocation. Defaults to 0, any
+	// lifetime is granted. It can't exceed the maximum lifetime of 1 hour.
+	MinAllocationLifetime time.Duration
+
+	// AllowedTransports are the REQUESTED-TRANSPORT protocol numbers Allocate requests may ask
+	// for. Other transports are refused with a 442 (Unsupported Transport Protocol). The server
+	// only implements UDP (17) and refuses anything else whether it is listed or not, so UDP is
+	// the only transport this can currently restrict, e.g. an empty list disables allocations.
+	// Defaults to nil, every implemented transport is allowed.
+	AllowedTransports []byte
 }
 
 func (s *ServerConfig) validate() error {
@@ -101,17 +386,103 @@ func (s *ServerConfig) validate() error {
 		return errNoAvailableConns
 	}
 
-	for _, s := range s.PacketConnConfigs {
+	// The RelayAddressGenerators are validated here so a misconfigured one fails NewServer
+	// rather than the first Allocate relayed by it
+	for i, s := range s.PacketConnConfigs {
 		if err := s.validate(); err != nil {
-			return err
+			return fmt.Errorf("%w (PacketConnConfigs[%d])", err, i)
 		}
 	}
 
-	for _, s := range s.ListenerConfigs {
+	for i, s := range s.ListenerConfigs {
 		if err := s.validate(); err != nil {
+			return fmt.Errorf("%w (ListenerConfigs[%d])", err, i)
+		}
+	}
+
+	if s.ExpiryJitter > maxExpiryJitter {
+		return errExpiryJitterInvalid
+	}
+
+	if s.MaxSessionDuration < 0 || s.MaxSessionDuration > maxSessionDuration {
+		return errMaxSessionDurationInvalid
+	}
+
+	if proto.SecurityFeatures(s.SecurityFeatures)&^proto.SecurityFeaturesMask != 0 {
+		return errSecurityFeaturesInvalid
+	}
+
+	// Advertising the password algorithms would make RFC 8489 clients use SHA-256, which
+	// the server can't check
+	if s.SecurityFeatures&SecurityFeaturePasswordAlgorithms != 0 {
+		return errPasswordAlgorithmsFeature
+	}
+
+	if s.RelayReadGoroutines < 0 {
+		return errRelayReadGoroutinesInvalid
+	}
+
+	if s.RelayMTU < 0 || s.RelayMTU > maxRelayMTU {
+		return errRelayMTUInvalid
+	}
+
+	if s.MaxBytesPerAllocation < 0 {
+		return errMaxBytesPerAllocationInvalid
+	}
+
+	if s.MaxPermissions < 0 {
+		return errMaxPermissionsInvalid
+	}
+
+	if s.MinAllocationLifetime < 0 || s.MinAllocationLifetime > maxAllocationLifetime {
+		return errMinAllocationLifetimeInvalid
+	}
+
+	if s.PartialMessageTimeout < 0 {
+		return errPartialMessageTimeoutInvalid
+	}
+
+	if s.EventsBufferSize < 0 {
+		return errEventsBufferSizeInvalid
+	}
+
+	if s.BindingRateBurst < 0 {
+		return errBindingRateBurstInvalid
+	}
+
+	if s.TenantAuthHandler != nil && s.ContextAuthHandler != nil {
+		return errAuthHandlersConflict
+	}
+
+	for realm, quota := range s.RealmQuotas {
+		if !s.servesRealm(realm) {
+			return errRealmQuotaUnknownRealm
+		} else if quota.MaxAllocations < 0 || quota.MaxRelayedBytes < 0 {
+			return errRealmQuotaInvalid
+		}
+	}
+
+	for _, r := range s.TenantRelayAddressGenerators {
+		if r == nil {
+			return errRelayAddressGeneratorUnset
+		} else if err := r.Validate(); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// servesRealm returns true if realm is the Realm or one of the AdditionalRealms
+func (s *ServerConfig) servesRealm(realm string) bool {
+	if realm == s.Realm {
+		return true
+	}
+
+	for _, additionalRealm := range s.AdditionalRealms {
+		if realm == additionalRealm {
+			return true
+		}
+	}
+	return false
+}
@@ -3,14 +3,32 @@
 package turn
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pion/dtls/v2"
 	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/pion/transport/test"
 	"github.com/pion/transport/vnet"
 	"github.com/pion/turn/v2/internal/proto"
+	"github.com/pion/turn/v2/turntest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -52,7 +70,8 @@ func TestServer(t *testing.T) {
 		})
 		assert.NoError(t, err)
 
-		assert.Equal(t, proto.DefaultLifetime, server.channelBindTimeout, "should match")
+		assert.Equal(t, proto.DefaultLifetime, server.ChannelBindTimeout(), "should match")
+		assert.Equal(t, "pion.ly", server.Realm())
 
 		conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
 		assert.NoError(t, err)
@@ -201,6 +220,106 @@ func buildVNet() (*VNet, error) {
 	}, nil
 }
 
+func TestServerChannelBindTimeout(t *testing.T) {
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+		Realm:              "pion.ly",
+		ChannelBindTimeout: 5 * time.Minute,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 5*time.Minute, server.ChannelBindTimeout())
+	assert.Equal(t, "pion.ly", server.Realm())
+
+	assert.NoError(t, server.Close())
+}
+
+func TestRelayAddressGeneratorStaticAdvertisedPort(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	// The relay is reached through a port forward shifting ports by a fixed offset
+	const portOffset = 1000
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+					AdvertisedPort: func(boundPort int) int {
+						return (boundPort+portOffset)%0xFFFF + 1
+					},
+				},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	// The peer sees the bound port, the client was given the advertised one
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_, err = relayConn.WriteTo([]byte("Hello"), peerConn.LocalAddr())
+	assert.NoError(t, err)
+
+	buf := make([]byte, inboundMTU)
+	_, from, err := peerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	boundPort := from.(*net.UDPAddr).Port
+	assert.Equal(t, (boundPort+portOffset)%0xFFFF+1, relayConn.LocalAddr().(*net.UDPAddr).Port)
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, server.Close())
+
+	// A mapping to an invalid port fails the allocation
+	generator := &RelayAddressGeneratorStatic{
+		RelayAddress:   net.ParseIP("127.0.0.1"),
+		Address:        "127.0.0.1",
+		AdvertisedPort: func(boundPort int) int { return 0 },
+	}
+	assert.NoError(t, generator.Validate())
+	_, _, err = generator.AllocatePacketConn("udp4", 0)
+	assert.True(t, errors.Is(err, errAdvertisedPortInvalid), "unexpected error: %v", err)
+}
+
 func TestServerVNet(t *testing.T) {
 	lim := test.TimeOut(time.Second * 30)
 	defer lim.Stop()
@@ -319,3 +438,2651 @@ func TestServerVNet(t *testing.T) {
 		assert.NoError(t, v.Close(), "should succeed")
 	})
 }
+
+func TestServerEvents(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	createServer := func(eventsBufferSize int) (*Server, net.PacketConn) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				return GenerateAuthKey(username, realm, "pass"), true
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.2"),
+						Address:      "127.0.0.1",
+					},
+				},
+			},
+			Realm:            "pion.ly",
+			LoggerFactory:    loggerFactory,
+			EventsBufferSize: eventsBufferSize,
+		})
+		assert.NoError(t, err)
+
+		return server, udpListener
+	}
+
+	createClient := func(serverAddr net.Addr, password string) (*Client, net.PacketConn) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: serverAddr.String(),
+			Username:       "user",
+			Password:       password,
+			Conn:           conn,
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		return client, conn
+	}
+
+	nextEvent := func(server *Server) Event {
+		select {
+		case e := <-server.Events():
+			return e
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "timed out waiting for event")
+			return Event{}
+		}
+	}
+
+	t.Run("Delivery", func(t *testing.T) {
+		server, udpListener := createServer(0)
+
+		client, conn := createClient(udpListener.LocalAddr(), "pass")
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+
+		e := nextEvent(server)
+		assert.Equal(t, EventAllocationCreated, e.Type)
+		assert.Equal(t, relayConn.LocalAddr().String(), e.RelayAddr.String())
+		assert.Equal(t, conn.LocalAddr().String(), e.SrcAddr.String())
+
+		// The advertised address differs from the bound one, the port assigned by the OS is the same
+		relayPort := relayConn.LocalAddr().(*net.UDPAddr).Port
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", relayPort), e.RelaySocketAddr.String())
+
+		assert.NoError(t, relayConn.Close())
+		e = nextEvent(server)
+		assert.Equal(t, EventAllocationDeleted, e.Type)
+		assert.Equal(t, DeletionReasonDeallocated, e.DeletionReason)
+		assert.Equal(t, relayConn.LocalAddr().String(), e.RelayAddr.String())
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", relayPort), e.RelaySocketAddr.String())
+
+		badClient, badConn := createClient(udpListener.LocalAddr(), "wrong")
+		_, err = badClient.Allocate()
+		assert.Error(t, err)
+
+		e = nextEvent(server)
+		assert.Equal(t, EventAuthFailure, e.Type)
+		assert.Equal(t, "user", e.Username)
+		assert.Equal(t, "pion.ly", e.Realm)
+		assert.Equal(t, uint64(0), server.DroppedEvents())
+
+		client.Close()
+		badClient.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, badConn.Close())
+		assert.NoError(t, server.Close())
+	})
+
+	t.Run("Summary", func(t *testing.T) {
+		server, udpListener := createServer(0)
+
+		client, conn := createClient(udpListener.LocalAddr(), "pass")
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+
+		e := nextEvent(server)
+		assert.Equal(t, EventAllocationCreated, e.Type)
+		relaySocketAddr := e.RelaySocketAddr
+
+		// Permissions are per IP, the peers need one each
+		peers := make([]net.PacketConn, 2)
+		for i, addr := range []string{"127.0.0.1:0", "127.0.0.2:0"} {
+			peers[i], err = net.ListenPacket("udp4", addr)
+			assert.NoError(t, err)
+		}
+
+		// 10 bytes to each peer, 20 bytes back from the first one
+		buf := make([]byte, 1500)
+		for _, peer := range peers {
+			_, err = relayConn.WriteTo(make([]byte, 10), peer.LocalAddr())
+			assert.NoError(t, err)
+			assert.NoError(t, peer.SetReadDeadline(time.Now().Add(5*time.Second)))
+			n, _, readErr := peer.ReadFrom(buf)
+			assert.NoError(t, readErr)
+			assert.Equal(t, 10, n)
+		}
+		_, err = peers[0].WriteTo(make([]byte, 20), relaySocketAddr)
+		assert.NoError(t, err)
+		assert.NoError(t, relayConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := relayConn.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, 20, n)
+
+		assert.NoError(t, relayConn.Close())
+		e = nextEvent(server)
+		assert.Equal(t, EventAllocationDeleted, e.Type)
+		assert.Equal(t, DeletionReasonDeallocated, e.DeletionReason)
+		assert.Equal(t, uint64(20), e.Summary.BytesToPeers)
+		assert.Equal(t, uint64(20), e.Summary.BytesFromPeers)
+		assert.Equal(t, 2, e.Summary.PeakPermissions)
+		assert.True(t, e.Summary.Duration > 0)
+
+		for _, peer := range peers {
+			assert.NoError(t, peer.Close())
+		}
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		server, udpListener := createServer(1)
+
+		for i := 0; i < 3; i++ {
+			client, conn := createClient(udpListener.LocalAddr(), "wrong")
+			_, err := client.Allocate()
+			assert.Error(t, err)
+
+			client.Close()
+			assert.NoError(t, conn.Close())
+		}
+
+		assert.Equal(t, EventAuthFailure, nextEvent(server).Type)
+		assert.Equal(t, uint64(2), server.DroppedEvents())
+		assert.NoError(t, server.Close())
+	})
+
+	t.Run("InvalidBufferSize", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		_, err = NewServer(ServerConfig{
+			PacketConnConfigs: []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: &turntest.LoopbackRelayGenerator{}}},
+			EventsBufferSize:  -1,
+		})
+		assert.Equal(t, errEventsBufferSizeInvalid, err)
+		assert.NoError(t, udpListener.Close())
+	})
+}
+
+// testSession is the context the ContextAuthHandler of TestServerContextAuthHandler returns
+type testSession struct {
+	id string
+}
+
+func TestServerContextAuthHandler(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	contextAuthHandler := func(username, realm string, srcAddr net.Addr) (key []byte, context interface{}, ok bool) {
+		return GenerateAuthKey(username, realm, "pass"), &testSession{id: "session-" + username}, true
+	}
+
+	_, err = NewServer(ServerConfig{
+		PacketConnConfigs:  []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"}}},
+		ContextAuthHandler: contextAuthHandler,
+		TenantAuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, tenant string, ok bool) {
+			return nil, "", false
+		},
+	})
+	assert.Equal(t, errAuthHandlersConflict, err)
+
+	server, err := NewServer(ServerConfig{
+		ContextAuthHandler: contextAuthHandler,
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	e := <-server.Events()
+	assert.Equal(t, EventAllocationCreated, e.Type)
+	session, ok := e.Context.(*testSession)
+	assert.True(t, ok)
+	assert.Equal(t, "session-user", session.id)
+
+	// The context of the allocation is delivered with its deletion
+	assert.NoError(t, relayConn.Close())
+	select {
+	case e = <-server.Events():
+		assert.Equal(t, EventAllocationDeleted, e.Type)
+		assert.Equal(t, DeletionReasonDeallocated, e.DeletionReason)
+		assert.Same(t, session, e.Context)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "allocation was not deleted")
+	}
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+// recordingBuffer is a RecordingSink writer that is closed with its allocation
+type recordingBuffer struct {
+	lock   sync.Mutex
+	buf    bytes.Buffer
+	closed chan struct{}
+}
+
+func (b *recordingBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *recordingBuffer) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestServerRecordingSink(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	sink := &recordingBuffer{closed: make(chan struct{})}
+	sinkRelayAddrs := make(chan net.Addr, 1)
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm: "pion.ly",
+		RecordingSink: func(srcAddr, dstAddr, relayAddr net.Addr) io.Writer {
+			sinkRelayAddrs <- relayAddr
+			return sink
+		},
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, relayConn.LocalAddr().String(), (<-sinkRelayAddrs).String())
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	buf := make([]byte, inboundMTU)
+	_, err = relayConn.WriteTo([]byte("ping"), peerConn.LocalAddr())
+	assert.NoError(t, err)
+	_, from, err := peerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	_, err = peerConn.WriteTo([]byte("pong"), from)
+	assert.NoError(t, err)
+	_, _, err = relayConn.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	// The sink is closed once the allocation is deleted
+	assert.NoError(t, relayConn.Close())
+	<-sink.closed
+
+	for _, expected := range []RelayRecord{
+		{Direction: RelayDirectionToPeer, Data: []byte("ping")},
+		{Direction: RelayDirectionToClient, Data: []byte("pong")},
+	} {
+		record, err := ReadRelayRecord(&sink.buf)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Direction, record.Direction)
+		assert.Equal(t, peerConn.LocalAddr().String(), record.Peer)
+		assert.Equal(t, expected.Data, record.Data)
+		assert.False(t, record.Time.IsZero())
+	}
+	_, err = ReadRelayRecord(&sink.buf)
+	assert.Equal(t, io.EOF, err)
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerRelayMTU(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	const relayMTU = 1200
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		RelayMTU:      relayMTU,
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// Client to peer, the payload larger than the RelayMTU is dropped
+	buf := make([]byte, 2*relayMTU)
+	_, err = relayConn.WriteTo(make([]byte, relayMTU+1), peerConn.LocalAddr())
+	assert.NoError(t, err)
+	_, err = relayConn.WriteTo(make([]byte, relayMTU), peerConn.LocalAddr())
+	assert.NoError(t, err)
+	n, from, err := peerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, relayMTU, n)
+	assert.Equal(t, uint64(1), server.OversizedPayloads())
+
+	// Peer to client
+	_, err = peerConn.WriteTo(make([]byte, relayMTU+1), from)
+	assert.NoError(t, err)
+	_, err = peerConn.WriteTo(make([]byte, relayMTU), from)
+	assert.NoError(t, err)
+	n, _, err = relayConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, relayMTU, n)
+	assert.Equal(t, uint64(2), server.OversizedPayloads())
+
+	// A datagram too large for any payload of RelayMTU bytes isn't truncated
+	_, err = conn.WriteTo(make([]byte, relayMTU+inboundOverhead+1), udpListener.LocalAddr())
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return server.OversizedPayloads() == 3
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerMaxBytesPerAllocation(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	_, err = NewServer(ServerConfig{
+		PacketConnConfigs:     []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"}}},
+		MaxBytesPerAllocation: -1,
+	})
+	assert.Equal(t, errMaxBytesPerAllocationInvalid, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:                 "pion.ly",
+		MaxBytesPerAllocation: 1000,
+		LoggerFactory:         logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, EventAllocationCreated, (<-server.Events()).Type)
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// The whole quota is relayed, the payload going past it tears the allocation down
+	buf := make([]byte, 1500)
+	for i := 0; i < 2; i++ {
+		_, err = relayConn.WriteTo(make([]byte, 500), peerConn.LocalAddr())
+		assert.NoError(t, err)
+		n, _, readErr := peerConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, 500, n)
+	}
+	_, err = relayConn.WriteTo([]byte{0}, peerConn.LocalAddr())
+	assert.NoError(t, err)
+
+	select {
+	case e := <-server.Events():
+		assert.Equal(t, EventAllocationDeleted, e.Type)
+		assert.Equal(t, DeletionReasonByteQuota, e.DeletionReason)
+		assert.Equal(t, relayConn.LocalAddr().String(), e.RelayAddr.String())
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "allocation past its byte quota was not deleted")
+	}
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerUnpermittedPayloads(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.NoError(t, client.CreatePermission(peerConn.LocalAddr()))
+
+	// Permissions are installed by IP, the unpermitted peer needs an address of its own
+	unpermittedConn, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	assert.NoError(t, err)
+	_, err = unpermittedConn.WriteTo([]byte("Spoof"), relayConn.LocalAddr())
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return server.UnpermittedPayloads() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Only the permitted peer reaches the client
+	_, err = peerConn.WriteTo([]byte("Hello"), relayConn.LocalAddr())
+	assert.NoError(t, err)
+	buf := make([]byte, 1500)
+	n, from, err := relayConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", string(buf[:n]))
+	assert.Equal(t, peerConn.LocalAddr().String(), from.String())
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, unpermittedConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerDTLS(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	dtlsConfig := &dtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			return []byte{0xAB, 0xC1, 0x23}, nil
+		},
+		PSKIdentityHint: []byte("pion"),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	}
+
+	dtlsListener, err := dtls.Listen("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, dtlsConfig)
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		ListenerConfigs: []ListenerConfig{
+			{
+				Listener: dtlsListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+				Datagram: true,
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	dtlsConn, err := dtls.Dial("udp4", dtlsListener.Addr().(*net.UDPAddr), dtlsConfig)
+	assert.NoError(t, err)
+
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: dtlsListener.Addr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           NewDatagramConn(dtlsConn),
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	// A datagram that is neither STUN nor ChannelData is dropped, unlike a stream it
+	// doesn't leave the following messages unframed
+	_, err = dtlsConn.Write(bytes.Repeat([]byte{0xFF}, 16))
+	assert.NoError(t, err)
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// Every message keeps its boundaries, whether it's small or close to the RelayMTU
+	buf := make([]byte, 1500)
+	for _, size := range []int{1, 100, 1000} {
+		payload := bytes.Repeat([]byte{byte(size)}, size)
+		_, err = relayConn.WriteTo(payload, peerConn.LocalAddr())
+		assert.NoError(t, err)
+
+		n, from, readErr := peerConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, payload, buf[:n])
+
+		_, err = peerConn.WriteTo(payload, from)
+		assert.NoError(t, err)
+
+		n, _, readErr = relayConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, payload, buf[:n])
+	}
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, dtlsConn.Close())
+	assert.NoError(t, peerConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerMaxConcurrentConnections(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		ListenerConfigs: []ListenerConfig{
+			{
+				Listener: tcpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:                    "pion.ly",
+		LoggerFactory:            logging.NewDefaultLoggerFactory(),
+		MaxConcurrentConnections: 1,
+	})
+	assert.NoError(t, err)
+
+	// binding sends a Binding request and reports if a response came back
+	binding := func(conn net.Conn) bool {
+		msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		assert.NoError(t, err)
+		if _, err = conn.Write(msg.Raw); err != nil {
+			return false
+		}
+
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		buf := make([]byte, inboundMTU)
+		n, err := conn.Read(buf)
+		return err == nil && stun.IsMessage(buf[:n])
+	}
+
+	first, err := net.Dial("tcp4", tcpListener.Addr().String())
+	assert.NoError(t, err)
+	assert.True(t, binding(first))
+
+	// The only slot is taken, the server hangs up
+	second, err := net.Dial("tcp4", tcpListener.Addr().String())
+	assert.NoError(t, err)
+	assert.False(t, binding(second))
+	assert.NoError(t, second.Close())
+
+	// Once the first connection is gone its slot can be reused
+	assert.NoError(t, first.Close())
+	assert.Eventually(t, func() bool {
+		third, err := net.Dial("tcp4", tcpListener.Addr().String())
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, third.Close())
+		}()
+
+		return binding(third)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.NoError(t, server.Close())
+}
+
+func TestServerConnStats(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		ListenerConfigs: []ListenerConfig{
+			{
+				Listener: tcpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:                    "pion.ly",
+		LoggerFactory:            logging.NewDefaultLoggerFactory(),
+		MaxConcurrentConnections: 1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ConnStats{}, server.ConnStats())
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	assert.NoError(t, err)
+
+	first, err := net.Dial("tcp4", tcpListener.Addr().String())
+	assert.NoError(t, err)
+	_, err = first.Write(msg.Raw)
+	assert.NoError(t, err)
+
+	assert.NoError(t, first.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, inboundMTU)
+	n, err := first.Read(buf)
+	assert.NoError(t, err)
+
+	stats := server.ConnStats()
+	assert.Equal(t, int64(1), stats.Active)
+	assert.Equal(t, uint64(1), stats.Accepted)
+	assert.Equal(t, uint64(len(msg.Raw)), stats.BytesReceived)
+	assert.Equal(t, uint64(n), stats.BytesSent)
+
+	// Connections refused by MaxConcurrentConnections are counted but never active
+	second, err := net.Dial("tcp4", tcpListener.Addr().String())
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return server.ConnStats().Rejected == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, second.Close())
+
+	assert.NoError(t, first.Close())
+	assert.Eventually(t, func() bool {
+		return server.ConnStats().Closed == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stats = server.ConnStats()
+	assert.Equal(t, int64(0), stats.Active)
+	assert.Equal(t, uint64(2), stats.Accepted)
+
+	assert.NoError(t, server.Close())
+}
+
+func TestServerAuthStats(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			if username != "user" {
+				return nil, false
+			}
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	newClient := func(username, password string) (*Client, net.PacketConn) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       username,
+			Password:       password,
+			Conn:           conn,
+			LoggerFactory:  logging.NewDefaultLoggerFactory(),
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+		return client, conn
+	}
+
+	for _, credentials := range [][2]string{{"user", "wrong"}, {"nobody", "pass"}} {
+		client, conn := newClient(credentials[0], credentials[1])
+		_, err = client.Allocate()
+		assert.Error(t, err)
+		client.Close()
+		assert.NoError(t, conn.Close())
+	}
+
+	client, conn := newClient("user", "pass")
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	// Every client is challenged first
+	assert.Equal(t, AuthStats{
+		Success:          1,
+		MissingIntegrity: 3,
+		BadIntegrity:     1,
+		UnknownUser:      1,
+	}, server.AuthStats())
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+// logBuffer collects the logs of a server
+type logBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestServerShadowAuthHandler(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	logs := &logBuffer{}
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.Writer = logs
+	loggerFactory.DefaultLogLevel = logging.LogLevelWarn
+
+	// The shadow handler has the password of "user" changed and knows "newuser"
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			if username != "user" {
+				return nil, false
+			}
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		ShadowAuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			switch username {
+			case "user":
+				return GenerateAuthKey(username, realm, "changed"), true
+			case "newuser":
+				return GenerateAuthKey(username, realm, "pass"), true
+			}
+			return nil, false
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	allocate := func(username string) error {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       username,
+			Password:       "pass",
+			Conn:           conn,
+			LoggerFactory:  logging.NewDefaultLoggerFactory(),
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+		defer client.Close()
+
+		relayConn, err := client.Allocate()
+		if err != nil {
+			return err
+		}
+		return relayConn.Close()
+	}
+
+	// Requests are answered as decided by the AuthHandler
+	assert.NoError(t, allocate("user"))
+	assert.Error(t, allocate("newuser"))
+	assert.Error(t, allocate("nobody"))
+
+	// The Allocate and the Refresh deleting the allocation of "user", the Allocate of "newuser"
+	assert.Equal(t, uint64(3), server.AuthStats().ShadowDiscrepancies)
+	assert.Equal(t, uint64(2), server.AuthStats().Success)
+	assert.Contains(t, logs.String(), `shadow auth discrepancy for "user" in realm "pion.ly"`)
+	assert.Contains(t, logs.String(), `shadow auth discrepancy for "newuser" in realm "pion.ly"`)
+	assert.NotContains(t, logs.String(), `shadow auth discrepancy for "nobody"`)
+
+	assert.NoError(t, server.Close())
+}
+
+// allocateInRealm sends an Allocate authenticated in realm from conn, the Client always
+// authenticates in the realm it is challenged with. It returns the error code of the
+// response, zero for a success response
+func allocateInRealm(t *testing.T, conn net.PacketConn, serverAddr net.Addr, realm string) stun.ErrorCode {
+	roundTrip := func(setters ...stun.Setter) *stun.Message {
+		msg, err := stun.Build(append([]stun.Setter{
+			stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			proto.RequestedTransport{Protocol: proto.ProtoUDP},
+		}, setters...)...)
+		assert.NoError(t, err)
+		_, err = conn.WriteTo(msg.Raw, serverAddr)
+		assert.NoError(t, err)
+
+		buf := make([]byte, 1500)
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		assert.NoError(t, err)
+		res := &stun.Message{Raw: buf[:n]}
+		assert.NoError(t, res.Decode())
+		return res
+	}
+
+	var nonce stun.Nonce
+	assert.NoError(t, nonce.GetFrom(roundTrip()))
+
+	res := roundTrip(stun.NewUsername("user"), stun.NewRealm(realm), nonce,
+		stun.NewLongTermIntegrity("user", realm, "pass"), stun.Fingerprint)
+	var code stun.ErrorCodeAttribute
+	if res.Type.Class == stun.ClassErrorResponse {
+		assert.NoError(t, code.GetFrom(res))
+	}
+	return code.Code
+}
+
+func TestServerRealmStats(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:            "pion.ly",
+		AdditionalRealms: []string{"tenant.ly"},
+		RealmQuotas:      map[string]RealmQuota{"tenant.ly": {MaxAllocations: 1}},
+		LoggerFactory:    logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	// Quotas can only be set for the realms that are served
+	_, err = NewServer(ServerConfig{
+		PacketConnConfigs: []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"}}},
+		Realm:             "pion.ly",
+		RealmQuotas:       map[string]RealmQuota{"tenant.ly": {MaxAllocations: 1}},
+	})
+	assert.Equal(t, errRealmQuotaUnknownRealm, err)
+	_, err = NewServer(ServerConfig{
+		PacketConnConfigs: []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"}}},
+		Realm:             "pion.ly",
+		RealmQuotas:       map[string]RealmQuota{"pion.ly": {MaxRelayedBytes: -1}},
+	})
+	assert.Equal(t, errRealmQuotaInvalid, err)
+
+	// The tenant realm is capped at a single allocation, the others are refused
+	var tenantConns []net.PacketConn
+	for _, expected := range []stun.ErrorCode{0, stun.CodeAllocQuotaReached} {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		tenantConns = append(tenantConns, conn)
+		assert.Equal(t, expected, allocateInRealm(t, conn, udpListener.LocalAddr(), "tenant.ly"))
+	}
+
+	// The default realm is unlimited, it sees a wrong password and relays to a peer
+	newClient := func(password string) (*Client, net.PacketConn) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       "user",
+			Password:       password,
+			Conn:           conn,
+			LoggerFactory:  logging.NewDefaultLoggerFactory(),
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+		return client, conn
+	}
+
+	client, conn := newClient("wrong")
+	_, err = client.Allocate()
+	assert.Error(t, err)
+	client.Close()
+	assert.NoError(t, conn.Close())
+
+	client, conn = newClient("pass")
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_, err = relayConn.WriteTo([]byte("Hello"), peerConn.LocalAddr())
+	assert.NoError(t, err)
+	buf := make([]byte, 1500)
+	_, _, err = peerConn.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	// The counters of each realm only see the clients of the realm
+	assert.Equal(t, map[string]RealmStats{
+		"pion.ly": {
+			Allocations:        1,
+			AllocationsCreated: 1,
+			RelayedBytes:       5,
+			AuthFailures:       1,
+		},
+		"tenant.ly": {
+			Allocations:        1,
+			AllocationsCreated: 1,
+		},
+	}, server.RealmStats())
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peerConn.Close())
+	for _, tenantConn := range tenantConns {
+		assert.NoError(t, tenantConn.Close())
+	}
+	assert.NoError(t, server.Close())
+
+	for _, stats := range server.RealmStats() {
+		assert.Equal(t, int64(0), stats.Allocations)
+	}
+}
+
+// slowCloseConn is a net.PacketConn whose Close blocks until unblock is closed
+type slowCloseConn struct {
+	net.PacketConn
+	unblock chan struct{}
+}
+
+func (c *slowCloseConn) Close() error {
+	<-c.unblock
+	return c.PacketConn.Close()
+}
+
+func TestServerCloseWithTimeout(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	newServer := func(conns ...net.PacketConn) *Server {
+		var packetConnConfigs []PacketConnConfig
+		for _, conn := range conns {
+			packetConnConfigs = append(packetConnConfigs, PacketConnConfig{
+				PacketConn: conn,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			})
+		}
+
+		server, err := NewServer(ServerConfig{
+			PacketConnConfigs: packetConnConfigs,
+			Realm:             "pion.ly",
+			LoggerFactory:     logging.NewDefaultLoggerFactory(),
+		})
+		assert.NoError(t, err)
+		return server
+	}
+
+	t.Run("Closed", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		assert.NoError(t, newServer(udpListener).CloseWithTimeout(time.Second))
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		slowListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		slowConn := &slowCloseConn{PacketConn: slowListener, unblock: make(chan struct{})}
+
+		start := time.Now()
+		err = newServer(udpListener, slowConn).CloseWithTimeout(100 * time.Millisecond)
+		assert.True(t, errors.Is(err, ErrCloseTimeout), "unexpected error: %v", err)
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+		// Only the conn that is still closing is reported
+		assert.Contains(t, err.Error(), "PacketConn "+slowListener.LocalAddr().String())
+		assert.NotContains(t, err.Error(), udpListener.LocalAddr().String())
+
+		// The straggler finishes closing in the background
+		close(slowConn.unblock)
+	})
+}
+
+// hmacNonceHandler issues stateless nonces, a timestamp signed with an HMAC of the client's address
+type hmacNonceHandler struct {
+	secret    []byte
+	validated uint64
+}
+
+func (h *hmacNonceHandler) sign(srcAddr net.Addr, timestamp string) string {
+	mac := hmac.New(sha256.New, h.secret)
+	fmt.Fprintf(mac, "%s/%s", srcAddr, timestamp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *hmacNonceHandler) Generate(srcAddr net.Addr) string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return timestamp + "/" + h.sign(srcAddr, timestamp)
+}
+
+func (h *hmacNonceHandler) Validate(srcAddr net.Addr, nonce string) (ok bool, stale bool) {
+	atomic.AddUint64(&h.validated, 1)
+
+	parts := strings.SplitN(nonce, "/", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(h.sign(srcAddr, parts[0]))) {
+		return false, false
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Hour {
+		return false, true
+	}
+	return true, false
+}
+
+func TestServerNonceHandler(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	nonceHandler := &hmacNonceHandler{secret: []byte("secret")}
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		NonceHandler:  nonceHandler,
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&nonceHandler.validated))
+
+	// The nonce the client was given is used for all its requests
+	assert.NoError(t, client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}))
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&nonceHandler.validated))
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+// panicNonceHandler panics validating the NONCE "panic"
+type panicNonceHandler struct{}
+
+func (panicNonceHandler) Generate(srcAddr net.Addr) string {
+	return "nonce"
+}
+
+func (panicNonceHandler) Validate(srcAddr net.Addr, nonce string) (ok bool, stale bool) {
+	if nonce == "panic" {
+		panic("bad nonce")
+	}
+	return true, false
+}
+
+func TestServerRequestPanic(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	panics := make(chan error, 1)
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:        "pion.ly",
+		NonceHandler: panicNonceHandler{},
+		OnRequestPanic: func(srcAddr net.Addr, packet []byte, err error) {
+			assert.NotEmpty(t, packet)
+			panics <- err
+		},
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		proto.RequestedTransport{Protocol: proto.ProtoUDP},
+		stun.NewUsername("user"),
+		stun.NewRealm("pion.ly"),
+		stun.NewNonce("panic"),
+		stun.NewLongTermIntegrity("user", "pion.ly", "pass"),
+	)
+	assert.NoError(t, err)
+	_, err = conn.WriteTo(msg.Raw, udpListener.LocalAddr())
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(<-panics, errRequestPanicked))
+
+	// The listener keeps serving after the panic
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+var errInMemoryAllocateConn = errors.New("turn: AllocateConn is not supported by inMemoryRelayAddressGenerator")
+
+// inMemoryRelayAddressGenerator allocates relays on a turntest.Network or UnixNetwork, at
+// 10.0.0.1 or fd00::1 depending on the requested address family
+type inMemoryRelayAddressGenerator struct {
+	network interface {
+		ListenPacket(network, address string) (net.PacketConn, error)
+	}
+	ipv4Only bool
+}
+
+func (g *inMemoryRelayAddressGenerator) Validate() error {
+	return nil
+}
+
+func (g *inMemoryRelayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	ip := "10.0.0.1"
+	if network == "udp6" && !g.ipv4Only {
+		ip = "fd00::1"
+	} else {
+		network = "udp4"
+	}
+
+	conn, err := g.network.ListenPacket(network, net.JoinHostPort(ip, strconv.Itoa(requestedPort)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.LocalAddr(), nil
+}
+
+// AllocateConn fails, only UDP is relayed
+func (g *inMemoryRelayAddressGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, errInMemoryAllocateConn
+}
+
+func TestServerInMemoryRelay(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	t.Run("Network", func(t *testing.T) {
+		testServerInMemoryRelay(t, turntest.NewNetwork())
+	})
+
+	// UNIX datagram sockets relay without UDP ports
+	t.Run("UnixNetwork", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("UNIX datagram sockets are not supported on windows")
+		}
+
+		dir, err := ioutil.TempDir("", "turn")
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(dir))
+		}()
+		testServerInMemoryRelay(t, turntest.NewUnixNetwork(dir))
+	})
+}
+
+func testServerInMemoryRelay(t *testing.T, network interface {
+	ListenPacket(network, address string) (net.PacketConn, error)
+}) {
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: &inMemoryRelayAddressGenerator{network: network},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", relayConn.LocalAddr().(*net.UDPAddr).IP.String())
+
+	peer, err := network.ListenPacket("udp4", "10.0.0.2:5000")
+	assert.NoError(t, err)
+
+	// Payloads are sent in Send indications until the channel is bound, then in ChannelData
+	buf := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		_, err = relayConn.WriteTo([]byte("Hello"), peer.LocalAddr())
+		assert.NoError(t, err)
+
+		n, from, readErr := peer.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, "Hello", string(buf[:n]))
+		assert.Equal(t, relayConn.LocalAddr().String(), from.String())
+
+		_, err = peer.WriteTo([]byte("World"), from)
+		assert.NoError(t, err)
+
+		n, from, readErr = relayConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, "World", string(buf[:n]))
+		assert.Equal(t, peer.LocalAddr().String(), from.String())
+	}
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, peer.Close())
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerQUICListener(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	listener := NewQUICListener(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478})
+	server, err := NewServer(ServerConfig{
+		ListenerConfigs: []ListenerConfig{
+			{
+				Listener: listener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	// A pipe stands in for a QUIC stream
+	clientStream, serverStream := net.Pipe()
+	remoteAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5000}
+	assert.NoError(t, listener.Serve(serverStream, remoteAddr))
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	assert.NoError(t, err)
+	_, err = clientStream.Write(msg.Raw)
+	assert.NoError(t, err)
+
+	buf := make([]byte, inboundMTU)
+	n, err := clientStream.Read(buf)
+	assert.NoError(t, err)
+
+	res := &stun.Message{Raw: buf[:n]}
+	assert.NoError(t, res.Decode())
+	assert.Equal(t, stun.BindingSuccess, res.Type)
+
+	var mapped stun.XORMappedAddress
+	assert.NoError(t, mapped.GetFrom(res))
+	assert.Equal(t, remoteAddr.String(), mapped.String())
+
+	assert.NoError(t, clientStream.Close())
+	assert.NoError(t, server.Close())
+	assert.Equal(t, errQUICListenerClosed, listener.Serve(serverStream, remoteAddr))
+}
+
+func TestServerAllocationStore(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	// The default AllocationStore keeps the records in memory
+	store, ok := server.AllocationStore().(*MemoryAllocationStore)
+	assert.True(t, ok)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	records := store.Records()
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, conn.LocalAddr().String(), records[0].SrcAddr.String())
+		assert.Equal(t, udpListener.LocalAddr().String(), records[0].DstAddr.String())
+		assert.Equal(t, "user", records[0].Username)
+		assert.Equal(t, relayConn.LocalAddr().String(), records[0].RelayAddr.String())
+		assert.Equal(t, proto.DefaultLifetime, records[0].Lifetime)
+	}
+
+	// Closing the relayed conn deletes the allocation and its record
+	assert.NoError(t, relayConn.Close())
+	assert.Eventually(t, func() bool {
+		return len(store.Records()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerDisableFingerprint(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	for _, disabled := range []bool{false, true} {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler:        turntest.MockAuthHandler(map[string]string{"user": "pass"}),
+			PacketConnConfigs:  []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: &turntest.LoopbackRelayGenerator{}}},
+			Realm:              "pion.ly",
+			DisableFingerprint: disabled,
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		// FINGERPRINT is the last attribute of a message, 4 bytes of header and a 4 byte CRC
+		roundTrip := func(request *stun.Message) []byte {
+			_, err = conn.WriteTo(request.Raw, udpListener.LocalAddr())
+			assert.NoError(t, err)
+			assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			buf := make([]byte, 1500)
+			n, _, readErr := conn.ReadFrom(buf)
+			assert.NoError(t, readErr)
+			return buf[:n]
+		}
+		endsWithFingerprint := func(raw []byte) bool {
+			return len(raw) >= 28 && stun.AttrType(binary.BigEndian.Uint16(raw[len(raw)-8:])) == stun.AttrFingerprint
+		}
+
+		raw := roundTrip(stun.MustBuild(stun.TransactionID, stun.BindingRequest))
+		res := &stun.Message{Raw: raw}
+		assert.NoError(t, res.Decode())
+		assert.Equal(t, stun.BindingSuccess, res.Type)
+		assert.Equal(t, !disabled, endsWithFingerprint(raw))
+		assert.Equal(t, !disabled, res.Contains(stun.AttrFingerprint))
+		if !disabled {
+			assert.NoError(t, stun.Fingerprint.Check(res))
+		}
+
+		// The other responses never carry it
+		raw = roundTrip(stun.MustBuild(stun.TransactionID, AllocateRequestType, RequestedTransport{Protocol: ProtoUDP}))
+		assert.False(t, endsWithFingerprint(raw))
+
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	}
+}
+
+func TestServerBindingRateLimit(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:            "pion.ly",
+		LoggerFactory:    logging.NewDefaultLoggerFactory(),
+		BindingRateLimit: 10,
+		BindingRateBurst: 5,
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	sendBinding := func() {
+		msg, buildErr := stun.Build(stun.TransactionID, stun.BindingRequest)
+		assert.NoError(t, buildErr)
+		_, writeErr := conn.WriteTo(msg.Raw, udpListener.LocalAddr())
+		assert.NoError(t, writeErr)
+	}
+
+	// A flood is answered up to the burst, the excess is dropped silently
+	const flood = 50
+	for i := 0; i < flood; i++ {
+		sendBinding()
+	}
+
+	buf := make([]byte, 1500)
+	answered := 0
+	for {
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+		if _, _, err = conn.ReadFrom(buf); err != nil {
+			break
+		}
+		answered++
+	}
+	assert.GreaterOrEqual(t, answered, 5)
+	assert.Less(t, answered, flood/2)
+	assert.Equal(t, uint64(flood-answered), server.DroppedBindingRequests())
+
+	// Every dropped request is delivered as an Event
+	rateLimited := 0
+	for len(server.Events()) > 0 {
+		e := <-server.Events()
+		assert.Equal(t, EventRateLimited, e.Type)
+		assert.Equal(t, conn.LocalAddr().String(), e.SrcAddr.String())
+		rateLimited++
+	}
+	assert.Equal(t, flood-answered, rateLimited)
+
+	// Requests at a normal rate are all answered
+	for i := 0; i < 5; i++ {
+		sendBinding()
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, _, err = conn.ReadFrom(buf)
+		assert.NoError(t, err)
+		time.Sleep(150 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(flood-answered), server.DroppedBindingRequests())
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+// sourceRecordingConn records the source address of every packet read
+type sourceRecordingConn struct {
+	net.PacketConn
+
+	lock    sync.Mutex
+	sources map[string]int
+}
+
+func (c *sourceRecordingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.lock.Lock()
+		c.sources[addr.String()]++
+		c.lock.Unlock()
+	}
+	return n, addr, err
+}
+
+func TestServerResponseTransport(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	var listeners []net.PacketConn
+	var packetConnConfigs []PacketConnConfig
+	for i := 0; i < 2; i++ {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		listeners = append(listeners, udpListener)
+		packetConnConfigs = append(packetConnConfigs, PacketConnConfig{
+			PacketConn: udpListener,
+			RelayAddressGenerator: &RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		})
+	}
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: packetConnConfigs,
+		Realm:             "pion.ly",
+		LoggerFactory:     logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	// The same client socket is answered by the listener each request was sent to
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	buf := make([]byte, 1500)
+	for _, udpListener := range append(listeners, listeners...) {
+		msg, buildErr := stun.Build(stun.TransactionID, stun.BindingRequest)
+		assert.NoError(t, buildErr)
+		_, err = conn.WriteTo(msg.Raw, udpListener.LocalAddr())
+		assert.NoError(t, err)
+
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, from, readErr := conn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, udpListener.LocalAddr().String(), from.String())
+	}
+	assert.NoError(t, conn.Close())
+
+	// The responses and the data relayed to an allocation egress the listener it was created on
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	recordingConn := &sourceRecordingConn{PacketConn: clientConn, sources: map[string]int{}}
+
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: listeners[1].LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           recordingConn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_, err = relayConn.WriteTo([]byte("Hello"), peer.LocalAddr())
+	assert.NoError(t, err)
+	_, _, err = peer.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	_, err = peer.WriteTo([]byte("Hello"), relayConn.LocalAddr())
+	assert.NoError(t, err)
+	n, _, err := relayConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", string(buf[:n]))
+
+	recordingConn.lock.Lock()
+	assert.Len(t, recordingConn.sources, 1)
+	assert.Greater(t, recordingConn.sources[listeners[1].LocalAddr().String()], 0)
+	recordingConn.lock.Unlock()
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, clientConn.Close())
+	assert.NoError(t, peer.Close())
+	assert.NoError(t, server.Close())
+}
+
+// slowRelayAddressGenerator allocates relays once release is closed, the relays are sent to allocated
+type slowRelayAddressGenerator struct {
+	*RelayAddressGeneratorStatic
+	release   chan struct{}
+	allocated chan net.PacketConn
+}
+
+func (g *slowRelayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	<-g.release
+	conn, addr, err := g.RelayAddressGeneratorStatic.AllocatePacketConn(network, requestedPort)
+	if err == nil {
+		g.allocated <- conn
+	}
+	return conn, addr, err
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	generator := &slowRelayAddressGenerator{
+		RelayAddressGeneratorStatic: &RelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP("127.0.0.1"),
+			Address:      "127.0.0.1",
+		},
+		release:   make(chan struct{}),
+		allocated: make(chan net.PacketConn, 8),
+	}
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: generator,
+			},
+		},
+		Realm:          "pion.ly",
+		RequestTimeout: 100 * time.Millisecond,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		STUNServerAddr: udpListener.LocalAddr().String(),
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	// The Allocate gives up on the relay with a 500 (Server Error)
+	_, err = client.Allocate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error 500")
+
+	// The listener keeps serving other requests
+	_, err = client.SendBindingRequest()
+	assert.NoError(t, err)
+
+	// The relay allocated too late is closed
+	close(generator.release)
+	relayConn := <-generator.allocated
+	assert.Eventually(t, func() bool {
+		_, err := relayConn.WriteTo([]byte{0}, conn.LocalAddr())
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+// A Binding request a peer sends to the relayed address, e.g. an ICE connectivity check, is
+// relayed to the client as is and isn't answered by the server
+func TestServerRelaysPeerBindingRequest(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.NoError(t, client.CreatePermission(peer.LocalAddr()))
+
+	check := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.NewUsername("remote:local"), stun.Fingerprint)
+	_, err = peer.WriteTo(check.Raw, relayConn.LocalAddr())
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	assert.NoError(t, relayConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, from, err := relayConn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, check.Raw, buf[:n])
+	assert.Equal(t, peer.LocalAddr().String(), from.String())
+
+	// The client answers it through the allocation
+	response := stun.MustBuild(stun.NewTransactionIDSetter(check.TransactionID), stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: net.ParseIP("127.0.0.1"), Port: peer.LocalAddr().(*net.UDPAddr).Port}, stun.Fingerprint)
+	_, err = relayConn.WriteTo(response.Raw, from)
+	assert.NoError(t, err)
+
+	assert.NoError(t, peer.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err = peer.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, response.Raw, buf[:n])
+
+	// Nothing but the client's response reached the peer
+	assert.NoError(t, peer.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, _, err = peer.ReadFrom(buf)
+	assert.Error(t, err)
+
+	assert.NoError(t, peer.Close())
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerMaxPermissions(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:          "pion.ly",
+		MaxPermissions: 3,
+	})
+	assert.NoError(t, err)
+
+	newAllocation := func() (*Client, net.PacketConn, net.PacketConn) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		client, err := NewClient(&ClientConfig{
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       "user",
+			Password:       "pass",
+			Conn:           conn,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		return client, conn, relayConn
+	}
+	peer := func(ip string) net.Addr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: 5000}
+	}
+
+	client1, conn1, relayConn1 := newAllocation()
+	client2, conn2, relayConn2 := newAllocation()
+
+	// The cap is shared by the allocations, the first takes two permissions and
+	// leaves a single one to the second
+	assert.NoError(t, client1.CreatePermission(peer("127.0.0.1"), peer("127.0.0.2")))
+	assert.NoError(t, client2.CreatePermission(peer("127.0.0.3")))
+	assert.Error(t, client2.CreatePermission(peer("127.0.0.4")))
+
+	// Refreshing a permission takes no more of the cap
+	assert.NoError(t, client2.CreatePermission(peer("127.0.0.3")))
+
+	// The permissions of a deleted allocation are given back
+	assert.NoError(t, relayConn1.Close())
+	assert.NoError(t, client2.CreatePermission(peer("127.0.0.4")))
+
+	client1.Close()
+	assert.NoError(t, conn1.Close())
+	assert.NoError(t, relayConn2.Close())
+	client2.Close()
+	assert.NoError(t, conn2.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerWithoutAuthHandler(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	for _, stunOnly := range []bool{true, false} {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		var panics int32
+		server, err := NewServer(ServerConfig{
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "127.0.0.1",
+					},
+				},
+			},
+			Realm:    "pion.ly",
+			STUNOnly: stunOnly,
+			OnRequestPanic: func(srcAddr net.Addr, packet []byte, err error) {
+				atomic.AddInt32(&panics, 1)
+			},
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: udpListener.LocalAddr().String(),
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Username:       "user",
+			Password:       "pass",
+			Conn:           conn,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		// Binding requests are answered without credentials
+		mappedAddr, err := client.SendBindingRequest()
+		assert.NoError(t, err)
+		assert.Equal(t, conn.LocalAddr().String(), mappedAddr.String())
+
+		// TURN methods are refused with a 405 in STUN-only mode, and with a 401
+		// otherwise as nobody can authenticate
+		_, err = client.Allocate()
+		assert.Error(t, err)
+		if stunOnly {
+			assert.Contains(t, err.Error(), "error 405")
+		}
+		assert.Equal(t, int32(0), atomic.LoadInt32(&panics))
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	}
+}
+
+func TestServerDeniedSourceIPs(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	_, denied, err := net.ParseCIDR("127.0.0.2/32")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:           "pion.ly",
+		DeniedSourceIPs: []net.IPNet{*denied},
+	})
+	assert.NoError(t, err)
+
+	allowedConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	deniedConn, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	assert.NoError(t, err)
+
+	answered := func(conn net.PacketConn) bool {
+		_, err := conn.WriteTo(stun.MustBuild(stun.TransactionID, stun.BindingRequest).Raw, udpListener.LocalAddr())
+		assert.NoError(t, err)
+
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		_, _, err = conn.ReadFrom(make([]byte, 1500))
+		return err == nil
+	}
+
+	assert.True(t, answered(allowedConn))
+	assert.False(t, answered(deniedConn))
+	assert.Equal(t, uint64(1), server.DeniedSourcePackets())
+
+	// Unblocked at runtime
+	server.SetDeniedSourceIPs(nil)
+	assert.True(t, answered(deniedConn))
+	assert.Equal(t, uint64(1), server.DeniedSourcePackets())
+
+	assert.NoError(t, allowedConn.Close())
+	assert.NoError(t, deniedConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerLogsCreatedAllocation(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	logs := &logBuffer{}
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.Writer = logs
+	loggerFactory.DefaultLogLevel = logging.LogLevelInfo
+
+	// The relay is advertised on another address than it is bound to, like behind a port forward
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("192.0.2.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	relayPort := relayConn.LocalAddr().(*net.UDPAddr).Port
+	assert.Contains(t, logs.String(), fmt.Sprintf("Created allocation of %v on %v for \"user\" relayed on 192.0.2.1:%d, bound to 127.0.0.1:%d",
+		conn.LocalAddr(), udpListener.LocalAddr(), relayPort, relayPort))
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerAllocations(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: turntest.MockAuthHandler(map[string]string{"user": "pass"}),
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: &turntest.LoopbackRelayGenerator{},
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, server.Allocations())
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	// Snapshots are taken while the client adds peers
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				server.Allocations()
+			}
+		}
+	}()
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.NoError(t, client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5000}))
+
+	// Writing to the peer binds a channel to it once the Send indication went out
+	var allocations []AllocationInfo
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		_, err = relayConn.WriteTo([]byte("Hello"), peer.LocalAddr())
+		assert.NoError(t, err)
+
+		if allocations = server.Allocations(); len(allocations) == 1 && len(allocations[0].ChannelBindings) == 1 {
+			break
+		}
+	}
+	close(stop)
+	<-readerDone
+
+	assert.Len(t, allocations, 1)
+	info := allocations[0]
+	assert.Equal(t, conn.LocalAddr().String(), info.SrcAddr.String())
+	assert.Equal(t, udpListener.LocalAddr().String(), info.DstAddr.String())
+	assert.Equal(t, "user", info.Username)
+	assert.Equal(t, relayConn.LocalAddr().String(), info.RelayAddr.String())
+
+	var permitted []string
+	for _, p := range info.Permissions {
+		permitted = append(permitted, p.Peer.(*net.UDPAddr).IP.String())
+		assert.True(t, p.ExpiresAt.After(time.Now()))
+	}
+	assert.ElementsMatch(t, []string{"127.0.0.1", "127.0.0.2"}, permitted)
+
+	assert.Len(t, info.ChannelBindings, 1)
+	for _, c := range info.ChannelBindings {
+		assert.True(t, c.Number >= MinChannelNumber && c.Number <= MaxChannelNumber)
+		assert.Equal(t, peer.LocalAddr().String(), c.Peer.String())
+		assert.True(t, c.ExpiresAt.After(time.Now()))
+	}
+
+	assert.NoError(t, peer.Close())
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+// failingRelayGenerator relays on the loopback interface and keeps the relay sockets, so
+// a test can close them underneath the allocations
+type failingRelayGenerator struct {
+	turntest.LoopbackRelayGenerator
+	relays chan net.PacketConn
+}
+
+func (g *failingRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.LoopbackRelayGenerator.AllocatePacketConn(network, requestedPort)
+	if err == nil {
+		g.relays <- conn
+	}
+	return conn, addr, err
+}
+
+func TestServerRelaySocketFailure(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	generator := &failingRelayGenerator{relays: make(chan net.PacketConn, 1)}
+	server, err := NewServer(ServerConfig{
+		AuthHandler: turntest.MockAuthHandler(map[string]string{"user": "pass"}),
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: generator,
+			},
+		},
+		Realm: "pion.ly",
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, EventAllocationCreated, (<-server.Events()).Type)
+
+	// The relay socket dying deletes the allocation instead of leaving it until it expires
+	assert.NoError(t, (<-generator.relays).Close())
+
+	e := <-server.Events()
+	assert.Equal(t, EventAllocationDeleted, e.Type)
+	assert.Equal(t, DeletionReasonRelayError, e.DeletionReason)
+	assert.Equal(t, relayConn.LocalAddr().String(), e.RelayAddr.String())
+	assert.Empty(t, server.Allocations())
+
+	// The next request of the client is refused, the allocation doesn't exist anymore
+	_, err = relayConn.WriteTo([]byte("Hello"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000})
+	assert.Error(t, err)
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerRelayAddressGeneratorValidation(t *testing.T) {
+	// Closed by the server started at the end
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, tcpListener.Close())
+	}()
+
+	valid := &turntest.LoopbackRelayGenerator{}
+	noRelayAddress := &RelayAddressGeneratorStatic{Address: "127.0.0.1"}
+
+	for _, tc := range []struct {
+		name   string
+		config ServerConfig
+		err    error
+	}{
+		{"PacketConnMissing", ServerConfig{
+			PacketConnConfigs: []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: valid}, {PacketConn: udpListener}},
+		}, errRelayAddressGeneratorUnset},
+		{"PacketConnInvalid", ServerConfig{
+			PacketConnConfigs: []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: noRelayAddress}},
+		}, errRelayAddressInvalid},
+		{"ListenerMissing", ServerConfig{
+			ListenerConfigs: []ListenerConfig{{Listener: tcpListener}},
+		}, errRelayAddressGeneratorUnset},
+		{"ListenerInvalid", ServerConfig{
+			ListenerConfigs: []ListenerConfig{{Listener: tcpListener, RelayAddressGenerator: &turntest.LoopbackRelayGenerator{MinPort: 2, MaxPort: 1}}},
+		}, nil},
+		{"TenantInvalid", ServerConfig{
+			PacketConnConfigs:            []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: valid}},
+			TenantRelayAddressGenerators: map[string]RelayAddressGenerator{"tenant": noRelayAddress},
+		}, errRelayAddressInvalid},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The server fails to start instead of failing the first Allocate
+			_, err := NewServer(tc.config)
+			assert.Error(t, err)
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err), "unexpected error: %v", err)
+			}
+		})
+	}
+
+	// Listeners added to a running server are validated as well
+	server, err := NewServer(ServerConfig{
+		PacketConnConfigs: []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: valid}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, errRelayAddressGeneratorUnset, server.AddListener(ListenerConfig{Listener: tcpListener}))
+	assert.NoError(t, server.Close())
+}
+
+// A removed listener keeps serving the connections it accepted until they are closed,
+// with or without ConnWorkers
+func TestServerRemoveListener(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	relayAddressGenerator := &RelayAddressGeneratorStatic{
+		RelayAddress: net.ParseIP("127.0.0.1"),
+		Address:      "127.0.0.1",
+	}
+
+	// ConnWorkers are only supported on linux
+	connWorkersOptions := []int{0}
+	if runtime.GOOS == "linux" {
+		connWorkersOptions = append(connWorkersOptions, 2)
+	}
+
+	for _, connWorkers := range connWorkersOptions {
+		oldListener, err := net.Listen("tcp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				return GenerateAuthKey(username, realm, "pass"), true
+			},
+			ListenerConfigs: []ListenerConfig{{Listener: oldListener, RelayAddressGenerator: relayAddressGenerator}},
+			Realm:           "pion.ly",
+			ConnWorkers:     connWorkers,
+		})
+		assert.NoError(t, err)
+
+		allocate := func(l net.Listener) (net.Conn, *Client, net.PacketConn) {
+			conn, dialErr := net.Dial("tcp4", l.Addr().String())
+			assert.NoError(t, dialErr)
+			client, clientErr := NewClient(&ClientConfig{
+				TURNServerAddr: l.Addr().String(),
+				Username:       "user",
+				Password:       "pass",
+				Conn:           NewSTUNConn(conn),
+			})
+			assert.NoError(t, clientErr)
+			assert.NoError(t, client.Listen())
+
+			relayConn, allocateErr := client.Allocate()
+			assert.NoError(t, allocateErr)
+			assert.Equal(t, EventAllocationCreated, (<-server.Events()).Type)
+			return conn, client, relayConn
+		}
+		oldConn, oldClient, oldRelayConn := allocate(oldListener)
+
+		// The replacement listener is added before the old one is removed
+		newListener, err := net.Listen("tcp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		assert.NoError(t, server.AddListener(ListenerConfig{Listener: newListener, RelayAddressGenerator: relayAddressGenerator}))
+		assert.NoError(t, server.RemoveListener(oldListener))
+		assert.Equal(t, errListenerNotFound, server.RemoveListener(oldListener))
+		_, err = net.Dial("tcp4", oldListener.Addr().String())
+		assert.Error(t, err)
+
+		newConn, newClient, newRelayConn := allocate(newListener)
+
+		// The allocation of the drained connection keeps relaying
+		peerConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		buf := make([]byte, inboundMTU)
+		for _, relayConn := range []net.PacketConn{oldRelayConn, newRelayConn} {
+			_, err = relayConn.WriteTo([]byte("Hello"), peerConn.LocalAddr())
+			assert.NoError(t, err)
+			n, from, readErr := peerConn.ReadFrom(buf)
+			assert.NoError(t, readErr)
+			assert.Equal(t, "Hello", string(buf[:n]))
+
+			_, err = peerConn.WriteTo([]byte("World"), from)
+			assert.NoError(t, err)
+			n, _, readErr = relayConn.ReadFrom(buf)
+			assert.NoError(t, readErr)
+			assert.Equal(t, "World", string(buf[:n]))
+		}
+
+		// The allocations of the removed listener are deleted once its last connection is closed
+		assert.NoError(t, oldConn.Close())
+		event := <-server.Events()
+		assert.Equal(t, EventAllocationDeleted, event.Type)
+		assert.Equal(t, DeletionReasonClosed, event.DeletionReason)
+		assert.Equal(t, oldRelayConn.LocalAddr().String(), event.RelayAddr.String())
+
+		assert.Error(t, oldRelayConn.Close(), "the connection is already closed")
+		oldClient.Close()
+		assert.NoError(t, newRelayConn.Close())
+		newClient.Close()
+		assert.NoError(t, peerConn.Close())
+		assert.NoError(t, server.Close())
+		assert.NoError(t, newConn.Close())
+
+		assert.Equal(t, errServerClosed, server.AddListener(ListenerConfig{Listener: newListener, RelayAddressGenerator: relayAddressGenerator}))
+	}
+}
+
+func TestServerSecurityFeatures(t *testing.T) {
+	for _, tc := range []struct {
+		features SecurityFeatures
+		err      error
+	}{
+		{1 << 24, errSecurityFeaturesInvalid},
+		{SecurityFeaturePasswordAlgorithms, errPasswordAlgorithmsFeature},
+		{SecurityFeaturePasswordAlgorithms | SecurityFeatureUsernameAnonymity, errPasswordAlgorithmsFeature},
+	} {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		_, err = NewServer(ServerConfig{
+			PacketConnConfigs: []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: &turntest.LoopbackRelayGenerator{}}},
+			SecurityFeatures:  tc.features,
+		})
+		assert.Equal(t, tc.err, err)
+		assert.NoError(t, udpListener.Close())
+	}
+}
@@ -12,6 +12,8 @@ import (
 
 var errInvalidTURNFrame = errors.New("data is not a valid TURN frame, no STUN or ChannelData found")
 var errIncompleteTURNFrame = errors.New("data contains incomplete STUN or TURN frame")
+var errTURNFrameTooLarge = errors.New("STUN or TURN frame is larger than the read buffer")
+var errPartialTURNFrameTimeout = errors.New("STUN or TURN frame was not completed in time")
 
 // STUNConn wraps a net.Conn and implements
 // net.PacketConn by being STUN aware and
@@ -19,6 +21,11 @@ var errIncompleteTURNFrame = errors.New("data contains incomplete STUN or TURN f
 type STUNConn struct {
 	nextConn net.Conn
 	buff     []byte
+
+	// partialTimeout bounds how long the start of a frame stays buffered without the rest
+	// of it arriving, partialSince is when it started. Zero disables the timeout
+	partialTimeout time.Duration
+	partialSince   time.Time
 }
 
 const (
@@ -39,25 +46,30 @@ func consumeSingleTURNFrame(p []byte) (int, error) {
 		return 0, errIncompleteTURNFrame
 	}
 
-	var datagramSize uint16
+	// The sizes are computed as int, the length of a frame plus its header doesn't fit in
+	// 16 bits and a size that wrapped around would never consume the frame
+	var datagramSize int
 	if stun.IsMessage(p) {
-		datagramSize = binary.BigEndian.Uint16(p[2:4]) + stunHeaderSize
+		datagramSize = int(binary.BigEndian.Uint16(p[2:4])) + stunHeaderSize
 	} else if num := binary.BigEndian.Uint16(p[0:4]); proto.ChannelNumber(num).Valid() {
-		datagramSize = binary.BigEndian.Uint16(p[channelDataNumberSize:channelDataHeaderSize])
+		datagramSize = int(binary.BigEndian.Uint16(p[channelDataNumberSize:channelDataHeaderSize]))
 		if paddingOverflow := (datagramSize + channelDataPadding) % channelDataPadding; paddingOverflow != 0 {
 			datagramSize = (datagramSize + channelDataPadding) - paddingOverflow
 		}
 
 		datagramSize += channelDataHeaderSize
+	} else if len(p) < stunHeaderSize && p[0]&0xC0 == 0 {
+		// The first two bits of a STUN message are zero, the header may not be complete yet
+		return 0, errIncompleteTURNFrame
 	} else {
 		return 0, errInvalidTURNFrame
 	}
 
-	if len(p) < int(datagramSize) {
+	if len(p) < datagramSize {
 		return 0, errIncompleteTURNFrame
 	}
 
-	return int(datagramSize), nil
+	return datagramSize, nil
 }
 
 // ReadFrom implements ReadFrom from net.PacketConn
@@ -66,6 +78,10 @@ func (s *STUNConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	n, err = consumeSingleTURNFrame(s.buff)
 	if err == errInvalidTURNFrame {
 		return 0, nil, err
+	} else if err == nil && n > len(p) {
+		// Skip the frame, the next read starts with the one after it
+		s.buff = s.buff[n:]
+		return 0, s.nextConn.RemoteAddr(), errTURNFrameTooLarge
 	} else if err == nil {
 		copy(p, s.buff[:n])
 		s.buff = s.buff[n:]
@@ -74,8 +90,14 @@ func (s *STUNConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	}
 
 	// Then read from the nextConn, appending to our buff
+	if err = s.trackPartial(); err != nil {
+		return 0, nil, err
+	}
 	n, err = s.nextConn.Read(p)
 	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && s.stalled(time.Now()) {
+			return 0, nil, errPartialTURNFrameTimeout
+		}
 		return 0, nil, err
 	}
 
@@ -83,6 +105,27 @@ func (s *STUNConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	return s.ReadFrom(p)
 }
 
+// trackPartial starts the partialTimeout once a frame was only partly received and stops
+// it once no frame is pending. A read deadline enforces it on blocking reads
+func (s *STUNConn) trackPartial() error {
+	switch {
+	case s.partialTimeout == 0:
+		return nil
+	case len(s.buff) == 0 && !s.partialSince.IsZero():
+		s.partialSince = time.Time{}
+		return s.nextConn.SetReadDeadline(time.Time{})
+	case len(s.buff) != 0 && s.partialSince.IsZero():
+		s.partialSince = time.Now()
+		return s.nextConn.SetReadDeadline(s.partialSince.Add(s.partialTimeout))
+	}
+	return nil
+}
+
+// stalled returns true if a partly received frame wasn't completed within partialTimeout
+func (s *STUNConn) stalled(now time.Time) bool {
+	return s.partialTimeout != 0 && len(s.buff) != 0 && !s.partialSince.IsZero() && now.Sub(s.partialSince) >= s.partialTimeout
+}
+
 // WriteTo implements WriteTo from net.PacketConn
 func (s *STUNConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return s.nextConn.Write(p)
@@ -0,0 +1,35 @@
+// +build !js
+
+package turn
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumeSingleTURNFrame(t *testing.T) {
+	stunHeader := func(length uint16) []byte {
+		return []byte{0x00, 0x01, byte(length >> 8), byte(length), 0x21, 0x12, 0xa4, 0x42, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		size int
+		err  error
+	}{
+		{"STUN", stunHeader(0), 20, nil},
+		{"STUNIncomplete", stunHeader(4), 0, errIncompleteTURNFrame},
+		{"ChannelDataPadded", []byte{0x40, 0x00, 0x00, 0x01, 0xAA, 0x00, 0x00, 0x00, 0xFF}, 8, nil},
+		{"Invalid", []byte{0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, 0, errInvalidTURNFrame},
+
+		// Lengths close to 16 bits must not wrap around to a frame that is never consumed
+		{"STUNLengthOverflow", stunHeader(0xFFEC), 0, errIncompleteTURNFrame},
+		{"ChannelDataLengthOverflow", []byte{0x40, 0x00, 0xFF, 0xFC, 0x00, 0x00, 0x00, 0x00, 0x00}, 0, errIncompleteTURNFrame},
+	} {
+		size, err := consumeSingleTURNFrame(tc.data)
+		assert.Equal(t, tc.err, err, tc.name)
+		assert.Equal(t, tc.size, size, tc.name)
+	}
+}
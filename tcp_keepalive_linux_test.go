@@ -0,0 +1,96 @@
+// +build linux
+
+package turn
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/test"
+	"github.com/pion/turn/v2/turntest"
+	"github.com/stretchr/testify/assert"
+)
+
+// acceptedListener hands the connections it accepts to the test as well
+type acceptedListener struct {
+	net.Listener
+	accepted chan net.Conn
+}
+
+func (l *acceptedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted <- conn
+	}
+	return conn, err
+}
+
+func tcpSockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	assert.NoError(t, err)
+
+	var value int
+	var sockoptErr error
+	assert.NoError(t, raw.Control(func(fd uintptr) {
+		value, sockoptErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	assert.NoError(t, sockoptErr)
+	return value
+}
+
+func TestListenerConfigTCPKeepAlive(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	for _, tc := range []struct {
+		name      string
+		keepAlive time.Duration
+		enabled   bool
+	}{
+		{"Enabled", 42 * time.Second, true},
+		{"Disabled", -1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+			assert.NoError(t, err)
+			listener := &acceptedListener{Listener: tcpListener, accepted: make(chan net.Conn, 1)}
+
+			server, err := NewServer(ServerConfig{
+				AuthHandler: turntest.MockAuthHandler(map[string]string{"user": "pass"}),
+				ListenerConfigs: []ListenerConfig{{
+					Listener:              listener,
+					RelayAddressGenerator: &turntest.LoopbackRelayGenerator{},
+					TCPKeepAlive:          tc.keepAlive,
+				}},
+			})
+			assert.NoError(t, err)
+
+			client, err := net.Dial("tcp4", tcpListener.Addr().String())
+			assert.NoError(t, err)
+			conn := <-listener.accepted
+
+			// The accept loop sets the keepalive before the first read of the conn, a
+			// request answered on it tells it did
+			_, err = client.Write(stun.MustBuild(stun.TransactionID, stun.BindingRequest).Raw)
+			assert.NoError(t, err)
+			_, err = client.Read(make([]byte, 1500))
+			assert.NoError(t, err)
+
+			if tc.enabled {
+				assert.Equal(t, 1, tcpSockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+				assert.Equal(t, 42, tcpSockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+			} else {
+				assert.Equal(t, 0, tcpSockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+			}
+
+			assert.NoError(t, client.Close())
+			assert.NoError(t, server.Close())
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package turntest_test
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/turn/v2/turntest"
+)
+
+// A server and a client on the loopback interface, the server accepts the user "user"
+// and relays on 127.0.0.1
+func ExampleLoopbackRelayGenerator() {
+	listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       "pion.ly",
+		AuthHandler: turntest.MockAuthHandler(map[string]string{"user": "pass"}),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            listener,
+				RelayAddressGenerator: &turntest.LoopbackRelayGenerator{},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Close()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: listener.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Conn:           conn,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+
+	if err = client.Listen(); err != nil {
+		panic(err)
+	}
+
+	relayConn, err := client.Allocate()
+	if err != nil {
+		panic(err)
+	}
+	defer relayConn.Close()
+
+	fmt.Println(relayConn.LocalAddr().(*net.UDPAddr).IP)
+	// Output: 127.0.0.1
+}
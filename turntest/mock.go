@@ -0,0 +1,107 @@
+package turntest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pion/stun"
+)
+
+var (
+	errPortRangeInvalid = errors.New("turntest: MinPort and MaxPort must be 0 or a range of ports")
+	errLoopbackIPv6     = errors.New("turntest: LoopbackRelayGenerator only relays over IPv4")
+	errTCPRelay         = errors.New("turntest: LoopbackRelayGenerator doesn't relay over TCP")
+)
+
+// MockAuthHandler returns an AuthHandler of turn.ServerConfig that accepts the users of
+// credentials, a map of username to password, in any realm. The key it returns is the one
+// turn.GenerateAuthKey derives from the password, other users are refused
+func MockAuthHandler(credentials map[string]string) func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		password, ok := credentials[username]
+		if !ok {
+			return nil, false
+		}
+		return stun.NewLongTermIntegrity(username, realm, password), true
+	}
+}
+
+// LoopbackRelayGenerator is a RelayAddressGenerator of turn.ServerConfig that binds the
+// relays on 127.0.0.1, they are advertised with the address they are bound to so clients
+// and peers on the same host reach them without a public IP.
+//
+// When MinPort and MaxPort are 0 every relay gets a port picked by the OS, otherwise the
+// port is one of MinPort to MaxPort, e.g. to test what happens once they are all used
+type LoopbackRelayGenerator struct {
+	MinPort int
+	MaxPort int
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// Validate is called on server startup and checks the port range
+func (g *LoopbackRelayGenerator) Validate() error {
+	if g.MinPort == 0 && g.MaxPort == 0 {
+		return nil
+	}
+	if g.MinPort <= 0 || g.MaxPort > 0xFFFF || g.MinPort > g.MaxPort {
+		return fmt.Errorf("%w: %d-%d", errPortRangeInvalid, g.MinPort, g.MaxPort)
+	}
+	return nil
+}
+
+// AllocatePacketConn binds a relay on 127.0.0.1, to requestedPort if it isn't 0 or else
+// to a free port of the range
+func (g *LoopbackRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	switch network {
+	case "udp", "udp4":
+	case "udp6":
+		return nil, nil, errLoopbackIPv6
+	default:
+		return nil, nil, errUnsupportedNet
+	}
+
+	if requestedPort != 0 || (g.MinPort == 0 && g.MaxPort == 0) {
+		return listenLoopback(requestedPort)
+	}
+
+	// Start at a random port of the range so relays of consecutive allocations differ
+	// like they would with ports picked by the OS
+	count := g.MaxPort - g.MinPort + 1
+	offset := g.randomOffset(count)
+	for i := 0; i < count; i++ {
+		conn, addr, err := listenLoopback(g.MinPort + (offset+i)%count)
+		if err == nil {
+			return conn, addr, nil
+		}
+	}
+	return nil, nil, errNoPortAvailable
+}
+
+// AllocateConn fails, only UDP is relayed
+func (g *LoopbackRelayGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, errTCPRelay
+}
+
+func (g *LoopbackRelayGenerator) randomOffset(n int) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.rand == nil {
+		g.rand = rand.New(rand.NewSource(rand.Int63())) // #nosec
+	}
+	return g.rand.Intn(n)
+}
+
+func listenLoopback(port int) (net.PacketConn, net.Addr, error) {
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.LocalAddr(), nil
+}
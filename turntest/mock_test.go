@@ -0,0 +1,78 @@
+package turntest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockAuthHandler(t *testing.T) {
+	handler := MockAuthHandler(map[string]string{"user": "pass"})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+	key, ok := handler("user", "pion.ly", addr)
+	assert.True(t, ok)
+	assert.Equal(t, []byte(stun.NewLongTermIntegrity("user", "pion.ly", "pass")), key)
+
+	_, ok = handler("other", "pion.ly", addr)
+	assert.False(t, ok)
+}
+
+func TestLoopbackRelayGenerator(t *testing.T) {
+	t.Run("Validate", func(t *testing.T) {
+		assert.NoError(t, (&LoopbackRelayGenerator{}).Validate())
+		assert.NoError(t, (&LoopbackRelayGenerator{MinPort: 50000, MaxPort: 50000}).Validate())
+		assert.Error(t, (&LoopbackRelayGenerator{MinPort: 50001, MaxPort: 50000}).Validate())
+		assert.Error(t, (&LoopbackRelayGenerator{MaxPort: 50000}).Validate())
+		assert.Error(t, (&LoopbackRelayGenerator{MinPort: 50000, MaxPort: 70000}).Validate())
+	})
+
+	t.Run("AnyPort", func(t *testing.T) {
+		g := &LoopbackRelayGenerator{}
+		conn, addr, err := g.AllocatePacketConn("udp4", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, conn.LocalAddr().String(), addr.String())
+		assert.True(t, addr.(*net.UDPAddr).IP.IsLoopback())
+		assert.NoError(t, conn.Close())
+
+		_, _, err = g.AllocatePacketConn("udp6", 0)
+		assert.Equal(t, errLoopbackIPv6, err)
+		_, _, err = g.AllocateConn("tcp4", 0)
+		assert.Equal(t, errTCPRelay, err)
+	})
+
+	t.Run("PortRange", func(t *testing.T) {
+		// Find two free consecutive ports for the range
+		probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		minPort := probe.LocalAddr().(*net.UDPAddr).Port
+		assert.NoError(t, probe.Close())
+
+		g := &LoopbackRelayGenerator{MinPort: minPort, MaxPort: minPort + 1}
+		assert.NoError(t, g.Validate())
+
+		var conns []net.PacketConn
+		for i := 0; i < 2; i++ {
+			conn, addr, err := g.AllocatePacketConn("udp4", 0)
+			if err != nil {
+				for _, conn := range conns {
+					assert.NoError(t, conn.Close())
+				}
+				t.Skipf("port of the range in use: %v", err)
+			}
+			port := addr.(*net.UDPAddr).Port
+			assert.True(t, port == minPort || port == minPort+1)
+			conns = append(conns, conn)
+		}
+
+		// Every port of the range is used
+		_, _, err = g.AllocatePacketConn("udp4", 0)
+		assert.Equal(t, errNoPortAvailable, err)
+
+		for _, conn := range conns {
+			assert.NoError(t, conn.Close())
+		}
+	})
+}
@@ -0,0 +1,227 @@
+// Package turntest contains helpers for testing code built on top of pion/turn
+package turntest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const packetQueueSize = 64
+
+var (
+	errClosed          = errors.New("turntest: use of closed PacketConn")
+	errAddressInUse    = errors.New("turntest: address already in use")
+	errNoPortAvailable = errors.New("turntest: no port available")
+	errUnsupportedNet  = errors.New("turntest: only udp, udp4 and udp6 are supported")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "turntest: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type packet struct {
+	data []byte
+	from net.Addr
+}
+
+// Network is an in-memory network of PacketConns. A datagram written to an
+// address is delivered to the PacketConn bound to it, datagrams to unbound
+// addresses are silently dropped like they would be with UDP.
+//
+// Network.ListenPacket can back a RelayAddressGenerator, so relays can be
+// tested without opening real sockets.
+type Network struct {
+	lock     sync.Mutex
+	conns    map[string]*PacketConn
+	nextPort int
+}
+
+// NewNetwork creates an empty Network
+func NewNetwork() *Network {
+	return &Network{
+		conns:    map[string]*PacketConn{},
+		nextPort: 49152,
+	}
+}
+
+// ListenPacket binds a PacketConn to address. The address must carry the IP
+// peers will write to, a port of 0 picks an unused one
+func (n *Network) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, errUnsupportedNet
+	}
+
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if addr.Port == 0 {
+		if addr.Port, err = n.freePort(addr.IP); err != nil {
+			return nil, err
+		}
+	} else if _, ok := n.conns[addr.String()]; ok {
+		return nil, errAddressInUse
+	}
+
+	c := &PacketConn{
+		network:       n,
+		addr:          addr,
+		inbound:       make(chan packet, packetQueueSize),
+		closed:        make(chan struct{}),
+		deadlineReset: make(chan struct{}),
+	}
+	n.conns[addr.String()] = c
+
+	return c, nil
+}
+
+func (n *Network) freePort(ip net.IP) (int, error) {
+	for i := 0; i < 65536-49152; i++ {
+		port := n.nextPort
+		if n.nextPort++; n.nextPort > 65535 {
+			n.nextPort = 49152
+		}
+
+		addr := &net.UDPAddr{IP: ip, Port: port}
+		if _, ok := n.conns[addr.String()]; !ok {
+			return port, nil
+		}
+	}
+	return 0, errNoPortAvailable
+}
+
+func (n *Network) find(addr net.Addr) *PacketConn {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.conns[addr.String()]
+}
+
+func (n *Network) remove(c *PacketConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.conns, c.addr.String())
+}
+
+// PacketConn is a net.PacketConn bound to an address of a Network
+type PacketConn struct {
+	network *Network
+	addr    *net.UDPAddr
+	inbound chan packet
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	deadlineLock  sync.Mutex
+	readDeadline  time.Time
+	deadlineReset chan struct{}
+}
+
+// ReadFrom reads the next datagram written to this PacketConn
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.deadlineLock.Lock()
+		deadline, reset := c.readDeadline, c.deadlineReset
+		c.deadlineLock.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		n, from, done, err := c.read(p, timeout, reset)
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return n, from, err
+		}
+	}
+}
+
+// read waits for a datagram, done is false if the read deadline was changed meanwhile
+func (c *PacketConn) read(p []byte, timeout <-chan time.Time, reset chan struct{}) (n int, from net.Addr, done bool, err error) {
+	select {
+	case pkt := <-c.inbound:
+		return copy(p, pkt.data), pkt.from, true, nil
+	case <-c.closed:
+		return 0, nil, true, errClosed
+	case <-timeout:
+		return 0, nil, true, timeoutError{}
+	case <-reset:
+		return 0, nil, false, nil
+	}
+}
+
+// WriteTo delivers p to the PacketConn bound to addr. Like UDP, the datagram
+// is dropped if nothing is bound to addr or the receiver's queue is full
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+
+	dst := c.network.find(addr)
+	if dst == nil {
+		return len(p), nil
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	select {
+	case dst.inbound <- packet{data: data, from: c.LocalAddr()}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Close unbinds the PacketConn and unblocks any pending ReadFrom
+func (c *PacketConn) Close() error {
+	err := errClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.remove(c)
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr returns the address the PacketConn is bound to
+func (c *PacketConn) LocalAddr() net.Addr {
+	addr := *c.addr
+	return &addr
+}
+
+// SetDeadline sets the read deadline, writes never block
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for pending and future ReadFrom calls
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	c.readDeadline = t
+	close(c.deadlineReset)
+	c.deadlineReset = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
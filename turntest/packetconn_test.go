@@ -0,0 +1,74 @@
+package turntest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketConn(t *testing.T) {
+	t.Run("ReadWrite", func(t *testing.T) {
+		n := NewNetwork()
+
+		a, err := n.ListenPacket("udp4", "10.0.0.1:0")
+		assert.NoError(t, err)
+		b, err := n.ListenPacket("udp4", "10.0.0.2:5000")
+		assert.NoError(t, err)
+
+		_, err = n.ListenPacket("udp4", "10.0.0.2:5000")
+		assert.Equal(t, errAddressInUse, err)
+
+		_, err = a.WriteTo([]byte("Hello"), b.LocalAddr())
+		assert.NoError(t, err)
+
+		buf := make([]byte, 1500)
+		l, from, err := b.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello", string(buf[:l]))
+		assert.Equal(t, a.LocalAddr().String(), from.String())
+
+		// Datagrams to unbound addresses are dropped
+		_, err = a.WriteTo([]byte("Hello"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 5000})
+		assert.NoError(t, err)
+
+		assert.NoError(t, a.Close())
+		assert.NoError(t, b.Close())
+		assert.Error(t, b.Close())
+
+		_, err = a.WriteTo([]byte("Hello"), b.LocalAddr())
+		assert.Equal(t, errClosed, err)
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		n := NewNetwork()
+
+		c, err := n.ListenPacket("udp4", "10.0.0.1:0")
+		assert.NoError(t, err)
+
+		assert.NoError(t, c.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+		_, _, err = c.ReadFrom(make([]byte, 1500))
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok)
+		assert.True(t, netErr.Timeout())
+
+		// A deadline set while blocked applies to the pending ReadFrom
+		assert.NoError(t, c.SetReadDeadline(time.Time{}))
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			assert.NoError(t, c.SetReadDeadline(time.Now()))
+		}()
+		_, _, err = c.ReadFrom(make([]byte, 1500))
+		assert.Equal(t, timeoutError{}, err)
+
+		// Close unblocks a pending ReadFrom
+		assert.NoError(t, c.SetReadDeadline(time.Time{}))
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			assert.NoError(t, c.Close())
+		}()
+		_, _, err = c.ReadFrom(make([]byte, 1500))
+		assert.Equal(t, errClosed, err)
+	})
+}
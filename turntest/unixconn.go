@@ -0,0 +1,179 @@
+package turntest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errNotUDPAddr = errors.New("turntest: address is not a *net.UDPAddr")
+
+// UnixNetwork binds PacketConns to UNIX datagram sockets in a directory, so relays can be
+// chained between processes without consuming UDP ports.
+//
+// TURN only has IP semantics, XOR-RELAYED-ADDRESS and XOR-PEER-ADDRESS carry an IP and a
+// port, so every socket is identified by the IP and port it would have over UDP. The socket
+// of 10.0.0.1:5000 is the file "10.0.0.1-5000" of the directory, the IP doesn't have to be
+// assigned to an interface and only tells the sockets apart. Datagrams from sockets that
+// aren't part of the directory, e.g. unnamed ones, are dropped. Unlike UDP, a write blocks
+// while the queue of the receiving socket is full.
+type UnixNetwork struct {
+	dir string
+
+	lock     sync.Mutex
+	nextPort int
+}
+
+// NewUnixNetwork creates a UnixNetwork on dir. UNIX socket paths are limited to about 100
+// bytes, dir should be short, e.g. created with ioutil.TempDir("", "turn")
+func NewUnixNetwork(dir string) *UnixNetwork {
+	return &UnixNetwork{
+		dir:      dir,
+		nextPort: 49152,
+	}
+}
+
+// ListenPacket binds a UnixPacketConn to address. The address must carry the IP peers
+// will write to, a port of 0 picks an unused one
+func (n *UnixNetwork) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, errUnsupportedNet
+	}
+
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.Port != 0 {
+		return n.listen(addr)
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for i := 0; i < 65536-49152; i++ {
+		addr.Port = n.nextPort
+		if n.nextPort++; n.nextPort > 65535 {
+			n.nextPort = 49152
+		}
+
+		c, err := n.listen(addr)
+		if errors.Is(err, syscall.EADDRINUSE) {
+			continue
+		}
+		return c, err
+	}
+	return nil, errNoPortAvailable
+}
+
+func (n *UnixNetwork) listen(addr *net.UDPAddr) (*UnixPacketConn, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: n.path(addr), Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &UnixPacketConn{network: n, conn: conn, addr: addr}, nil
+}
+
+// path returns the socket file of addr
+func (n *UnixNetwork) path(addr *net.UDPAddr) string {
+	return filepath.Join(n.dir, fmt.Sprintf("%s-%d", addr.IP, addr.Port))
+}
+
+// addr returns the address of a socket file of the directory, or nil
+func (n *UnixNetwork) addr(path string) *net.UDPAddr {
+	if filepath.Dir(path) != filepath.Clean(n.dir) {
+		return nil
+	}
+
+	name := filepath.Base(path)
+	i := strings.LastIndex(name, "-")
+	if i == -1 {
+		return nil
+	}
+	ip := net.ParseIP(name[:i])
+	port, err := strconv.Atoi(name[i+1:])
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+// UnixPacketConn is a net.PacketConn bound to a UNIX datagram socket of a UnixNetwork. It
+// is addressed with *net.UDPAddr like a UDP socket
+type UnixPacketConn struct {
+	network *UnixNetwork
+	conn    *net.UnixConn
+	addr    *net.UDPAddr
+}
+
+// ReadFrom reads the next datagram written to this UnixPacketConn
+func (c *UnixPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.conn.ReadFromUnix(p)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if from != nil {
+			if addr := c.network.addr(from.Name); addr != nil {
+				return n, addr, nil
+			}
+		}
+	}
+}
+
+// WriteTo delivers p to the socket of addr. Like UDP, the datagram is dropped if nothing
+// is bound to addr
+func (c *UnixPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errNotUDPAddr
+	}
+
+	n, err := c.conn.WriteToUnix(p, &net.UnixAddr{Name: c.network.path(udpAddr), Net: "unixgram"})
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		return len(p), nil
+	}
+	return n, err
+}
+
+// Close closes the socket and removes its file
+func (c *UnixPacketConn) Close() error {
+	err := c.conn.Close()
+	if removeErr := os.Remove(c.network.path(c.addr)); err == nil && !os.IsNotExist(removeErr) {
+		err = removeErr
+	}
+	return err
+}
+
+// LocalAddr returns the address the UnixPacketConn is bound to
+func (c *UnixPacketConn) LocalAddr() net.Addr {
+	addr := *c.addr
+	return &addr
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *UnixPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of ReadFrom
+func (c *UnixPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of WriteTo
+func (c *UnixPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,57 @@
+// +build !windows
+
+package turntest
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixPacketConn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "turn")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+	n := NewUnixNetwork(dir)
+
+	a, err := n.ListenPacket("udp4", "10.0.0.1:0")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:49152", a.LocalAddr().String())
+	b, err := n.ListenPacket("udp4", "10.0.0.2:5000")
+	assert.NoError(t, err)
+
+	_, err = n.ListenPacket("udp4", "10.0.0.2:5000")
+	assert.Error(t, err)
+	_, err = n.ListenPacket("tcp4", "10.0.0.2:5001")
+	assert.Equal(t, errUnsupportedNet, err)
+
+	_, err = a.WriteTo([]byte("Hello"), b.LocalAddr())
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	l, from, err := b.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", string(buf[:l]))
+	assert.Equal(t, a.LocalAddr().String(), from.String())
+
+	// Datagrams to unbound addresses are dropped
+	_, err = a.WriteTo([]byte("Hello"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 5000})
+	assert.NoError(t, err)
+	_, err = a.WriteTo([]byte("Hello"), &net.UnixAddr{Name: "10.0.0.2-5000", Net: "unixgram"})
+	assert.Equal(t, errNotUDPAddr, err)
+
+	// Closing removes the socket, writes to it are dropped and the port can be bound again
+	assert.NoError(t, b.Close())
+	_, err = a.WriteTo([]byte("Hello"), b.LocalAddr())
+	assert.NoError(t, err)
+	b, err = n.ListenPacket("udp4", "10.0.0.2:5000")
+	assert.NoError(t, err)
+
+	assert.NoError(t, a.Close())
+	assert.NoError(t, b.Close())
+}